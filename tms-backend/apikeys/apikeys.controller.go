@@ -0,0 +1,140 @@
+package apikeys
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	dto "github.com/auditrakkr/tms-fullstack/tms-backend/dtos"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/gin-gonic/gin"
+)
+
+type ApiKeyController struct {
+	apiKeyService *ApiKeyService
+}
+
+func NewApiKeyController(apiKeyService *ApiKeyService) *ApiKeyController {
+	return &ApiKeyController{
+		apiKeyService: apiKeyService,
+	}
+}
+
+// CreateApiKey makes an API key for the tenant. The response is the only time the key is shown
+func (ac *ApiKeyController) CreateApiKey(c *gin.Context) {
+	tenantId, ok := tenantIdParam(c)
+	if !ok {
+		return
+	}
+	var createApiKeyDto dto.CreateApiKeyDto
+	if err := c.ShouldBindJSON(&createApiKeyDto); err != nil || strings.TrimSpace(createApiKeyDto.Name) == "" || len(createApiKeyDto.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: name and scopes are required"})
+		return
+	}
+
+	var createdBy *uint
+	if userId := c.GetUint(global.CONTEXT_USER_ID_KEY); userId != 0 {
+		createdBy = &userId
+	}
+	apiKey, key, err := ac.apiKeyService.Create(tenantId, createdBy, &createApiKeyDto)
+	if errors.Is(err, ErrUnknownScope) || errors.Is(err, ErrExpiresInPast) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "scopes": global.ApiKeyScopes})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"apiKey": apiKey, "key": key})
+}
+
+// GetApiKeys lists the API keys of the tenant, without their secrets
+func (ac *ApiKeyController) GetApiKeys(c *gin.Context) {
+	tenantId, ok := tenantIdParam(c)
+	if !ok {
+		return
+	}
+	apiKeys, err := ac.apiKeyService.FindAll(tenantId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"apiKeys": apiKeys})
+}
+
+// GetApiKey returns an API key of the tenant, without its secret
+func (ac *ApiKeyController) GetApiKey(c *gin.Context) {
+	tenantId, apiKeyId, ok := apiKeyParams(c)
+	if !ok {
+		return
+	}
+	apiKey, err := ac.apiKeyService.FindOne(tenantId, apiKeyId)
+	if errors.Is(err, ErrApiKeyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"apiKey": apiKey})
+}
+
+// RotateApiKey gives an API key a new secret. The response is the only time the new key is shown
+func (ac *ApiKeyController) RotateApiKey(c *gin.Context) {
+	tenantId, apiKeyId, ok := apiKeyParams(c)
+	if !ok {
+		return
+	}
+	apiKey, key, err := ac.apiKeyService.Rotate(tenantId, apiKeyId)
+	if errors.Is(err, ErrApiKeyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"apiKey": apiKey, "key": key})
+}
+
+// DeleteApiKey revokes an API key of the tenant
+func (ac *ApiKeyController) DeleteApiKey(c *gin.Context) {
+	tenantId, apiKeyId, ok := apiKeyParams(c)
+	if !ok {
+		return
+	}
+	err := ac.apiKeyService.Revoke(tenantId, apiKeyId)
+	if errors.Is(err, ErrApiKeyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
+
+func tenantIdParam(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func apiKeyParams(c *gin.Context) (uint, uint, bool) {
+	tenantId, ok := tenantIdParam(c)
+	if !ok {
+		return 0, 0, false
+	}
+	id, err := strconv.ParseUint(c.Params.ByName("apiKeyId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return 0, 0, false
+	}
+	return tenantId, uint(id), true
+}
@@ -0,0 +1,214 @@
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/database"
+	dto "github.com/auditrakkr/tms-fullstack/tms-backend/dtos"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/repositories"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/utils"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrApiKeyNotFound = errors.New("API key not found")
+	ErrInvalidApiKey  = errors.New("invalid API key")
+	ErrApiKeyExpired  = errors.New("API key has expired")
+	ErrUnknownScope   = errors.New("unknown API key scope")
+	ErrExpiresInPast  = errors.New("expiry must be in the future")
+)
+
+type ApiKeyService struct {
+	apiKeyRepo repositories.Repository[models.ApiKey]
+}
+
+func NewApiKeyService() *ApiKeyService {
+	return &ApiKeyService{
+		apiKeyRepo: repositories.Repository[models.ApiKey]{DB: database.DB},
+	}
+}
+
+/* CREATE */
+
+// Create makes an API key for a tenant and returns it with the key itself, which is not stored
+// and cannot be shown again
+func (s *ApiKeyService) Create(tenantId uint, createdBy *uint, createApiKeyDto *dto.CreateApiKeyDto) (*models.ApiKey, string, error) {
+	if err := validateScopes(createApiKeyDto.Scopes); err != nil {
+		return nil, "", err
+	}
+	if createApiKeyDto.ExpiresAt != nil && !createApiKeyDto.ExpiresAt.After(time.Now()) {
+		return nil, "", ErrExpiresInPast
+	}
+	prefix, secret, err := newKey()
+	if err != nil {
+		return nil, "", err
+	}
+	apiKey, err := s.apiKeyRepo.Create(&models.ApiKey{
+		TenantID:    tenantId,
+		Name:        strings.TrimSpace(createApiKeyDto.Name),
+		Prefix:      prefix,
+		SecretHash:  utils.HashToken(secret),
+		Scopes:      createApiKeyDto.Scopes,
+		ExpiresAt:   createApiKeyDto.ExpiresAt,
+		CreatedByID: createdBy,
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create API key: %v", err)
+	}
+	return apiKey, prefix + "_" + secret, nil
+}
+
+/* READ */
+
+// FindAll lists the API keys of a tenant
+func (s *ApiKeyService) FindAll(tenantId uint) ([]models.ApiKey, error) {
+	var apiKeys []models.ApiKey
+	err := s.apiKeyRepo.CreateQueryBuilder().Where("tenant_id = ?", tenantId).Order("id DESC").Find(&apiKeys).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to find API keys: %v", err)
+	}
+	return apiKeys, nil
+}
+
+// FindOne returns an API key of a tenant
+func (s *ApiKeyService) FindOne(tenantId uint, apiKeyId uint) (*models.ApiKey, error) {
+	var apiKey models.ApiKey
+	err := s.apiKeyRepo.CreateQueryBuilder().Where("id = ? AND tenant_id = ?", apiKeyId, tenantId).First(&apiKey).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrApiKeyNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find API key: %v", err)
+	}
+	return &apiKey, nil
+}
+
+/* ROTATE */
+
+// Rotate gives an API key a new secret and returns the new key. The previous one keeps
+// working for global.API_KEY_ROTATION_GRACE so the integration can be switched over.
+func (s *ApiKeyService) Rotate(tenantId uint, apiKeyId uint) (*models.ApiKey, string, error) {
+	apiKey, err := s.FindOne(tenantId, apiKeyId)
+	if err != nil {
+		return nil, "", err
+	}
+	_, secret, err := newKey()
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	graceEnd := now.Add(global.API_KEY_ROTATION_GRACE)
+	// Conditional on the current secret so two concurrent rotations do not both win
+	result := s.apiKeyRepo.CreateQueryBuilder().
+		Where("id = ? AND secret_hash = ?", apiKey.ID, apiKey.SecretHash).
+		Updates(map[string]any{
+			"secret_hash":                utils.HashToken(secret),
+			"previous_secret_hash":       apiKey.SecretHash,
+			"previous_secret_expires_at": graceEnd,
+			"rotated_at":                 now,
+		})
+	if result.Error != nil {
+		return nil, "", fmt.Errorf("failed to rotate API key: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, "", fmt.Errorf("failed to rotate API key: it was rotated concurrently")
+	}
+	apiKey.RotatedAt = &now
+	return apiKey, apiKey.Prefix + "_" + secret, nil
+}
+
+/* DELETE */
+
+// Revoke deletes an API key; it stops working right away
+func (s *ApiKeyService) Revoke(tenantId uint, apiKeyId uint) error {
+	result := s.apiKeyRepo.CreateQueryBuilder().Where("id = ? AND tenant_id = ?", apiKeyId, tenantId).Delete(&models.ApiKey{})
+	if result.Error != nil {
+		return fmt.Errorf("failed to revoke API key: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrApiKeyNotFound
+	}
+	return nil
+}
+
+/* AUTHENTICATION */
+
+// Authenticate returns the API key of key, recording its use by ip
+func (s *ApiKeyService) Authenticate(key string, ip string) (*models.ApiKey, error) {
+	separator := strings.LastIndex(key, "_")
+	if !IsApiKey(key) || separator <= len(global.API_KEY_PREFIX) {
+		return nil, ErrInvalidApiKey
+	}
+	prefix, secretHash := key[:separator], utils.HashToken(key[separator+1:])
+
+	var apiKey models.ApiKey
+	err := s.apiKeyRepo.CreateQueryBuilder().Where("prefix = ?", prefix).First(&apiKey).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidApiKey
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find API key: %v", err)
+	}
+
+	now := time.Now()
+	valid := subtle.ConstantTimeCompare([]byte(secretHash), []byte(apiKey.SecretHash)) == 1
+	if !valid && apiKey.PreviousSecretHash != "" && apiKey.PreviousSecretExpiresAt != nil && apiKey.PreviousSecretExpiresAt.After(now) {
+		valid = subtle.ConstantTimeCompare([]byte(secretHash), []byte(apiKey.PreviousSecretHash)) == 1
+	}
+	if !valid {
+		return nil, ErrInvalidApiKey
+	}
+	if apiKey.ExpiresAt != nil && !apiKey.ExpiresAt.After(now) {
+		return nil, ErrApiKeyExpired
+	}
+
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= global.API_KEY_TOUCH_INTERVAL {
+		err := s.apiKeyRepo.CreateQueryBuilder().Where("id = ?", apiKey.ID).
+			Updates(map[string]any{"last_used_at": now, "last_used_ip": ip}).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to update API key: %v", err)
+		}
+		apiKey.LastUsedAt, apiKey.LastUsedIP = &now, ip
+	}
+	return &apiKey, nil
+}
+
+// IsApiKey tells whether a credential is an API key rather than a token
+func IsApiKey(credential string) bool {
+	return strings.HasPrefix(credential, global.API_KEY_PREFIX)
+}
+
+/* HELPERS */
+
+// newKey returns a random prefix (global.API_KEY_PREFIX and 12 hex digits) and secret
+func newKey() (string, string, error) {
+	bytes := make([]byte, 38)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", "", fmt.Errorf("failed to generate API key: %v", err)
+	}
+	return global.API_KEY_PREFIX + hex.EncodeToString(bytes[:6]), hex.EncodeToString(bytes[6:]), nil
+}
+
+func validateScopes(scopes []global.ApiKeyScope) error {
+	for _, scope := range scopes {
+		known := false
+		for _, s := range global.ApiKeyScopes {
+			if s == scope {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("%w: %q", ErrUnknownScope, scope)
+		}
+	}
+	return nil
+}
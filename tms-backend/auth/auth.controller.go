@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/auth/dtos"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/impersonations"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/passwords"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/sessions"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/sso"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/throttle"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/users"
+	"github.com/gin-gonic/gin"
+)
+
+type AuthController struct {
+	authService *AuthService
+}
+
+func NewAuthController(authService *AuthService) *AuthController {
+	return &AuthController{
+		authService: authService,
+	}
+}
+
+// Login signs a user in with an email address and password
+func (ac *AuthController) Login(c *gin.Context) {
+	var loginDto dtos.LoginDto
+	if err := c.ShouldBindJSON(&loginDto); err != nil || loginDto.Email == "" || loginDto.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+	user, err := ac.authService.ValidateUser(loginDto.Email, loginDto.Password, c)
+	if err != nil {
+		ac.errorResponse(c, err)
+		return
+	}
+	response, err := ac.authService.Login(user, LoginOptions{TenantID: loginDto.TenantID, Device: loginDto.Device}, c)
+	if err != nil {
+		ac.errorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// ChangePassword sets a new password and signs the user in
+func (ac *AuthController) ChangePassword(c *gin.Context) {
+	var changePasswordDto dtos.ChangePasswordDto
+	if err := c.ShouldBindJSON(&changePasswordDto); err != nil || changePasswordDto.Email == "" || changePasswordDto.NewPassword == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+	options := LoginOptions{TenantID: changePasswordDto.TenantID, Device: changePasswordDto.Device}
+	response, err := ac.authService.ChangePassword(changePasswordDto.Email, changePasswordDto.CurrentPassword, changePasswordDto.NewPassword, options, c)
+	if err != nil {
+		ac.errorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// Refresh rotates the refresh token of a session and returns a new access token
+func (ac *AuthController) Refresh(c *gin.Context) {
+	var refreshTokenDto dtos.RefreshTokenDto
+	if err := c.ShouldBindJSON(&refreshTokenDto); err != nil || refreshTokenDto.RefreshToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+	response, err := ac.authService.Refresh(refreshTokenDto.RefreshToken, c)
+	if err != nil {
+		ac.errorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// Logout signs the session of the request out. Under an impersonation, it ends the
+// impersonation instead; the impersonator stays signed in.
+func (ac *AuthController) Logout(c *gin.Context) {
+	if impersonationId := c.GetUint(global.CONTEXT_IMPERSONATION_ID_KEY); impersonationId != 0 {
+		ac.EndImpersonation(c)
+		return
+	}
+	err := ac.authService.Logout(c.GetUint(global.CONTEXT_USER_ID_KEY), c.GetUint(global.CONTEXT_SESSION_ID_KEY))
+	if err != nil && !errors.Is(err, sessions.ErrSessionNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Signed out"})
+}
+
+/* MAGIC LINK */
+
+// RequestMagicLink emails a link to sign in without a password. It is throttled like password reset requests
+func (ac *AuthController) RequestMagicLink(c *gin.Context) {
+	var requestDto dtos.MagicLinkRequestDto
+	if err := c.ShouldBindJSON(&requestDto); err != nil || requestDto.Email == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+	if err := throttle.LimitMailRequest(requestDto.Email, c); err != nil {
+		ac.errorResponse(c, err)
+		return
+	}
+	notification, err := ac.authService.RequestMagicLink(requestDto.Email, requestDto.TenantID, c)
+	if err != nil {
+		ac.errorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, notification)
+}
+
+// LoginWithMagicLink exchanges the token of a sign-in link for access and refresh tokens
+func (ac *AuthController) LoginWithMagicLink(c *gin.Context) {
+	var magicLinkDto dtos.MagicLinkDto
+	if err := c.ShouldBindJSON(&magicLinkDto); err != nil || magicLinkDto.Token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+	response, err := ac.authService.LoginWithMagicLink(magicLinkDto.Token, magicLinkDto.Device, c)
+	if err != nil {
+		ac.errorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+/* SINGLE SIGN-ON */
+
+// LoginWithSSO exchanges the code of a completed sign-in with a tenant's identity provider for access and refresh tokens
+func (ac *AuthController) LoginWithSSO(c *gin.Context) {
+	var ssoTokenDto dtos.SSOTokenDto
+	if err := c.ShouldBindJSON(&ssoTokenDto); err != nil || ssoTokenDto.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+	response, err := ac.authService.LoginWithSSO(ssoTokenDto.Code, c)
+	if err != nil {
+		ac.errorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+/* IMPERSONATION */
+
+// Impersonate lets landlord support staff act as a user of a tenant
+func (ac *AuthController) Impersonate(c *gin.Context) {
+	var impersonateDto dtos.ImpersonateDto
+	if err := c.ShouldBindJSON(&impersonateDto); err != nil || impersonateDto.UserID == 0 || impersonateDto.TenantID == 0 || strings.TrimSpace(impersonateDto.Reason) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: userId, tenantId and reason are required"})
+		return
+	}
+	options := ImpersonateOptions{UserID: impersonateDto.UserID, TenantID: impersonateDto.TenantID, Reason: impersonateDto.Reason}
+	response, err := ac.authService.Impersonate(c.GetUint(global.CONTEXT_USER_ID_KEY), c.GetUint(global.CONTEXT_SESSION_ID_KEY), options, c)
+	if err != nil {
+		ac.errorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// EndImpersonation ends the impersonation of the request's token
+func (ac *AuthController) EndImpersonation(c *gin.Context) {
+	impersonationId := c.GetUint(global.CONTEXT_IMPERSONATION_ID_KEY)
+	if impersonationId == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Not impersonating"})
+		return
+	}
+	err := ac.authService.EndImpersonation(impersonationId, c.GetUint(global.CONTEXT_IMPERSONATOR_ID_KEY))
+	if err != nil && !errors.Is(err, impersonations.ErrImpersonationNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Impersonation ended"})
+}
+
+func (ac *AuthController) errorResponse(c *gin.Context, err error) {
+	if throttle.WriteLimitError(c, err) {
+		return
+	}
+	var policyError *passwords.PolicyError
+	switch {
+	case errors.Is(err, ErrInvalidCredentials), errors.Is(err, ErrInvalidRefreshToken), errors.Is(err, sessions.ErrRefreshTokenReused), errors.Is(err, ErrInvalidMagicLink), errors.Is(err, sso.ErrInvalidCode):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrNotTeamMember), errors.Is(err, ErrImpersonationForbidden), errors.Is(err, ErrImpersonating), errors.Is(err, users.ErrMagicLinkDisabled),
+		errors.Is(err, ErrAccountDisabled):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrSSORequired):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error(), "ssoRequired": true})
+	case errors.Is(err, ErrPasswordChangeRequired):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error(), "passwordChangeRequired": true})
+	case errors.As(err, &policyError):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "violations": policyError.Violations})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/apikeys"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/config"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/impersonations"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/keys"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// ImpersonationResponse is what starting an impersonation returns
+type ImpersonationResponse struct {
+	AccessToken   string                `json:"accessToken"`
+	ExpiresAt     time.Time             `json:"expiresAt"`
+	Impersonation *models.Impersonation `json:"impersonation"`
+	User          *models.User          `json:"user"`
+}
+
+// ImpersonateOptions name who to impersonate, and why
+type ImpersonateOptions struct {
+	UserID   uint
+	TenantID uint
+	Reason   string
+}
+
+// Impersonate lets a landlord user, signed in with session sessionId, act as a user on the team
+// of a tenant. Landlord admins may impersonate the users of any tenant, tech-support account
+// officers those of their tenants. It returns an access token for the user, naming the
+// impersonator, that lasts global.IMPERSONATION_EXPIRATION and cannot be refreshed.
+// The tenant's admins are told.
+func (s *AuthService) Impersonate(impersonatorId uint, sessionId uint, options ImpersonateOptions, c *gin.Context) (*ImpersonationResponse, error) {
+	impersonator, err := s.userService.FindById(impersonatorId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkImpersonator(impersonator, options.TenantID); err != nil {
+		return nil, err
+	}
+
+	user, err := s.userService.FindById(options.UserID)
+	if err != nil {
+		return nil, err
+	}
+	// Landlord users are not tenant users, whatever team they are on
+	if user.ID == impersonator.ID || user.Landlord {
+		return nil, fmt.Errorf("%w: landlord users cannot be impersonated", ErrImpersonationForbidden)
+	}
+	isMember, err := s.userService.IsTeamMember(user.ID, options.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	if !isMember {
+		return nil, ErrNotTeamMember
+	}
+
+	impersonation, err := s.impersonationService.Start(impersonator, sessionId, user, options.TenantID, options.Reason, c)
+	if err != nil {
+		return nil, err
+	}
+	accessToken, err := s.CreateImpersonationToken(impersonator, user, impersonation, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create access token: %v", err)
+	}
+	log.Printf("User %d started impersonating user %d of tenant %d (impersonation %d): %s", impersonator.ID, user.ID, options.TenantID, impersonation.ID, impersonation.Reason)
+
+	if err := s.userService.NotifyImpersonation(impersonation, impersonator, user, c); err != nil {
+		log.Printf("Error notifying the admins of tenant %d of impersonation %d: %v", options.TenantID, impersonation.ID, err)
+	}
+
+	user.Sanitize()
+	return &ImpersonationResponse{AccessToken: accessToken, ExpiresAt: impersonation.ExpiresAt, Impersonation: impersonation, User: user}, nil
+}
+
+// EndImpersonation stops an impersonation before it expires
+func (s *AuthService) EndImpersonation(impersonationId uint, impersonatorId uint) error {
+	return s.impersonationService.End(impersonationId, impersonatorId)
+}
+
+// checkImpersonator tells whether a user may impersonate the users of a tenant
+func (s *AuthService) checkImpersonator(impersonator *models.User, tenantId uint) error {
+	if !impersonator.Landlord {
+		return fmt.Errorf("%w: landlord support staff only", ErrImpersonationForbidden)
+	}
+	for _, role := range impersonator.Roles {
+		if role.Name == string(global.AdminLandlord) || role.Name == string(global.SuperAdminLandlord) {
+			return nil
+		}
+	}
+	isTechSupport, err := s.userService.HasAccountOfficerRole(impersonator.ID, tenantId, global.AOT)
+	if err != nil {
+		return err
+	}
+	if !isTechSupport {
+		return fmt.Errorf("%w: only landlord admins and the tenant's tech-support account officers may", ErrImpersonationForbidden)
+	}
+	return nil
+}
+
+// CreateImpersonationToken signs the access token of an impersonation. It has no refresh token
+// and is only valid while the impersonation and the impersonator's session are.
+func (s *AuthService) CreateImpersonationToken(impersonator *models.User, user *models.User, impersonation *models.Impersonation, c *gin.Context) (string, error) {
+	key, err := keys.Access.SigningKey()
+	if err != nil {
+		return "", err
+	}
+	payload := tokenPayload(user, &models.Session{})
+	token := jwt.NewWithClaims(key.Method, jwt.MapClaims{
+		"username": payload.Username,
+		"sub":      payload.Sub,
+		"sid":      impersonation.SessionID,
+		"tid":      impersonation.TenantID,
+		"act":      map[string]any{"sub": impersonator.ID, "username": impersonator.PrimaryEmailAddress},
+		"imp":      impersonation.ID,
+		"iss":      config.AppConfig.JWT.Issuer,
+		"iat":      time.Now().Unix(),
+		"exp":      impersonation.ExpiresAt.Unix(),
+	})
+	token.Header["kid"] = key.Kid
+
+	return token.SignedString(key.Private)
+}
+
+// authenticateImpersonation checks that the impersonation of a token, and the session of its
+// impersonator, are still going, and stores who is calling on the context: the impersonated
+// user, without a session
+func authenticateImpersonation(c *gin.Context, payload *AuthTokenPayload, services *authServices) error {
+	if payload.Act == nil {
+		return fmt.Errorf("invalid token: impersonation without an actor")
+	}
+	session, err := services.sessions.FindActive(payload.Act.Sub, payload.SessionID)
+	if err != nil {
+		return err
+	}
+	impersonation, err := services.impersonations.FindActive(payload.ImpersonationID, payload.Act.Sub)
+	if err != nil {
+		return err
+	}
+	if err := services.sessions.Touch(session, c); err != nil {
+		return err
+	}
+
+	c.Set(contextPayloadKey, payload)
+	c.Set(global.CONTEXT_USER_ID_KEY, impersonation.UserID)
+	c.Set(global.CONTEXT_TENANT_ID_KEY, impersonation.TenantID)
+	c.Set(global.CONTEXT_IMPERSONATION_ID_KEY, impersonation.ID)
+	c.Set(global.CONTEXT_IMPERSONATOR_ID_KEY, impersonation.ImpersonatorID)
+	return nil
+}
+
+// DenyImpersonation keeps impersonators away from sensitive actions: password changes,
+// billing, credentials, deletions
+func DenyImpersonation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if payload := impersonationPayload(c); payload != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": ErrImpersonating.Error()})
+			return
+		}
+		c.Next()
+	}
+}
+
+// AuditImpersonation records every request made with an impersonation token, whatever its
+// route and outcome, in the audit trail of the impersonation. It is installed on the router.
+func AuditImpersonation() gin.HandlerFunc {
+	impersonationService := impersonations.NewImpersonationService()
+	return func(c *gin.Context) {
+		payload := impersonationPayload(c)
+		if payload == nil {
+			c.Next()
+			return
+		}
+		start := time.Now()
+		c.Next()
+		if err := impersonationService.RecordRequest(payload.ImpersonationID, c, time.Since(start)); err != nil {
+			log.Printf("Error auditing impersonation %d: %v", payload.ImpersonationID, err)
+		}
+	}
+}
+
+// impersonationPayload returns the payload of the request's access token if it is an
+// impersonation token with a valid signature, nil otherwise
+func impersonationPayload(c *gin.Context) *AuthTokenPayload {
+	if value, ok := c.Get(contextImpersonationKey); ok {
+		payload, _ := value.(*AuthTokenPayload)
+		return payload
+	}
+	var impersonation *AuthTokenPayload
+	if tokenString := bearerToken(c); tokenString != "" && !apikeys.IsApiKey(tokenString) {
+		if payload, err := parseToken(tokenString, keys.Access); err == nil && payload.ImpersonationID != 0 {
+			impersonation = payload
+		}
+	}
+	c.Set(contextImpersonationKey, impersonation)
+	return impersonation
+}
@@ -11,6 +11,15 @@ type AuthTokenPayload struct {
 		Landlord bool `json:"landlord"`
 		Roles []string `json:"roles"`
 	} `json:"sub"`
+	SessionID uint `json:"sid"`
+	TenantID uint `json:"tid,omitempty"`
+	// Set on impersonation tokens: Sub is the impersonated user, Act the landlord user acting
+	// as Sub (RFC 8693 actor claim) and SessionID a session of Act
+	Act *struct {
+		Sub uint `json:"sub"`
+		Username string `json:"username"`
+	} `json:"act,omitempty"`
+	ImpersonationID uint `json:"imp,omitempty"`
 }
 
 // JwtConstants holds configuration for JWT
@@ -0,0 +1,389 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/apikeys"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/impersonations"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/keys"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/repositories"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/sessions"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/users"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// contextPayloadKey holds the AuthTokenPayload of an authenticated request,
+// contextImpersonationKey that of a request with an impersonation token (see impersonationPayload)
+const (
+	contextPayloadKey       = "authTokenPayload"
+	contextImpersonationKey = "impersonationTokenPayload"
+)
+
+// authServices are what requests are authenticated against
+type authServices struct {
+	sessions       *sessions.SessionService
+	impersonations *impersonations.ImpersonationService
+	apiKeys        apiKeyAuthenticator
+	teams          teamDirectory
+}
+
+// apiKeyAuthenticator checks the API key of a request (see apikeys.ApiKeyService)
+type apiKeyAuthenticator interface {
+	Authenticate(key string, ip string) (*models.ApiKey, error)
+}
+
+// teamDirectory tells who is on the team of a tenant (see users.UserService)
+type teamDirectory interface {
+	IsTeamMember(userId uint, tenantId uint) (bool, error)
+	HasTenantRole(userId uint, tenantId uint, role global.TenantTeamRole) (bool, error)
+}
+
+// newAuthServices is a variable so tests can authenticate against fakes
+var newAuthServices = func() *authServices {
+	return &authServices{
+		sessions:       sessions.NewSessionService(),
+		impersonations: impersonations.NewImpersonationService(),
+		apiKeys:        apikeys.NewApiKeyService(),
+		teams:          users.NewUserService(),
+	}
+}
+
+// RequireAuth only lets through requests with a valid access token (Authorization: Bearer)
+// whose session is still signed in. It sets global.CONTEXT_USER_ID_KEY,
+// global.CONTEXT_SESSION_ID_KEY and, for a session signed in to a tenant, global.CONTEXT_TENANT_ID_KEY.
+//
+// Routes that list scopes also accept tenant API keys (Authorization: Bearer or X-API-Key)
+// holding every one of them. For those global.CONTEXT_API_KEY_ID_KEY and
+// global.CONTEXT_TENANT_ID_KEY are set instead.
+func RequireAuth(scopes ...global.ApiKeyScope) gin.HandlerFunc {
+	services := newAuthServices()
+	return func(c *gin.Context) {
+		if handleApiKey(c, services, scopes, nil) {
+			return
+		}
+		if _, err := authenticate(c, services); err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		c.Next()
+	}
+}
+
+// OptionalAuth is RequireAuth for routes anonymous callers may use too: a request with a bearer token
+// must be authenticated, one without goes through as it is, with no user on the context.
+func OptionalAuth() gin.HandlerFunc {
+	services := newAuthServices()
+	return func(c *gin.Context) {
+		if bearerToken(c) == "" {
+			c.Next()
+			return
+		}
+		if _, err := authenticate(c, services); err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireApiKey only lets through requests with a tenant API key holding every one of scopes,
+// for routes that are not for users at all. It sets global.CONTEXT_API_KEY_ID_KEY and
+// global.CONTEXT_TENANT_ID_KEY.
+func RequireApiKey(scopes ...global.ApiKeyScope) gin.HandlerFunc {
+	services := newAuthServices()
+	return func(c *gin.Context) {
+		if !handleApiKey(c, services, scopes, nil) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing API key"})
+		}
+	}
+}
+
+// RequireLandlordAdmin is RequireAuth for landlord users with the admin_landlord or super_admin_landlord role.
+// With scopes, tenant API keys holding them get through too: the handlers keep those to the data of
+// their tenant (global.CONTEXT_TENANT_ID_KEY, whenever global.CONTEXT_API_KEY_ID_KEY is set).
+func RequireLandlordAdmin(scopes ...global.ApiKeyScope) gin.HandlerFunc {
+	services := newAuthServices()
+	return func(c *gin.Context) {
+		if len(scopes) > 0 && handleApiKey(c, services, scopes, nil) {
+			return
+		}
+		payload, err := authenticate(c, services)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if !isLandlordAdmin(payload) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "landlord admins only"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireLandlordAdminForDeleted is RequireLandlordAdmin for list requests that ask for soft-deleted
+// records (see repositories.ListsDeleted). Other requests go through as they are.
+func RequireLandlordAdminForDeleted() gin.HandlerFunc {
+	requireLandlordAdmin := RequireLandlordAdmin()
+	return func(c *gin.Context) {
+		if !repositories.ListsDeleted(c.Request.URL) {
+			c.Next()
+			return
+		}
+		requireLandlordAdmin(c)
+	}
+}
+
+// RequireTenantAdmin is RequireAuth for admins of the tenant of the :id route parameter,
+// and for landlord admins. With scopes, API keys of that tenant holding them get through too.
+func RequireTenantAdmin(scopes ...global.ApiKeyScope) gin.HandlerFunc {
+	return requireTenantRole(scopes, func(services *authServices, userId uint, tenantId uint) (bool, error) {
+		return services.teams.HasTenantRole(userId, tenantId, global.A)
+	}, "tenant admins only")
+}
+
+// RequireTenantMember is RequireAuth for members of the team of the tenant of the :id route
+// parameter, and for landlord admins. With scopes, API keys of that tenant holding them get through too.
+func RequireTenantMember(scopes ...global.ApiKeyScope) gin.HandlerFunc {
+	return requireTenantRole(scopes, func(services *authServices, userId uint, tenantId uint) (bool, error) {
+		return services.teams.IsTeamMember(userId, tenantId)
+	}, "tenant team members only")
+}
+
+// requireTenantRole lets through landlord admins, users for whom allowed holds on the tenant of
+// the :id route parameter, and API keys of that tenant holding scopes
+func requireTenantRole(scopes []global.ApiKeyScope, allowed func(services *authServices, userId uint, tenantId uint) (bool, error), denied string) gin.HandlerFunc {
+	services := newAuthServices()
+	return func(c *gin.Context) {
+		tenantId, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+			return
+		}
+		ownTenant := func(apiKey *models.ApiKey) error {
+			if apiKey.TenantID != uint(tenantId) {
+				return fmt.Errorf("%w: it is the key of another tenant", ErrApiKeyForbidden)
+			}
+			return nil
+		}
+		if handleApiKey(c, services, scopes, ownTenant) {
+			return
+		}
+
+		payload, err := authenticate(c, services)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if isLandlordAdmin(payload) {
+			c.Next()
+			return
+		}
+		ok, err := allowed(services, payload.Sub.ID, uint(tenantId))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": denied})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireUserAccess is RequireAuth for the user of the :id route parameter and for landlord admins.
+// With scopes, API keys holding them get through too, for users on the team of their tenant.
+func RequireUserAccess(scopes ...global.ApiKeyScope) gin.HandlerFunc {
+	services := newAuthServices()
+	return func(c *gin.Context) {
+		userId, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+			return
+		}
+		teamMember := func(apiKey *models.ApiKey) error {
+			member, err := services.teams.IsTeamMember(uint(userId), apiKey.TenantID)
+			if err != nil {
+				return err
+			}
+			if !member {
+				return fmt.Errorf("%w: the user is not on the team of the key's tenant", ErrApiKeyForbidden)
+			}
+			return nil
+		}
+		if handleApiKey(c, services, scopes, teamMember) {
+			return
+		}
+
+		payload, err := authenticate(c, services)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if payload.Sub.ID != uint(userId) && !isLandlordAdmin(payload) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "only the user and landlord admins"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// authenticate verifies the access token of a request and its session, and stores who is calling on the context
+func authenticate(c *gin.Context, services *authServices) (*AuthTokenPayload, error) {
+	tokenString := bearerToken(c)
+	if tokenString == "" {
+		return nil, fmt.Errorf("missing bearer token")
+	}
+	payload, err := parseToken(tokenString, keys.Access)
+	if err != nil {
+		return nil, err
+	}
+	if payload.ImpersonationID != 0 {
+		return payload, authenticateImpersonation(c, payload, services)
+	}
+
+	// Signed-out sessions lose access right away, not when their access token expires
+	session, err := services.sessions.FindActive(payload.Sub.ID, payload.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := services.sessions.Touch(session, c); err != nil {
+		return nil, err
+	}
+
+	c.Set(contextPayloadKey, payload)
+	c.Set(global.CONTEXT_USER_ID_KEY, session.UserID)
+	c.Set(global.CONTEXT_SESSION_ID_KEY, session.ID)
+	if session.TenantID != nil {
+		c.Set(global.CONTEXT_TENANT_ID_KEY, *session.TenantID)
+	}
+	return payload, nil
+}
+
+// parseToken verifies a token signed by a key of manager, the one its kid header names, and returns its payload
+func parseToken(tokenString string, manager *keys.Manager) (*AuthTokenPayload, error) {
+	kid := ""
+	if unverified, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{}); err == nil {
+		kid, _ = unverified.Header["kid"].(string)
+	}
+	candidates, err := manager.VerificationKeys(kid)
+	if errors.Is(err, keys.ErrUnknownKey) {
+		return nil, fmt.Errorf("invalid token: %v", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load token keys: %v", err)
+	}
+
+	// Tokens without a kid predate key management: try every key
+	claims := jwt.MapClaims{}
+	err = keys.ErrUnknownKey
+	for _, key := range candidates {
+		claims = jwt.MapClaims{}
+		_, err = jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
+			return key.Public, nil
+		}, jwt.WithValidMethods([]string{key.Algorithm}))
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %v", err)
+	}
+
+	// Claims hold username, sub and sid as CreateAccessToken made them
+	var payload AuthTokenPayload
+	encoded, err := json.Marshal(claims)
+	if err == nil {
+		err = json.Unmarshal(encoded, &payload)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %v", err)
+	}
+	return &payload, nil
+}
+
+// apiKeyCredential returns the API key a request is made with, if any
+func apiKeyCredential(c *gin.Context) string {
+	if key := strings.TrimSpace(c.GetHeader("X-API-Key")); key != "" {
+		return key
+	}
+	if token := bearerToken(c); apikeys.IsApiKey(token) {
+		return token
+	}
+	return ""
+}
+
+// bearerToken returns the credential of the Authorization header, if it is a bearer one
+func bearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(header[7:])
+}
+
+// handleApiKey authenticates requests made with an API key (see authenticateApiKey) and passes
+// them on or aborts them. It tells whether the request had one: if not, it is left untouched.
+func handleApiKey(c *gin.Context, services *authServices, scopes []global.ApiKeyScope, allowed func(apiKey *models.ApiKey) error) bool {
+	credential := apiKeyCredential(c)
+	if credential == "" {
+		return false
+	}
+	if err := authenticateApiKey(c, services.apiKeys, credential, scopes, allowed); err != nil {
+		status := http.StatusUnauthorized
+		if errors.Is(err, ErrApiKeyForbidden) {
+			status = http.StatusForbidden
+		}
+		c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+		return true
+	}
+	c.Next()
+	return true
+}
+
+// authenticateApiKey verifies the API key of a request, that it holds scopes and that allowed
+// (if not nil) accepts it, and stores the key and its tenant on the context. Routes without scopes
+// are for users only.
+func authenticateApiKey(c *gin.Context, apiKeys apiKeyAuthenticator, credential string, scopes []global.ApiKeyScope, allowed func(apiKey *models.ApiKey) error) error {
+	apiKey, err := apiKeys.Authenticate(credential, c.ClientIP())
+	if err != nil {
+		return err
+	}
+	if len(scopes) == 0 {
+		return fmt.Errorf("%w: this route is for signed-in users only", ErrApiKeyForbidden)
+	}
+	if !apiKey.HasScopes(scopes...) {
+		return fmt.Errorf("%w: it needs the scopes %v", ErrApiKeyForbidden, scopes)
+	}
+	if allowed != nil {
+		if err := allowed(apiKey); err != nil {
+			return err
+		}
+	}
+	c.Set(global.CONTEXT_API_KEY_ID_KEY, apiKey.ID)
+	c.Set(global.CONTEXT_TENANT_ID_KEY, apiKey.TenantID)
+	return nil
+}
+
+func isLandlordAdmin(payload *AuthTokenPayload) bool {
+	return payload.Sub.Landlord && hasAnyRole(payload.Sub.Roles, string(global.AdminLandlord), string(global.SuperAdminLandlord))
+}
+
+func hasAnyRole(roles []string, wanted ...string) bool {
+	for _, role := range roles {
+		for _, w := range wanted {
+			if role == w {
+				return true
+			}
+		}
+	}
+	return false
+}
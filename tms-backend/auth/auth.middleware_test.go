@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/apikeys"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// fakeApiKeys knows the API keys of the tests by their credential
+type fakeApiKeys map[string]*models.ApiKey
+
+func (f fakeApiKeys) Authenticate(key string, ip string) (*models.ApiKey, error) {
+	apiKey, ok := f[key]
+	if !ok {
+		return nil, apikeys.ErrInvalidApiKey
+	}
+	return apiKey, nil
+}
+
+// fakeTeams puts users on tenant teams: tenant ID to user IDs
+type fakeTeams map[uint][]uint
+
+func (f fakeTeams) IsTeamMember(userId uint, tenantId uint) (bool, error) {
+	for _, member := range f[tenantId] {
+		if member == userId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f fakeTeams) HasTenantRole(userId uint, tenantId uint, role global.TenantTeamRole) (bool, error) {
+	return false, nil
+}
+
+func useFakeAuthServices(t *testing.T) {
+	t.Helper()
+	previous := newAuthServices
+	t.Cleanup(func() { newAuthServices = previous })
+	newAuthServices = func() *authServices {
+		return &authServices{
+			apiKeys: fakeApiKeys{
+				"erp-key":        {Model: gorm.Model{ID: 1}, TenantID: 1, Scopes: models.ApiKeyScopes{global.ScopeTenantsRead, global.ScopeTenantsWrite, global.ScopeUsersRead, global.ScopeUsersWrite}},
+				"monitoring-key": {Model: gorm.Model{ID: 2}, TenantID: 1, Scopes: models.ApiKeyScopes{global.ScopeTenantsRead, global.ScopeMailRead}},
+				"other-key":      {Model: gorm.Model{ID: 3}, TenantID: 2, Scopes: models.ApiKeyScopes{global.ScopeTenantsWrite, global.ScopeUsersWrite, global.ScopeMailWrite}},
+			},
+			teams: fakeTeams{1: {10}, 2: {20}},
+		}
+	}
+}
+
+func TestApiKeyScopes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useFakeAuthServices(t)
+
+	router := gin.New()
+	ok := func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"tenantId": c.GetUint(global.CONTEXT_TENANT_ID_KEY)})
+	}
+	router.GET("/me", RequireAuth(), ok)
+	router.GET("/scoped", RequireAuth(global.ScopeUsersRead), ok)
+	router.GET("/scim", RequireApiKey(global.ScopeSCIM), ok)
+	router.PATCH("/tenants/:id", RequireTenantAdmin(global.ScopeTenantsWrite), ok)
+	router.GET("/tenants/:id", RequireTenantMember(global.ScopeTenantsRead), ok)
+	router.DELETE("/tenants/:id", RequireTenantAdmin(), ok)
+	router.PATCH("/users/:id", RequireUserAccess(global.ScopeUsersWrite), ok)
+	router.GET("/mail/outbox", RequireLandlordAdmin(global.ScopeMailRead), ok)
+	router.GET("/mail/suppressions", RequireLandlordAdmin(), ok)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		want   int
+	}{
+		{"unknown key", http.MethodGet, "/scoped", "no-such-key", http.StatusUnauthorized},
+		{"route for users only", http.MethodGet, "/me", "erp-key", http.StatusForbidden},
+		{"scope held", http.MethodGet, "/scoped", "erp-key", http.StatusOK},
+		{"scope missing", http.MethodGet, "/scoped", "monitoring-key", http.StatusForbidden},
+		{"no key on an API key route", http.MethodGet, "/scim", "", http.StatusUnauthorized},
+		{"scim scope missing", http.MethodGet, "/scim", "erp-key", http.StatusForbidden},
+
+		{"write scope on own tenant", http.MethodPatch, "/tenants/1", "erp-key", http.StatusOK},
+		{"read scope only", http.MethodPatch, "/tenants/1", "monitoring-key", http.StatusForbidden},
+		{"another tenant", http.MethodPatch, "/tenants/1", "other-key", http.StatusForbidden},
+		{"read scope on own tenant", http.MethodGet, "/tenants/1", "monitoring-key", http.StatusOK},
+		{"read scope on another tenant", http.MethodGet, "/tenants/2", "monitoring-key", http.StatusForbidden},
+		{"tenant route for users only", http.MethodDelete, "/tenants/1", "erp-key", http.StatusForbidden},
+
+		{"user on the key's team", http.MethodPatch, "/users/10", "erp-key", http.StatusOK},
+		{"user on another team", http.MethodPatch, "/users/20", "erp-key", http.StatusForbidden},
+		{"users scope missing", http.MethodPatch, "/users/10", "monitoring-key", http.StatusForbidden},
+
+		{"mail scope held", http.MethodGet, "/mail/outbox", "monitoring-key", http.StatusOK},
+		{"mail scope missing", http.MethodGet, "/mail/outbox", "erp-key", http.StatusForbidden},
+		{"landlord route without scopes", http.MethodGet, "/mail/suppressions", "monitoring-key", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(test.method, test.path, nil)
+			if test.key != "" {
+				request.Header.Set("X-API-Key", test.key)
+			}
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, request)
+			if response.Code != test.want {
+				t.Errorf("%s %s = %d, want %d: %s", test.method, test.path, response.Code, test.want, response.Body)
+			}
+		})
+	}
+}
+
+func TestApiKeySetsItsTenant(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useFakeAuthServices(t)
+
+	router := gin.New()
+	router.GET("/mail/outbox", RequireLandlordAdmin(global.ScopeMailRead), func(c *gin.Context) {
+		if got := c.GetUint(global.CONTEXT_TENANT_ID_KEY); got != 1 {
+			t.Errorf("tenant = %d, want 1", got)
+		}
+		if got := c.GetUint(global.CONTEXT_API_KEY_ID_KEY); got != 2 {
+			t.Errorf("API key = %d, want 2", got)
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/mail/outbox", nil)
+	request.Header.Set("X-API-Key", "monitoring-key")
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	if response.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d: %s", response.Code, http.StatusNoContent, response.Body)
+	}
+}
+
+func TestOptionalAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useFakeAuthServices(t)
+
+	router := gin.New()
+	router.POST("/tenants/", OptionalAuth(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"userId": c.GetUint(global.CONTEXT_USER_ID_KEY)})
+	})
+	post := func(authorization string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/tenants/", nil)
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+
+	if response := post(""); response.Code != http.StatusOK || response.Body.String() != `{"userId":0}` {
+		t.Errorf("anonymous request = %d %s, want 200 without a user", response.Code, response.Body)
+	}
+	if response := post("Bearer not-a-token"); response.Code != http.StatusUnauthorized {
+		t.Errorf("request with an invalid token = %d, want 401", response.Code)
+	}
+}
@@ -1,22 +1,35 @@
 package auth
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"log"
 	//"net/http"
+	"sync"
 	"time"
 
 	"github.com/auditrakkr/tms-fullstack/tms-backend/auth/dtos"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/config"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/impersonations"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/keys"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/sessions"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/sso"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/throttle"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/users"
-	"github.com/dgrijalva/jwt-go"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type AuthService struct {
 	userService *users.UserService
+	sessionService *sessions.SessionService
+	impersonationService *impersonations.ImpersonationService
+	ssoService *sso.SSOService
 	googleConfig dtos.GoogleProfileDto
 	facebookConfig dtos.FacebookProfileDto
 }
@@ -24,24 +37,65 @@ type AuthService struct {
 func NewAuthService(userService *users.UserService, jwtConfig JwtConstants, googleConfig dtos.GoogleProfileDto, facebookConfig dtos.FacebookProfileDto) *AuthService {
 	return &AuthService{
 		userService: userService,
+		sessionService: sessions.NewSessionService(),
+		impersonationService: impersonations.NewImpersonationService(),
+		ssoService: sso.NewSSOService(userService),
 		googleConfig: googleConfig,
 		facebookConfig: facebookConfig,
 	}
 }
 
-func (s *AuthService) ValidateUser(email, password string) (*models.User, error) {
-	user, err := s.userService.FindByPrimaryEmailAddress(email)
-	if err != nil {
-		return nil, fmt.Errorf("failed to find user: %v", err)
+var (
+	ErrInvalidCredentials     = errors.New("invalid email address or password")
+	ErrPasswordChangeRequired = errors.New("the password must be changed before signing in")
+	ErrInvalidRefreshToken    = errors.New("invalid or expired refresh token")
+	ErrNotTeamMember          = errors.New("the user is not a member of the tenant's team")
+	ErrApiKeyForbidden        = errors.New("the API key may not access this route")
+	ErrImpersonationForbidden = errors.New("not allowed to impersonate this user")
+	ErrImpersonating          = errors.New("not allowed while impersonating a user")
+	ErrInvalidMagicLink       = errors.New("invalid, expired or already used sign-in link")
+	ErrSSORequired            = errors.New("this address must sign in with the organization's identity provider")
+	ErrAccountDisabled        = errors.New("the account is deactivated")
+)
+
+// LoginResponse is what a successful login returns
+type LoginResponse struct {
+	AccessToken  string       `json:"accessToken"`
+	RefreshToken string       `json:"refreshToken"`
+	User         *models.User `json:"user"`
+}
+
+// ValidateUser checks the credentials of a user. Unknown addresses and wrong
+// passwords return the same ErrInvalidCredentials.
+// Failures are counted per account and per client IP address: after a few, attempts are
+// delayed, then locked out (see throttle.LoginAccounts), which returns a *throttle.LimitError.
+//
+// Addresses of a domain whose tenant enforces single sign-on get ErrSSORequired, whatever the password.
+func (s *AuthService) ValidateUser(email, password string, c *gin.Context) (*models.User, error) {
+	if err := s.checkSSONotEnforced(email); err != nil {
+		return nil, err
+	}
+	if err := throttle.LoginIPs.Check(c.ClientIP()); err != nil {
+		return nil, err
 	}
-	if user == nil {
-		return nil, errors.New("user not found")
+	if err := throttle.LoginAccounts.Check(email); err != nil {
+		return nil, err
+	}
+
+	user, err := s.userService.FindByPrimaryEmailAddress(email)
+	if err != nil || user == nil || user.PasswordHash == "" {
+		// Take as long as a wrong password, so the response time does not tell whether the account exists
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return nil, s.loginFailed(email, nil, c)
 	}
 
 	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
 
 	if err != nil {
-		return nil, errors.New("invalid password")
+		return nil, s.loginFailed(email, user, c)
+	}
+	if err := throttle.LoginAccounts.Reset(email); err != nil {
+		log.Printf("Error resetting failed logins of user %d: %v", user.ID, err)
 	}
 
 	// Remove sensitive information
@@ -50,50 +104,71 @@ func (s *AuthService) ValidateUser(email, password string) (*models.User, error)
 	return user, nil
 }
 
-func (s *AuthService) CreateAccessToken(user *models.User, c *gin.Context) (string, error) {
+// dummyPasswordHash is what ValidateUser compares passwords with when there is no account to compare with
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("not the password of any account"), bcrypt.DefaultCost)
+	if err != nil {
+		panic(fmt.Sprintf("failed to hash the dummy password: %v", err))
+	}
+	return hash
+})
 
-	jwtConstants := config.AppConfig.JWT
-	// Create token payload
-	payload := AuthTokenPayload{
-		Username: user.PrimaryEmailAddress,
-		Sub: struct {
-			ID        uint     `json:"id"`
-			FirstName string   `json:"first_name"`
-			LastName  string   `json:"last_name"`
-			Landlord  bool     `json:"landlord"`
-			Roles     []string `json:"roles"`
+// checkSSONotEnforced returns ErrSSORequired for addresses that may only sign in with their tenant's identity provider
+func (s *AuthService) checkSSONotEnforced(email string) error {
+	enforced, err := s.ssoService.IsEnforced(email)
+	if err != nil {
+		return err
+	}
+	if enforced {
+		return ErrSSORequired
+	}
+	return nil
+}
 
-		}{
-			ID:        user.ID,
-			FirstName: user.FirstName,
-			LastName:  user.LastName,
-			Landlord:  user.Landlord,
-		},
+// loginFailed counts a failed login and tells the user when it locks the account out.
+// Unknown addresses are counted too, so a lockout does not reveal who has an account.
+func (s *AuthService) loginFailed(email string, user *models.User, c *gin.Context) error {
+	if _, err := throttle.LoginIPs.Fail(c.ClientIP()); err != nil {
+		return err
+	}
+	locked, err := throttle.LoginAccounts.Fail(email)
+	if err != nil {
+		return err
+	}
+	if locked && user != nil {
+		log.Printf("Locking out user %d after %d failed logins, the last one from %s", user.ID, throttle.LoginAccounts.MaxFailures, c.ClientIP())
+		if err := s.userService.NotifyAccountLocked(user, throttle.LoginAccounts.Lockout, c); err != nil {
+			log.Printf("Error sending lockout notice to user %d: %v", user.ID, err)
+		}
 	}
+	return ErrInvalidCredentials
+}
 
+// CreateAccessToken signs a short-lived access token for a session of a user
+func (s *AuthService) CreateAccessToken(user *models.User, session *models.Session, c *gin.Context) (string, error) {
 
+	jwtConstants := config.AppConfig.JWT
+	payload := tokenPayload(user, session)
 
-	// Add roles if they exist
-	for _, role := range user.Roles {
-		payload.Sub.Roles = append(payload.Sub.Roles, role.Name)
+	key, err := keys.Access.SigningKey()
+	if err != nil {
+		return "", err
 	}
 
-	// Create token with claims
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+	// Create token with claims; kid tells verifiers which published key signed it
+	token := jwt.NewWithClaims(key.Method, jwt.MapClaims{
 		"username": payload.Username,
 		"sub":      payload.Sub,
-		"iss":      c.Request.Host,
+		"sid":      payload.SessionID,
+		"tid":      payload.TenantID,
+		"iss":      config.AppConfig.JWT.Issuer,
 		"iat":      time.Now().Unix(),
 		"exp":      time.Now().Add(time.Second * time.Duration(jwtConstants.SecretKeyExpiration)).Unix(),
 	})
 
-	// Sign the token with private key
-	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(jwtConstants.Secret))
-	if err != nil {
-		return "", err
-	}
+	token.Header["kid"] = key.Kid
 
-	signedToken, err := token.SignedString(privateKey)
+	signedToken, err := token.SignedString(key.Private)
 	if err != nil {
 		return "", err
 	}
@@ -101,58 +176,212 @@ func (s *AuthService) CreateAccessToken(user *models.User, c *gin.Context) (stri
 	return signedToken, nil
 }
 
-func (s *AuthService) CreateRefreshToken(user *models.User, c *gin.Context) (string, error) {
-	jwtConstants := config.AppConfig.JWT
+// CreateRefreshToken signs a refresh token for a session of a user. Each one has its own
+// jti, so every rotation gives a different token; the caller stores it with sessions.Rotate.
+func (s *AuthService) CreateRefreshToken(user *models.User, session *models.Session, c *gin.Context) (string, error) {
+	payload := tokenPayload(user, session)
 
-	// Create token payload similar to access token
-	payload := AuthTokenPayload{
-		Username: user.PrimaryEmailAddress,
-		Sub: struct {
-			ID        uint     `json:"id"`
-			FirstName string   `json:"first_name"`
-			LastName  string   `json:"last_name"`
-			Landlord  bool     `json:"landlord"`
-			Roles     []string `json:"roles"`
-
-		}{
-			ID:        user.ID,
-			FirstName: user.FirstName,
-			LastName:  user.LastName,
-			Landlord:  user.Landlord,
-		},
+	tokenId := make([]byte, 16)
+	if _, err := rand.Read(tokenId); err != nil {
+		return "", err
 	}
 
-	// Add roles if they exist
-	for _, role := range user.Roles {
-		payload.Sub.Roles = append(payload.Sub.Roles, role.Name)
+	key, err := keys.Refresh.SigningKey()
+	if err != nil {
+		return "", err
 	}
 
-	// Create token with claims
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+	token := jwt.NewWithClaims(key.Method, jwt.MapClaims{
 		"username": payload.Username,
 		"sub":      payload.Sub,
-		"iss":      c.Request.Host,
+		"sid":      payload.SessionID,
+		"jti":      hex.EncodeToString(tokenId),
+		"iss":      config.AppConfig.JWT.Issuer,
 		"iat":      time.Now().Unix(),
-		"exp":      time.Now().Add(time.Second * time.Duration(jwtConstants.RefreshSecretKeyExpiration)).Unix(),
+		"exp":      session.ExpiresAt.Unix(),
 	})
 
-	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(jwtConstants.RefreshSecret))
+	token.Header["kid"] = key.Kid
+
+	signedToken, err := token.SignedString(key.Private)
 	if err != nil {
 		return "", err
 	}
 
-	signedToken, err := token.SignedString(privateKey)
+	return signedToken, nil
+}
+
+// tokenPayload is what the tokens of a session say about its user
+func tokenPayload(user *models.User, session *models.Session) AuthTokenPayload {
+	payload := AuthTokenPayload{Username: user.PrimaryEmailAddress, SessionID: session.ID}
+	payload.Sub.ID = user.ID
+	payload.Sub.FirstName = user.FirstName
+	payload.Sub.LastName = user.LastName
+	payload.Sub.Landlord = user.Landlord
+	// Add roles if they exist
+	for _, role := range user.Roles {
+		payload.Sub.Roles = append(payload.Sub.Roles, role.Name)
+	}
+	if session.TenantID != nil {
+		payload.TenantID = *session.TenantID
+	}
+	return payload
+}
+
+// LoginOptions describe the session a login starts
+type LoginOptions struct {
+	TenantID uint   // tenant the user signs in to, 0 for none
+	Device   string // name of the device, guessed from the user agent if empty
+	// Signed in by an identity provider: a password that must be changed is not in the way
+	identityProvider bool
+}
+
+// Login starts a session for a user and returns its access and refresh tokens.
+// A user whose password must be changed gets ErrPasswordChangeRequired instead and
+// has to go through ChangePassword.
+// Deactivated users (see models.User.IsActive) get ErrAccountDisabled, however they signed in.
+func (s *AuthService) Login(user *models.User, options LoginOptions, c *gin.Context) (*LoginResponse, error) {
+	// Reload for the roles and the current IsPasswordChangeRequired
+	user, err := s.userService.FindById(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !user.IsActive {
+		return nil, ErrAccountDisabled
+	}
+	if user.IsPasswordChangeRequired && !options.identityProvider {
+		return nil, ErrPasswordChangeRequired
+	}
+
+	var tenantId *uint
+	if options.TenantID > 0 {
+		isMember, err := s.userService.IsTeamMember(user.ID, options.TenantID)
+		if err != nil {
+			return nil, err
+		}
+		if !isMember {
+			return nil, ErrNotTeamMember
+		}
+		tenantId = &options.TenantID
+	}
+
+	session, err := s.sessionService.Create(user.ID, tenantId, options.Device, c)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	return s.issueTokens(user, session, c)
+}
 
-	err = s.userService.SetRefreshTokenHash(user.ID, string(signedToken))
+// RequestMagicLink emails a user a link to sign in to a tenant without a password, see users.MagicLinkRequest
+// Like passwords, sign-in links are refused to addresses of a domain that enforces single sign-on.
+func (s *AuthService) RequestMagicLink(email string, tenantId uint, c *gin.Context) (*global.GenericNotificationResponse, error) {
+	if err := s.checkSSONotEnforced(email); err != nil {
+		return nil, err
+	}
+	return s.userService.MagicLinkRequest(email, tenantId, c)
+}
+
+// LoginWithMagicLink uses up the token of a sign-in link and starts a session like Login.
+// Like a password reset, it proves the user owns the address, so it lifts a sign-in lockout.
+func (s *AuthService) LoginWithMagicLink(token string, device string, c *gin.Context) (*LoginResponse, error) {
+	user, tenantId, err := s.userService.UseMagicLink(token)
+	if errors.Is(err, users.ErrInvalidMagicLink) || errors.Is(err, users.ErrMagicLinkExpired) {
+		return nil, ErrInvalidMagicLink
+	}
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	if err := throttle.LoginAccounts.Reset(user.PrimaryEmailAddress); err != nil {
+		log.Printf("Error resetting sign-in lockout of user %d: %v", user.ID, err)
+	}
+	return s.Login(user, LoginOptions{TenantID: tenantId, Device: device}, c)
+}
 
-	return signedToken, nil
+// LoginWithSSO uses up the code of a sign-in with a tenant's identity provider (see sso.SSOService.CompleteLogin)
+// and starts a session on the tenant like Login
+func (s *AuthService) LoginWithSSO(code string, c *gin.Context) (*LoginResponse, error) {
+	login, err := s.ssoService.UseCode(code)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.userService.FindById(*login.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return s.Login(user, LoginOptions{TenantID: login.TenantID, Device: login.Device, identityProvider: true}, c)
+}
+
+// Refresh exchanges a refresh token for new access and refresh tokens. The refresh token
+// can only be used once: presenting it again signs its session out (see sessions.UseRefreshToken).
+// Sessions of a deactivated user are signed out with ErrAccountDisabled.
+func (s *AuthService) Refresh(refreshToken string, c *gin.Context) (*LoginResponse, error) {
+	payload, err := parseToken(refreshToken, keys.Refresh)
+	if err != nil || payload.SessionID == 0 {
+		return nil, ErrInvalidRefreshToken
+	}
+	session, err := s.sessionService.UseRefreshToken(payload.SessionID, refreshToken)
+	if errors.Is(err, sessions.ErrRefreshTokenReused) {
+		log.Printf("Refresh token reuse on session %d of user %d from %s: session signed out", payload.SessionID, payload.Sub.ID, c.ClientIP())
+		return nil, err
+	}
+	if errors.Is(err, sessions.ErrSessionNotFound) || errors.Is(err, sessions.ErrSessionEnded) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.userService.FindById(session.UserID)
+	if err != nil {
+		return nil, err
+	}
+	// Deactivating a user signs their sessions out (see users.UserService.UpdateProvisionedUser):
+	// this catches a session signed in while it was being done
+	if !user.IsActive {
+		err := s.sessionService.Revoke(user.ID, session.ID, sessions.RevokedByDeactivation)
+		if err != nil && !errors.Is(err, sessions.ErrSessionNotFound) {
+			return nil, err
+		}
+		return nil, ErrAccountDisabled
+	}
+	if user.IsPasswordChangeRequired {
+		return nil, ErrPasswordChangeRequired
+	}
+	return s.issueTokens(user, session, c)
 }
 
-// Login handles user login and returns access and refresh tokens
-func (s *AuthService) Login(user *models.User)
\ No newline at end of file
+// Logout signs a session out
+func (s *AuthService) Logout(userId uint, sessionId uint) error {
+	return s.sessionService.Revoke(userId, sessionId, sessions.RevokedBySignOut)
+}
+
+// issueTokens creates the tokens of a session and makes the refresh token its current one
+func (s *AuthService) issueTokens(user *models.User, session *models.Session, c *gin.Context) (*LoginResponse, error) {
+	refreshToken, err := s.CreateRefreshToken(user, session, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create refresh token: %v", err)
+	}
+	if err := s.sessionService.Rotate(session, refreshToken, c); err != nil {
+		return nil, err
+	}
+	accessToken, err := s.CreateAccessToken(user, session, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create access token: %v", err)
+	}
+
+	user.Sanitize()
+	return &LoginResponse{AccessToken: accessToken, RefreshToken: refreshToken, User: user}, nil
+}
+
+// ChangePassword replaces the password of a user who knows the current one, then signs the user in.
+// This is how a user with IsPasswordChangeRequired gets to sign in.
+func (s *AuthService) ChangePassword(email, currentPassword, newPassword string, options LoginOptions, c *gin.Context) (*LoginResponse, error) {
+	user, err := s.ValidateUser(email, currentPassword, c)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.userService.SetUserPassword(user.ID, newPassword); err != nil {
+		return nil, err
+	}
+	return s.Login(user, options, c)
+}
@@ -0,0 +1,8 @@
+package dtos
+
+// ImpersonateDto asks to act as a user of a tenant, for support
+type ImpersonateDto struct {
+	UserID   uint   `json:"userId" validate:"required"`
+	TenantID uint   `json:"tenantId" validate:"required"` // tenant whose team the user is on
+	Reason   string `json:"reason" validate:"required"`   // shown to the tenant admins and kept in the audit trail
+}
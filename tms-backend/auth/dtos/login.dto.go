@@ -0,0 +1,40 @@
+package dtos
+
+// LoginDto holds the credentials of a user signing in
+type LoginDto struct {
+	Email    string `json:"email" validate:"required,email"`
+	Password string `json:"password" validate:"required"`
+	TenantID uint   `json:"tenantId,omitempty"` // tenant to sign in to, if any
+	Device   string `json:"device,omitempty"`   // name of the device, guessed from the user agent if empty
+}
+
+// ChangePasswordDto replaces the password of a user who knows the current one
+type ChangePasswordDto struct {
+	Email           string `json:"email" validate:"required,email"`
+	CurrentPassword string `json:"currentPassword" validate:"required"`
+	NewPassword     string `json:"newPassword" validate:"required"`
+	TenantID        uint   `json:"tenantId,omitempty"`
+	Device          string `json:"device,omitempty"`
+}
+
+// RefreshTokenDto exchanges a refresh token for new tokens
+type RefreshTokenDto struct {
+	RefreshToken string `json:"refreshToken" validate:"required"`
+}
+
+// MagicLinkRequestDto asks for a link to sign in without a password
+type MagicLinkRequestDto struct {
+	Email    string `json:"email" validate:"required,email"`
+	TenantID uint   `json:"tenantId,omitempty"` // tenant to sign in to; may be left out by users on a single team
+}
+
+// MagicLinkDto exchanges the token of a sign-in link for tokens
+type MagicLinkDto struct {
+	Token  string `json:"token" validate:"required"`
+	Device string `json:"device,omitempty"`
+}
+
+// SSOTokenDto exchanges the code of a completed single sign-on for tokens
+type SSOTokenDto struct {
+	Code string `json:"code" validate:"required"`
+}
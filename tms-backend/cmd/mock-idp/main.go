@@ -0,0 +1,58 @@
+// Command mock-idp is an identity provider for trying out and testing tenant single sign-on locally.
+// It speaks OpenID Connect and SAML 2.0 and signs in whoever is typed into its form, or with -auto
+// the user given by its flags, without asking.
+//
+//	go run ./cmd/mock-idp -addr 127.0.0.1:9000 -groups admins
+//
+// Then set the SSO of a tenant (PUT /tenants/:id/sso) to, for OpenID Connect:
+//
+//	{"enabled": true, "protocol": "oidc", "domains": ["example.com"], "jitProvisioning": true,
+//	 "roleMapping": {"admins": ["Admin"]},
+//	 "oidc": {"discoveryUrl": "http://127.0.0.1:9000", "clientId": "tms", "clientSecret": "secret"}}
+//
+// or, for SAML, {"protocol": "saml", "saml": {"idpMetadataUrl": "http://127.0.0.1:9000/saml/metadata"}, ...}
+// and open /auth/sso/:tenantId/login in a browser. Nobody signs in until the domain is verified
+// (POST /tenants/:id/sso/domains/:domain/verify).
+// Keys are generated at every start.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/sso/mockidp"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:9000", "address to listen on")
+	issuer := flag.String("issuer", "", "issuer URL, http://<addr> if empty")
+	clientID := flag.String("client-id", "tms", "OpenID Connect client ID")
+	clientSecret := flag.String("client-secret", "secret", "OpenID Connect client secret")
+	email := flag.String("email", "jane.doe@example.com", "email address of the user")
+	givenName := flag.String("given-name", "Jane", "first name of the user")
+	familyName := flag.String("family-name", "Doe", "last name of the user")
+	groups := flag.String("groups", "", "comma separated groups of the user")
+	auto := flag.Bool("auto", false, "sign the user of the flags in without showing the form")
+	flag.Parse()
+
+	if *issuer == "" {
+		*issuer = "http://" + *addr
+	}
+	idp, err := mockidp.New(*issuer, *clientID, *clientSecret, *auto, mockidp.Identity{
+		Email:      *email,
+		GivenName:  *givenName,
+		FamilyName: *familyName,
+		Groups:     mockidp.SplitGroups(*groups),
+	})
+	if err != nil {
+		log.Fatalf("Failed to start mock identity provider: %v", err)
+	}
+	handler, err := idp.Handler()
+	if err != nil {
+		log.Fatalf("Failed to start mock identity provider: %v", err)
+	}
+
+	log.Printf("Mock identity provider %s listening on %s (OpenID Connect client %s, SAML metadata %s/saml/metadata)", idp.Issuer(), *addr, *clientID, idp.Issuer())
+	log.Fatal(http.ListenAndServe(*addr, handler))
+}
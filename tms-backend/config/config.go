@@ -2,7 +2,10 @@ package config
 
 import (
 	"log"
+	"strings"
+	"time"
 
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
 	"github.com/joho/godotenv"
 	"github.com/spf13/viper"
 
@@ -12,6 +15,12 @@ import (
 )
 
 type Config struct {
+	App struct {
+		RootURL string // public base URL of the application, used for links in emails
+		// Other base URLs the application is reached through (e.g. tenant domains). A link
+		// uses the one the request came through, RootURL otherwise
+		TrustedURLs []string
+	}
 	Postgres struct{
 		Host     string
 		Port     int
@@ -43,6 +52,28 @@ type Config struct {
 		SecretKeyExpiration      int
 		RefreshSecret            string
 		RefreshSecretKeyExpiration int
+		SigningAlgorithm         string // of the keys generated on rotation: RS256, ES256 or EdDSA
+		Issuer                   string // iss claim of the tokens, the root URL if not set
+	}
+
+	// Signed, expiring download URLs for private files
+	FileURLSigning struct {
+		Keys       string // comma separated kid:secret pairs, the first one signs new URLs
+		Expiration int    // default lifetime of a signed URL in seconds
+	}
+
+	// Inbound bounce and complaint webhooks of the email provider
+	MailWebhooks struct {
+		Secret string // shared token the provider must send, as ?token= or the basic auth password
+	}
+
+	Passwords struct {
+		BreachCorpusDir string // directory of Pwned Passwords range files, the breach check is skipped if empty
+	}
+
+	// Soft-deleted records are purged once they have been in the trash this long, never if 0 or less
+	Trash struct {
+		Retention time.Duration
 	}
 }
 var AppConfig *Config
@@ -66,6 +97,13 @@ func LoadConfig() {
 	// This is just a placeholder implementation.
 	AppConfig = &Config{}
 
+	AppConfig.App.RootURL = viper.GetString("APP_ROOT_HTTP_URL")
+	for _, trustedURL := range strings.Split(viper.GetString("APP_TRUSTED_HTTP_URLS"), ",") {
+		if trustedURL = strings.TrimSpace(trustedURL); trustedURL != "" {
+			AppConfig.App.TrustedURLs = append(AppConfig.App.TrustedURLs, trustedURL)
+		}
+	}
+
 	// PostgreSQL configuration
 	AppConfig.Postgres.Host = viper.GetString("POSTGRES_HOST")
 	AppConfig.Postgres.Port = viper.GetInt("POSTGRES_PORT")
@@ -83,6 +121,27 @@ func LoadConfig() {
 	AppConfig.JWT.SecretKeyExpiration = viper.GetInt("SECRET_KEY_EXPIRATION")
 	AppConfig.JWT.RefreshSecret = viper.GetString("REFRESH_SECRET")
 	AppConfig.JWT.RefreshSecretKeyExpiration = viper.GetInt("REFRESH_SECRET_KEY_EXPIRATION")
+	AppConfig.JWT.SigningAlgorithm = viper.GetString("JWT_SIGNING_ALGORITHM")
+	AppConfig.JWT.Issuer = viper.GetString("JWT_ISSUER")
+	if AppConfig.JWT.Issuer == "" {
+		AppConfig.JWT.Issuer = AppConfig.App.RootURL
+	}
+
+	// Signed file URL configuration
+	AppConfig.FileURLSigning.Keys = viper.GetString("FILE_URL_SIGNING_KEYS")
+	AppConfig.FileURLSigning.Expiration = viper.GetInt("FILE_URL_EXPIRATION")
+
+	// Mail webhook configuration
+	AppConfig.MailWebhooks.Secret = viper.GetString("MAIL_WEBHOOK_SECRET")
+
+	// Password policy configuration
+	AppConfig.Passwords.BreachCorpusDir = viper.GetString("PASSWORD_BREACH_CORPUS_DIR")
+
+	// Trash retention configuration, in days
+	AppConfig.Trash.Retention = global.TRASH_DEFAULT_RETENTION
+	if viper.IsSet("TRASH_RETENTION_DAYS") {
+		AppConfig.Trash.Retention = time.Duration(viper.GetInt("TRASH_RETENTION_DAYS")) * 24 * time.Hour
+	}
 	// Configure OAuth2 for Google and Facebook
 	GoogleOAuthConfig = &oauth2.Config{
 		ClientID:     viper.GetString("GOOGLE_CLIENT_ID"),
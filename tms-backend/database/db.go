@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strings"
 
 	"github.com/auditrakkr/tms-fullstack/tms-backend/config"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
@@ -76,6 +77,14 @@ func ConnectDB() {
 			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'theme_type') THEN
 				CREATE TYPE theme_type AS ENUM ('standard', 'auditrakkr');
 			END IF;
+
+			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'email_status') THEN
+				CREATE TYPE email_status AS ENUM ('pending', 'sending', 'retry', 'sent', 'dead');
+			END IF;
+
+			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'email_deliverability') THEN
+				CREATE TYPE email_deliverability AS ENUM ('deliverable', 'soft_bounced', 'hard_bounced', 'complained');
+			END IF;
 		END $$;
 	`).Error
 	if err != nil {
@@ -85,6 +94,18 @@ func ConnectDB() {
 	// Ensure uuid-ossp extension is available
 	DB.Exec("CREATE EXTENSION IF NOT EXISTS \"uuid-ossp\";")
 
+	// Before AutoMigrate creates their partial replacements
+	if err := dropFullUniqueKeys(); err != nil {
+		log.Fatalf("Failed to migrate unique keys: %v", err)
+	}
+
+	// Signing keys were unique by kid alone, they now are by purpose and kid
+	if DB.Migrator().HasIndex(&models.SigningKey{}, "idx_signing_keys_kid") {
+		if err := DB.Migrator().DropIndex(&models.SigningKey{}, "idx_signing_keys_kid"); err != nil {
+			log.Fatalf("Failed to migrate signing keys: %v", err)
+		}
+	}
+
 	if err := DB.AutoMigrate(
 		&models.User{},
 		&models.Tenant{},
@@ -98,6 +119,17 @@ func ConnectDB() {
 		&models.Theme{},
 		&models.FacebookProfile{},
 		&models.GoogleProfile{},
+		&models.EmailOutbox{},
+		&models.EmailSendLog{},
+		&models.EmailSuppression{},
+		&models.PasswordHistory{},
+		&models.Session{},
+		&models.SigningKey{},
+		&models.ApiKey{},
+		&models.Impersonation{},
+		&models.ImpersonationRequest{},
+		&models.MagicLink{},
+		&models.SSOLogin{},
 		); err != nil {
 		log.Fatalf("Failed to migrate database: %v", err)
 	}
@@ -106,6 +138,67 @@ func ConnectDB() {
 	log.Println("Connected to PostgreSQL database successfully")
 }
 
+// softDeletedUniqueKeys are the unique keys that soft-deleted rows must not hold, for a new row to
+// take their values (e.g. the email address of a deleted user). The models declare them as unique
+// indexes WHERE deleted_at IS NULL; these are the columns of each, sorted.
+var softDeletedUniqueKeys = []struct {
+	table   string
+	columns []string
+}{
+	{"users", []string{"primary_email_address"}},
+	{"users", []string{"backup_email_address"}},
+	{"tenants", []string{"region_root_domain", "subdomain"}},
+	{"tenants", []string{"custom_url_slug"}},
+	{"billings", []string{"code"}},
+	{"regions", []string{"name"}},
+	{"roles", []string{"name"}},
+	{"tenant_account_officers", []string{"tenant_id", "user_id"}},
+	{"tenant_teams", []string{"tenant_id", "user_id"}},
+	{"google_profiles", []string{"google_id"}},
+	{"google_profiles", []string{"email"}},
+	{"facebook_profiles", []string{"facebook_id"}},
+}
+
+// dropFullUniqueKeys drops the unique constraints and indexes over every row that databases created
+// before softDeletedUniqueKeys were partial
+func dropFullUniqueKeys() error {
+	for _, key := range softDeletedUniqueKeys {
+		var uniqueKeys []struct {
+			IndexName      string
+			ConstraintName string
+		}
+		err := DB.Raw(`
+			SELECT ci.relname AS index_name, COALESCE(con.conname, '') AS constraint_name
+			FROM pg_index i
+				JOIN pg_class ct ON ct.oid = i.indrelid
+				JOIN pg_class ci ON ci.oid = i.indexrelid
+				LEFT JOIN pg_constraint con ON con.conindid = i.indexrelid AND con.contype = 'u'
+			WHERE i.indisunique AND NOT i.indisprimary AND i.indpred IS NULL
+				AND ct.relname = ? AND ct.relnamespace = current_schema()::regnamespace
+				AND ARRAY(
+					SELECT a.attname::text FROM pg_attribute a
+					WHERE a.attrelid = ct.oid AND a.attnum = ANY(i.indkey) ORDER BY a.attname
+				) = string_to_array(?, ',')
+		`, key.table, strings.Join(key.columns, ",")).Scan(&uniqueKeys).Error
+		if err != nil {
+			return err
+		}
+
+		for _, uniqueKey := range uniqueKeys {
+			if uniqueKey.ConstraintName != "" {
+				err = DB.Migrator().DropConstraint(key.table, uniqueKey.ConstraintName)
+			} else {
+				err = DB.Migrator().DropIndex(key.table, uniqueKey.IndexName)
+			}
+			if err != nil {
+				return err
+			}
+			log.Printf("Dropped unique key %s of %s, for one that leaves out deleted rows", uniqueKey.IndexName, key.table)
+		}
+	}
+	return nil
+}
+
 func CloseDB() {
 	if DB != nil {
 		sqlDB, err := DB.DB()
@@ -0,0 +1,9 @@
+package dto
+
+// ChangeEmailRequestDto asks to change a user's primary email address, to a new
+// address or to the user's backup address. The user's current password is required.
+type ChangeEmailRequestDto struct {
+    CurrentPassword string  `json:"currentPassword" validate:"required"`
+    NewEmailAddress *string `json:"newEmailAddress,omitempty" validate:"omitempty,email"` // Optional field with email validation
+    PromoteBackup   bool    `json:"promoteBackup,omitempty"`                             // Use the backup address; it swaps with the primary one
+}
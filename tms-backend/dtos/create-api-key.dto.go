@@ -0,0 +1,14 @@
+package dto
+
+import (
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+)
+
+// CreateApiKeyDto describes a new API key of a tenant
+type CreateApiKeyDto struct {
+    Name      string               `json:"name" validate:"required"`          // Required field, what the key is for
+    Scopes    []global.ApiKeyScope `json:"scopes" validate:"required,min=1"`  // Required field, see global.ApiKeyScopes
+    ExpiresAt *time.Time           `json:"expiresAt,omitempty"`               // Optional field, the key never expires without it
+}
@@ -92,6 +92,7 @@ type AuthEnabled struct {
 	Google    bool `json:"google"`
 	Facebook  bool `json:"facebook"`
 	TwoFactor bool `json:"two_factor"`
+	MagicLink bool `json:"magic_link"`
 }
 
 type FBOauth2Constants struct {
@@ -112,6 +113,25 @@ type OtherUserOptions struct {
 	ConfirmEmailMailOptionSettings_TextTemplate  string `json:"confirm_email_mail_option_settings_text_template"`
 	PasswordResetExpiration                      int    `json:"password_reset_expiration"`
 	EmailVerificationExpiration                  int    `json:"email_verification_expiration"`
+	MailTemplates                                map[string]MailTemplateOverride `json:"mail_templates,omitempty"`
+	PasswordPolicy                               *PasswordPolicy                 `json:"password_policy,omitempty"`
+}
+
+type PasswordPolicy struct {
+	MinLength        int      `json:"min_length,omitempty"`
+	RequireUppercase bool     `json:"require_uppercase,omitempty"`
+	RequireLowercase bool     `json:"require_lowercase,omitempty"`
+	RequireDigit     bool     `json:"require_digit,omitempty"`
+	RequireSymbol    bool     `json:"require_symbol,omitempty"`
+	BannedWords      []string `json:"banned_words,omitempty"`
+	CheckBreached    *bool    `json:"check_breached,omitempty"`
+	HistorySize      int      `json:"history_size,omitempty"`
+}
+
+type MailTemplateOverride struct {
+	Subject      string `json:"subject,omitempty"`
+	TextTemplate string `json:"text_template,omitempty"`
+	HtmlTemplate string `json:"html_template,omitempty"`
 }
 type SizeLimits struct {
 	LogoFileSizeLimit    int `json:"logo_file_size_limit"`
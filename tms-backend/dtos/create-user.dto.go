@@ -32,8 +32,7 @@ type CreateUserDto struct {
 	BackupEmailAddress            *string       `json:"backupEmailAddress,omitempty" validate:"omitempty,email"` // Optional field with email validation
 	Phone                         *PhoneDto     `json:"phone,omitempty"`                                         // Optional field
 	IsPrimaryEmailAddressVerified *bool         `json:"isPrimaryEmailAddressVerified,omitempty"`                 // Optional field
-	PasswordSalt                  *string       `json:"passwordSalt,omitempty"`                                  // Optional field
-	PasswordHash                  string        `json:"passwordHash" validate:"required"`                        // Required field
+	Password                      string        `json:"password" validate:"required"`                            // Required field, hashed by the server
 	IsPasswordChangeRequired      *bool         `json:"isPasswordChangeRequired,omitempty"`                      // Optional field
 }
 
@@ -0,0 +1,7 @@
+package dto
+
+// EmailVerificationRequestDto asks for a verification link, for a user found by id or by the address itself
+type EmailVerificationRequestDto struct {
+    Email  *string `json:"email,omitempty" validate:"omitempty,email"` // Optional field with email validation
+    UserID uint    `json:"userId,omitempty"`                           // Optional field, takes precedence over email
+}
@@ -0,0 +1,7 @@
+package dto
+
+// ResetPasswordRequestDto asks for a password reset link
+type ResetPasswordRequestDto struct {
+    Email    string `json:"email" validate:"required,email"` // Required field with email validation
+    TenantID uint   `json:"tenantId,omitempty"`               // Optional field, the tenant whose settings and branding apply
+}
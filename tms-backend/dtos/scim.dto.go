@@ -0,0 +1,86 @@
+package dto
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ScimUserDto is a SCIM 2.0 User (RFC 7643 section 4.1): a user on the team of a tenant.
+// userName is the primary email address; groups are the team roles and read-only.
+type ScimUserDto struct {
+    Schemas     []string          `json:"schemas"`
+    ID          string            `json:"id,omitempty"`
+    ExternalID  string            `json:"externalId,omitempty"`
+    UserName    string            `json:"userName"`                 // Required field
+    Name        *ScimNameDto      `json:"name,omitempty"`
+    DisplayName string            `json:"displayName,omitempty"`
+    Emails      []ScimEmailDto    `json:"emails,omitempty"`
+    Active      *bool             `json:"active,omitempty"`         // Optional field, true without it
+    Groups      []ScimMemberDto   `json:"groups,omitempty"`
+    Meta        *ScimMetaDto      `json:"meta,omitempty"`
+}
+
+type ScimNameDto struct {
+    Formatted  string `json:"formatted,omitempty"`
+    GivenName  string `json:"givenName,omitempty"`
+    MiddleName string `json:"middleName,omitempty"`
+    FamilyName string `json:"familyName,omitempty"`
+}
+
+type ScimEmailDto struct {
+    Value   string `json:"value"`
+    Type    string `json:"type,omitempty"`
+    Primary bool   `json:"primary,omitempty"`
+}
+
+// ScimGroupDto is a SCIM 2.0 Group (RFC 7643 section 4.2): a team role of a tenant, its id the role name
+type ScimGroupDto struct {
+    Schemas     []string          `json:"schemas"`
+    ID          string            `json:"id,omitempty"`
+    DisplayName string            `json:"displayName"`              // Required field
+    Members     []ScimMemberDto   `json:"members,omitempty"`
+    Meta        *ScimMetaDto      `json:"meta,omitempty"`
+}
+
+// ScimMemberDto is a member of a group or a group of a user, Value its id
+type ScimMemberDto struct {
+    Value   string `json:"value"`
+    Display string `json:"display,omitempty"`
+    Ref     string `json:"$ref,omitempty"`
+}
+
+type ScimMetaDto struct {
+    ResourceType string     `json:"resourceType"`
+    Created      *time.Time `json:"created,omitempty"`
+    LastModified *time.Time `json:"lastModified,omitempty"`
+    Location     string     `json:"location,omitempty"`
+}
+
+// ScimPatchDto is a SCIM 2.0 PATCH request (RFC 7644 section 3.5.2)
+type ScimPatchDto struct {
+    Schemas    []string                `json:"schemas"`
+    Operations []ScimPatchOperationDto `json:"Operations"` // Required field
+}
+
+type ScimPatchOperationDto struct {
+    Op    string          `json:"op"`              // add, replace or remove, in any case
+    Path  string          `json:"path,omitempty"`  // Optional field, the value holds the attributes without it
+    Value json.RawMessage `json:"value,omitempty"`
+}
+
+// ScimListResponseDto is a page of resources (RFC 7644 section 3.4.2)
+type ScimListResponseDto struct {
+    Schemas      []string `json:"schemas"`
+    TotalResults int64    `json:"totalResults"`
+    StartIndex   int      `json:"startIndex"`
+    ItemsPerPage int      `json:"itemsPerPage"`
+    Resources    any      `json:"Resources"`
+}
+
+// ScimErrorDto is a SCIM 2.0 error response (RFC 7644 section 3.12)
+type ScimErrorDto struct {
+    Schemas  []string `json:"schemas"`
+    Status   string   `json:"status"`
+    ScimType string   `json:"scimType,omitempty"`
+    Detail   string   `json:"detail,omitempty"`
+}
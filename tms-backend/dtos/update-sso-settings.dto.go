@@ -0,0 +1,31 @@
+package dto
+
+import (
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+)
+
+// UpdateSSOSettingsDto replaces the single sign-on settings of a tenant, see models.SSOSettings
+type UpdateSSOSettingsDto struct {
+    Enabled         bool                                 `json:"enabled"`
+    Protocol        global.SSOProtocol                   `json:"protocol" validate:"required,oneof=oidc saml"` // Required field
+    OIDC            *OIDCSettingsDto                     `json:"oidc,omitempty"`                              // Required for oidc
+    SAML            *SAMLSettingsDto                     `json:"saml,omitempty"`                              // Required for saml
+    Domains         []string                             `json:"domains" validate:"required,min=1"`           // Required field
+    EnforceSSO      bool                                 `json:"enforceSso"`
+    JITProvisioning bool                                 `json:"jitProvisioning"`
+    RoleClaim       string                               `json:"roleClaim,omitempty"`
+    RoleMapping     map[string][]global.TenantTeamRole   `json:"roleMapping,omitempty"`
+    DefaultRoles    []global.TenantTeamRole              `json:"defaultRoles,omitempty"`
+}
+
+type OIDCSettingsDto struct {
+    DiscoveryURL string   `json:"discoveryUrl" validate:"required,url"`
+    ClientID     string   `json:"clientId" validate:"required"`
+    ClientSecret *string  `json:"clientSecret,omitempty"` // Optional field, the current secret is kept without it
+    Scopes       []string `json:"scopes,omitempty"`
+}
+
+type SAMLSettingsDto struct {
+    IDPMetadataURL string `json:"idpMetadataUrl,omitempty"`
+    IDPMetadata    string `json:"idpMetadata,omitempty"` // Either this or idpMetadataUrl
+}
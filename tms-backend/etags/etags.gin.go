@@ -0,0 +1,104 @@
+package etags
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/repositories"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// The ETag of a versioned record (see models.Versioning) is its version. Requests changing one
+// (PATCH, PUT, DELETE) must send the ETag they read back in If-Match, or "*" to change it whatever
+// its version: 412 Precondition Failed if the record was changed since.
+
+// Set sets the ETag header to version
+func Set(c *gin.Context, version uint) {
+	c.Header("ETag", fmt.Sprintf("%q", strconv.FormatUint(uint64(version), 10)))
+}
+
+// IfMatch returns the version the If-Match header asks for, 0 for "*". Without the header, or with
+// an ETag that is not one of ours, it answers the request and returns false.
+func IfMatch(c *gin.Context) (uint, bool) {
+	ifMatch := strings.TrimSpace(c.GetHeader("If-Match"))
+	if ifMatch == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header required: send the ETag of the record read, or * to change it anyway"})
+		return 0, false
+	}
+	if ifMatch == "*" {
+		return 0, true
+	}
+	version, ok := parse(ifMatch)
+	if !ok {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "If-Match does not match the ETag of the record"})
+		return 0, false
+	}
+	return version, true
+}
+
+// IfMatchEach is IfMatch for a change of count records at once: If-Match lists the ETag of each,
+// comma separated in the order of the records, or is "*". It returns their versions, all 0 for "*".
+func IfMatchEach(c *gin.Context, count int) ([]uint, bool) {
+	ifMatch := strings.TrimSpace(c.GetHeader("If-Match"))
+	if ifMatch == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header required: send the ETags of the records read, or * to change them anyway"})
+		return nil, false
+	}
+	versions := make([]uint, count)
+	if ifMatch == "*" {
+		return versions, true
+	}
+	tags := strings.Split(ifMatch, ",")
+	if len(tags) != count {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("If-Match must list the ETags of the %d records, in their order", count)})
+		return nil, false
+	}
+	for i, tag := range tags {
+		version, ok := parse(strings.TrimSpace(tag))
+		if !ok {
+			c.JSON(http.StatusPreconditionFailed, gin.H{"error": "If-Match does not match the ETags of the records"})
+			return nil, false
+		}
+		versions[i] = version
+	}
+	return versions, true
+}
+
+// parse reads the version of one of our ETags
+func parse(tag string) (uint, bool) {
+	// A weak ETag never matches for a change (RFC 9110, 13.1.1), nor does one we did not send
+	quoted := len(tag) > 2 && strings.HasPrefix(tag, `"`) && strings.HasSuffix(tag, `"`)
+	version, err := strconv.ParseUint(strings.Trim(tag, `"`), 10, 32)
+	if !quoted || err != nil || version == 0 {
+		return 0, false
+	}
+	return uint(version), true
+}
+
+// WriteConflict answers a *repositories.ConflictError with 412 and the ETag of the record now.
+// It reports whether err was one.
+func WriteConflict(c *gin.Context, err error) bool {
+	var conflictError *repositories.ConflictError
+	if !errors.As(err, &conflictError) {
+		return false
+	}
+	Set(c, conflictError.CurrentVersion)
+	c.JSON(http.StatusPreconditionFailed, gin.H{"error": conflictError.Error(), "version": conflictError.CurrentVersion})
+	return true
+}
+
+// WriteChangeError answers an error updating or deleting a versioned record: 412 if it was changed
+// since read, 404 if it is gone. entity names the record in the 404, e.g. "Region".
+func WriteChangeError(c *gin.Context, err error, entity string) {
+	switch {
+	case WriteConflict(c, err):
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": entity + " not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
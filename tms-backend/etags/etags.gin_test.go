@@ -0,0 +1,103 @@
+package etags
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/repositories"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// testContext is a request with the If-Match header ifMatch, none if it is empty
+func testContext(ifMatch string) (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPatch, "/regions/1", nil)
+	if ifMatch != "" {
+		c.Request.Header.Set("If-Match", ifMatch)
+	}
+	return c, recorder
+}
+
+func TestIfMatch(t *testing.T) {
+	tests := []struct {
+		ifMatch string
+		version uint
+		ok      bool
+		status  int
+	}{
+		{``, 0, false, http.StatusPreconditionRequired},
+		{`*`, 0, true, http.StatusOK},
+		{`"3"`, 3, true, http.StatusOK},
+		{` "3" `, 3, true, http.StatusOK},
+		{`3`, 0, false, http.StatusPreconditionFailed},
+		{`W/"3"`, 0, false, http.StatusPreconditionFailed},
+		{`"0"`, 0, false, http.StatusPreconditionFailed},
+		{`"-1"`, 0, false, http.StatusPreconditionFailed},
+		{`"abc"`, 0, false, http.StatusPreconditionFailed},
+		{`""`, 0, false, http.StatusPreconditionFailed},
+		{`"3", "4"`, 0, false, http.StatusPreconditionFailed},
+	}
+	for _, test := range tests {
+		c, recorder := testContext(test.ifMatch)
+		version, ok := IfMatch(c)
+		if version != test.version || ok != test.ok {
+			t.Errorf("IfMatch(%s) = %d, %v, want %d, %v", test.ifMatch, version, ok, test.version, test.ok)
+		}
+		if recorder.Code != test.status {
+			t.Errorf("IfMatch(%s) answered %d, want %d", test.ifMatch, recorder.Code, test.status)
+		}
+	}
+}
+
+func TestIfMatchEach(t *testing.T) {
+	tests := []struct {
+		ifMatch  string
+		versions []uint
+		ok       bool
+		status   int
+	}{
+		{``, nil, false, http.StatusPreconditionRequired},
+		{`*`, []uint{0, 0}, true, http.StatusOK},
+		{`"3","4"`, []uint{3, 4}, true, http.StatusOK},
+		{`"3" , "4"`, []uint{3, 4}, true, http.StatusOK},
+		{`"3"`, nil, false, http.StatusBadRequest},
+		{`"3","4","5"`, nil, false, http.StatusBadRequest},
+		{`"3",W/"4"`, nil, false, http.StatusPreconditionFailed},
+		{`"3",*`, nil, false, http.StatusPreconditionFailed},
+	}
+	for _, test := range tests {
+		c, recorder := testContext(test.ifMatch)
+		versions, ok := IfMatchEach(c, 2)
+		if !reflect.DeepEqual(versions, test.versions) || ok != test.ok {
+			t.Errorf("IfMatchEach(%s) = %v, %v, want %v, %v", test.ifMatch, versions, ok, test.versions, test.ok)
+		}
+		if recorder.Code != test.status {
+			t.Errorf("IfMatchEach(%s) answered %d, want %d", test.ifMatch, recorder.Code, test.status)
+		}
+	}
+}
+
+func TestWriteChangeError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		etag   string
+	}{
+		{fmt.Errorf("failed to update region: %w", &repositories.ConflictError{Table: "regions", ID: 1, Version: 2, CurrentVersion: 3}), http.StatusPreconditionFailed, `"3"`},
+		{fmt.Errorf("failed to update region: %w", gorm.ErrRecordNotFound), http.StatusNotFound, ""},
+		{fmt.Errorf("failed to update region"), http.StatusInternalServerError, ""},
+	}
+	for _, test := range tests {
+		c, recorder := testContext("")
+		WriteChangeError(c, test.err, "Region")
+		if recorder.Code != test.status || recorder.Header().Get("ETag") != test.etag {
+			t.Errorf("WriteChangeError(%v) = %d with ETag %q, want %d with %q", test.err, recorder.Code, recorder.Header().Get("ETag"), test.status, test.etag)
+		}
+	}
+}
@@ -44,8 +44,56 @@ const (
 	User       TenantRoles = "user"
 )
 
+// ApiKeyScope is a permission granted to a tenant API key. Routes accept API keys with
+// auth.RequireAuth(scopes...); the key must hold every scope the route lists.
+type ApiKeyScope string
+
+const (
+	ScopeTenantsRead  ApiKeyScope = "tenants:read"
+	ScopeTenantsWrite ApiKeyScope = "tenants:write"
+	ScopeUsersRead    ApiKeyScope = "users:read"
+	ScopeUsersWrite   ApiKeyScope = "users:write"
+	ScopeMailRead     ApiKeyScope = "mail:read"
+	ScopeMailWrite    ApiKeyScope = "mail:write"
+	ScopeSCIM         ApiKeyScope = "scim" // user provisioning by the tenant's identity provider, at /scim/v2
+)
+
+// ApiKeyScopes are the scopes API keys can be given
+var ApiKeyScopes = []ApiKeyScope{ScopeTenantsRead, ScopeTenantsWrite, ScopeUsersRead, ScopeUsersWrite, ScopeMailRead, ScopeMailWrite, ScopeSCIM}
+
+type EmailStatus string
+
+const (
+	EmailPending EmailStatus = "pending" // waiting for its first attempt
+	EmailSending EmailStatus = "sending" // claimed by a worker
+	EmailRetry   EmailStatus = "retry"   // failed, another attempt is scheduled
+	EmailSent    EmailStatus = "sent"
+	EmailDead    EmailStatus = "dead" // gave up after MAIL_MAX_ATTEMPTS, can be resent by an admin
+)
+
+// EmailDeliverability is what bounces and complaints taught us about an email address
+type EmailDeliverability string
+
+const (
+	EmailDeliverable EmailDeliverability = "deliverable"
+	EmailSoftBounced EmailDeliverability = "soft_bounced" // temporary failures, suppressed after MAIL_SOFT_BOUNCE_LIMIT in a row
+	EmailHardBounced EmailDeliverability = "hard_bounced" // the address does not exist, never send to it again
+	EmailComplained  EmailDeliverability = "complained"   // the recipient reported our mail as spam
+)
+
 const PROTOCOL = "https"
 
+// Keys under which the authenticated caller's identity is stored on the gin context
+const (
+	CONTEXT_USER_ID_KEY    = "userId"
+	CONTEXT_TENANT_ID_KEY  = "tenantId"
+	CONTEXT_SESSION_ID_KEY = "sessionId"
+	CONTEXT_API_KEY_ID_KEY = "apiKeyId" // set instead of the user and session for API key callers
+	// Set, with the impersonated user as the user, for requests made under an impersonation
+	CONTEXT_IMPERSONATION_ID_KEY = "impersonationId"
+	CONTEXT_IMPERSONATOR_ID_KEY  = "impersonatorId"
+)
+
 const (
 	APP_NAME                = "TMS"
 	APP_VERSION             = "1.0.0"
@@ -61,6 +109,133 @@ const (
 const (
 	UPLOAD_DIRECTORY              = "uploads"
 	PHOTO_FILE_SIZE_LIMIT         = 2 * 1024 * 1024 // 2MB
+	LOGO_FILE_SIZE_LIMIT          = 1 * 1024 * 1024 // 1MB
 	PASSWORD_RESET_EXPIRATION     = 24 * time.Hour  // 24 hours
 	EMAIL_VERIFICATION_EXPIRATION = 48 * time.Hour  // 48 hours
+	EMAIL_CHANGE_REVERT_EXPIRATION = 7 * 24 * time.Hour // how long the old address can undo an email change
+	MAGIC_LINK_EXPIRATION         = 15 * time.Minute
+	// Client app page the sign-in links of magic-link emails open, with ?token=. It posts the token
+	// to /auth/magic-link/verify: opening the link does not use it up, so mail scanners cannot either
+	MAGIC_LINK_CLIENT_PATH = "/magic-link"
+)
+
+// LOGO_SIZES are the square bounding boxes (in pixels) of the PNG derivatives
+// generated for every uploaded tenant logo
+var LOGO_SIZES = map[string]int{
+	"small":  64,
+	"medium": 128,
+	"large":  256,
+}
+
+// PHOTO_SIZES are the bounding boxes (in pixels) of the renditions generated
+// for every uploaded user photo. The original is also re-encoded, capped at PHOTO_MAX_DIMENSION
+var PHOTO_SIZES = map[string]int{
+	"thumb":  96,
+	"medium": 320,
+	"large":  800,
+}
+
+const PHOTO_MAX_DIMENSION = 2048
+
+// Default password policy, see models.PasswordPolicy for the per-tenant settings
+const (
+	PASSWORD_MIN_LENGTH     = 10
+	PASSWORD_MAX_LENGTH     = 72 // bcrypt ignores what comes after 72 bytes
+	PASSWORD_HISTORY_SIZE   = 5
+	PASSWORD_CHECK_BREACHED = true
+)
+
+// Brute-force protection, see the throttle package. Failures are counted over the window;
+// after the free ones each attempt waits a delay doubling up to THROTTLE_MAX_DELAY
+const (
+	LOGIN_MAX_FAILED_ATTEMPTS     = 10 // failed logins locking an account out
+	LOGIN_FREE_FAILED_ATTEMPTS    = 3
+	LOGIN_IP_MAX_FAILED_ATTEMPTS  = 100 // failed logins of any account locking an IP address out
+	LOGIN_IP_FREE_FAILED_ATTEMPTS = 20
+	LOGIN_FAILURE_WINDOW          = 15 * time.Minute
+	LOGIN_LOCKOUT_DURATION        = 15 * time.Minute
+	MAIL_REQUEST_LIMIT            = 5 // password reset and verification requests per address
+	MAIL_REQUEST_FREE_LIMIT       = 2
+	MAIL_REQUEST_IP_LIMIT         = 30 // password reset and verification requests per IP address
+	MAIL_REQUEST_IP_FREE_LIMIT    = 10
+	MAIL_REQUEST_WINDOW           = time.Hour
+	THROTTLE_BASE_DELAY           = time.Second
+	THROTTLE_MAX_DELAY            = 30 * time.Second
+)
+
+// Token signing keys, see the keys package
+const (
+	JWT_DEFAULT_SIGNING_ALGORITHM = "RS256" // or ES256, EdDSA
+	JWT_KEY_ROTATION_INTERVAL     = 30 * 24 * time.Hour
+	JWT_KEY_OVERLAP               = 24 * time.Hour // at least; a retired key verifies as long as the tokens it signed live
+	JWT_KEY_CACHE_TTL             = time.Minute    // keys are reloaded this often, to see the rotations of other instances
+)
+
+// Sessions, see models.Session
+const (
+	SESSION_DEFAULT_EXPIRATION = 30 * 24 * time.Hour // without REFRESH_SECRET_KEY_EXPIRATION
+	SESSION_TOUCH_INTERVAL     = time.Minute         // last seen is updated at most this often
+)
+
+// Impersonation of tenant users by landlord support staff, see models.Impersonation
+const (
+	IMPERSONATION_EXPIRATION = 15 * time.Minute // of the token; there is no refresh, support starts a new one
+)
+
+// Single sign-on with a tenant's identity provider, see models.SSOSettings
+const (
+	SSO_LOGIN_EXPIRATION = 10 * time.Minute // to sign in at the identity provider
+	SSO_CODE_EXPIRATION  = time.Minute      // for the client app to exchange the code of a completed sign-in
+	// Client app page a completed sign-in redirects to, with ?code= or ?error=. It posts the code to /auth/sso/token
+	SSO_CLIENT_PATH        = "/sso"
+	SSO_DEFAULT_ROLE_CLAIM = "groups"
+	// A tenant proves it owns an email domain with a TXT record SSO_DOMAIN_TXT_LABEL.<domain>
+	// whose value is SSO_DOMAIN_TXT_PREFIX followed by the domain's token
+	SSO_DOMAIN_TXT_LABEL  = "_tms-sso-verification"
+	SSO_DOMAIN_TXT_PREFIX = "tms-sso-verification="
+)
+
+// SSOProtocol is how a tenant's identity provider signs users in
+type SSOProtocol string
+
+const (
+	SSOProtocolOIDC SSOProtocol = "oidc"
+	SSOProtocolSAML SSOProtocol = "saml"
+)
+
+// Pages of list endpoints, see repositories.ListQuery
+const (
+	LIST_DEFAULT_PAGE_SIZE = 20
+	LIST_MAX_PAGE_SIZE     = 100
+)
+
+// Trash of soft-deleted records, see repositories.Repository.Restore and Purge
+const (
+	TRASH_DEFAULT_RETENTION = 30 * 24 * time.Hour // without TRASH_RETENTION_DAYS
+	TRASH_PURGE_INTERVAL    = time.Hour
+	TRASH_PURGE_BATCH_SIZE  = 500 // records of a resource purged at once
+)
+
+// SCIM 2.0 provisioning of a tenant's team, see the scim package
+const (
+	SCIM_DEFAULT_PAGE_SIZE = 100
+	SCIM_MAX_PAGE_SIZE     = 200
+)
+
+// Tenant API keys, see models.ApiKey
+const (
+	API_KEY_PREFIX         = "tms_"
+	API_KEY_ROTATION_GRACE = 24 * time.Hour // the previous secret of a rotated key keeps working this long
+	API_KEY_TOUCH_INTERVAL = time.Minute    // last used is updated at most this often
+)
+
+// Outbound email queue
+const (
+	MAIL_OUTBOX_WORKERS    = 4
+	MAIL_MAX_ATTEMPTS      = 8
+	MAIL_RETRY_BASE_DELAY  = 30 * time.Second
+	MAIL_RETRY_MAX_DELAY   = 6 * time.Hour
+	MAIL_SEND_LEASE        = 5 * time.Minute // a claimed email is retried if its worker does not finish within this time
+	MAIL_OUTBOX_POLL_DELAY = 5 * time.Second
+	MAIL_SOFT_BOUNCE_LIMIT = 3 // consecutive soft bounces after which an address is suppressed
 )
@@ -1,22 +1,26 @@
 package global
 
 import (
-	"crypto/tls"
-	"fmt"
 	"log"
-	"net/smtp"
 	"os"
-	"strings"
 
 	"github.com/joho/godotenv"
 )
 
-// SMTP configuration variables
+// SMTP configuration variables. They are the fallback for tenants and regions
+// without their own SMTPAuth settings
 var (
     SMTP_HOST     string
     SMTP_PORT     string
     SMTP_USERNAME string
     SMTP_PASSWORD string
+    SMTP_SECURE   string // "true" for implicit TLS (usually port 465), otherwise STARTTLS when offered
+
+    // XOAUTH2 instead of a password
+    SMTP_CLIENT_ID     string
+    SMTP_CLIENT_SECRET string
+    SMTP_ACCESS_URL    string // OAuth2 token endpoint
+    SMTP_REFRESH_TOKEN string
 )
 
 
@@ -39,11 +43,16 @@ func init() {
 func loadSMTPConfig() {
     SMTP_HOST = getEnvWithDefault("SMTP_HOST", "smtp.gmail.com")
     SMTP_PORT = getEnvWithDefault("SMTP_PORT", "587")
-    SMTP_USERNAME = os.Getenv("SMTP_USERNAME")
+    SMTP_USERNAME = getEnvWithDefault("SMTP_USERNAME", os.Getenv("SMTP_USER"))
     SMTP_PASSWORD = os.Getenv("SMTP_PASSWORD")
+    SMTP_SECURE = os.Getenv("SMTP_SECURE")
+    SMTP_CLIENT_ID = os.Getenv("SMTP_CLIENT_ID")
+    SMTP_CLIENT_SECRET = os.Getenv("SMTP_CLIENT_SECRET")
+    SMTP_ACCESS_URL = os.Getenv("SMTP_ACCESS_URL")
+    SMTP_REFRESH_TOKEN = os.Getenv("SMTP_REFRESH_TOKEN")
 
     // Validate required configuration
-    if SMTP_USERNAME == "" || SMTP_PASSWORD == "" {
+    if SMTP_USERNAME == "" || (SMTP_PASSWORD == "" && SMTP_REFRESH_TOKEN == "") {
         log.Println("Warning: SMTP credentials are not set. Email functionality will not work.")
     }
 }
@@ -77,156 +86,8 @@ type Attachment struct {
     Filename string
     Content  []byte
     ContentType string
+    ContentID string // if set, the attachment is an inline image referenced from the HTML as cid:<ContentID>
 }
 
-// MailOptionSettings holds templates and default values for various email types
-type MailOptionSettings struct {
-    From         string
-    Subject      string
-    TextTemplate string
-    HtmlTemplate string // Optional HTML template
-}
-
-// Define mail templates for different types of notifications
-var (
-    ConfirmEmailMailOptionSettings = MailOptionSettings{
-        From:         "noreply@auditrakkr.com",
-        Subject:      "Email Verification",
-        TextTemplate: "Please verify your email by clicking this link: {url}",
-        HtmlTemplate: "<p>Please verify your email by clicking this link: <a href=\"{url}\">Verify Email</a></p>",
-    }
-
-    ResetPasswordMailOptionSettings = MailOptionSettings{
-        From:         "noreply@auditrakkr.com",
-        Subject:      "Password Reset Request",
-        TextTemplate: "Reset your password by clicking this link: {url}",
-        HtmlTemplate: "<p>Reset your password by clicking this link: <a href=\"{url}\">Reset Password</a></p>",
-    }
-)
-
-// SendMail sends an email using the provided options
-func SendMail(options MailOptions) error {
-	// Check if SMTP is properly configured
-    if SMTP_USERNAME == "" || SMTP_PASSWORD == "" {
-        return fmt.Errorf("SMTP is not configured properly. Check environment variables")
-    }
-
-    // Set up authentication information
-    auth := smtp.PlainAuth("", SMTP_USERNAME, SMTP_PASSWORD, SMTP_HOST)
-
-    // Build email headers
-    headers := make(map[string]string)
-    headers["From"] = options.From
-    headers["To"] = options.To
-    headers["Subject"] = options.Subject
-    headers["MIME-Version"] = "1.0"
-
-    // Handle CC and BCC if provided
-    if len(options.Cc) > 0 {
-        headers["Cc"] = strings.Join(options.Cc, ",")
-    }
-
-    if options.ReplyTo != "" {
-        headers["Reply-To"] = options.ReplyTo
-    }
-
-    // Determine if we should send HTML or plain text
-    var contentType string
-    var body string
-
-    if options.Html != "" {
-        contentType = "text/html; charset=UTF-8"
-        body = options.Html
-    } else {
-        contentType = "text/plain; charset=UTF-8"
-        body = options.Text
-    }
-
-    headers["Content-Type"] = contentType
-
-    // Build the message
-    message := ""
-    for key, value := range headers {
-        message += fmt.Sprintf("%s: %s\r\n", key, value)
-    }
-    message += "\r\n" + body
-
-    // Get all recipients (To + Cc + Bcc)
-    var recipients []string
-    recipients = append(recipients, strings.Split(options.To, ",")...)
-    recipients = append(recipients, options.Cc...)
-    recipients = append(recipients, options.Bcc...)
-
-    // Connect to the SMTP server with TLS
-    // Create a custom TLS config
-    tlsConfig := &tls.Config{
-        ServerName: SMTP_HOST,
-    }
-
-    // Connect to the server
-    smtpServer := fmt.Sprintf("%s:%s", SMTP_HOST, SMTP_PORT)
-    client, err := smtp.Dial(smtpServer)
-    if err != nil {
-        return fmt.Errorf("failed to connect to SMTP server: %v", err)
-    }
-    defer client.Close()
-
-    // Start TLS
-    if err = client.StartTLS(tlsConfig); err != nil {
-        return fmt.Errorf("failed to start TLS: %v", err)
-    }
-
-    // Authenticate
-    if err = client.Auth(auth); err != nil {
-        return fmt.Errorf("authentication failed: %v", err)
-    }
-
-    // Set the sender
-    if err = client.Mail(options.From); err != nil {
-        return fmt.Errorf("failed to set sender: %v", err)
-    }
-
-    // Set the recipients
-    for _, recipient := range recipients {
-        recipient = strings.TrimSpace(recipient)
-        if recipient != "" {
-            if err = client.Rcpt(recipient); err != nil {
-                return fmt.Errorf("failed to add recipient %s: %v", recipient, err)
-            }
-        }
-    }
-
-    // Send the email body
-    wc, err := client.Data()
-    if err != nil {
-        return fmt.Errorf("failed to start data session: %v", err)
-    }
-
-    _, err = wc.Write([]byte(message))
-    if err != nil {
-        return fmt.Errorf("failed to write email data: %v", err)
-    }
-
-    err = wc.Close()
-    if err != nil {
-        return fmt.Errorf("failed to close data writer: %v", err)
-    }
-
-    // Close the connection
-    err = client.Quit()
-    if err != nil {
-        return fmt.Errorf("failed to close connection: %v", err)
-    }
-
-    return nil
-}
-
-// SendMailAsync sends an email asynchronously using a goroutine
-func SendMailAsync(options MailOptions) {
-    go func() {
-        err := SendMail(options)
-        if err != nil {
-            log.Printf("Error sending email: %v\n", err)
-        }
-    }()
-}
+// MAIL_FROM_ADDRESS is the sender of system emails. Their content comes from the mail package templates
+const MAIL_FROM_ADDRESS = "noreply@auditrakkr.com"
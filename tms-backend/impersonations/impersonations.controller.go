@@ -0,0 +1,58 @@
+package impersonations
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ImpersonationController struct {
+	impersonationService *ImpersonationService
+}
+
+func NewImpersonationController(impersonationService *ImpersonationService) *ImpersonationController {
+	return &ImpersonationController{
+		impersonationService: impersonationService,
+	}
+}
+
+// GetTenantImpersonations lists who impersonated the users of the tenant, and when
+func (ic *ImpersonationController) GetTenantImpersonations(c *gin.Context) {
+	tenantId, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+	impersonations, err := ic.impersonationService.FindByTenant(uint(tenantId))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"impersonations": impersonations})
+}
+
+// GetTenantImpersonation returns an impersonation of a user of the tenant with the requests made under it
+func (ic *ImpersonationController) GetTenantImpersonation(c *gin.Context) {
+	tenantId, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+	impersonationId, err := strconv.ParseUint(c.Params.ByName("impersonationId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid impersonation ID"})
+		return
+	}
+	impersonation, err := ic.impersonationService.FindOneWithRequests(uint(tenantId), uint(impersonationId))
+	if errors.Is(err, ErrImpersonationNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"impersonation": impersonation})
+}
@@ -0,0 +1,131 @@
+package impersonations
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/database"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/repositories"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrImpersonationNotFound = errors.New("impersonation not found")
+	ErrImpersonationEnded    = errors.New("impersonation has ended or expired")
+)
+
+type ImpersonationService struct {
+	impersonationRepo repositories.Repository[models.Impersonation]
+	requestRepo       repositories.Repository[models.ImpersonationRequest]
+}
+
+func NewImpersonationService() *ImpersonationService {
+	return &ImpersonationService{
+		impersonationRepo: repositories.Repository[models.Impersonation]{DB: database.DB},
+		requestRepo:       repositories.Repository[models.ImpersonationRequest]{DB: database.DB},
+	}
+}
+
+/* START AND END */
+
+// Start records that impersonator, signed in with session sessionId, acts as user on the team of tenantId.
+// Authorization is the caller's business.
+func (s *ImpersonationService) Start(impersonator *models.User, sessionId uint, user *models.User, tenantId uint, reason string, c *gin.Context) (*models.Impersonation, error) {
+	impersonation, err := s.impersonationRepo.Create(&models.Impersonation{
+		ImpersonatorID:    impersonator.ID,
+		ImpersonatorEmail: impersonator.PrimaryEmailAddress,
+		SessionID:         sessionId,
+		UserID:            user.ID,
+		UserEmail:         user.PrimaryEmailAddress,
+		TenantID:          tenantId,
+		Reason:            strings.TrimSpace(reason),
+		IPAddress:         c.ClientIP(),
+		ExpiresAt:         time.Now().Add(global.IMPERSONATION_EXPIRATION),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create impersonation: %v", err)
+	}
+	return impersonation, nil
+}
+
+// FindActive returns an impersonation of impersonatorId that has neither ended nor expired
+func (s *ImpersonationService) FindActive(impersonationId uint, impersonatorId uint) (*models.Impersonation, error) {
+	var impersonation models.Impersonation
+	err := s.impersonationRepo.CreateQueryBuilder().
+		Where("id = ? AND impersonator_id = ?", impersonationId, impersonatorId).
+		First(&impersonation).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrImpersonationNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find impersonation: %v", err)
+	}
+	if impersonation.EndedAt != nil || !impersonation.ExpiresAt.After(time.Now()) {
+		return nil, ErrImpersonationEnded
+	}
+	return &impersonation, nil
+}
+
+// End stops an impersonation of impersonatorId; its token no longer works
+func (s *ImpersonationService) End(impersonationId uint, impersonatorId uint) error {
+	result := s.impersonationRepo.CreateQueryBuilder().
+		Where("id = ? AND impersonator_id = ? AND ended_at IS NULL", impersonationId, impersonatorId).
+		Update("ended_at", time.Now())
+	if result.Error != nil {
+		return fmt.Errorf("failed to end impersonation: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrImpersonationNotFound
+	}
+	return nil
+}
+
+/* AUDIT TRAIL */
+
+// RecordRequest adds the request of c, which has been handled, to the audit trail of an impersonation
+func (s *ImpersonationService) RecordRequest(impersonationId uint, c *gin.Context, duration time.Duration) error {
+	_, err := s.requestRepo.Create(&models.ImpersonationRequest{
+		ImpersonationID: impersonationId,
+		Method:          c.Request.Method,
+		Path:            c.Request.URL.RequestURI(),
+		Route:           c.FullPath(),
+		Status:          c.Writer.Status(),
+		IPAddress:       c.ClientIP(),
+		DurationMs:      duration.Milliseconds(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record impersonated request: %v", err)
+	}
+	return nil
+}
+
+// FindByTenant lists the impersonations of the users of a tenant, newest first
+func (s *ImpersonationService) FindByTenant(tenantId uint) ([]models.Impersonation, error) {
+	var impersonations []models.Impersonation
+	err := s.impersonationRepo.CreateQueryBuilder().Where("tenant_id = ?", tenantId).Order("id DESC").Find(&impersonations).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to find impersonations: %v", err)
+	}
+	return impersonations, nil
+}
+
+// FindOneWithRequests returns an impersonation of a tenant user with the requests made under it
+func (s *ImpersonationService) FindOneWithRequests(tenantId uint, impersonationId uint) (*models.Impersonation, error) {
+	var impersonation models.Impersonation
+	err := s.impersonationRepo.CreateQueryBuilder().
+		Preload("Requests", func(db *gorm.DB) *gorm.DB { return db.Order("id ASC") }).
+		Where("id = ? AND tenant_id = ?", impersonationId, tenantId).
+		First(&impersonation).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrImpersonationNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find impersonation: %v", err)
+	}
+	return &impersonation, nil
+}
@@ -0,0 +1,51 @@
+package keys
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type KeyController struct{}
+
+func NewKeyController() *KeyController {
+	return &KeyController{}
+}
+
+// GetJWKS publishes the public keys of access tokens (RFC 7517), for other services to verify them
+func (kc *KeyController) GetJWKS(c *gin.Context) {
+	set, err := Access.JWKS()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// Verifiers are expected to refetch the set when a token names a kid they do not know
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, set)
+}
+
+// RotateKeys makes new signing keys, of the access and refresh tokens or of the purpose given
+func (kc *KeyController) RotateKeys(c *gin.Context) {
+	managers := []*Manager{Access, Refresh}
+	switch Purpose(c.Query("purpose")) {
+	case "":
+	case PurposeAccess:
+		managers = []*Manager{Access}
+	case PurposeRefresh:
+		managers = []*Manager{Refresh}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "purpose must be access or refresh"})
+		return
+	}
+
+	rotated := gin.H{}
+	for _, manager := range managers {
+		key, err := manager.Rotate()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		rotated[string(manager.purpose)] = gin.H{"kid": key.Kid, "alg": key.Algorithm}
+	}
+	c.JSON(http.StatusOK, gin.H{"rotated": rotated})
+}
@@ -0,0 +1,94 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// JWK is a public key as published in a JSON Web Key Set (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC and OKP
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet is the document served at /.well-known/jwks.json
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// publicJWK describes a public key, without kid, use and alg
+func publicJWK(publicKey crypto.PublicKey) (JWK, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return JWK{Kty: "RSA", N: encode(key.N.Bytes()), E: encode(big.NewInt(int64(key.E)).Bytes())}, nil
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return JWK{}, fmt.Errorf("unsupported curve %s", key.Curve.Params().Name)
+		}
+		ecdhKey, err := key.ECDH()
+		if err != nil {
+			return JWK{}, err
+		}
+		// Uncompressed point: 0x04 || X || Y
+		point := ecdhKey.Bytes()
+		return JWK{Kty: "EC", Crv: "P-256", X: encode(point[1:33]), Y: encode(point[33:])}, nil
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: encode(key)}, nil
+	}
+	return JWK{}, fmt.Errorf("unsupported key type %T", publicKey)
+}
+
+// thumbprint returns the RFC 7638 thumbprint of a public key, used as its kid
+func thumbprint(publicKey crypto.PublicKey) (string, error) {
+	jwk, err := publicJWK(publicKey)
+	if err != nil {
+		return "", err
+	}
+	// The required members only, in lexicographic order
+	var members any
+	switch jwk.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{jwk.Crv, jwk.Kty, jwk.X, jwk.Y}
+	default:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	}
+	encoded, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
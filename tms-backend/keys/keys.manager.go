@@ -0,0 +1,517 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/config"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/database"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/sessions"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/utils"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrUnknownKey           = errors.New("unknown signing key")
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm: use RS256, ES256 or EdDSA")
+	ErrSharedKey            = errors.New("SECRET_KEY and REFRESH_SECRET hold the same key: refresh tokens would pass for access tokens")
+)
+
+// Purpose separates the keys of access tokens, published for other services to verify
+// them, from those of refresh tokens, which only this application verifies
+type Purpose string
+
+const (
+	PurposeAccess  Purpose = "access"
+	PurposeRefresh Purpose = "refresh"
+)
+
+// Key is a loaded signing key
+type Key struct {
+	Kid       string
+	Algorithm string
+	Method    jwt.SigningMethod
+	Private   crypto.PrivateKey
+	Public    crypto.PublicKey
+	CreatedAt time.Time
+	RetiresAt *time.Time
+	ExpiresAt *time.Time
+}
+
+// Manager loads, caches and rotates the signing keys of one purpose. The keys live in the
+// database so every instance signs with the same key and verifies the others' tokens.
+type Manager struct {
+	purpose  Purpose
+	mu       sync.RWMutex
+	keys     []*Key // newest first
+	loadedAt time.Time
+}
+
+var (
+	Access  = &Manager{purpose: PurposeAccess}
+	Refresh = &Manager{purpose: PurposeRefresh}
+)
+
+/* SIGN AND VERIFY */
+
+// SigningKey returns the key new tokens are signed with, rotating it first if it is
+// older than global.JWT_KEY_ROTATION_INTERVAL
+func (m *Manager) SigningKey() (*Key, error) {
+	if err := m.ensureLoaded(false); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	key := m.activeKey()
+	m.mu.RUnlock()
+	if key != nil && time.Since(key.CreatedAt) < global.JWT_KEY_ROTATION_INTERVAL {
+		return key, nil
+	}
+
+	rotated, err := m.rotate(key)
+	if err != nil {
+		if key != nil {
+			// Keep signing with the old key rather than failing every sign-in
+			log.Printf("Error rotating %s token signing key: %v", m.purpose, err)
+			return key, nil
+		}
+		return nil, err
+	}
+	return rotated, nil
+}
+
+// VerificationKeys returns the keys a token with the given kid may be signed with:
+// the key of the kid, or every unexpired key for tokens made before keys had kids
+func (m *Manager) VerificationKeys(kid string) ([]*Key, error) {
+	if err := m.ensureLoaded(false); err != nil {
+		return nil, err
+	}
+	if kid == "" {
+		return m.unexpiredKeys(), nil
+	}
+	if key := m.findKey(kid); key != nil {
+		return []*Key{key}, nil
+	}
+	// Another instance may have rotated since the keys were loaded
+	if err := m.ensureLoaded(true); err != nil {
+		return nil, err
+	}
+	if key := m.findKey(kid); key != nil {
+		return []*Key{key}, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// JWKS returns the public keys that verify unexpired tokens
+func (m *Manager) JWKS() (*JWKSet, error) {
+	if err := m.ensureLoaded(false); err != nil {
+		return nil, err
+	}
+	set := &JWKSet{Keys: []JWK{}}
+	for _, key := range m.unexpiredKeys() {
+		jwk, err := publicJWK(key.Public)
+		if err != nil {
+			return nil, err
+		}
+		jwk.Kid, jwk.Use, jwk.Alg = key.Kid, "sig", key.Algorithm
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
+
+// Rotate makes a new key of the configured algorithm the signing key. The previous one
+// keeps verifying for the overlap window: as long as the tokens it signed can live.
+func (m *Manager) Rotate() (*Key, error) {
+	if err := m.ensureLoaded(false); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	current := m.activeKey()
+	m.mu.RUnlock()
+	return m.rotate(current)
+}
+
+/* LOADING */
+
+func (m *Manager) ensureLoaded(force bool) error {
+	m.mu.RLock()
+	fresh := m.keys != nil && time.Since(m.loadedAt) < global.JWT_KEY_CACHE_TTL
+	m.mu.RUnlock()
+	if fresh && !force {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if database.DB == nil {
+		// Without a database the keys only live in this process
+		if m.keys == nil {
+			key, err := m.initialKey()
+			if err != nil {
+				return err
+			}
+			m.keys = []*Key{key}
+		}
+		m.loadedAt = time.Now()
+		return nil
+	}
+
+	keys, err := m.loadKeys(database.DB)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		keys, err = m.createInitialKey()
+		if err != nil {
+			return err
+		}
+	}
+	m.keys, m.loadedAt = keys, time.Now()
+	return nil
+}
+
+// loadKeys reads the unexpired keys of the manager's purpose, newest first
+func (m *Manager) loadKeys(db *gorm.DB) ([]*Key, error) {
+	var records []models.SigningKey
+	err := db.Where("purpose = ? AND (expires_at IS NULL OR expires_at > ?)", m.purpose, time.Now()).
+		Order("id DESC").Find(&records).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signing keys: %v", err)
+	}
+	keys := make([]*Key, 0, len(records))
+	for i := range records {
+		key, err := keyFromRecord(&records[i])
+		if err != nil {
+			log.Printf("Error loading signing key %s: %v", records[i].Kid, err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// createInitialKey stores the first key of the purpose, unless another instance just did
+func (m *Manager) createInitialKey() ([]*Key, error) {
+	var keys []*Key
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := m.lock(tx); err != nil {
+			return err
+		}
+		var err error
+		if keys, err = m.loadKeys(tx); err != nil || len(keys) > 0 {
+			return err
+		}
+		key, err := m.initialKey()
+		if err != nil {
+			return err
+		}
+		if err := saveKey(tx, m.purpose, key); err != nil {
+			return err
+		}
+		keys = []*Key{key}
+		return nil
+	})
+	return keys, err
+}
+
+// initialKey imports the private key PEM of the configuration (SECRET_KEY or REFRESH_SECRET),
+// so tokens signed before keys were managed keep verifying, or generates a key
+func (m *Manager) initialKey() (*Key, error) {
+	key, err := configuredKey(m.purpose)
+	if err != nil || key != nil {
+		return key, err
+	}
+	return generateKey(configuredAlgorithm())
+}
+
+// CheckConfiguredKeys refuses a configuration whose access and refresh token keys are the same
+// key, whatever their PEM encoding: each purpose must verify only its own tokens
+func CheckConfiguredKeys() error {
+	access, err := configuredKey(PurposeAccess)
+	if err != nil {
+		return err
+	}
+	refresh, err := configuredKey(PurposeRefresh)
+	if err != nil {
+		return err
+	}
+	if access != nil && refresh != nil && access.Kid == refresh.Kid {
+		return ErrSharedKey
+	}
+	return nil
+}
+
+// configuredKey is the private key PEM of the configuration for purpose, nil if it holds none
+func configuredKey(purpose Purpose) (*Key, error) {
+	keyPEM := ""
+	if config.AppConfig != nil {
+		keyPEM = config.AppConfig.JWT.Secret
+		if purpose == PurposeRefresh {
+			keyPEM = config.AppConfig.JWT.RefreshSecret
+		}
+	}
+	if !strings.Contains(keyPEM, "PRIVATE KEY") {
+		return nil, nil
+	}
+	privateKey, err := parsePrivateKeyPEM([]byte(keyPEM))
+	if err != nil {
+		return nil, fmt.Errorf("failed to import configured %s token key: %v", purpose, err)
+	}
+	return newKey(privateKey, time.Now())
+}
+
+/* ROTATION */
+
+func (m *Manager) rotate(current *Key) (*Key, error) {
+	if database.DB == nil {
+		key, err := generateKey(configuredAlgorithm())
+		if err != nil {
+			return nil, err
+		}
+		m.mu.Lock()
+		m.retire(current, time.Now())
+		m.keys = append([]*Key{key}, m.keys...)
+		m.mu.Unlock()
+		return key, nil
+	}
+
+	var rotated *Key
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := m.lock(tx); err != nil {
+			return err
+		}
+		// Another instance may have rotated already
+		keys, err := m.loadKeys(tx)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if key.RetiresAt == nil && (current == nil || key.Kid != current.Kid) && key.CreatedAt.After(time.Now().Add(-global.JWT_KEY_ROTATION_INTERVAL)) {
+				rotated = key
+				return nil
+			}
+		}
+
+		key, err := generateKey(configuredAlgorithm())
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		expiresAt := now.Add(m.overlap())
+		err = tx.Model(&models.SigningKey{}).
+			Where("purpose = ? AND retires_at IS NULL", m.purpose).
+			Updates(map[string]any{"retires_at": now, "expires_at": expiresAt}).Error
+		if err != nil {
+			return fmt.Errorf("failed to retire signing key: %v", err)
+		}
+		if err := saveKey(tx, m.purpose, key); err != nil {
+			return err
+		}
+		rotated = key
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Rotated %s token signing key, new kid %s", m.purpose, rotated.Kid)
+	if err := m.ensureLoaded(true); err != nil {
+		return nil, err
+	}
+	return rotated, nil
+}
+
+// retire stops an in-memory key from signing. The caller holds the lock.
+func (m *Manager) retire(key *Key, now time.Time) {
+	if key == nil {
+		return
+	}
+	expiresAt := now.Add(m.overlap())
+	key.RetiresAt, key.ExpiresAt = &now, &expiresAt
+}
+
+// overlap is how long a retired key keeps verifying: the lifetime of the tokens it signed
+func (m *Manager) overlap() time.Duration {
+	lifetime := sessions.Lifetime()
+	if m.purpose == PurposeAccess {
+		lifetime = 0
+		if config.AppConfig != nil {
+			lifetime = time.Duration(config.AppConfig.JWT.SecretKeyExpiration) * time.Second
+		}
+	}
+	return max(global.JWT_KEY_OVERLAP, lifetime)
+}
+
+// lock serializes the key changes of a purpose across instances for the transaction
+func (m *Manager) lock(tx *gorm.DB) error {
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "signing-keys-"+string(m.purpose)).Error; err != nil {
+		return fmt.Errorf("failed to lock signing keys: %v", err)
+	}
+	return nil
+}
+
+/* HELPERS */
+
+// activeKey returns the newest key that still signs. The caller holds the lock.
+func (m *Manager) activeKey() *Key {
+	for _, key := range m.keys {
+		if key.RetiresAt == nil {
+			return key
+		}
+	}
+	return nil
+}
+
+func (m *Manager) findKey(kid string) *Key {
+	for _, key := range m.unexpiredKeys() {
+		if key.Kid == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+func (m *Manager) unexpiredKeys() []*Key {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := make([]*Key, 0, len(m.keys))
+	for _, key := range m.keys {
+		if key.ExpiresAt == nil || key.ExpiresAt.After(time.Now()) {
+			keys = append(keys, key)
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys
+}
+
+func configuredAlgorithm() string {
+	if config.AppConfig != nil && config.AppConfig.JWT.SigningAlgorithm != "" {
+		return config.AppConfig.JWT.SigningAlgorithm
+	}
+	return global.JWT_DEFAULT_SIGNING_ALGORITHM
+}
+
+// generateKey makes a new key: RSA 2048 for RS256, P-256 for ES256, Ed25519 for EdDSA
+func generateKey(algorithm string) (*Key, error) {
+	var privateKey crypto.PrivateKey
+	var err error
+	switch algorithm {
+	case "RS256":
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "EdDSA":
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedAlgorithm, algorithm)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %v", err)
+	}
+	return newKey(privateKey, time.Now())
+}
+
+// newKey describes a private key; its type decides the algorithm
+func newKey(privateKey crypto.PrivateKey, createdAt time.Time) (*Key, error) {
+	key := &Key{Private: privateKey, CreatedAt: createdAt}
+	switch private := privateKey.(type) {
+	case *rsa.PrivateKey:
+		key.Algorithm, key.Method, key.Public = "RS256", jwt.SigningMethodRS256, &private.PublicKey
+	case *ecdsa.PrivateKey:
+		if private.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%w: ECDSA keys must be on P-256", ErrUnsupportedAlgorithm)
+		}
+		key.Algorithm, key.Method, key.Public = "ES256", jwt.SigningMethodES256, &private.PublicKey
+	case ed25519.PrivateKey:
+		key.Algorithm, key.Method, key.Public = "EdDSA", jwt.SigningMethodEdDSA, private.Public()
+	default:
+		return nil, fmt.Errorf("%w: key type %T", ErrUnsupportedAlgorithm, privateKey)
+	}
+	kid, err := thumbprint(key.Public)
+	if err != nil {
+		return nil, err
+	}
+	key.Kid = kid
+	return key, nil
+}
+
+// parsePrivateKeyPEM reads a PKCS #8, PKCS #1 (RSA) or SEC 1 (EC) private key
+func parsePrivateKeyPEM(data []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid PEM")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key format")
+}
+
+func saveKey(tx *gorm.DB, purpose Purpose, key *Key) error {
+	privateDER, err := x509.MarshalPKCS8PrivateKey(key.Private)
+	if err != nil {
+		return fmt.Errorf("failed to encode private key: %v", err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(key.Public)
+	if err != nil {
+		return fmt.Errorf("failed to encode public key: %v", err)
+	}
+	encrypted, err := utils.Encrypt(string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER})))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt private key: %v", err)
+	}
+
+	record := &models.SigningKey{
+		Kid:          key.Kid,
+		Purpose:      string(purpose),
+		Algorithm:    key.Algorithm,
+		PublicKey:    string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})),
+		PrivateKey:   *encrypted.Content,
+		PrivateKeyIV: *encrypted.IV,
+	}
+	if err := tx.Create(record).Error; err != nil {
+		return fmt.Errorf("failed to save signing key: %v", err)
+	}
+	key.CreatedAt = record.CreatedAt
+	return nil
+}
+
+func keyFromRecord(record *models.SigningKey) (*Key, error) {
+	decrypted, err := utils.Decrypt(&struct {
+		IV      string `json:"iv"`
+		Content string `json:"content"`
+	}{IV: record.PrivateKeyIV, Content: record.PrivateKey})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key: %v", err)
+	}
+	privateKey, err := parsePrivateKeyPEM([]byte(decrypted))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key (was SECRET_KEY_FOR_CRYPTO_ENCRYPTION changed?): %v", err)
+	}
+	key, err := newKey(privateKey, record.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	key.RetiresAt, key.ExpiresAt = record.RetiresAt, record.ExpiresAt
+	return key, nil
+}
@@ -0,0 +1,182 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/database"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrRecipientsSuppressed = errors.New("every recipient of the email is suppressed after bounces or complaints")
+
+// BounceType is the kind of feedback received about a sent email
+type BounceType string
+
+const (
+	BounceHard BounceType = "hard"      // permanent failure: the address does not exist
+	BounceSoft BounceType = "soft"      // temporary failure: mailbox full, greylisting, ...
+	Complaint  BounceType = "complaint" // the recipient reported the email as spam
+	Delivered  BounceType = "delivered" // the receiving server accepted the email
+)
+
+// BounceEvent is one piece of feedback about one recipient, from a provider webhook or a DSN
+type BounceEvent struct {
+	Address    string     `json:"address"`
+	Type       BounceType `json:"type"`
+	Status     string     `json:"status,omitempty"` // enhanced status code, e.g. 5.1.1
+	Diagnostic string     `json:"diagnostic,omitempty"`
+	Source     string     `json:"source"`
+	OccurredAt time.Time  `json:"occurredAt"`
+}
+
+// RecordBounceEvents updates the deliverability of the addresses the events are about,
+// and of the users who have them as primary or backup address
+func RecordBounceEvents(events []BounceEvent) error {
+	if database.DB == nil {
+		return fmt.Errorf("failed to record bounces: database is not connected")
+	}
+	for _, event := range events {
+		if err := recordBounceEvent(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func recordBounceEvent(event BounceEvent) error {
+	address := normalizeAddress(event.Address)
+	if address == "" {
+		return nil
+	}
+	if event.OccurredAt.IsZero() {
+		event.OccurredAt = time.Now()
+	}
+
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		var suppression models.EmailSuppression
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("address = ?", address).First(&suppression).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if event.Type == Delivered {
+				// Nothing to learn from a delivery to an address that never bounced
+				return nil
+			}
+			suppression = models.EmailSuppression{Address: address, Status: global.EmailDeliverable}
+		} else if err != nil {
+			return fmt.Errorf("failed to find suppression: %v", err)
+		}
+
+		applyBounceEvent(&suppression, event)
+		if err := tx.Save(&suppression).Error; err != nil {
+			return fmt.Errorf("failed to save suppression: %v", err)
+		}
+		if suppression.Suppressed && event.Type != Delivered {
+			log.Printf("Suppressing email address %s after %s bounce: %s %s", address, event.Type, event.Status, event.Diagnostic)
+		}
+		return syncUserDeliverability(tx, address, suppression.Status)
+	})
+}
+
+// applyBounceEvent moves an address through its deliverability states. Hard bounces and
+// complaints are final until an admin lifts the suppression; soft bounces only count.
+func applyBounceEvent(suppression *models.EmailSuppression, event BounceEvent) {
+	switch event.Type {
+	case BounceHard:
+		suppression.Status = global.EmailHardBounced
+		suppression.Suppressed = true
+	case Complaint:
+		suppression.Status = global.EmailComplained
+		suppression.Suppressed = true
+	case BounceSoft:
+		suppression.SoftBounces++
+		if suppression.Status == global.EmailDeliverable || suppression.Status == "" {
+			suppression.Status = global.EmailSoftBounced
+		}
+		if suppression.SoftBounces >= global.MAIL_SOFT_BOUNCE_LIMIT {
+			suppression.Suppressed = true
+		}
+	case Delivered:
+		suppression.SoftBounces = 0
+		if suppression.Status == global.EmailSoftBounced {
+			suppression.Status = global.EmailDeliverable
+			suppression.Suppressed = false
+		}
+		return
+	}
+
+	suppression.LastSource = event.Source
+	suppression.LastStatus = event.Status
+	suppression.LastDiagnostic = event.Diagnostic
+	suppression.LastEventAt = event.OccurredAt
+}
+
+func syncUserDeliverability(tx *gorm.DB, address string, status global.EmailDeliverability) error {
+	err := tx.Model(&models.User{}).Where("LOWER(primary_email_address) = ?", address).
+		Update("primary_email_deliverability", status).Error
+	if err == nil {
+		err = tx.Model(&models.User{}).Where("LOWER(backup_email_address) = ?", address).
+			Update("backup_email_deliverability", status).Error
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update user deliverability: %v", err)
+	}
+	return nil
+}
+
+// DeliverabilityOf returns what is known about an address; addresses never reported are deliverable
+func DeliverabilityOf(address string) global.EmailDeliverability {
+	if database.DB == nil || address == "" {
+		return global.EmailDeliverable
+	}
+	var suppression models.EmailSuppression
+	if err := database.DB.Where("address = ?", normalizeAddress(address)).First(&suppression).Error; err != nil {
+		return global.EmailDeliverable
+	}
+	return suppression.Status
+}
+
+// suppressedAddresses returns the set of the given addresses nothing must be sent to
+func suppressedAddresses(addresses []string) (map[string]bool, error) {
+	suppressed := map[string]bool{}
+	if database.DB == nil || len(addresses) == 0 {
+		return suppressed, nil
+	}
+
+	normalized := make([]string, len(addresses))
+	for i, address := range addresses {
+		normalized[i] = normalizeAddress(address)
+	}
+	var found []string
+	err := database.DB.Model(&models.EmailSuppression{}).
+		Where("address IN ? AND suppressed = true", normalized).
+		Pluck("address", &found).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to check suppressed addresses: %v", err)
+	}
+	for _, address := range found {
+		suppressed[address] = true
+	}
+	return suppressed, nil
+}
+
+// withoutSuppressed drops the suppressed addresses from a list
+func withoutSuppressed(addresses []string, suppressed map[string]bool) []string {
+	var kept []string
+	for _, address := range addresses {
+		if !suppressed[normalizeAddress(address)] {
+			kept = append(kept, address)
+		}
+	}
+	return kept
+}
+
+// normalizeAddress returns the lower case bare address of "Name <address>"
+func normalizeAddress(address string) string {
+	return strings.ToLower(smtpAddress(address))
+}
@@ -0,0 +1,263 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/config"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// maxWebhookSize bounds the body of a provider webhook call (SendGrid batches events) or a forwarded DSN
+const maxWebhookSize = 5 * 1024 * 1024
+
+type MailController struct {
+	mailService *MailService
+}
+
+func NewMailController(mailService *MailService) *MailController {
+	return &MailController{
+		mailService: mailService,
+	}
+}
+
+// GetTemplates lists the built-in email templates and the supported locales
+func (mc *MailController) GetTemplates(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"templates": Templates(), "locales": Locales()})
+}
+
+// PreviewTemplate renders a template with sample data.
+// Optional queries: ?locale=, ?tenantId= or ?regionId= to apply their branding and overrides,
+// and ?format=html|text|json (default html)
+func (mc *MailController) PreviewTemplate(c *gin.Context) {
+	tenantId, err := strconv.ParseUint(c.DefaultQuery("tenantId", "0"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+	regionId, err := strconv.ParseUint(c.DefaultQuery("regionId", "0"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid region ID"})
+		return
+	}
+
+	message, err := mc.mailService.PreviewTemplate(c.Params.ByName("name"), LocaleFromRequest(c), uint(tenantId), uint(regionId))
+	if err != nil {
+		if errors.Is(err, ErrUnknownTemplate) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		// Most likely a broken override: show the admin what is wrong with it
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch c.DefaultQuery("format", "html") {
+	case "text":
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(message.Text))
+	case "json":
+		c.JSON(http.StatusOK, gin.H{"message": message})
+	default:
+		// Overrides are tenant supplied: don't let a preview run scripts in the admin's session
+		c.Header("Content-Security-Policy", "default-src 'none'; img-src * data:; style-src 'unsafe-inline'; sandbox")
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(message.HTML))
+	}
+}
+
+/* OUTBOX */
+
+// GetOutboxEmails lists queued emails. Optional queries: ?status=pending|sending|retry|sent|dead, ?limit= (default 50), ?offset=
+func (mc *MailController) GetOutboxEmails(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+		return
+	}
+
+	emails, count, err := mc.mailService.FindOutboxEmails(callerTenantID(c), c.Query("status"), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"emails": emails, "count": count})
+}
+
+func (mc *MailController) GetOutboxEmail(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email ID"})
+		return
+	}
+
+	email, err := mc.mailService.FindOutboxEmail(uint(id), callerTenantID(c))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"email": email})
+}
+
+// ResendEmail queues a failed (or sent) email for delivery again
+func (mc *MailController) ResendEmail(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email ID"})
+		return
+	}
+
+	email, err := mc.mailService.ResendEmail(uint(id), callerTenantID(c))
+	if err != nil {
+		if errors.Is(err, ErrEmailBeingSent) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"email": email})
+}
+
+// callerTenantID is the tenant whose emails an API key caller is limited to, 0 for landlord admins
+func callerTenantID(c *gin.Context) uint {
+	if c.GetUint(global.CONTEXT_API_KEY_ID_KEY) == 0 {
+		return 0
+	}
+	return c.GetUint(global.CONTEXT_TENANT_ID_KEY)
+}
+
+/* BOUNCES */
+
+// RequireWebhookToken rejects webhook calls without the MAIL_WEBHOOK_SECRET token,
+// given as ?token= or as the basic auth password (providers support one or the other)
+func RequireWebhookToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		secret := ""
+		if config.AppConfig != nil {
+			secret = config.AppConfig.MailWebhooks.Secret
+		}
+		if secret == "" {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Mail webhooks are not configured"})
+			return
+		}
+
+		token := c.Query("token")
+		if _, password, ok := c.Request.BasicAuth(); ok && token == "" {
+			token = password
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid webhook token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// readWebhookBody reads the body of a webhook call, at most maxWebhookSize bytes: 413 beyond
+func readWebhookBody(c *gin.Context) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxWebhookSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+			return nil, false
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return body, true
+}
+
+// HandleWebhook receives the bounce and complaint events of a provider: ses, sendgrid, mailgun or postmark
+func (mc *MailController) HandleWebhook(c *gin.Context) {
+	body, ok := readWebhookBody(c)
+	if !ok {
+		return
+	}
+
+	events, err := mc.mailService.HandleWebhook(c.Params.ByName("provider"), body)
+	if err != nil {
+		if errors.Is(err, ErrUnknownProvider) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		// Providers retry on 5xx: only ask for it when recording failed, not for a bad payload
+		if errors.Is(err, ErrInvalidWebhook) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": len(events)})
+}
+
+// HandleDSN receives a bounce message (the raw RFC 5322 message as body), e.g. piped from the bounce mailbox
+func (mc *MailController) HandleDSN(c *gin.Context) {
+	body, ok := readWebhookBody(c)
+	if !ok {
+		return
+	}
+
+	events, err := mc.mailService.HandleDSN(bytes.NewReader(body))
+	if err != nil {
+		if errors.Is(err, ErrNotABounce) {
+			// Accept it so whatever forwards the mailbox does not retry an out of office reply forever
+			c.JSON(http.StatusOK, gin.H{"events": 0, "ignored": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
+
+// GetSuppressions lists addresses that bounced or complained. Optional queries: ?suppressed=true, ?limit= (default 50), ?offset=
+func (mc *MailController) GetSuppressions(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+		return
+	}
+
+	suppressions, count, err := mc.mailService.FindSuppressions(c.Query("suppressed") == "true", limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"suppressions": suppressions, "count": count})
+}
+
+// LiftSuppression lets mail be sent to a suppressed address again
+func (mc *MailController) LiftSuppression(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid suppression ID"})
+		return
+	}
+
+	if err := mc.mailService.LiftSuppression(uint(id)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,191 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+var ErrNotABounce = errors.New("message is not a delivery status notification or feedback report")
+
+// maxDSNSize bounds what is read from a bounce message; the reports come first, the
+// returned original message (which can be large) last
+const maxDSNSize = 10 * 1024 * 1024
+
+// ParseDSN extracts the bounce events of a bounce message received in a mailbox:
+// a delivery status notification (RFC 3464, multipart/report; report-type=delivery-status)
+// or an abuse feedback report (RFC 5965, report-type=feedback-report).
+// Delayed and delivered notifications carry no deliverability information and are skipped.
+func ParseDSN(r io.Reader) ([]BounceEvent, error) {
+	message, err := mail.ReadMessage(io.LimitReader(r, maxDSNSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message: %v", err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["boundary"] == "" {
+		return nil, ErrNotABounce
+	}
+	occurredAt, err := message.Header.Date()
+	if err != nil {
+		occurredAt = time.Now()
+	}
+
+	var events []BounceEvent
+	var originalRecipients []string
+	isFeedbackReport := false
+
+	parts := multipart.NewReader(message.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read report: %v", err)
+		}
+
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		body := decodedPartBody(part)
+		switch partType {
+		case "message/delivery-status", "message/global-delivery-status":
+			fields, err := readFieldGroups(body)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read delivery status: %v", err)
+			}
+			events = append(events, deliveryStatusEvents(fields, occurredAt)...)
+		case "message/feedback-report":
+			isFeedbackReport = true
+			fields, err := readFieldGroups(body)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read feedback report: %v", err)
+			}
+			for _, group := range fields {
+				for _, recipient := range group.Values("Original-Rcpt-To") {
+					originalRecipients = append(originalRecipients, typedValue(recipient))
+				}
+			}
+		case "message/rfc822", "text/rfc822-headers", "message/global", "message/global-headers":
+			// The returned original: a complaint is about whoever it was sent to
+			if original, err := mail.ReadMessage(body); err == nil && len(originalRecipients) == 0 {
+				if to, err := original.Header.AddressList("To"); err == nil {
+					for _, address := range to {
+						originalRecipients = append(originalRecipients, address.Address)
+					}
+				}
+			}
+		}
+		part.Close()
+	}
+
+	if isFeedbackReport {
+		for _, recipient := range originalRecipients {
+			events = append(events, BounceEvent{Address: recipient, Type: Complaint, Source: "dsn", OccurredAt: occurredAt})
+		}
+	}
+	if len(events) == 0 && !isFeedbackReport && params["report-type"] != "delivery-status" {
+		return nil, ErrNotABounce
+	}
+	return events, nil
+}
+
+// deliveryStatusEvents turns the per-recipient groups of a delivery status into events.
+// The first group holds the per-message fields.
+func deliveryStatusEvents(groups []textproto.MIMEHeader, occurredAt time.Time) []BounceEvent {
+	var events []BounceEvent
+	for i, group := range groups {
+		if i == 0 && group.Get("Final-Recipient") == "" {
+			continue
+		}
+		if !strings.EqualFold(strings.TrimSpace(group.Get("Action")), "failed") {
+			continue
+		}
+		address := typedValue(group.Get("Final-Recipient"))
+		if address == "" {
+			address = typedValue(group.Get("Original-Recipient"))
+		}
+		status := strings.TrimSpace(group.Get("Status"))
+		events = append(events, BounceEvent{
+			Address:    address,
+			Type:       bounceTypeOfStatus(status),
+			Status:     status,
+			Diagnostic: typedValue(group.Get("Diagnostic-Code")),
+			Source:     "dsn",
+			OccurredAt: occurredAt,
+		})
+	}
+	return events
+}
+
+// bounceTypeOfStatus classifies an enhanced status code (RFC 3463). 5.x.x failures are
+// permanent, except those that say nothing about the address itself: a full mailbox
+// (x.2.2) or the receiving server's policy (x.7.x, usually spam filtering)
+func bounceTypeOfStatus(status string) BounceType {
+	if !strings.HasPrefix(status, "5.") {
+		return BounceSoft
+	}
+	if strings.HasPrefix(status[1:], ".2.2") || strings.HasPrefix(status[1:], ".7.") {
+		return BounceSoft
+	}
+	return BounceHard
+}
+
+// typedValue strips the type of a "type; value" field such as "rfc822; user@example.com"
+func typedValue(field string) string {
+	if semicolon := strings.Index(field, ";"); semicolon >= 0 {
+		field = field[semicolon+1:]
+	}
+	return strings.Trim(strings.TrimSpace(field), "<>")
+}
+
+// readFieldGroups reads header-style field groups separated by blank lines
+func readFieldGroups(r io.Reader) ([]textproto.MIMEHeader, error) {
+	reader := textproto.NewReader(bufio.NewReader(r))
+	var groups []textproto.MIMEHeader
+	for {
+		// Skip the blank lines between groups
+		for {
+			line, err := reader.R.Peek(1)
+			if err != nil {
+				return groups, nil
+			}
+			if line[0] != '\r' && line[0] != '\n' {
+				break
+			}
+			reader.R.ReadByte()
+		}
+
+		group, err := reader.ReadMIMEHeader()
+		if len(group) > 0 {
+			groups = append(groups, group)
+		}
+		if err == io.EOF {
+			return groups, nil
+		}
+		if err != nil {
+			return groups, err
+		}
+	}
+}
+
+// decodedPartBody undoes a base64 transfer encoding; multipart.Reader already decodes quoted-printable
+func decodedPartBody(part *multipart.Part) io.Reader {
+	if strings.EqualFold(part.Header.Get("Content-Transfer-Encoding"), "base64") {
+		content, _ := io.ReadAll(part)
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(content), nil)))
+		if err == nil {
+			return bytes.NewReader(decoded)
+		}
+		return bytes.NewReader(content)
+	}
+	return part
+}
@@ -0,0 +1,286 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+)
+
+// BuildMessage formats an email as an RFC 5322 message for the SMTP DATA command:
+//
+//	multipart/mixed                     only with regular attachments
+//	└ multipart/alternative             only with both a text and an HTML body
+//	  ├ text/plain
+//	  └ multipart/related               only with inline images
+//	    ├ text/html
+//	    └ image/png; Content-ID <logo>
+//
+// Non-ASCII header values are RFC 2047 encoded; Bcc recipients are never written.
+func BuildMessage(options global.MailOptions) ([]byte, error) {
+	return newMessageBuilder(time.Now(), randomHex(16)).build(options)
+}
+
+// messageBuilder holds what makes a message unique, so the same inputs always
+// produce the same output
+type messageBuilder struct {
+	date       time.Time
+	unique     string
+	boundaries int
+}
+
+func newMessageBuilder(date time.Time, unique string) *messageBuilder {
+	return &messageBuilder{date: date, unique: unique}
+}
+
+func (b *messageBuilder) build(options global.MailOptions) ([]byte, error) {
+	var inline, attached []global.Attachment
+	for _, attachment := range options.Attachments {
+		if attachment.ContentID != "" && options.Html != "" {
+			inline = append(inline, attachment)
+		} else {
+			attached = append(attached, attachment)
+		}
+	}
+
+	var message bytes.Buffer
+	writeHeader(&message, "Date", b.date.Format(time.RFC1123Z))
+	writeHeader(&message, "From", formatAddressList(options.From))
+	writeHeader(&message, "To", formatAddressList(options.To))
+	if len(options.Cc) > 0 {
+		writeHeader(&message, "Cc", formatAddressList(strings.Join(options.Cc, ",")))
+	}
+	if options.ReplyTo != "" {
+		writeHeader(&message, "Reply-To", formatAddressList(options.ReplyTo))
+	}
+	writeHeader(&message, "Subject", mime.QEncoding.Encode("UTF-8", options.Subject))
+	writeHeader(&message, "Message-ID", fmt.Sprintf("<%s@%s>", b.unique, senderDomain(options.From)))
+	writeHeader(&message, "MIME-Version", "1.0")
+
+	body := func(w partWriter) error { return b.writeBodies(w, options.Text, options.Html, inline) }
+	if len(attached) > 0 {
+		body = func(w partWriter) error {
+			return b.writeMultipart(w, "mixed", func(mw *multipart.Writer) error {
+				if err := b.writeBodies(nestedPart(mw), options.Text, options.Html, inline); err != nil {
+					return err
+				}
+				for _, attachment := range attached {
+					if err := writeAttachment(mw, attachment, "attachment"); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+	}
+
+	if err := body(topLevelPart(&message)); err != nil {
+		return nil, err
+	}
+	return message.Bytes(), nil
+}
+
+// partWriter starts a MIME entity with the given headers and returns the writer for its body
+type partWriter func(header textproto.MIMEHeader) (io.Writer, error)
+
+// topLevelPart writes the entity headers after the message headers
+func topLevelPart(message *bytes.Buffer) partWriter {
+	return func(header textproto.MIMEHeader) (io.Writer, error) {
+		for _, key := range []string{"Content-Type", "Content-Transfer-Encoding", "Content-Disposition", "Content-ID"} {
+			if value := header.Get(key); value != "" {
+				writeHeader(message, key, value)
+			}
+		}
+		message.WriteString("\r\n")
+		return message, nil
+	}
+}
+
+func nestedPart(mw *multipart.Writer) partWriter {
+	return func(header textproto.MIMEHeader) (io.Writer, error) {
+		return mw.CreatePart(header)
+	}
+}
+
+// writeBodies writes the text and/or HTML bodies, as multipart/alternative when there are both
+func (b *messageBuilder) writeBodies(w partWriter, text string, html string, inline []global.Attachment) error {
+	switch {
+	case html == "":
+		return writeText(w, "text/plain", text)
+	case text == "":
+		return b.writeHTML(w, html, inline)
+	default:
+		return b.writeMultipart(w, "alternative", func(mw *multipart.Writer) error {
+			if err := writeText(nestedPart(mw), "text/plain", text); err != nil {
+				return err
+			}
+			return b.writeHTML(nestedPart(mw), html, inline)
+		})
+	}
+}
+
+// writeHTML writes the HTML body, as multipart/related with its inline images if it has any
+func (b *messageBuilder) writeHTML(w partWriter, html string, inline []global.Attachment) error {
+	if len(inline) == 0 {
+		return writeText(w, "text/html", html)
+	}
+	return b.writeMultipart(w, "related", func(mw *multipart.Writer) error {
+		if err := writeText(nestedPart(mw), "text/html", html); err != nil {
+			return err
+		}
+		for _, attachment := range inline {
+			if err := writeAttachment(mw, attachment, "inline"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *messageBuilder) writeMultipart(w partWriter, subtype string, parts func(mw *multipart.Writer) error) error {
+	b.boundaries++
+	boundary := fmt.Sprintf("%s-%s-%d", subtype, b.unique, b.boundaries)
+
+	body, err := w(textproto.MIMEHeader{
+		"Content-Type": {mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": boundary})},
+	})
+	if err != nil {
+		return err
+	}
+
+	mw := multipart.NewWriter(body)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return err
+	}
+	if err := parts(mw); err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+func writeText(w partWriter, mediaType string, content string) error {
+	body, err := w(textproto.MIMEHeader{
+		"Content-Type":              {mediaType + "; charset=UTF-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+
+	qp := quotedprintable.NewWriter(body)
+	if _, err := qp.Write([]byte(content)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func writeAttachment(mw *multipart.Writer, attachment global.Attachment, disposition string) error {
+	contentType := attachment.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header := textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"base64"},
+	}
+	if attachment.Filename != "" {
+		// FormatMediaType uses RFC 2231 for non-ASCII file names
+		header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+	} else {
+		header.Set("Content-Disposition", disposition)
+	}
+	if attachment.ContentID != "" {
+		header.Set("Content-ID", "<"+strings.Trim(attachment.ContentID, "<>")+">")
+	}
+
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	// Base64 in lines of 76 characters
+	encoded := base64.StdEncoding.EncodeToString(attachment.Content)
+	for len(encoded) > 76 {
+		if _, err := io.WriteString(part, encoded[:76]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = io.WriteString(part, encoded+"\r\n")
+	return err
+}
+
+// formatAddressList RFC 2047 encodes the display names of a comma separated address list.
+// Addresses that do not parse are written unchanged.
+func formatAddressList(list string) string {
+	addresses, err := mail.ParseAddressList(list)
+	if err != nil {
+		return list
+	}
+	formatted := make([]string, len(addresses))
+	for i, address := range addresses {
+		formatted[i] = address.String()
+	}
+	return strings.Join(formatted, ", ")
+}
+
+func senderDomain(from string) string {
+	if address, err := mail.ParseAddress(from); err == nil {
+		if at := strings.LastIndex(address.Address, "@"); at >= 0 {
+			return address.Address[at+1:]
+		}
+	}
+	return "localhost"
+}
+
+// writeHeader writes a header, folding it at spaces so lines stay under 78 characters where possible
+func writeHeader(message *bytes.Buffer, key string, value string) {
+	// A line break in a value would start a new (injected) header
+	value = strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+
+	line := key + ":"
+	lineLength := len(line)
+	message.WriteString(line)
+	for _, word := range strings.Split(value, " ") {
+		if lineLength+1+len(word) > 76 && lineLength > len(key)+1 {
+			message.WriteString("\r\n")
+			lineLength = 0
+		}
+		message.WriteString(" " + word)
+		lineLength += 1 + len(word)
+	}
+	message.WriteString("\r\n")
+}
+
+func randomHex(length int) string {
+	b := make([]byte, length)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// smtpAddress returns the bare address of "Name <address>" for the SMTP envelope
+func smtpAddress(address string) string {
+	if parsed, err := mail.ParseAddress(address); err == nil {
+		return parsed.Address
+	}
+	return strings.TrimSpace(address)
+}
+
+func smtpAddresses(addresses []string) []string {
+	bare := make([]string, len(addresses))
+	for i, address := range addresses {
+		bare[i] = smtpAddress(address)
+	}
+	return bare
+}
@@ -0,0 +1,195 @@
+package mail
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+)
+
+// go test ./mail -run TestBuildMessage -update rewrites the golden files after an intended change
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+var pngPixel = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89")
+
+func TestBuildMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		options global.MailOptions
+	}{
+		{
+			name: "text-only",
+			options: global.MailOptions{
+				From:    "noreply@auditrakkr.com",
+				To:      "jane@example.com",
+				Subject: "Welcome",
+				Text:    "Hello Jane,\n\nWelcome aboard.",
+			},
+		},
+		{
+			name: "alternative",
+			options: global.MailOptions{
+				From:    "Auditrakkr <noreply@auditrakkr.com>",
+				To:      "jane@example.com",
+				Subject: "Verify your email address",
+				Text:    "Open https://app.example.com/verify?token=abc to verify your address.",
+				Html:    `<p>Open <a href="https://app.example.com/verify?token=abc">this link</a> to verify your address.</p>`,
+			},
+		},
+		{
+			name: "inline-image",
+			options: global.MailOptions{
+				From:    "noreply@auditrakkr.com",
+				To:      "jane@example.com",
+				Subject: "Your tenant",
+				Text:    "Your tenant is ready.",
+				Html:    `<img src="cid:logo"><p>Your tenant is ready.</p>`,
+				Attachments: []global.Attachment{
+					{Filename: "logo.png", Content: pngPixel, ContentType: "image/png", ContentID: "logo"},
+				},
+			},
+		},
+		{
+			name: "attachments",
+			options: global.MailOptions{
+				From:    "billing@auditrakkr.com",
+				To:      "accounts@example.com",
+				Cc:      []string{"cfo@example.com"},
+				Bcc:     []string{"archive@auditrakkr.com"},
+				ReplyTo: "support@auditrakkr.com",
+				Subject: "Invoice 2024-001",
+				Text:    "Your invoice is attached.",
+				Html:    `<img src="cid:logo"><p>Your invoice is attached.</p>`,
+				Attachments: []global.Attachment{
+					{Filename: "logo.png", Content: pngPixel, ContentType: "image/png", ContentID: "logo"},
+					{Filename: "invoice-2024-001.pdf", Content: bytes.Repeat([]byte("%PDF-1.4 "), 12), ContentType: "application/pdf"},
+					{Filename: "notes.txt", Content: []byte("no content type")},
+				},
+			},
+		},
+		{
+			name: "header-encoding",
+			options: global.MailOptions{
+				From:    "Équipe Auditrakkr <noreply@auditrakkr.com>",
+				To:      "José Müller <jose@example.com>, plain@example.com",
+				Subject: "Réinitialisation du mot de passe de votre compte, valable une heure seulement",
+				Text:    "Bonjour José, voici le lien — valable une heure.",
+				Attachments: []global.Attachment{
+					{Filename: "relevé de compte.pdf", Content: []byte("%PDF-1.4"), ContentType: "application/pdf"},
+				},
+			},
+		},
+		{
+			name: "header-injection",
+			options: global.MailOptions{
+				From:    "noreply@auditrakkr.com",
+				To:      "jane@example.com",
+				Subject: "Hello\r\nBcc: victim@example.com",
+				Text:    "Hello",
+			},
+		},
+	}
+
+	date := time.Date(2024, time.March, 1, 9, 30, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := newMessageBuilder(date, "0123456789abcdef").build(test.options)
+			if err != nil {
+				t.Fatalf("build: %v", err)
+			}
+
+			golden := filepath.Join("testdata", test.name+".eml")
+			if *update {
+				if err := os.WriteFile(golden, message, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("missing golden file (run with -update): %v", err)
+			}
+			if !bytes.Equal(message, want) {
+				t.Errorf("message differs from %s:\n--- got ---\n%s\n--- want ---\n%s", golden, message, want)
+			}
+
+			checkMessage(t, message, test.options)
+		})
+	}
+}
+
+// checkMessage parses the message back, as a mail client would
+func checkMessage(t *testing.T, message []byte, options global.MailOptions) {
+	t.Helper()
+	for _, line := range strings.Split(string(message), "\r\n") {
+		if strings.HasPrefix(strings.ToLower(line), "bcc:") {
+			t.Errorf("Bcc header written: %q", line)
+		}
+	}
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		t.Fatalf("message does not parse: %v", err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil {
+		t.Fatalf("subject does not decode: %v", err)
+	}
+	// Encoded words keep line breaks inside the Subject, where they cannot start a header
+	if subject != options.Subject {
+		t.Errorf("Subject = %q, want %q", subject, options.Subject)
+	}
+	if _, err := parsed.Header.AddressList("To"); err != nil {
+		t.Errorf("To does not parse: %v", err)
+	}
+
+	var attachments int
+	walkParts(t, parsed.Header.Get("Content-Type"), parsed.Body, func(header map[string][]string, body []byte) {
+		if len(header["Content-Disposition"]) > 0 {
+			attachments++
+		}
+	})
+	if attachments != len(options.Attachments) {
+		t.Errorf("found %d attachments, want %d", attachments, len(options.Attachments))
+	}
+}
+
+// walkParts calls leaf for every non-multipart entity of a MIME tree
+func walkParts(t *testing.T, contentType string, body io.Reader, leaf func(header map[string][]string, body []byte)) {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatalf("Content-Type %q does not parse: %v", contentType, err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return
+	}
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatalf("%s part does not parse: %v", mediaType, err)
+		}
+		partType := part.Header.Get("Content-Type")
+		if strings.HasPrefix(partType, "multipart/") {
+			walkParts(t, partType, part, leaf)
+			continue
+		}
+		content, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatalf("part does not read: %v", err)
+		}
+		leaf(part.Header, content)
+	}
+}
@@ -0,0 +1,283 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/database"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// EnqueueOptions describes where a queued email comes from
+type EnqueueOptions struct {
+	TenantID *uint
+	Template string
+}
+
+// Deliver sends one queued email through the SMTP server of its tenant, see SMTPSettingsForTenant
+var Deliver = func(ctx context.Context, email *models.EmailOutbox) error {
+	settings, err := SMTPSettingsForTenant(email.TenantID)
+	if err != nil {
+		return err
+	}
+	message, err := BuildMessage(MailOptionsFromOutbox(email))
+	if err != nil {
+		return fmt.Errorf("failed to build message: %v", err)
+	}
+	return SendSMTP(ctx, settings, smtpAddress(email.From), smtpAddresses(email.Recipients()), message)
+}
+
+// SMTPSettingsForTenant resolves the SMTP server for a tenant's mail: the tenant's own
+// SMTPAuth, then its region's, then the SMTP_* environment settings. tenantId may be nil.
+func SMTPSettingsForTenant(tenantId *uint) (*SMTPSettings, error) {
+	if tenantId == nil || database.DB == nil {
+		return DefaultSMTPSettings(), nil
+	}
+
+	var tenant models.Tenant
+	err := database.DB.Preload("TenantConfigDetail.Region").First(&tenant, *tenantId).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to find tenant: %v", err)
+	}
+
+	settings, err := SettingsFromSMTPAuth(tenant.TenantConfigDetail.SMTPAuth)
+	if settings != nil || err != nil {
+		return settings, err
+	}
+
+	region := tenant.TenantConfigDetail.Region
+	if region.ID == 0 && tenant.RegionName != "" {
+		database.DB.Where("name = ?", tenant.RegionName).First(&region)
+	}
+	settings, err = SettingsFromSMTPAuth(region.SMTPAuth)
+	if settings != nil || err != nil {
+		return settings, err
+	}
+
+	return DefaultSMTPSettings(), nil
+}
+
+// wake nudges idle workers when a new email is queued
+var wake = make(chan struct{}, 1)
+
+// Enqueue stores an email in the outbox for delivery by the mail workers.
+// An error means the email was not queued and will not be sent; ErrRecipientsSuppressed
+// when every To address is suppressed. Suppressed Cc and Bcc addresses are dropped silently.
+func Enqueue(options global.MailOptions, enqueueOptions EnqueueOptions) (*models.EmailOutbox, error) {
+	if database.DB == nil {
+		return nil, fmt.Errorf("failed to queue email: database is not connected")
+	}
+
+	var to models.EmailAddresses
+	for _, address := range strings.Split(options.To, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			to = append(to, address)
+		}
+	}
+	if len(to) == 0 {
+		return nil, fmt.Errorf("failed to queue email: no recipient")
+	}
+
+	// Sending to addresses that bounced or complained hurts the reputation of the sender
+	suppressed, err := suppressedAddresses(append(append(append([]string{}, to...), options.Cc...), options.Bcc...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to queue email: %v", err)
+	}
+	if len(suppressed) > 0 {
+		to = withoutSuppressed(to, suppressed)
+		options.Cc = withoutSuppressed(options.Cc, suppressed)
+		options.Bcc = withoutSuppressed(options.Bcc, suppressed)
+		if len(to) == 0 {
+			return nil, ErrRecipientsSuppressed
+		}
+	}
+
+	email := &models.EmailOutbox{
+		TenantID:      enqueueOptions.TenantID,
+		Template:      enqueueOptions.Template,
+		From:          options.From,
+		To:            to,
+		Cc:            options.Cc,
+		Bcc:           options.Bcc,
+		ReplyTo:       options.ReplyTo,
+		Subject:       options.Subject,
+		Text:          options.Text,
+		Html:          options.Html,
+		Attachments:   options.Attachments,
+		Status:        global.EmailPending,
+		MaxAttempts:   global.MAIL_MAX_ATTEMPTS,
+		NextAttemptAt: time.Now(),
+	}
+	if err := database.DB.Create(email).Error; err != nil {
+		return nil, fmt.Errorf("failed to queue email: %v", err)
+	}
+
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+	return email, nil
+}
+
+// MailOptionsFromOutbox converts a queued email back to the options it was queued with
+func MailOptionsFromOutbox(email *models.EmailOutbox) global.MailOptions {
+	return global.MailOptions{
+		To:          strings.Join(email.To, ","),
+		From:        email.From,
+		Subject:     email.Subject,
+		Text:        email.Text,
+		Html:        email.Html,
+		ReplyTo:     email.ReplyTo,
+		Cc:          email.Cc,
+		Bcc:         email.Bcc,
+		Attachments: email.Attachments,
+	}
+}
+
+var startWorkersOnce sync.Once
+
+// StartOutboxWorkers starts the pool of workers delivering queued emails. They stop when ctx is done.
+// Workers on several instances can share the outbox: emails are claimed with SKIP LOCKED.
+func StartOutboxWorkers(ctx context.Context, workers int) {
+	startWorkersOnce.Do(func() {
+		for i := 0; i < workers; i++ {
+			go outboxWorker(ctx)
+		}
+		log.Printf("Started %d outbound email workers", workers)
+	})
+}
+
+func outboxWorker(ctx context.Context) {
+	ticker := time.NewTicker(global.MAIL_OUTBOX_POLL_DELAY)
+	defer ticker.Stop()
+
+	for {
+		// Drain everything that is due before going back to sleep
+		for {
+			email, err := claimNextEmail()
+			if err != nil {
+				log.Printf("Error claiming queued email: %v", err)
+				break
+			}
+			if email == nil {
+				break
+			}
+			processEmail(ctx, email)
+			if ctx.Err() != nil {
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claimNextEmail locks the next due email and leases it to the calling worker.
+// Emails whose lease expired (their worker died mid-send) are due again.
+func claimNextEmail() (*models.EmailOutbox, error) {
+	if database.DB == nil {
+		return nil, nil
+	}
+
+	var email models.EmailOutbox
+	now := time.Now()
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("(status IN ? AND next_attempt_at <= ?) OR (status = ? AND locked_until < ?)",
+				[]global.EmailStatus{global.EmailPending, global.EmailRetry}, now, global.EmailSending, now).
+			Order("next_attempt_at").
+			First(&email).Error
+		if err != nil {
+			return err
+		}
+
+		lockedUntil := now.Add(global.MAIL_SEND_LEASE)
+		email.Status = global.EmailSending
+		email.Attempts++
+		email.LockedUntil = &lockedUntil
+		return tx.Model(&email).Updates(map[string]any{
+			"status":       email.Status,
+			"attempts":     email.Attempts,
+			"locked_until": email.LockedUntil,
+		}).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &email, nil
+}
+
+// processEmail attempts delivery and records the outcome for every recipient
+func processEmail(ctx context.Context, email *models.EmailOutbox) {
+	started := time.Now()
+	sendErr := Deliver(ctx, email)
+	duration := time.Since(started).Milliseconds()
+
+	logs := make([]models.EmailSendLog, 0, len(email.Recipients()))
+	for _, recipient := range email.Recipients() {
+		entry := models.EmailSendLog{
+			EmailOutboxID: email.ID,
+			Recipient:     recipient,
+			Attempt:       email.Attempts,
+			Success:       sendErr == nil,
+			DurationMs:    duration,
+		}
+		if sendErr != nil {
+			entry.Error = sendErr.Error()
+		}
+		logs = append(logs, entry)
+	}
+	if err := database.DB.Create(&logs).Error; err != nil {
+		log.Printf("Error saving send log of email %d: %v", email.ID, err)
+	}
+
+	updates := map[string]any{"locked_until": nil}
+	switch {
+	case sendErr == nil:
+		updates["status"] = global.EmailSent
+		updates["sent_at"] = time.Now()
+		updates["last_error"] = ""
+	case email.Attempts >= email.MaxAttempts:
+		updates["status"] = global.EmailDead
+		updates["last_error"] = sendErr.Error()
+		log.Printf("Giving up on email %d to %s after %d attempts: %v", email.ID, strings.Join(email.To, ","), email.Attempts, sendErr)
+	default:
+		updates["status"] = global.EmailRetry
+		updates["last_error"] = sendErr.Error()
+		updates["next_attempt_at"] = time.Now().Add(retryDelay(email.Attempts))
+	}
+
+	if err := database.DB.Model(email).Updates(updates).Error; err != nil {
+		log.Printf("Error updating status of email %d: %v", email.ID, err)
+	}
+}
+
+// retryDelay grows exponentially with the number of attempts made, with jitter
+// so emails that failed together do not all retry at the same moment
+func retryDelay(attempts int) time.Duration {
+	delay := global.MAIL_RETRY_BASE_DELAY
+	for i := 1; i < attempts && delay < global.MAIL_RETRY_MAX_DELAY; i++ {
+		delay *= 2
+	}
+	if delay > global.MAIL_RETRY_MAX_DELAY {
+		delay = global.MAIL_RETRY_MAX_DELAY
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
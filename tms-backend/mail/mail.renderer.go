@@ -0,0 +1,422 @@
+package mail
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"log"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"golang.org/x/text/language"
+)
+
+// Built-in templates. Every template has a <locale>/<name>.txt file defining the
+// "subject" and "content" blocks and a <locale>/<name>.html file defining "content".
+// <locale>/common.tmpl holds blocks shared by all templates of a locale.
+//
+//go:embed templates
+var templateFS embed.FS
+
+const (
+	DefaultLocale       = "en"
+	defaultPrimaryColor = "#485fc7"
+)
+
+var ErrUnknownTemplate = errors.New("unknown email template")
+
+// Message is a rendered email
+type Message struct {
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html"`
+	// Inline holds the images the HTML references with cid: URLs. Send them as attachments
+	Inline []global.Attachment `json:"-"`
+}
+
+// Branding is the look of an email: whose name and logo it carries
+type Branding struct {
+	Name string `json:"name"`
+	// LogoURL is an absolute URL or, when Logo is set, the cid: URL of the inline logo
+	LogoURL      htmltemplate.URL   `json:"logoUrl"`
+	Logo         *global.Attachment `json:"-"`
+	PrimaryColor string             `json:"primaryColor"`
+	Year         int                `json:"year"`
+}
+
+// TemplateData is what templates are executed with. Template specific values are in Data
+type TemplateData struct {
+	Subject  string
+	Locale   string
+	Branding Branding
+	Data     map[string]any
+}
+
+// Scope selects the locale, branding and overrides used to render a template
+type Scope struct {
+	Locale   string
+	Branding *Branding // nil uses the application's branding
+	// Overrides are searched in order, so put the most specific first (tenant, then region)
+	Overrides []*models.OtherUserOptions
+	// Strict returns override errors instead of falling back to the built-in template
+	Strict bool
+}
+
+// TemplateInfo describes a built-in template and the sample data used to preview it
+type TemplateInfo struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	SampleData  map[string]any `json:"sampleData"`
+}
+
+var registry = []TemplateInfo{
+	{
+		Name:        "confirm-email",
+		Description: "Email address verification link",
+		SampleData: map[string]any{
+			"FirstName": "Jane",
+			"URL":       "https://example.com/v1/users/confirm-primary-email/sample-token",
+			"ExpiresIn": "48 hours",
+		},
+	},
+	{
+		Name:        "reset-password",
+		Description: "Password reset link",
+		SampleData: map[string]any{
+			"FirstName": "Jane",
+			"URL":       "https://example.com/v1/users/reset-password/sample-token",
+			"ExpiresIn": "24 hours",
+		},
+	},
+	{
+		Name:        "magic-link",
+		Description: "Single-use link to sign in without a password",
+		SampleData: map[string]any{
+			"FirstName": "Jane",
+			"URL":       "https://example.com/magic-link?token=sample-token",
+			"ExpiresIn": "15 minutes",
+		},
+	},
+	{
+		Name:        "change-email",
+		Description: "Confirmation link for a new email address, sent to the new address",
+		SampleData: map[string]any{
+			"FirstName": "Jane",
+			"NewEmail":  "jane.doe@example.org",
+			"URL":       "https://example.com/v1/users/confirm-email-change/sample-token",
+			"ExpiresIn": "48 hours",
+		},
+	},
+	{
+		Name:        "email-change-notice",
+		Description: "Notice of an email address change with a revert link, sent to the old address",
+		SampleData: map[string]any{
+			"FirstName": "Jane",
+			"NewEmail":  "jane.doe@example.org",
+			"URL":       "https://example.com/v1/users/revert-email-change/sample-token",
+			"ExpiresIn": "7 days",
+		},
+	},
+	{
+		Name:        "account-locked",
+		Description: "Notice of an account locked after too many failed sign-in attempts",
+		SampleData: map[string]any{
+			"FirstName": "Jane",
+			"IPAddress": "203.0.113.7",
+			"LockedFor": "15 minutes",
+		},
+	},
+	{
+		Name:        "account-unlocked",
+		Description: "Notice of an account unlocked by an administrator",
+		SampleData: map[string]any{
+			"FirstName": "Jane",
+		},
+	},
+	{
+		Name:        "impersonation-started",
+		Description: "Notice to tenant admins that landlord support is acting as one of their users",
+		SampleData: map[string]any{
+			"FirstName":         "Jane",
+			"ImpersonatorName":  "Sam Support",
+			"ImpersonatorEmail": "sam.support@example.com",
+			"UserName":          "John Doe",
+			"UserEmail":         "john.doe@example.org",
+			"Reason":            "Ticket #4521: report does not load",
+			"ExpiresIn":         "15 minutes",
+		},
+	},
+}
+
+// legacyTextTemplates maps the single text template fields of OtherUserOptions,
+// which use a {url} placeholder, to the templates they override
+var legacyTextTemplates = map[string]func(*models.OtherUserOptions) string{
+	"confirm-email":  func(o *models.OtherUserOptions) string { return o.ConfirmEmailMailOptionSettings_TextTemplate },
+	"reset-password": func(o *models.OtherUserOptions) string { return o.ResetPasswordMailOptionSettings_TextTemplate },
+}
+
+// Templates lists the built-in templates
+func Templates() []TemplateInfo {
+	return registry
+}
+
+// Lookup returns the built-in template with the given name
+func Lookup(name string) (*TemplateInfo, bool) {
+	for i := range registry {
+		if registry[i].Name == name {
+			return &registry[i], true
+		}
+	}
+	return nil, false
+}
+
+// Locales lists the locales that have built-in templates, DefaultLocale first
+func Locales() []string {
+	locales := []string{DefaultLocale}
+	entries, _ := fs.ReadDir(templateFS, "templates")
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != DefaultLocale {
+			locales = append(locales, entry.Name())
+		}
+	}
+	return locales
+}
+
+// MatchLocale picks the best supported locale for an Accept-Language style list of preferences
+func MatchLocale(preferences ...string) string {
+	supported := Locales()
+	tags := make([]language.Tag, len(supported))
+	for i, locale := range supported {
+		tags[i] = language.Make(locale)
+	}
+	matcher := language.NewMatcher(tags)
+	_, index, confidence := matcher.Match(parseLanguages(preferences)...)
+	if confidence == language.No {
+		return DefaultLocale
+	}
+	return supported[index]
+}
+
+func parseLanguages(preferences []string) []language.Tag {
+	var tags []language.Tag
+	for _, preference := range preferences {
+		parsed, _, err := language.ParseAcceptLanguage(preference)
+		if err == nil {
+			tags = append(tags, parsed...)
+		}
+	}
+	return tags
+}
+
+// DefaultBranding is used when an email is not sent on behalf of a tenant
+func DefaultBranding() Branding {
+	return Branding{
+		Name:         global.APP_NAME,
+		PrimaryColor: defaultPrimaryColor,
+		Year:         time.Now().Year(),
+	}
+}
+
+// Render renders a built-in template with data, applying the locale, branding and overrides of scope
+func Render(name string, data map[string]any, scope Scope) (*Message, error) {
+	if _, ok := Lookup(name); !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTemplate, name)
+	}
+
+	locale := MatchLocale(scope.Locale)
+	branding := DefaultBranding()
+	if scope.Branding != nil {
+		branding = *scope.Branding
+		if branding.Name == "" {
+			branding.Name = global.APP_NAME
+		}
+		if branding.PrimaryColor == "" {
+			branding.PrimaryColor = defaultPrimaryColor
+		}
+		if branding.Year == 0 {
+			branding.Year = time.Now().Year()
+		}
+	}
+	if branding.Logo != nil {
+		// Embed the logo: many email clients block remote images
+		branding.LogoURL = htmltemplate.URL("cid:" + branding.Logo.ContentID)
+	}
+	templateData := &TemplateData{Locale: locale, Branding: branding, Data: data}
+
+	override := findOverride(name, locale, scope.Overrides)
+	message, err := render(name, locale, templateData, override)
+	if err != nil && override != nil {
+		if scope.Strict {
+			return nil, err
+		}
+		// A broken override must not stop emails such as password resets from going out
+		log.Printf("Warning: ignoring override of email template %s: %v", name, err)
+		message, err = render(name, locale, templateData, nil)
+	}
+	if err == nil && branding.Logo != nil && strings.Contains(message.HTML, string(branding.LogoURL)) {
+		message.Inline = append(message.Inline, *branding.Logo)
+	}
+	return message, err
+}
+
+func render(name string, locale string, data *TemplateData, override *models.MailTemplateOverride) (*Message, error) {
+	base, err := parsedTemplates(name, locale)
+	if err != nil {
+		return nil, err
+	}
+
+	textSet, err := base.text.Clone()
+	if err != nil {
+		return nil, err
+	}
+	htmlSet, err := base.html.Clone()
+	if err != nil {
+		return nil, err
+	}
+
+	if override != nil {
+		if override.Subject != "" {
+			if _, err := textSet.New("subject").Parse(override.Subject); err != nil {
+				return nil, fmt.Errorf("failed to parse subject override: %v", err)
+			}
+		}
+		if override.TextTemplate != "" {
+			if _, err := textSet.New("content").Parse(override.TextTemplate); err != nil {
+				return nil, fmt.Errorf("failed to parse text template override: %v", err)
+			}
+		}
+		if override.HtmlTemplate != "" {
+			if _, err := htmlSet.New("content").Parse(override.HtmlTemplate); err != nil {
+				return nil, fmt.Errorf("failed to parse html template override: %v", err)
+			}
+		}
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := textSet.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, fmt.Errorf("failed to render subject: %v", err)
+	}
+	// Subjects are a single header line
+	data.Subject = strings.Join(strings.Fields(subject.String()), " ")
+
+	if err := textSet.ExecuteTemplate(&text, "layout.txt", data); err != nil {
+		return nil, fmt.Errorf("failed to render text body: %v", err)
+	}
+	if err := htmlSet.ExecuteTemplate(&html, "layout.html", data); err != nil {
+		return nil, fmt.Errorf("failed to render html body: %v", err)
+	}
+
+	return &Message{
+		Subject: data.Subject,
+		Text:    strings.TrimSpace(text.String()) + "\n",
+		HTML:    html.String(),
+	}, nil
+}
+
+type templateSet struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// parsed caches the built-in templates per name and locale. They are never
+// executed directly, only cloned, so overrides can still redefine their blocks
+var parsed sync.Map
+
+func parsedTemplates(name string, locale string) (*templateSet, error) {
+	cacheKey := locale + "/" + name
+	if set, ok := parsed.Load(cacheKey); ok {
+		return set.(*templateSet), nil
+	}
+
+	textSet, err := texttemplate.ParseFS(templateFS,
+		"templates/layout.txt",
+		"templates/"+locale+"/common.tmpl",
+		"templates/"+locale+"/"+name+".txt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse text template %s: %v", cacheKey, err)
+	}
+	htmlSet, err := htmltemplate.ParseFS(templateFS,
+		"templates/layout.html",
+		"templates/"+locale+"/common.tmpl",
+		"templates/"+locale+"/"+name+".html")
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse html template %s: %v", cacheKey, err)
+	}
+
+	set, _ := parsed.LoadOrStore(cacheKey, &templateSet{text: textSet, html: htmlSet})
+	return set.(*templateSet), nil
+}
+
+// findOverride merges the overrides of a template field by field, the first
+// non-empty value winning. Locale specific entries ("name.locale") take
+// precedence over generic ones within the same options.
+func findOverride(name string, locale string, options []*models.OtherUserOptions) *models.MailTemplateOverride {
+	var merged models.MailTemplateOverride
+	found := false
+
+	apply := func(candidate models.MailTemplateOverride) {
+		if merged.Subject == "" && candidate.Subject != "" {
+			merged.Subject, found = candidate.Subject, true
+		}
+		if merged.TextTemplate == "" && candidate.TextTemplate != "" {
+			merged.TextTemplate, found = candidate.TextTemplate, true
+		}
+		if merged.HtmlTemplate == "" && candidate.HtmlTemplate != "" {
+			merged.HtmlTemplate, found = candidate.HtmlTemplate, true
+		}
+	}
+
+	for _, option := range options {
+		if option == nil {
+			continue
+		}
+		if candidate, ok := option.MailTemplates[name+"."+locale]; ok {
+			apply(candidate)
+		}
+		if candidate, ok := option.MailTemplates[name]; ok {
+			apply(candidate)
+		}
+		if legacy, ok := legacyTextTemplates[name]; ok && legacy(option) != "" {
+			apply(models.MailTemplateOverride{
+				TextTemplate: strings.ReplaceAll(legacy(option), "{url}", "{{.Data.URL}}"),
+			})
+		}
+	}
+
+	if !found {
+		return nil
+	}
+	return &merged
+}
+
+var durationUnits = map[string][3][2]string{
+	"en": {{"day", "days"}, {"hour", "hours"}, {"minute", "minutes"}},
+	"fr": {{"jour", "jours"}, {"heure", "heures"}, {"minute", "minutes"}},
+}
+
+// FormatDuration renders d in whole days, hours or minutes (e.g. "48 hours") for use in templates
+func FormatDuration(d time.Duration, locale string) string {
+	units, ok := durationUnits[locale]
+	if !ok {
+		units = durationUnits[DefaultLocale]
+	}
+
+	value, unit := int(d/time.Minute), units[2]
+	switch {
+	case d >= 72*time.Hour && d%(24*time.Hour) == 0:
+		value, unit = int(d/(24*time.Hour)), units[0]
+	case d >= time.Hour && d%time.Hour == 0:
+		value, unit = int(d/time.Hour), units[1]
+	}
+	if value == 1 {
+		return fmt.Sprintf("%d %s", value, unit[0])
+	}
+	return fmt.Sprintf("%d %s", value, unit[1])
+}
@@ -0,0 +1,342 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/config"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/database"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/repositories"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/storage"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// logoURLExpiration keeps linked logos in sent emails displayable long after they were sent
+	logoURLExpiration = 365 * 24 * time.Hour
+	maxInlineLogoSize = 100 * 1024
+)
+
+var ErrEmailBeingSent = errors.New("email is being sent")
+
+type MailService struct {
+	tenantRepo      repositories.Repository[models.Tenant]
+	regionRepo      repositories.Repository[models.Region]
+	outboxRepo      repositories.Repository[models.EmailOutbox]
+	suppressionRepo repositories.Repository[models.EmailSuppression]
+}
+
+func NewMailService() *MailService {
+	return &MailService{
+		tenantRepo:      repositories.Repository[models.Tenant]{DB: database.DB},
+		regionRepo:      repositories.Repository[models.Region]{DB: database.DB},
+		outboxRepo:      repositories.Repository[models.EmailOutbox]{DB: database.DB},
+		suppressionRepo: repositories.Repository[models.EmailSuppression]{DB: database.DB},
+	}
+}
+
+/* OUTBOX */
+
+// FindOutboxEmails lists queued emails, most recent first, optionally filtered by status.
+// A tenantId other than 0 lists only the emails of that tenant.
+func (s *MailService) FindOutboxEmails(tenantId uint, status string, limit int, offset int) ([]models.EmailOutbox, int64, error) {
+	filtered := func() *gorm.DB {
+		query := s.tenantEmails(tenantId)
+		if status != "" {
+			query = query.Where("status = ?", status)
+		}
+		return query
+	}
+
+	var count int64
+	if err := filtered().Count(&count).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to count emails: %v", err)
+	}
+
+	var emails []models.EmailOutbox
+	err := filtered().Order("created_at DESC").Limit(limit).Offset(offset).Find(&emails).Error
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to find emails: %v", err)
+	}
+	return emails, count, nil
+}
+
+// FindOutboxEmail returns a queued email with its send log; of tenant tenantId unless it is 0
+func (s *MailService) FindOutboxEmail(id uint, tenantId uint) (*models.EmailOutbox, error) {
+	var email models.EmailOutbox
+	err := s.tenantEmails(tenantId).
+		Preload("SendLogs", func(db *gorm.DB) *gorm.DB { return db.Order("created_at") }).
+		Where("id = ?", id).
+		First(&email).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to find email: %v", err)
+	}
+	return &email, nil
+}
+
+// ResendEmail queues an email for delivery again with a fresh set of attempts; one of tenant
+// tenantId unless it is 0
+func (s *MailService) ResendEmail(id uint, tenantId uint) (*models.EmailOutbox, error) {
+	var email models.EmailOutbox
+	if err := s.tenantEmails(tenantId).Where("id = ?", id).First(&email).Error; err != nil {
+		return nil, fmt.Errorf("failed to find email: %w", err)
+	}
+	if email.Status == global.EmailSending {
+		return nil, ErrEmailBeingSent
+	}
+
+	email.Status = global.EmailPending
+	email.Attempts = 0
+	email.NextAttemptAt = time.Now()
+	err := s.outboxRepo.CreateQueryBuilder().
+		Where("id = ? AND status <> ?", id, global.EmailSending).
+		Updates(map[string]any{
+			"status":          email.Status,
+			"attempts":        email.Attempts,
+			"next_attempt_at": email.NextAttemptAt,
+		}).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to requeue email: %v", err)
+	}
+
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+	return &email, nil
+}
+
+// tenantEmails queries the outbox of tenant tenantId, the whole outbox if it is 0
+func (s *MailService) tenantEmails(tenantId uint) *gorm.DB {
+	query := s.outboxRepo.CreateQueryBuilder()
+	if tenantId != 0 {
+		query = query.Where("tenant_id = ?", tenantId)
+	}
+	return query
+}
+
+/* BOUNCES */
+
+// HandleWebhook records the bounces and complaints of a provider webhook call.
+// Amazon SNS subscriptions are confirmed on the fly.
+func (s *MailService) HandleWebhook(provider string, body []byte) ([]BounceEvent, error) {
+	result, err := ParseWebhook(provider, body)
+	if err != nil {
+		return nil, err
+	}
+	if result.SubscribeURL != "" {
+		if err := confirmSNSSubscription(result.SubscribeURL); err != nil {
+			return nil, err
+		}
+	}
+	if err := RecordBounceEvents(result.Events); err != nil {
+		return nil, err
+	}
+	return result.Events, nil
+}
+
+// HandleDSN records the bounces of a bounce message received in a mailbox, see ParseDSN
+func (s *MailService) HandleDSN(message io.Reader) ([]BounceEvent, error) {
+	events, err := ParseDSN(message)
+	if err != nil {
+		return nil, err
+	}
+	if err := RecordBounceEvents(events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// confirmSNSSubscription visits the confirmation URL of an SNS subscription. Only AWS
+// URLs are visited, so the webhook cannot be used to make the server fetch arbitrary URLs.
+func confirmSNSSubscription(subscribeURL string) error {
+	parsed, err := url.Parse(subscribeURL)
+	if err != nil || parsed.Scheme != "https" || !strings.HasSuffix(parsed.Hostname(), ".amazonaws.com") {
+		return fmt.Errorf("failed to confirm SNS subscription: unexpected URL %q", subscribeURL)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	response, err := client.Get(parsed.String())
+	if err != nil {
+		return fmt.Errorf("failed to confirm SNS subscription: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to confirm SNS subscription: %s", response.Status)
+	}
+	return nil
+}
+
+// FindSuppressions lists the addresses bounces or complaints were received for, most recent first.
+// With suppressedOnly, only those nothing is sent to anymore.
+func (s *MailService) FindSuppressions(suppressedOnly bool, limit int, offset int) ([]models.EmailSuppression, int64, error) {
+	filtered := func() *gorm.DB {
+		query := s.suppressionRepo.CreateQueryBuilder()
+		if suppressedOnly {
+			query = query.Where("suppressed = true")
+		}
+		return query
+	}
+
+	var count int64
+	if err := filtered().Count(&count).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to count suppressions: %v", err)
+	}
+	var suppressions []models.EmailSuppression
+	err := filtered().Order("last_event_at DESC").Limit(limit).Offset(offset).Find(&suppressions).Error
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to find suppressions: %v", err)
+	}
+	return suppressions, count, nil
+}
+
+// LiftSuppression forgets the bounces of an address, e.g. once its owner fixed their mailbox,
+// so mail is sent to it again
+func (s *MailService) LiftSuppression(id uint) error {
+	suppression, err := s.suppressionRepo.FindByID(id)
+	if err != nil {
+		return fmt.Errorf("failed to find suppression: %v", err)
+	}
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Delete(suppression).Error; err != nil {
+			return fmt.Errorf("failed to delete suppression: %v", err)
+		}
+		return syncUserDeliverability(tx, suppression.Address, global.EmailDeliverable)
+	})
+}
+
+// PreviewTemplate renders a built-in template with its sample data.
+// If tenantId (or regionId) is not 0, that tenant's (or region's) branding and overrides are applied.
+func (s *MailService) PreviewTemplate(name string, locale string, tenantId uint, regionId uint) (*Message, error) {
+	info, ok := Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTemplate, name)
+	}
+
+	scope := Scope{Locale: locale, Strict: true}
+	switch {
+	case tenantId != 0:
+		tenant, err := s.findTenant(tenantId)
+		if err != nil {
+			return nil, err
+		}
+		scope = ScopeForTenant(tenant, &tenant.TenantConfigDetail.Region, locale)
+		scope.Strict = true
+	case regionId != 0:
+		region, err := s.regionRepo.FindByID(regionId)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find region: %v", err)
+		}
+		scope.Overrides = []*models.OtherUserOptions{region.OtherUserOptions}
+	}
+
+	return Render(name, info.SampleData, scope)
+}
+
+// ScopeForTenantId returns the rendering scope of a tenant, see ScopeForTenant
+func (s *MailService) ScopeForTenantId(tenantId uint, locale string) (Scope, error) {
+	tenant, err := s.findTenant(tenantId)
+	if err != nil {
+		return Scope{}, err
+	}
+	return ScopeForTenant(tenant, &tenant.TenantConfigDetail.Region, locale), nil
+}
+
+func (s *MailService) findTenant(tenantId uint) (*models.Tenant, error) {
+	var tenant models.Tenant
+	err := s.tenantRepo.CreateQueryBuilder().
+		Preload("TenantConfigDetail.Region").
+		Preload("CustomTheme").
+		Where("id = ?", tenantId).
+		First(&tenant).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to find tenant: %v", err)
+	}
+	return &tenant, nil
+}
+
+// ScopeForTenant brands emails with the tenant's name, logo and theme colour and
+// applies the tenant's template overrides, then the region's. region may be nil.
+func ScopeForTenant(tenant *models.Tenant, region *models.Region, locale string) Scope {
+	branding := BrandingForTenant(tenant, region)
+	scope := Scope{
+		Locale:    locale,
+		Branding:  &branding,
+		Overrides: []*models.OtherUserOptions{tenant.TenantConfigDetail.OtherUserOptions},
+	}
+	if region != nil {
+		scope.Overrides = append(scope.Overrides, region.OtherUserOptions)
+	}
+	return scope
+}
+
+// BrandingForTenant returns the branding of emails sent on behalf of a tenant.
+// The logo is embedded when it can be read from the tenant's storage, otherwise linked.
+func BrandingForTenant(tenant *models.Tenant, region *models.Region) Branding {
+	branding := DefaultBranding()
+	branding.Name = tenant.Name
+	if color := tenant.CustomTheme.TailwiindConfig.PrimaryColor; strings.HasPrefix(color, "#") {
+		branding.PrimaryColor = color
+	}
+	if tenant.Logo == "" {
+		return branding
+	}
+
+	if logo := readTenantLogo(tenant, region); logo != nil {
+		branding.Logo = logo
+		return branding
+	}
+
+	// Email clients need an absolute URL. The logo route requires a signed URL,
+	// so sign one that outlives the email
+	if config.AppConfig != nil && config.AppConfig.App.RootURL != "" {
+		logoURL, _ := storage.DefaultSigner().Sign(fmt.Sprintf("/tenants/%d/logo", tenant.ID),
+			url.Values{"size": {"medium"}}, storage.SignOptions{Expiration: logoURLExpiration})
+		branding.LogoURL = htmltemplate.URL(strings.TrimRight(config.AppConfig.App.RootURL, "/") + logoURL)
+	}
+	return branding
+}
+
+// readTenantLogo loads the medium PNG rendition of a tenant's logo for embedding
+func readTenantLogo(tenant *models.Tenant, region *models.Region) *global.Attachment {
+	store, err := storage.ForTenant(tenant, region)
+	if err != nil {
+		return nil
+	}
+	reader, info, err := store.Get(context.Background(), "logos/medium.png")
+	if err != nil {
+		return nil
+	}
+	defer reader.Close()
+
+	// Keep messages small: an oversized logo is linked instead
+	if info.Size > maxInlineLogoSize {
+		return nil
+	}
+	content, err := io.ReadAll(io.LimitReader(reader, maxInlineLogoSize))
+	if err != nil {
+		return nil
+	}
+	return &global.Attachment{
+		Filename:    "logo.png",
+		ContentType: "image/png",
+		Content:     content,
+		ContentID:   fmt.Sprintf("logo-%s@tms", tenant.UUID),
+	}
+}
+
+// LocaleFromRequest picks the best supported locale from the request's ?locale
+// query or its Accept-Language header
+func LocaleFromRequest(c *gin.Context) string {
+	return MatchLocale(c.Query("locale"), c.GetHeader("Accept-Language"))
+}
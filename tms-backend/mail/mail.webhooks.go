@@ -0,0 +1,257 @@
+package mail
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnknownProvider = errors.New("unknown email provider")
+	ErrInvalidWebhook  = errors.New("invalid webhook payload")
+)
+
+// WebhookResult is what a provider webhook call carried
+type WebhookResult struct {
+	Events []BounceEvent
+	// SubscribeURL is set when Amazon SNS asks to confirm the subscription of the webhook
+	SubscribeURL string
+}
+
+// ParseWebhook extracts the bounce events of a provider's webhook call.
+// Events the deliverability of an address does not depend on (opens, clicks, ...) are skipped.
+func ParseWebhook(provider string, body []byte) (*WebhookResult, error) {
+	var result *WebhookResult
+	var err error
+	switch provider {
+	case "ses":
+		result, err = parseSESWebhook(body)
+	case "sendgrid":
+		result, err = parseSendGridWebhook(body)
+	case "mailgun":
+		result, err = parseMailgunWebhook(body)
+	case "postmark":
+		result, err = parsePostmarkWebhook(body)
+	default:
+		return nil, ErrUnknownProvider
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w from %s: %v", ErrInvalidWebhook, provider, err)
+	}
+	for i := range result.Events {
+		result.Events[i].Source = provider
+	}
+	return result, nil
+}
+
+/* AMAZON SES (through SNS) */
+
+func parseSESWebhook(body []byte) (*WebhookResult, error) {
+	var notification struct {
+		Type         string
+		Message      string
+		SubscribeURL string
+	}
+	if err := json.Unmarshal(body, &notification); err != nil {
+		return nil, err
+	}
+	if notification.Type == "SubscriptionConfirmation" {
+		return &WebhookResult{SubscribeURL: notification.SubscribeURL}, nil
+	}
+
+	// Notifications name the kind notificationType, event publishing eventType
+	var message struct {
+		NotificationType string `json:"notificationType"`
+		EventType        string `json:"eventType"`
+		Bounce           struct {
+			BounceType        string `json:"bounceType"`
+			Timestamp         time.Time
+			BouncedRecipients []struct {
+				EmailAddress   string `json:"emailAddress"`
+				Status         string `json:"status"`
+				DiagnosticCode string `json:"diagnosticCode"`
+			} `json:"bouncedRecipients"`
+		} `json:"bounce"`
+		Complaint struct {
+			Timestamp            time.Time
+			ComplainedRecipients []struct {
+				EmailAddress string `json:"emailAddress"`
+			} `json:"complainedRecipients"`
+		} `json:"complaint"`
+		Delivery struct {
+			Timestamp  time.Time
+			Recipients []string `json:"recipients"`
+		} `json:"delivery"`
+	}
+	if err := json.Unmarshal([]byte(notification.Message), &message); err != nil {
+		return nil, err
+	}
+
+	result := &WebhookResult{}
+	kind := message.NotificationType
+	if kind == "" {
+		kind = message.EventType
+	}
+	switch kind {
+	case "Bounce":
+		// Only Permanent bounces are about the address; Transient and Undetermined may pass
+		bounceType := BounceSoft
+		if message.Bounce.BounceType == "Permanent" {
+			bounceType = BounceHard
+		}
+		for _, recipient := range message.Bounce.BouncedRecipients {
+			result.Events = append(result.Events, BounceEvent{
+				Address:    recipient.EmailAddress,
+				Type:       bounceType,
+				Status:     recipient.Status,
+				Diagnostic: recipient.DiagnosticCode,
+				OccurredAt: message.Bounce.Timestamp,
+			})
+		}
+	case "Complaint":
+		for _, recipient := range message.Complaint.ComplainedRecipients {
+			result.Events = append(result.Events, BounceEvent{
+				Address:    recipient.EmailAddress,
+				Type:       Complaint,
+				OccurredAt: message.Complaint.Timestamp,
+			})
+		}
+	case "Delivery":
+		for _, recipient := range message.Delivery.Recipients {
+			result.Events = append(result.Events, BounceEvent{
+				Address:    recipient,
+				Type:       Delivered,
+				OccurredAt: message.Delivery.Timestamp,
+			})
+		}
+	}
+	return result, nil
+}
+
+/* SENDGRID */
+
+func parseSendGridWebhook(body []byte) (*WebhookResult, error) {
+	var events []struct {
+		Email     string `json:"email"`
+		Event     string `json:"event"`
+		Type      string `json:"type"` // "bounce" or "blocked" for bounce events
+		Status    string `json:"status"`
+		Reason    string `json:"reason"`
+		Timestamp int64  `json:"timestamp"`
+	}
+	if err := json.Unmarshal(body, &events); err != nil {
+		return nil, err
+	}
+
+	result := &WebhookResult{}
+	for _, event := range events {
+		bounceEvent := BounceEvent{
+			Address:    event.Email,
+			Status:     event.Status,
+			Diagnostic: event.Reason,
+			OccurredAt: time.Unix(event.Timestamp, 0),
+		}
+		switch event.Event {
+		case "bounce":
+			// A block is the receiving server refusing us, not the address failing
+			bounceEvent.Type = BounceHard
+			if event.Type == "blocked" {
+				bounceEvent.Type = BounceSoft
+			}
+		case "spamreport":
+			bounceEvent.Type = Complaint
+		case "delivered":
+			bounceEvent.Type = Delivered
+		default:
+			continue
+		}
+		result.Events = append(result.Events, bounceEvent)
+	}
+	return result, nil
+}
+
+/* MAILGUN */
+
+func parseMailgunWebhook(body []byte) (*WebhookResult, error) {
+	var payload struct {
+		EventData struct {
+			Event          string  `json:"event"`
+			Severity       string  `json:"severity"`
+			Recipient      string  `json:"recipient"`
+			Timestamp      float64 `json:"timestamp"`
+			DeliveryStatus struct {
+				Code        int    `json:"code"`
+				Message     string `json:"message"`
+				Description string `json:"description"`
+			} `json:"delivery-status"`
+		} `json:"event-data"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	data := payload.EventData
+	bounceEvent := BounceEvent{
+		Address:    data.Recipient,
+		OccurredAt: time.Unix(int64(data.Timestamp), 0),
+	}
+	switch data.Event {
+	case "failed":
+		bounceEvent.Type = BounceSoft
+		if data.Severity == "permanent" {
+			bounceEvent.Type = BounceHard
+		}
+		if data.DeliveryStatus.Code != 0 {
+			bounceEvent.Status = strconv.Itoa(data.DeliveryStatus.Code)
+		}
+		bounceEvent.Diagnostic = strings.TrimSpace(data.DeliveryStatus.Message + " " + data.DeliveryStatus.Description)
+	case "complained":
+		bounceEvent.Type = Complaint
+	case "delivered":
+		bounceEvent.Type = Delivered
+	default:
+		return &WebhookResult{}, nil
+	}
+	return &WebhookResult{Events: []BounceEvent{bounceEvent}}, nil
+}
+
+/* POSTMARK */
+
+func parsePostmarkWebhook(body []byte) (*WebhookResult, error) {
+	var payload struct {
+		RecordType  string
+		Type        string
+		Email       string
+		Recipient   string
+		Description string
+		Details     string
+		BouncedAt   time.Time
+		DeliveredAt time.Time
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	bounceEvent := BounceEvent{Address: payload.Email, OccurredAt: payload.BouncedAt}
+	switch payload.RecordType {
+	case "Bounce":
+		bounceEvent.Type = BounceSoft
+		if payload.Type == "HardBounce" || payload.Type == "BadEmailAddress" {
+			bounceEvent.Type = BounceHard
+		}
+		bounceEvent.Status = payload.Type
+		bounceEvent.Diagnostic = strings.TrimSpace(payload.Description + " " + payload.Details)
+	case "SpamComplaint":
+		bounceEvent.Type = Complaint
+	case "Delivery":
+		bounceEvent.Type = Delivered
+		bounceEvent.Address = payload.Recipient
+		bounceEvent.OccurredAt = payload.DeliveredAt
+	default:
+		return &WebhookResult{}, nil
+	}
+	return &WebhookResult{Events: []BounceEvent{bounceEvent}}, nil
+}
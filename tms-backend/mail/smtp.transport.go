@@ -0,0 +1,393 @@
+package mail
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/utils"
+)
+
+const (
+	smtpDialTimeout    = 30 * time.Second
+	smtpSendTimeout    = 2 * time.Minute
+	smtpIdleTimeout    = time.Minute
+	defaultMaxConns    = 5
+	defaultMaxMessages = 100
+)
+
+// SMTPSettings is a resolved SMTP server configuration
+type SMTPSettings struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// ImplicitTLS connects over TLS from the start (SMTPS, usually port 465).
+	// Otherwise STARTTLS is used when the server offers it, and required if RequireTLS is set
+	ImplicitTLS bool
+	RequireTLS  bool
+
+	// XOAUTH2 instead of a password
+	OAuth        bool
+	ClientID     string
+	ClientSecret string
+	AccessToken  string
+	RefreshToken string
+	TokenURL     string
+
+	// Pool keeps connections open for MaxMessages messages. MaxConnections bounds
+	// concurrent connections to the server whether pooling or not
+	Pool           bool
+	MaxConnections int
+	MaxMessages    int
+}
+
+// wellKnownServices mirrors the service shortcuts of SMTPAuth.SMTPService
+var wellKnownServices = map[string]struct {
+	host        string
+	port        int
+	implicitTLS bool
+}{
+	"gmail":     {"smtp.gmail.com", 465, true},
+	"outlook":   {"smtp.office365.com", 587, false},
+	"office365": {"smtp.office365.com", 587, false},
+	"yahoo":     {"smtp.mail.yahoo.com", 465, true},
+	"sendgrid":  {"smtp.sendgrid.net", 587, false},
+	"mailgun":   {"smtp.mailgun.org", 587, false},
+	"ses":       {"email-smtp.us-east-1.amazonaws.com", 465, true},
+}
+
+// SettingsFromSMTPAuth resolves tenant or region SMTPAuth settings. Returns nil if none are configured.
+func SettingsFromSMTPAuth(auth *models.SMTPAuth) (*SMTPSettings, error) {
+	if auth == nil || (auth.SMTPHost == "" && auth.SMTPService == "") {
+		return nil, nil
+	}
+
+	settings := &SMTPSettings{
+		Host:           auth.SMTPHost,
+		Port:           auth.SMTPPort,
+		Username:       auth.SMTPUser,
+		OAuth:          auth.SMTPOauth,
+		Pool:           auth.SMTPPool,
+		MaxConnections: auth.SMTPMaxConnections,
+		MaxMessages:    auth.SMTPMaxMessages,
+	}
+	if service, ok := wellKnownServices[strings.ToLower(auth.SMTPService)]; ok && settings.Host == "" {
+		settings.Host = service.host
+		if settings.Port == 0 {
+			settings.Port = service.port
+		}
+		settings.ImplicitTLS = service.implicitTLS
+	}
+	applySecure(settings, auth.SMTPSecure)
+
+	if auth.SMTPPwd != nil && auth.SMTPPwd.IV != nil && auth.SMTPPwd.Content != nil {
+		password, err := utils.Decrypt(&struct {
+			IV      string `json:"iv"`
+			Content string `json:"content"`
+		}{
+			IV:      *auth.SMTPPwd.IV,
+			Content: *auth.SMTPPwd.Content,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt SMTP password: %v", err)
+		}
+		settings.Password = password
+	}
+
+	settings.ClientID = valueOrEmpty(auth.SMTPClientID)
+	settings.ClientSecret = valueOrEmpty(auth.SMTPClientSecret)
+	settings.AccessToken = valueOrEmpty(auth.SMTPAccessToken)
+	settings.RefreshToken = valueOrEmpty(auth.SMTPRefreshToken)
+	settings.TokenURL = valueOrEmpty(auth.SMTPAccessUrl)
+
+	return normalizeSettings(settings), nil
+}
+
+// DefaultSMTPSettings are the process wide settings from the SMTP_* environment variables
+func DefaultSMTPSettings() *SMTPSettings {
+	port, _ := strconv.Atoi(global.SMTP_PORT)
+	settings := &SMTPSettings{
+		Host:         global.SMTP_HOST,
+		Port:         port,
+		Username:     global.SMTP_USERNAME,
+		Password:     global.SMTP_PASSWORD,
+		OAuth:        global.SMTP_PASSWORD == "" && global.SMTP_REFRESH_TOKEN != "",
+		ClientID:     global.SMTP_CLIENT_ID,
+		ClientSecret: global.SMTP_CLIENT_SECRET,
+		RefreshToken: global.SMTP_REFRESH_TOKEN,
+		TokenURL:     global.SMTP_ACCESS_URL,
+		Pool:         true,
+	}
+	applySecure(settings, global.SMTP_SECURE)
+	return normalizeSettings(settings)
+}
+
+// applySecure interprets SMTPSecure: "true"/"tls"/"ssl" for implicit TLS, "starttls" to
+// require STARTTLS, "none" for plain connections; anything else uses STARTTLS when offered
+func applySecure(settings *SMTPSettings, secure string) {
+	switch strings.ToLower(strings.TrimSpace(secure)) {
+	case "true", "tls", "ssl", "implicit":
+		settings.ImplicitTLS = true
+	case "starttls":
+		settings.ImplicitTLS = false
+		settings.RequireTLS = true
+	case "none":
+		settings.ImplicitTLS = false
+		settings.RequireTLS = false
+	}
+}
+
+func normalizeSettings(settings *SMTPSettings) *SMTPSettings {
+	if settings.Port == 0 {
+		settings.Port = 587
+		if settings.ImplicitTLS {
+			settings.Port = 465
+		}
+	}
+	if settings.MaxConnections <= 0 {
+		settings.MaxConnections = defaultMaxConns
+	}
+	if settings.MaxMessages <= 0 {
+		settings.MaxMessages = defaultMaxMessages
+	}
+	// Never send credentials in the clear to a remote server
+	if settings.Username != "" && !settings.ImplicitTLS && settings.Host != "localhost" && settings.Host != "127.0.0.1" {
+		settings.RequireTLS = true
+	}
+	return settings
+}
+
+func valueOrEmpty(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+// poolKey identifies a server and account; a changed password or token yields a new pool
+func (s *SMTPSettings) poolKey() string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%s|%s|%t|%t|%t|%d|%d",
+		s.Password, s.ClientID, s.RefreshToken, s.AccessToken, s.ImplicitTLS, s.RequireTLS, s.Pool, s.MaxConnections, s.MaxMessages)))
+	return fmt.Sprintf("%s:%d|%s|%s", s.Host, s.Port, s.Username, hex.EncodeToString(hash[:8]))
+}
+
+var pools sync.Map
+
+// SendSMTP delivers a message through the server described by settings,
+// reusing pooled connections when settings.Pool is set
+func SendSMTP(ctx context.Context, settings *SMTPSettings, from string, recipients []string, message []byte) error {
+	if settings.Host == "" {
+		return fmt.Errorf("SMTP is not configured")
+	}
+	pool, _ := pools.LoadOrStore(settings.poolKey(), &smtpPool{
+		settings: settings,
+		slots:    make(chan struct{}, settings.MaxConnections),
+	})
+	return pool.(*smtpPool).send(ctx, from, recipients, message)
+}
+
+// smtpPool bounds the connections to one server and keeps idle ones for reuse
+type smtpPool struct {
+	settings *SMTPSettings
+	slots    chan struct{}
+
+	mu   sync.Mutex
+	idle []*smtpConn
+}
+
+type smtpConn struct {
+	conn     net.Conn
+	client   *smtp.Client
+	messages int
+	lastUsed time.Time
+}
+
+func (p *smtpPool) send(ctx context.Context, from string, recipients []string, message []byte) error {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.slots }()
+
+	conn, reused := p.takeIdle(), true
+	if conn == nil {
+		var err error
+		if conn, err = p.dial(ctx); err != nil {
+			return err
+		}
+		reused = false
+	}
+
+	err := conn.send(from, recipients, message)
+	if err != nil && reused && isConnectionError(err) {
+		// The server closed the pooled connection in the meantime: retry once on a fresh one
+		conn.close()
+		if conn, err = p.dial(ctx); err != nil {
+			return err
+		}
+		err = conn.send(from, recipients, message)
+	}
+	if err != nil {
+		conn.close()
+		return err
+	}
+
+	conn.messages++
+	conn.lastUsed = time.Now()
+	if p.settings.Pool && conn.messages < p.settings.MaxMessages {
+		p.putIdle(conn)
+	} else {
+		conn.quit()
+	}
+	return nil
+}
+
+func (p *smtpPool) takeIdle() *smtpConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.idle) > 0 {
+		conn := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if time.Since(conn.lastUsed) < smtpIdleTimeout {
+			return conn
+		}
+		conn.quit()
+	}
+	return nil
+}
+
+func (p *smtpPool) putIdle(conn *smtpConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.idle = append(p.idle, conn)
+}
+
+func (p *smtpPool) dial(ctx context.Context) (*smtpConn, error) {
+	settings := p.settings
+	addr := net.JoinHostPort(settings.Host, strconv.Itoa(settings.Port))
+	tlsConfig := &tls.Config{ServerName: settings.Host, MinVersion: tls.VersionTLS12}
+	dialer := &net.Dialer{Timeout: smtpDialTimeout}
+
+	var conn net.Conn
+	var err error
+	if settings.ImplicitTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SMTP server: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(smtpSendTimeout))
+
+	client, err := smtp.NewClient(conn, settings.Host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to SMTP server: %v", err)
+	}
+	c := &smtpConn{conn: conn, client: client}
+
+	if !settings.ImplicitTLS {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				c.close()
+				return nil, fmt.Errorf("failed to start TLS: %v", err)
+			}
+		} else if settings.RequireTLS {
+			c.close()
+			return nil, fmt.Errorf("SMTP server %s does not support STARTTLS", settings.Host)
+		}
+	}
+
+	if settings.Username != "" {
+		var auth smtp.Auth
+		if settings.OAuth {
+			token, err := oauth2Token(settings)
+			if err != nil {
+				c.close()
+				return nil, err
+			}
+			auth = &xoauth2Auth{username: settings.Username, token: token}
+		} else {
+			auth = smtp.PlainAuth("", settings.Username, settings.Password, settings.Host)
+		}
+		if err := client.Auth(auth); err != nil {
+			c.close()
+			if settings.OAuth {
+				forgetOAuth2Token(settings)
+			}
+			return nil, fmt.Errorf("authentication failed: %v", err)
+		}
+	}
+
+	return c, nil
+}
+
+func (c *smtpConn) send(from string, recipients []string, message []byte) error {
+	c.conn.SetDeadline(time.Now().Add(smtpSendTimeout))
+
+	if c.messages > 0 {
+		// Clear any state left by the previous message
+		if err := c.client.Reset(); err != nil {
+			return err
+		}
+	}
+	if err := c.client.Mail(from); err != nil {
+		return fmt.Errorf("failed to set sender: %v", err)
+	}
+	for _, recipient := range recipients {
+		if recipient = strings.TrimSpace(recipient); recipient == "" {
+			continue
+		}
+		if err := c.client.Rcpt(recipient); err != nil {
+			return fmt.Errorf("failed to add recipient %s: %v", recipient, err)
+		}
+	}
+
+	wc, err := c.client.Data()
+	if err != nil {
+		return fmt.Errorf("failed to start data session: %v", err)
+	}
+	if _, err := wc.Write(message); err != nil {
+		return fmt.Errorf("failed to write email data: %v", err)
+	}
+	if err := wc.Close(); err != nil {
+		return fmt.Errorf("failed to close data writer: %v", err)
+	}
+	return nil
+}
+
+func (c *smtpConn) quit() {
+	c.conn.SetDeadline(time.Now().Add(smtpDialTimeout))
+	if err := c.client.Quit(); err != nil {
+		c.client.Close()
+	}
+}
+
+func (c *smtpConn) close() {
+	c.client.Close()
+}
+
+// isConnectionError tells network failures (worth retrying on a new connection)
+// from SMTP replies such as a rejected recipient
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	message := err.Error()
+	return strings.Contains(message, "EOF") || strings.Contains(message, "broken pipe") || strings.Contains(message, "connection reset")
+}
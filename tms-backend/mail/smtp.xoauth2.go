@@ -0,0 +1,76 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"net/smtp"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// xoauth2Auth implements the XOAUTH2 SASL mechanism used by Gmail and Office 365
+type xoauth2Auth struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, fmt.Errorf("refusing to send an OAuth2 token over an unencrypted connection")
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// The server sent a JSON error description; an empty response makes it fail the command with it
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// tokenSources caches one refreshing token source per OAuth2 client and refresh token,
+// so access tokens are reused until they expire
+var tokenSources sync.Map
+
+func oauth2Token(settings *SMTPSettings) (string, error) {
+	cacheKey := oauth2CacheKey(settings)
+	source, ok := tokenSources.Load(cacheKey)
+	if !ok {
+		var tokenSource oauth2.TokenSource
+		if settings.RefreshToken == "" {
+			tokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: settings.AccessToken})
+		} else {
+			endpoint := google.Endpoint
+			if settings.TokenURL != "" {
+				endpoint = oauth2.Endpoint{TokenURL: settings.TokenURL}
+			}
+			cfg := &oauth2.Config{
+				ClientID:     settings.ClientID,
+				ClientSecret: settings.ClientSecret,
+				Endpoint:     endpoint,
+			}
+			// The stored access token has no known expiry, so start from the refresh token.
+			// The token source outlives this request, so it must not use its context
+			tokenSource = cfg.TokenSource(context.Background(), &oauth2.Token{RefreshToken: settings.RefreshToken})
+		}
+		source, _ = tokenSources.LoadOrStore(cacheKey, tokenSource)
+	}
+
+	token, err := source.(oauth2.TokenSource).Token()
+	if err != nil {
+		return "", fmt.Errorf("failed to refresh SMTP OAuth2 token: %v", err)
+	}
+	return token.AccessToken, nil
+}
+
+// forgetOAuth2Token drops a cached token the server rejected, so the next attempt fetches a new one
+func forgetOAuth2Token(settings *SMTPSettings) {
+	tokenSources.Delete(oauth2CacheKey(settings))
+}
+
+func oauth2CacheKey(settings *SMTPSettings) string {
+	return settings.ClientID + "|" + settings.RefreshToken + "|" + settings.AccessToken
+}
@@ -1,10 +1,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log"
 
 	"github.com/auditrakkr/tms-fullstack/tms-backend/config"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/database"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/keys"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/mail"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/regions"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/roles"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/tenant-config-details"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/tenants"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/trash"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/users"
 	"github.com/gin-gonic/gin"
 )
 
@@ -19,7 +30,21 @@ func main() {
 	// Start the server
 	// app.Start()
 	config.LoadConfig()
+	if err := keys.CheckConfiguredKeys(); err != nil {
+		log.Fatalf("Invalid token signing keys: %v", err)
+	}
 	database.ConnectDB()
+
+	// Deliver queued emails in the background
+	mail.StartOutboxWorkers(context.Background(), global.MAIL_OUTBOX_WORKERS)
+	// Empty the trash of records deleted long ago; those referencing others go first
+	trash.StartRetentionJob(context.Background(), config.AppConfig.Trash.Retention,
+		tenantconfigdetails.NewTenantConfigDetailsService(),
+		tenants.NewTenantService(),
+		users.NewUserService(),
+		roles.NewRoleService(),
+		regions.NewRegionService(),
+	)
 	// Initialize the server
 	// server := config.NewServer()
 	// Start the server
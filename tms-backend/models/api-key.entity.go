@@ -0,0 +1,83 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"gorm.io/gorm"
+)
+
+type ApiKeyScopes []global.ApiKeyScope
+
+// ApiKey gives a machine (ERP sync, monitoring, ...) access to the API on behalf of a tenant.
+// The key is Prefix + "_" + a secret; the prefix identifies it, only the hash of the secret
+// is kept (see utils.HashToken). The key itself is shown once, when it is created or rotated.
+type ApiKey struct {
+	gorm.Model
+	TenantID uint `gorm:"index;not null"`
+	Tenant Tenant `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Name string `gorm:"type:varchar(255);not null"`
+	Prefix string `gorm:"type:varchar(32);uniqueIndex;not null"`
+	SecretHash string `gorm:"type:varchar(255);not null" json:"-"`
+	// The secret before the last rotation, valid until PreviousSecretExpiresAt
+	PreviousSecretHash string `gorm:"type:varchar(255)" json:"-"`
+	PreviousSecretExpiresAt *time.Time `json:"-"`
+	Scopes ApiKeyScopes `gorm:"type:jsonb;not null"`
+	ExpiresAt *time.Time // never, if nil
+	LastUsedAt *time.Time
+	LastUsedIP string `gorm:"type:varchar(64)"`
+	RotatedAt *time.Time
+	CreatedByID *uint // user who created the key
+}
+
+// HasScopes tells whether the key was given every one of scopes
+func (k *ApiKey) HasScopes(scopes ...global.ApiKeyScope) bool {
+	for _, scope := range scopes {
+		found := false
+		for _, s := range k.Scopes {
+			if s == scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Implement `sql.Scanner` for ApiKeyScopes
+func (a *ApiKeyScopes) Scan(value interface{}) error {
+	if value == nil {
+		*a = nil
+		return nil
+	}
+
+	bytes, ok := value.([]byte)
+	if !ok {
+		return fmt.Errorf("failed to convert value to []byte")
+	}
+
+	if err := json.Unmarshal(bytes, a); err != nil {
+		return fmt.Errorf("failed to unmarshal ApiKeyScopes: %w", err)
+	}
+
+	return nil
+}
+
+// Implement `driver.Valuer` for ApiKeyScopes
+func (a ApiKeyScopes) Value() (driver.Value, error) {
+	if a == nil {
+		a = ApiKeyScopes{}
+	}
+	bytes, err := json.Marshal(a)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal ApiKeyScopes: %w", err)
+	}
+
+	return bytes, nil
+}
@@ -5,7 +5,7 @@ import "gorm.io/gorm"
 
 type Billing struct {
 	gorm.Model
-	Code string `gorm:"type:varchar(255);not null;unique"`
+	Code string `gorm:"type:varchar(255);not null;uniqueIndex:uix_billings_code,where:deleted_at IS NULL"`
 	Description string `gorm:"type:text"`
 	Type string `gorm:"type:varchar(255);not null"` //could be a categorization of the billing
 	TenantID uint
@@ -0,0 +1,127 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"gorm.io/gorm"
+)
+
+type EmailAddresses []string
+
+type EmailAttachments []global.Attachment
+
+// EmailOutbox is an outbound email. Emails are stored before they are sent so that
+// none is lost to a restart or an SMTP outage; the mail workers deliver them.
+type EmailOutbox struct {
+	gorm.Model
+	TenantID *uint `gorm:"index"`
+	Template string `gorm:"type:varchar(255)"` // name of the mail template it was rendered from, if any
+
+	From string `gorm:"type:varchar(255);not null"`
+	To EmailAddresses `gorm:"type:jsonb;not null"`
+	Cc EmailAddresses `gorm:"type:jsonb"`
+	Bcc EmailAddresses `gorm:"type:jsonb"`
+	ReplyTo string `gorm:"type:varchar(255)"`
+	Subject string `gorm:"type:text"`
+	// The bodies hold the links (and their tokens) of password reset, verification and sign-in emails:
+	// they are never sent back over the API
+	Text string `gorm:"type:text" json:"-"`
+	Html string `gorm:"type:text" json:"-"`
+	Attachments EmailAttachments `gorm:"type:jsonb" json:"-"`
+
+	Status global.EmailStatus `gorm:"type:email_status;default:'pending';index:idx_email_outbox_due,priority:1" json:"status"`
+	Attempts int `gorm:"default:0"`
+	MaxAttempts int `gorm:"default:8"`
+	NextAttemptAt time.Time `gorm:"index:idx_email_outbox_due,priority:2"`
+	LockedUntil *time.Time
+	LastError string `gorm:"type:text"`
+	SentAt *time.Time
+
+	SendLogs []EmailSendLog
+}
+
+// EmailSendLog records the outcome of one delivery attempt for one recipient
+type EmailSendLog struct {
+	gorm.Model
+	EmailOutboxID uint `gorm:"index"`
+	Recipient string `gorm:"type:varchar(255);index"`
+	Attempt int
+	Success bool
+	Error string `gorm:"type:text"`
+	DurationMs int64
+}
+
+// Recipients returns every To, Cc and Bcc address
+func (e *EmailOutbox) Recipients() []string {
+	recipients := append([]string{}, e.To...)
+	recipients = append(recipients, e.Cc...)
+	return append(recipients, e.Bcc...)
+}
+
+// Implement `sql.Scanner` for EmailAddresses
+func (a *EmailAddresses) Scan(value interface{}) error {
+	if value == nil {
+		*a = nil
+		return nil
+	}
+
+	bytes, ok := value.([]byte)
+	if !ok {
+		return fmt.Errorf("failed to convert value to []byte")
+	}
+
+	if err := json.Unmarshal(bytes, a); err != nil {
+		return fmt.Errorf("failed to unmarshal EmailAddresses: %w", err)
+	}
+
+	return nil
+}
+
+// Implement `driver.Valuer` for EmailAddresses
+func (a EmailAddresses) Value() (driver.Value, error) {
+	if a == nil {
+		a = EmailAddresses{}
+	}
+	bytes, err := json.Marshal(a)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal EmailAddresses: %w", err)
+	}
+
+	return bytes, nil
+}
+
+// Implement `sql.Scanner` for EmailAttachments
+func (a *EmailAttachments) Scan(value interface{}) error {
+	if value == nil {
+		*a = nil
+		return nil
+	}
+
+	bytes, ok := value.([]byte)
+	if !ok {
+		return fmt.Errorf("failed to convert value to []byte")
+	}
+
+	if err := json.Unmarshal(bytes, a); err != nil {
+		return fmt.Errorf("failed to unmarshal EmailAttachments: %w", err)
+	}
+
+	return nil
+}
+
+// Implement `driver.Valuer` for EmailAttachments
+func (a EmailAttachments) Value() (driver.Value, error) {
+	if a == nil {
+		a = EmailAttachments{}
+	}
+	bytes, err := json.Marshal(a)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal EmailAttachments: %w", err)
+	}
+
+	return bytes, nil
+}
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"gorm.io/gorm"
+)
+
+// EmailSuppression is the deliverability of one email address, learnt from the bounces and
+// complaints reported by the email provider's webhooks and by DSN bounce messages.
+// Nothing is sent to a suppressed address.
+type EmailSuppression struct {
+	gorm.Model
+	Address string `gorm:"type:varchar(255);uniqueIndex;not null"` // lower case bare address
+	Status global.EmailDeliverability `gorm:"type:email_deliverability;default:'deliverable'"`
+	Suppressed bool `gorm:"default:false;index"`
+	SoftBounces int `gorm:"default:0"` // consecutive, reset by a delivery
+
+	LastSource string `gorm:"type:varchar(50)"` // provider of the last event, or "dsn"
+	LastStatus string `gorm:"type:varchar(20)"` // enhanced status code of the last bounce, e.g. 5.1.1
+	LastDiagnostic string `gorm:"type:text"`
+	LastEventAt time.Time
+}
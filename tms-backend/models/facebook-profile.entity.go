@@ -54,7 +54,7 @@ func (n Name) ToDriverValue() (driver.Value, error) {
 type FacebookProfile struct {
 	gorm.Model
 	UserID uint `gorm:"constraint:OnDelete:CASCADE"`
-	FacebookID string `gorm:"type:varchar(255);unique;index;not null"`
+	FacebookID string `gorm:"type:varchar(255);uniqueIndex:uix_facebook_profiles_facebook_id,where:deleted_at IS NULL;index;not null"`
 	DisplayName string `gorm:"type:varchar(255)"`
 	Photos string `gorm:"type:varchar(255)"`
 	Emails Emails `gorm:"type:jsonb"`
@@ -34,13 +34,13 @@ func (b BirthDate) Value() (driver.Value, error) {
 type GoogleProfile struct {
 	gorm.Model
 	UserID uint `gorm:"constraint:OnDelete:CASCADE"`
-	GoogleID string `gorm:"type:varchar(255);unique;index;not null"`
+	GoogleID string `gorm:"type:varchar(255);uniqueIndex:uix_google_profiles_google_id,where:deleted_at IS NULL;index;not null"`
 	GivenName string `gorm:"type:varchar(255)"`
 	FamilyName string `gorm:"type:varchar(255)"`
 	Name string `gorm:"type:varchar(255)"`
 	Gender string `gorm:"type:varchar(255)"`
 	BirthDate BirthDate `gorm:"type:jsonb"`
-	Email string `gorm:"type:varchar(255);unique;index;not null"`
+	Email string `gorm:"type:varchar(255);uniqueIndex:uix_google_profiles_email,where:deleted_at IS NULL;index;not null"`
 	EmailVerified bool `gorm:"index;default:false"`
 	Picture string `gorm:"type:varchar(255)"`
 	Profile string `gorm:"type:varchar(255)"`
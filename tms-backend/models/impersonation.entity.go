@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Impersonation is a landlord user (support staff) acting as a tenant user, to see what
+// the user sees. It is kept, with every request made under it, as an audit trail:
+// there are no constraints that would delete it along with the users or the tenant.
+type Impersonation struct {
+	gorm.Model
+	ImpersonatorID uint `gorm:"index;not null"`
+	ImpersonatorEmail string `gorm:"type:varchar(255)"` // denormalized for the audit trail
+	SessionID uint `gorm:"index"` // session of the impersonator it was started from
+	UserID uint `gorm:"index;not null"` // impersonated user
+	UserEmail string `gorm:"type:varchar(255)"`
+	TenantID uint `gorm:"index;not null"`
+	Reason string `gorm:"type:text"`
+	IPAddress string `gorm:"type:varchar(64)"`
+	ExpiresAt time.Time
+	EndedAt *time.Time
+
+	Requests []ImpersonationRequest `json:"requests,omitempty"`
+}
+
+// ImpersonationRequest is a request made under an impersonation
+type ImpersonationRequest struct {
+	gorm.Model
+	ImpersonationID uint `gorm:"index;not null"`
+	Method string `gorm:"type:varchar(10)"`
+	Path string `gorm:"type:text"`
+	Route string `gorm:"type:varchar(255)"` // matched route pattern, empty if none
+	Status int
+	IPAddress string `gorm:"type:varchar(64)"`
+	DurationMs int64
+}
@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MagicLink is a single-use link to sign in without a password, sent by email. Only the
+// hash of its token is kept (see utils.HashToken); the token names the link's ID.
+type MagicLink struct {
+	gorm.Model
+	UserID uint `gorm:"index;not null"`
+	User User `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	TenantID uint `gorm:"index;not null"` // tenant the link signs in to
+	TokenHash string `gorm:"type:varchar(255);not null" json:"-"`
+	ExpiresAt time.Time
+	UsedAt *time.Time
+	IPAddress string `gorm:"type:varchar(64)"` // that requested the link
+}
@@ -0,0 +1,13 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// PasswordHistory keeps the hashes of a user's previous passwords so they are not reused
+type PasswordHistory struct {
+	gorm.Model
+	UserID uint `gorm:"index;not null"`
+	User User `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	PasswordHash string `gorm:"type:varchar(255);not null" json:"-"`
+}
@@ -6,7 +6,8 @@ import (
 
 type Region struct {
     gorm.Model
-    Name string `gorm:"type:varchar(255);not null;index;unique"`
+    Versioning
+    Name string `gorm:"type:varchar(255);not null;index;uniqueIndex:uix_regions_name,where:deleted_at IS NULL"`
     RootDomainName string `gorm:"type:varchar(255);not null"`
     Description *string `gorm:"type:text"`
     Country *string `gorm:"type:varchar(255)"`
@@ -5,7 +5,8 @@ import "gorm.io/gorm"
 
 type Role struct {
 	gorm.Model
-	Name string `gorm:"type:varchar(255);not null;unique"`
+	Versioning
+	Name string `gorm:"type:varchar(255);not null;uniqueIndex:uix_roles_name,where:deleted_at IS NULL"`
 	Description string `gorm:"type:text"`
 	Users []User `gorm:"many2many:user_roles;"`
 	Landlord bool `gorm:"default:true"`
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Session is one signed-in device of a user. Its refresh token is rotated on every
+// refresh; only the hash of the current one is kept (see utils.HashToken).
+type Session struct {
+	gorm.Model
+	UserID uint `gorm:"index;not null"`
+	User User `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	TenantID *uint `gorm:"index"` // tenant the user signed in to, if any
+	Device string `gorm:"type:varchar(255)"` // named by the client, or guessed from the user agent
+	IPAddress string `gorm:"type:varchar(64)"`
+	UserAgent string `gorm:"type:text"`
+	LastSeenAt time.Time
+	ExpiresAt time.Time `gorm:"index"`
+	RefreshTokenHash string `gorm:"type:varchar(255);index" json:"-"`
+	RevokedAt *time.Time `gorm:"index"`
+	RevokedReason string `gorm:"type:varchar(255)"` // sign-out, admin, refresh token reuse, ...
+
+	Current bool `gorm:"-" json:"current"` // set in listings for the session of the request
+}
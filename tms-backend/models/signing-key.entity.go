@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SigningKey is a key tokens are signed with. Keys are rotated: a retired key no longer
+// signs but still verifies (and is published in the JWKS) until it expires.
+type SigningKey struct {
+	gorm.Model
+	Kid string `gorm:"type:varchar(100);uniqueIndex:idx_signing_keys_purpose_kid,priority:2;not null"` // RFC 7638 thumbprint of the public key
+	Purpose string `gorm:"type:varchar(20);index;uniqueIndex:idx_signing_keys_purpose_kid,priority:1;not null"` // "access" or "refresh" tokens
+	Algorithm string `gorm:"type:varchar(20);not null"` // RS256, ES256 or EdDSA
+	PublicKey string `gorm:"type:text;not null"` // PKIX PEM
+	// PKCS #8 PEM, encrypted with utils.Encrypt
+	PrivateKey string `gorm:"type:text;not null" json:"-"`
+	PrivateKeyIV string `gorm:"type:varchar(64);not null" json:"-"`
+	RetiresAt *time.Time // stops signing
+	ExpiresAt *time.Time `gorm:"index"` // stops verifying
+}
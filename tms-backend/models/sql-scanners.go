@@ -324,6 +324,35 @@ func (o OtherUserOptions) Value() (driver.Value, error) {
 	return bytes, nil
 }
 
+// Implement `sql.Scanner` for SSOSettings
+func (s *SSOSettings) Scan(value interface{}) error {
+	if value == nil {
+		*s = SSOSettings{}
+		return nil
+	}
+
+	bytes, ok := value.([]byte)
+	if !ok {
+		return fmt.Errorf("failed to convert value to []byte")
+	}
+
+	if err := json.Unmarshal(bytes, s); err != nil {
+		return fmt.Errorf("failed to unmarshal SSOSettings: %w", err)
+	}
+
+	return nil
+}
+
+// Implement `driver.Valuer` for SSOSettings
+func (s SSOSettings) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal SSOSettings: %w", err)
+	}
+
+	return bytes, nil
+}
+
 // Implement `sql.Scanner` for SizeLimits
 func (s *SizeLimits) Scan(value interface{}) error {
 	if value == nil {
@@ -407,4 +436,32 @@ func (l Logo) Value() (driver.Value, error) {
 	}
 
 	return bytes, nil
-}
\ No newline at end of file
+}
+// Implement `sql.Scanner` for TailwindProperties
+func (t *TailwindProperties) Scan(value interface{}) error {
+	if value == nil {
+		*t = TailwindProperties{}
+		return nil
+	}
+
+	bytes, ok := value.([]byte)
+	if !ok {
+		return fmt.Errorf("failed to convert value to []byte")
+	}
+
+	if err := json.Unmarshal(bytes, t); err != nil {
+		return fmt.Errorf("failed to unmarshal TailwindProperties: %w", err)
+	}
+
+	return nil
+}
+
+// Implement `driver.Valuer` for TailwindProperties
+func (t TailwindProperties) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal TailwindProperties: %w", err)
+	}
+
+	return bytes, nil
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SSOLogin is a sign-in with a tenant's identity provider, from the redirect to the IdP until
+// the client app exchanges the code of the completed sign-in for tokens. Its state and code are
+// tokens naming its ID; only their hashes are kept (see utils.HashToken).
+type SSOLogin struct {
+	gorm.Model
+	TenantID uint `gorm:"index;not null"`
+	Tenant Tenant `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	StateHash string `gorm:"type:varchar(255);not null" json:"-"`
+	Nonce string `gorm:"type:varchar(255)" json:"-"` // OIDC, for the ID token
+	CodeVerifier string `gorm:"type:varchar(255)" json:"-"` // OIDC, PKCE
+	RequestID string `gorm:"type:varchar(255)" json:"-"` // SAML, of the AuthnRequest
+	Device string `gorm:"type:varchar(255)"`
+	ExpiresAt time.Time // of the sign-in, then of its code
+	// Set once the IdP signed the user in
+	UserID *uint
+	CodeHash string `gorm:"type:varchar(255)" json:"-"`
+	UsedAt *time.Time
+	IPAddress string `gorm:"type:varchar(64)"` // that started the sign-in
+}
@@ -10,8 +10,8 @@ import (
  */
 type TenantAccountOfficer struct {
 	gorm.Model
-	TenantID uint `gorm:"uniqueIndex:idx_tenant_user"`
-	UserID uint `gorm:"uniqueIndex:idx_tenant_user"`
+	TenantID uint `gorm:"uniqueIndex:uix_tenant_account_officers_tenant_user,where:deleted_at IS NULL"`
+	UserID uint `gorm:"uniqueIndex:uix_tenant_account_officers_tenant_user,where:deleted_at IS NULL"`
 	Tenant Tenant `gorm:"constraint:OnDelete:CASCADE"`
 	User User `gorm:"constraint:OnDelete:CASCADE"`
 	//  Denormalizing roles  e.g. manager, tech-support, etc. for efficiency of access for display on the client side
@@ -1,6 +1,9 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"gorm.io/gorm"
+)
 
 
 type WebServerProperties struct {
@@ -95,6 +98,7 @@ type AuthEnabled struct {
 	Google bool `json:"google"`
 	Facebook bool `json:"facebook"`
 	TwoFactor bool `json:"two_factor"`
+	MagicLink bool `json:"magic_link"` // passwordless sign-in with a link sent by email
 }
 
 type FBOauth2Constants struct {
@@ -110,11 +114,84 @@ type GoogleOauth2Constants struct {
 	CreateUserIfNotExists bool `json:"create_user_if_not_exists"`
 }
 
+// SSOSettings are for employees of the tenant to sign in with its own identity provider (IdP)
+type SSOSettings struct {
+	Enabled bool `json:"enabled"`
+	Protocol global.SSOProtocol `json:"protocol"`
+	OIDC *OIDCSettings `json:"oidc,omitempty"`
+	SAML *SAMLSettings `json:"saml,omitempty"`
+	// Email domains of the tenant's employees, lower case. The IdP can only sign in addresses of these domains
+	Domains []string `json:"domains"`
+	// The Domains the tenant proved it owns with a DNS TXT record (see DomainTokens). Only these are
+	// discovered, enforce single sign-on and sign in with the IdP
+	VerifiedDomains []string `json:"verified_domains,omitempty"`
+	// Token of the TXT record proving the ownership of each of Domains, see global.SSO_DOMAIN_TXT_LABEL
+	DomainTokens map[string]string `json:"domain_tokens,omitempty"`
+	// Refuse password and sign-in link logins to addresses of Domains: they must sign in with the IdP
+	EnforceSSO bool `json:"enforce_sso"`
+	// Create the accounts and team memberships of users the IdP signs in for the first time
+	JITProvisioning bool `json:"jit_provisioning"`
+	// OIDC claim or SAML attribute listing the user's groups, global.SSO_DEFAULT_ROLE_CLAIM if empty
+	RoleClaim string `json:"role_claim,omitempty"`
+	// Team roles of the members of each group. With a mapping, the IdP decides the roles at every sign-in
+	RoleMapping map[string][]global.TenantTeamRole `json:"role_mapping,omitempty"`
+	// Roles of provisioned users in none of the mapped groups, Employee if empty
+	DefaultRoles []global.TenantTeamRole `json:"default_roles,omitempty"`
+}
+
+// OIDCSettings connect to an OpenID Connect provider found by discovery
+type OIDCSettings struct {
+	// Issuer URL, or its /.well-known/openid-configuration
+	DiscoveryURL string `json:"discovery_url"`
+	ClientID string `json:"client_id"`
+	ClientSecret *struct {
+		IV *string `json:"iv"`
+		Content *string `json:"content"`
+	} `json:"client_secret,omitempty"`
+	// Requested besides openid, email and profile, e.g. for the role claim
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// SAMLSettings describe a SAML 2.0 identity provider by its metadata
+type SAMLSettings struct {
+	IDPMetadataURL string `json:"idp_metadata_url,omitempty"`
+	// The metadata XML, for IdPs that do not publish it. Used when IDPMetadataURL is empty
+	IDPMetadata string `json:"idp_metadata,omitempty"`
+}
+
 type OtherUserOptions struct {
 	ResetPasswordMailOptionSettings_TextTemplate string `json:"reset_password_mail_option_settings_text_template"`
 	ConfirmEmailMailOptionSettings_TextTemplate string `json:"confirm_email_mail_option_settings_text_template"`
 	PasswordResetExpiration int `json:"password_reset_expiration"`
 	EmailVerificationExpiration int `json:"email_verification_expiration"`
+	// Email template overrides keyed by template name, optionally suffixed with a locale e.g. "reset-password.fr"
+	MailTemplates map[string]MailTemplateOverride `json:"mail_templates,omitempty"`
+	// Requirements for the passwords of the tenant's team members. nil uses the defaults
+	PasswordPolicy *PasswordPolicy `json:"password_policy,omitempty"`
+}
+
+// PasswordPolicy constrains new passwords. Zero values keep the defaults
+// (see global.PASSWORD_*); a user on several teams gets the strictest combination.
+type PasswordPolicy struct {
+	MinLength int `json:"min_length,omitempty"`
+	RequireUppercase bool `json:"require_uppercase,omitempty"`
+	RequireLowercase bool `json:"require_lowercase,omitempty"`
+	RequireDigit bool `json:"require_digit,omitempty"`
+	RequireSymbol bool `json:"require_symbol,omitempty"`
+	// Words a password must not contain, case-insensitive and ignoring common character substitutions
+	BannedWords []string `json:"banned_words,omitempty"`
+	// Reject passwords found in the breach corpus. nil keeps the default
+	CheckBreached *bool `json:"check_breached,omitempty"`
+	// Number of previous passwords that cannot be reused
+	HistorySize int `json:"history_size,omitempty"`
+}
+
+// MailTemplateOverride replaces parts of an email template. Empty fields keep the default.
+// Templates use Go template syntax with the same data as the built-in templates.
+type MailTemplateOverride struct {
+	Subject string `json:"subject,omitempty"`
+	TextTemplate string `json:"text_template,omitempty"`
+	HtmlTemplate string `json:"html_template,omitempty"`
 }
 type SizeLimits struct {
 	LogoFileSizeLimit int `json:"logo_file_size_limit"`
@@ -136,6 +213,7 @@ type Logo struct {
 
 type TenantConfigDetail struct {
 	gorm.Model
+	Versioning
 	WebServerProperties *WebServerProperties `gorm:"type:jsonb"`
 	DBProperties *DBProperties `gorm:"type:jsonb"`
 	DBSchema string
@@ -151,8 +229,9 @@ type TenantConfigDetail struct {
 	SizeLimits *SizeLimits `gorm:"type:jsonb"`
 	Theme *ThemeType `gorm:"type:jsonb"`
 	Logo *Logo `gorm:"type:jsonb"`
+	SSO *SSOSettings `gorm:"type:jsonb"`
 	TenantID uint
-	RegionID uint
+	RegionID *uint // nil when the tenant is in no region
 	Region Region
 	
 }
@@ -1,8 +1,11 @@
 package models
 
 import (
+	"strings"
+
 	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 /**
@@ -10,8 +13,8 @@ import (
  */
 type TenantTeam struct {
     gorm.Model
-    TenantID uint `gorm:"uniqueIndex:idx_tenant_team_user"`
-    UserID uint `gorm:"uniqueIndex:idx_tenant_team_user"`
+    TenantID uint `gorm:"uniqueIndex:uix_tenant_teams_tenant_user,where:deleted_at IS NULL"`
+    UserID uint `gorm:"uniqueIndex:uix_tenant_teams_tenant_user,where:deleted_at IS NULL"`
     Tenant Tenant `gorm:"constraint:OnDelete:CASCADE"`
     User User `gorm:"constraint:OnDelete:CASCADE"`
     Roles []global.TenantTeamRole `gorm:"type:tenant_team_role[]"`
@@ -19,4 +22,16 @@ type TenantTeam struct {
     TenantUniqueName string
     //  Denormalizing tenant unique ID for efficiency of access on the client side
     TenantUniqueID uint
+    // Id of the user at the tenant's identity provider, set by SCIM provisioning (its externalId)
+    ExternalID string `gorm:"index"`
+}
+
+// TeamRolesExpr is roles as a tenant_team_role[] value, to write TenantTeam.Roles with:
+// the enum array has no Go type gorm can bind directly
+func TeamRolesExpr(roles []global.TenantTeamRole) clause.Expr {
+	names := make([]string, len(roles))
+	for i, role := range roles {
+		names[i] = string(role)
+	}
+	return gorm.Expr("?::tenant_team_role[]", "{"+strings.Join(names, ",")+"}")
 }
@@ -9,10 +9,11 @@ import (
 
 type Tenant struct {
 	gorm.Model
+	Versioning
 	UUID uuid.UUID `gorm:"type:uuid;default:uuid_generate_v4();unique;not null"`
 	Name string `gorm:"type:varchar(255);not null"`
-	Subdomain string `gorm:"type:varchar(255);uniqueIndex:idx_subdomain_region;not null"`
-	CustomURLSlug string `gorm:"type:varchar(255);unique"`
+	Subdomain string `gorm:"type:varchar(255);uniqueIndex:uix_tenants_subdomain_region,where:deleted_at IS NULL;not null"`
+	CustomURLSlug string `gorm:"type:varchar(255);uniqueIndex:uix_tenants_custom_url_slug,where:deleted_at IS NULL AND custom_url_slug <> ''"`
 	Address string `gorm:"type:varchar(255)"`
 	MoreInfo string `gorm:"type:text"`
 	Logo string `gorm:"type:varchar(255)"`
@@ -36,7 +37,7 @@ type Tenant struct {
 	TenantConfigDetail TenantConfigDetail
 	RegionName string `gorm:"type:varchar(255)"` //denormalized region unique name called getTenantsByRegionName in tenants service
 
-	RegionRootDomain string `gorm:"type:varchar(255);uniqueIndex:idx_subdomain_region"` //denomalized so as to set up unique index with tenant name. So tenantName.rootDomainName cannot be the repeated
+	RegionRootDomain string `gorm:"type:varchar(255);uniqueIndex:uix_tenants_subdomain_region,where:deleted_at IS NULL"` //denomalized so as to set up unique index with tenant name. So tenantName.rootDomainName cannot be the repeated
 
 
 }
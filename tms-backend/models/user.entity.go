@@ -33,6 +33,7 @@ func (p Phone) Value() (driver.Value, error) {
 
 type User struct {
 	gorm.Model
+	Versioning
 	Landlord bool `gorm:"default:false"`
 	FirstName string `gorm:"type:varchar(255);not null"`
 	MiddleName string `gorm:"type:varchar(255)"`
@@ -52,27 +53,42 @@ type User struct {
 
 	Photo string
 	PhotoMimeType string
+	// Storage keys (relative to the file root) of the re-encoded renditions generated on upload
 	// PhotoURL string `gorm:"type:varchar(255)"`
-	// PhotoThumbURL string `gorm:"type:varchar(255)"`
-	// PhotoMediumURL string `gorm:"type:varchar(255)"`
-	// PhotoLargeURL string `gorm:"type:varchar(255)"`
-	// PhotoOriginalURL string `gorm:"type:varchar(255)"`
+	PhotoThumbURL string `gorm:"type:varchar(255)"`
+	PhotoMediumURL string `gorm:"type:varchar(255)"`
+	PhotoLargeURL string `gorm:"type:varchar(255)"`
+	PhotoOriginalURL string `gorm:"type:varchar(255)"`
 	IsActive bool `gorm:"default:true"`
 
-	PrimaryEmailAddress string `gorm:"uniqueIndex;not null"`
-	BackupEmailAddress string `gorm:"unique"`
+	PrimaryEmailAddress string `gorm:"uniqueIndex:uix_users_primary_email_address,where:deleted_at IS NULL;not null"`
+	BackupEmailAddress string `gorm:"uniqueIndex:uix_users_backup_email_address,where:deleted_at IS NULL AND backup_email_address <> ''"`
 
 	PhoneNumbers Phone `gorm:"type:jsonb"`
 	IsPrimaryEmailVerified bool `gorm:"default:false"`
 	IsBackupEmailVerified bool `gorm:"default:false"`
+	// Learnt from bounces and complaints, see EmailSuppression
+	PrimaryEmailDeliverability global.EmailDeliverability `gorm:"type:email_deliverability;default:'deliverable'"`
+	BackupEmailDeliverability global.EmailDeliverability `gorm:"type:email_deliverability;default:'deliverable'"`
 	PasswordSalt string `gorm:"type:varchar(255)"`
 	PasswordHash string `gorm:"type:varchar(255)"`
 	IsPasswordChangeRequired bool `gorm:"default:false"`
 	ResetPasswordToken string `gorm:"type:varchar(255)"`
 	ResetPasswordExpiration time.Time
+	// Verification tokens are stored hashed, see utils.HashToken
 	PrimaryEmailVerificationToken string `gorm:"type:varchar(255)"`
 	BackupEmailVerificationToken string `gorm:"type:varchar(255)"`
-	EmailVerificationTokenExpiration time.Time
+	EmailVerificationTokenExpiration time.Time // of the primary email verification token
+	BackupEmailVerificationTokenExpiration time.Time
+
+	// Primary email address change waiting for confirmation from the new address
+	PendingPrimaryEmailAddress string `gorm:"type:varchar(255)"`
+	EmailChangeToken string `gorm:"type:varchar(255)"`
+	EmailChangeTokenExpiration time.Time
+	// The address the last change replaces, which can undo it with the revert link
+	PreviousPrimaryEmailAddress string `gorm:"type:varchar(255)"`
+	EmailChangeRevertToken string `gorm:"type:varchar(255)"`
+	EmailChangeRevertExpiration time.Time
 
 	// Incorporating OTP possibly for 2FA
 	OTPEnabled *bool `gorm:"default:false;not null"`
@@ -87,7 +103,7 @@ type User struct {
 
 	AccountOfficerForWhichTenants []TenantAccountOfficer `gorm:"foreignKey:UserID"`
 
-	/** for refresh token save after successful login*/
+	/** Deprecated: refresh tokens are kept per device, see Session */
 	RefreshTokenHash string `gorm:"type:varchar(255)"`
 
 	FacebookProfile FacebookProfile
@@ -103,6 +119,9 @@ func (u *User) Sanitize() {
     u.PrimaryEmailVerificationToken = ""
     u.BackupEmailVerificationToken = ""
     u.EmailVerificationTokenExpiration = time.Time{}
+    u.BackupEmailVerificationTokenExpiration = time.Time{}
+    u.EmailChangeToken = ""
+    u.EmailChangeRevertToken = ""
     u.OTPSecret = ""
     u.OTPEnabled = nil
 }
\ No newline at end of file
@@ -0,0 +1,17 @@
+package models
+
+// Versioning is embedded in records edited concurrently (e.g. by several landlord admins).
+// Each update through repositories.Repository bumps the version, and one made from a stale copy
+// fails with a repositories.ConflictError instead of overwriting the changes made since.
+// The version is also the ETag of the record over HTTP, see etags.
+type Versioning struct {
+	Version uint `gorm:"not null;default:1"`
+}
+
+func (v *Versioning) GetVersion() uint {
+	return v.Version
+}
+
+func (v *Versioning) SetVersion(version uint) {
+	v.Version = version
+}
@@ -0,0 +1,53 @@
+package passwords
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/config"
+)
+
+// IsBreached looks a password up in the local breach corpus. The corpus is a directory of
+// k-anonymity range files as served by the Pwned Passwords API: one file per 5 character
+// prefix of the uppercase SHA-1 of the passwords (e.g. "21BD1"), holding "SUFFIX:COUNT"
+// lines for the rest of the hashes. Only the file of the prefix is read.
+// Without PASSWORD_BREACH_CORPUS_DIR nothing is breached.
+func IsBreached(password string) (bool, error) {
+	if config.AppConfig == nil || config.AppConfig.Passwords.BreachCorpusDir == "" {
+		return false, nil
+	}
+
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := os.Open(filepath.Join(config.AppConfig.Passwords.BreachCorpusDir, prefix))
+	if errors.Is(err, os.ErrNotExist) {
+		// No range file: no known breached password has that prefix
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to open breach corpus: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		hashSuffix, count, _ := strings.Cut(line, ":")
+		// Padding entries of the API have a count of 0
+		if strings.EqualFold(hashSuffix, suffix) && strings.TrimSpace(count) != "0" {
+			return true, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("failed to read breach corpus: %v", err)
+	}
+	return false, nil
+}
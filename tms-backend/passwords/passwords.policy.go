@@ -0,0 +1,159 @@
+package passwords
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+)
+
+// minPersonalWordLength keeps short names and email local parts from banning half the dictionary
+const minPersonalWordLength = 3
+
+// Policy is the effective password policy of a user
+type Policy struct {
+	MinLength        int
+	MaxLength        int
+	RequireUppercase bool
+	RequireLowercase bool
+	RequireDigit     bool
+	RequireSymbol    bool
+	BannedWords      []string
+	CheckBreached    bool
+	HistorySize      int
+}
+
+// PolicyError lists every requirement a password fails
+type PolicyError struct {
+	Violations []string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("password does not meet the password policy: %s", strings.Join(e.Violations, "; "))
+}
+
+// DefaultPolicy returns the policy of users no tenant sets one for
+func DefaultPolicy() Policy {
+	return Policy{
+		MinLength:     global.PASSWORD_MIN_LENGTH,
+		MaxLength:     global.PASSWORD_MAX_LENGTH,
+		CheckBreached: global.PASSWORD_CHECK_BREACHED,
+		HistorySize:   global.PASSWORD_HISTORY_SIZE,
+	}
+}
+
+// MergePolicies returns the strictest combination of the default policy and the
+// policies of the tenants a user belongs to. nil policies are skipped.
+func MergePolicies(tenantPolicies ...*models.PasswordPolicy) Policy {
+	policy := DefaultPolicy()
+	for _, tenantPolicy := range tenantPolicies {
+		if tenantPolicy == nil {
+			continue
+		}
+		// The maximum stays at bcrypt's limit; a tenant can only ask for more
+		policy.MinLength = max(policy.MinLength, min(tenantPolicy.MinLength, global.PASSWORD_MAX_LENGTH))
+		policy.RequireUppercase = policy.RequireUppercase || tenantPolicy.RequireUppercase
+		policy.RequireLowercase = policy.RequireLowercase || tenantPolicy.RequireLowercase
+		policy.RequireDigit = policy.RequireDigit || tenantPolicy.RequireDigit
+		policy.RequireSymbol = policy.RequireSymbol || tenantPolicy.RequireSymbol
+		policy.BannedWords = append(policy.BannedWords, tenantPolicy.BannedWords...)
+		if tenantPolicy.CheckBreached != nil && *tenantPolicy.CheckBreached {
+			policy.CheckBreached = true
+		}
+		policy.HistorySize = max(policy.HistorySize, tenantPolicy.HistorySize)
+	}
+	return policy
+}
+
+// Validate checks a new password against the policy. personalWords (names, email
+// addresses) are banned like the policy's banned words; an email address bans its local part.
+// A failed policy returns a *PolicyError.
+func (p Policy) Validate(password string, personalWords ...string) error {
+	var violations []string
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		violations = append(violations, fmt.Sprintf("must be at most %d bytes long", p.MaxLength))
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+	if p.RequireUppercase && !hasUpper {
+		violations = append(violations, "must contain an uppercase letter")
+	}
+	if p.RequireLowercase && !hasLower {
+		violations = append(violations, "must contain a lowercase letter")
+	}
+	if p.RequireDigit && !hasDigit {
+		violations = append(violations, "must contain a digit")
+	}
+	if p.RequireSymbol && !hasSymbol {
+		violations = append(violations, "must contain a symbol")
+	}
+
+	normalized := normalize(password)
+	for _, word := range p.BannedWords {
+		if word = normalize(word); word != "" && strings.Contains(normalized, word) {
+			violations = append(violations, "must not contain a banned word")
+			break
+		}
+	}
+	for _, word := range personalWords {
+		if at := strings.LastIndex(word, "@"); at >= 0 {
+			word = word[:at]
+		}
+		if word = normalize(word); utf8.RuneCountInString(word) >= minPersonalWordLength && strings.Contains(normalized, word) {
+			violations = append(violations, "must not contain your name or email address")
+			break
+		}
+	}
+
+	if len(violations) == 0 && p.CheckBreached {
+		breached, err := IsBreached(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			violations = append(violations, "appears in a list of passwords exposed in data breaches")
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// leetReplacer undoes the usual character substitutions. Look-alikes map to one letter
+// ("l", "1", "!" and "i" all become "i") so a word and its disguise normalize the same.
+var leetReplacer = strings.NewReplacer(
+	"0", "o", "1", "i", "!", "i", "l", "i", "|", "i", "3", "e", "4", "a", "@", "a",
+	"5", "s", "$", "s", "7", "t", "+", "t", "8", "b", "9", "g",
+)
+
+// normalize lower cases s, undoes substitutions and drops separators
+func normalize(s string) string {
+	s = leetReplacer.Replace(strings.ToLower(s))
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, s)
+}
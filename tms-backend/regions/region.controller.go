@@ -1,14 +1,18 @@
 package regions
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 
 	dto "github.com/auditrakkr/tms-fullstack/tms-backend/dtos"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/etags"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/repositories"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 
@@ -70,22 +74,28 @@ func (rc *RegionController) UpdateRegion(c *gin.Context) {
 		return
 	}
 
+	version, ok := etags.IfMatch(c)
+	if !ok {
+		return
+	}
+
 	var updateRegionDto dto.UpdateRegionDto
 	if err := c.ShouldBindJSON(&updateRegionDto); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
 		return
 	}
 
-	region, err := rc.regionService.Update(uint(regionId), &updateRegionDto)
+	region, err := rc.regionService.Update(uint(regionId), version, &updateRegionDto)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		etags.WriteChangeError(c, err, "Region")
 		return
 	}
 
+	etags.Set(c, region.Version)
 	c.JSON(http.StatusOK, gin.H{"region": region})
 }
 
-// SaveRegion handles PUT request for full region update
+// SaveRegion handles PUT request for full region update (If-Match is required to replace one)
 func (rc *RegionController) SaveRegion(c *gin.Context) {
 	var region models.Region
 	if err := c.ShouldBindJSON(&region); err != nil {
@@ -93,53 +103,40 @@ func (rc *RegionController) SaveRegion(c *gin.Context) {
 		return
 	}
 
-	savedRegion, err := rc.regionService.Save(&region)
+	var version uint
+	if region.ID != 0 {
+		var ok bool
+		if version, ok = etags.IfMatch(c); !ok {
+			return
+		}
+	}
+
+	savedRegion, err := rc.regionService.Save(&region, version)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		etags.WriteChangeError(c, err, "Region")
 		return
 	}
 
+	etags.Set(c, savedRegion.Version)
 	c.JSON(http.StatusOK, gin.H{"region": savedRegion})
 }
 
 
 /* GET */
 
-// GetAllRegions handles GET request for fetching all regions
+// GetAllRegions lists a page of regions, filtered and sorted by the query parameters (see repositories.ListQuery)
 func (rc *RegionController) GetAllRegions(c *gin.Context) {
-
-	// Check if query parameters exist
-	findOptionsParam := c.Query("findOptions")
-	if findOptionsParam != "" {
-		// Parse the find options
-		findOptions := make(map[string]any)
-		err := c.ShouldBindQuery(&findOptions)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid find options"})
-			return
-		}
-
-		regions, totalCount, err := rc.regionService.FindAllWithOptions(findOptions)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	regions, err := rc.regionService.FindAllWithOptions(c.Request.URL)
+	if err != nil {
+		if errors.Is(err, repositories.ErrInvalidListQuery) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-
-		c.JSON(http.StatusOK, gin.H{
-			"regions": regions,
-			"total": totalCount,
-		})
-		return
-	}
-
-	// No query parameters, get all regions
-	regions, err := rc.regionService.GetAllRegions()
-	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"regions": regions})
+	c.JSON(http.StatusOK, regions)
 }
 
 // FindOne handles GET request for fetching a single region by ID
@@ -156,6 +153,7 @@ func (rc *RegionController) FindOne(c *gin.Context) {
 		return
 	}
 
+	etags.Set(c, region.Version)
 	c.JSON(http.StatusOK, gin.H{"region": region})
 }
 
@@ -168,6 +166,7 @@ func (rc *RegionController) FindByName(c *gin.Context) {
 		return
 	}
 
+	etags.Set(c, region.Version)
 	c.JSON(http.StatusOK, gin.H{"region": region})
 }
 
@@ -194,9 +193,14 @@ func (rc *RegionController) DeleteRegion(c *gin.Context) {
 		return
 	}
 
-	err = rc.regionService.Delete(uint(regionId))
+	version, ok := etags.IfMatch(c)
+	if !ok {
+		return
+	}
+
+	err = rc.regionService.Delete(uint(regionId), version)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		etags.WriteChangeError(c, err, "Region")
 		return
 	}
 
@@ -205,6 +209,9 @@ func (rc *RegionController) DeleteRegion(c *gin.Context) {
 
 
 /* ASSOCIATION section */
+// The tenant config details are versioned: If-Match is required to add them to or remove them from
+// a region, the ETag of the one of the URL or those of the tenantConfigDetailIds in their order
+
 // AddTenantConfigDetailById handles PATCH request for adding a tenant config detail to a region
 
 func (rc *RegionController) AddTenantConfigDetailById(c *gin.Context) {
@@ -222,13 +229,19 @@ func (rc *RegionController) AddTenantConfigDetailById(c *gin.Context) {
         return
     }
 
+    version, ok := etags.IfMatch(c)
+    if !ok {
+        return
+    }
+
 	// Call the service method to add the tenant config detail to the region
-    err = rc.regionService.AddTenantConfigDetailById(uint(regionId), uint(tenantConfigDetailId))
+    tenantConfigDetail, err := rc.regionService.AddTenantConfigDetailById(uint(regionId), uint(tenantConfigDetailId), version)
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        rc.writeAssociationError(c, err)
         return
     }
 
+    etags.Set(c, tenantConfigDetail.Version)
     c.JSON(http.StatusOK, gin.H{
         "message": "Tenant config detail added to region successfully",
     })
@@ -262,10 +275,15 @@ func (rc *RegionController) AddTenantConfigDetailsById(c *gin.Context) {
         tenantConfigDetailIds = append(tenantConfigDetailIds, uint(id))
     }
 
+    versions, ok := etags.IfMatchEach(c, len(tenantConfigDetailIds))
+    if !ok {
+        return
+    }
+
 	// Call the service method to add the tenant config details to the region
-    tenantConfigDetails, err := rc.regionService.AddTenantConfigDetailsById(uint(regionId), tenantConfigDetailIds)
+    tenantConfigDetails, err := rc.regionService.AddTenantConfigDetailsById(c.Request.Context(), uint(regionId), tenantConfigDetailIds, versions)
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        rc.writeAssociationError(c, err)
         return
     }
 
@@ -296,13 +314,19 @@ func (rc *RegionController) RemoveTenantConfigDetailById(c *gin.Context) {
 		return
 	}
 
+	version, ok := etags.IfMatch(c)
+	if !ok {
+		return
+	}
+
 	// Remove the tenant config detail from the region
-	err = rc.regionService.RemoveTenantConfigDetailById(uint(regionId), uint(tenantConfigDetailId))
+	tenantConfigDetail, err := rc.regionService.RemoveTenantConfigDetailById(uint(regionId), uint(tenantConfigDetailId), version)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		rc.writeAssociationError(c, err)
 		return
 	}
 
+	etags.Set(c, tenantConfigDetail.Version)
 	c.JSON(http.StatusOK, gin.H{"message": "Tenant config detail removed from region successfully"})
 }
 
@@ -334,12 +358,74 @@ func (rc *RegionController) RemoveTenantConfigDetailsById(c *gin.Context) {
 		tenantConfigDetailIds = append(tenantConfigDetailIds, uint(id))
 	}
 
+	versions, ok := etags.IfMatchEach(c, len(tenantConfigDetailIds))
+	if !ok {
+		return
+	}
+
 	// Remove the tenant config details from the region
-	err = rc.regionService.RemoveTenantConfigDetailsById(uint(regionId), tenantConfigDetailIds)
+	err = rc.regionService.RemoveTenantConfigDetailsById(c.Request.Context(), uint(regionId), tenantConfigDetailIds, versions)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		rc.writeAssociationError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Tenant config details removed from region successfully"})
 }
+
+/* TRASH */
+
+// RestoreRegion takes a deleted region out of the trash
+func (rc *RegionController) RestoreRegion(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("regionId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid region ID"})
+		return
+	}
+	region, err := rc.regionService.Restore(uint(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Region not found in the trash"})
+		case errors.Is(err, repositories.ErrRestoreConflict):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"region": region})
+}
+
+// PurgeRegion deletes a region in the trash for good
+func (rc *RegionController) PurgeRegion(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("regionId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid region ID"})
+		return
+	}
+	if err := rc.regionService.Purge(uint(id)); err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Region not found in the trash"})
+		case errors.Is(err, repositories.ErrStillReferenced):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// writeAssociationError answers an error adding tenant config details to or removing them from a
+// region: 412 if one was changed since read
+func (rc *RegionController) writeAssociationError(c *gin.Context, err error) {
+	switch {
+	case etags.WriteConflict(c, err):
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -1,13 +1,17 @@
 package regions
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/auditrakkr/tms-fullstack/tms-backend/database"
 	dto "github.com/auditrakkr/tms-fullstack/tms-backend/dtos"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/repositories"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/utils"
@@ -18,6 +22,7 @@ import (
 type RegionService struct {
 	regionRepo             repositories.Repository[models.Region]
 	tenantConfigDetailRepo repositories.Repository[models.TenantConfigDetail]
+	uow                    *repositories.UnitOfWork
 	cache                  *database.RedisCache
 }
 
@@ -25,6 +30,7 @@ func NewRegionService() *RegionService {
 	return &RegionService{
 		regionRepo:             repositories.Repository[models.Region]{DB: database.DB},
 		tenantConfigDetailRepo: repositories.Repository[models.TenantConfigDetail]{DB: database.DB},
+		uow:                    repositories.NewUnitOfWork(database.DB),
 		cache:                  database.Cache,
 	}
 }
@@ -93,11 +99,15 @@ func (s *RegionService) InsertRegions(regions *[]dto.CreateRegionDto) (*[]models
 
 /* UPDATE */
 
-func (s *RegionService) Update(regionId uint, updateRegionDto *dto.UpdateRegionDto) (*models.Region, error) {
+// Update changes the region provided it is still at version (the ETag read), whatever its version if 0
+func (s *RegionService) Update(regionId uint, version uint, updateRegionDto *dto.UpdateRegionDto) (*models.Region, error) {
 	// Find the region
 	region, err := s.regionRepo.FindByID(regionId)
 	if err != nil {
-		return nil, fmt.Errorf("failed to find region: %v", err)
+		return nil, fmt.Errorf("failed to find region: %w", err)
+	}
+	if version != 0 {
+		region.Version = version
 	}
 
 	// Copy data from DTO to model
@@ -113,7 +123,7 @@ func (s *RegionService) Update(regionId uint, updateRegionDto *dto.UpdateRegionD
 	// Update the region
 	err = s.regionRepo.Update(region)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to update region: %w", err)
 	}
 
 	// Clear cache
@@ -124,7 +134,19 @@ func (s *RegionService) Update(regionId uint, updateRegionDto *dto.UpdateRegionD
 	return region, nil
 }
 
-func (s *RegionService) Save(region *models.Region) (*models.Region, error) {
+// Save creates the region, or replaces it provided it is still at version (0 for any version)
+func (s *RegionService) Save(region *models.Region, version uint) (*models.Region, error) {
+	if region.ID != 0 {
+		if version == 0 {
+			current, err := s.regionRepo.FindByID(region.ID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to find region: %w", err)
+			}
+			version = current.Version
+		}
+		region.Version = version
+	}
+
 	// Handle encryption of sensitive data
 	if err := s.encryptSensitiveData(region); err != nil {
 		return nil, fmt.Errorf("failed to encrypt sensitive data: %v", err)
@@ -133,7 +155,7 @@ func (s *RegionService) Save(region *models.Region) (*models.Region, error) {
 	// Save the region
 	region, err := s.regionRepo.Save(region)
 	if err != nil {
-		return nil, fmt.Errorf("failed to save region: %v", err)
+		return nil, fmt.Errorf("failed to save region: %w", err)
 	}
 
 	// Clear cache
@@ -146,12 +168,24 @@ func (s *RegionService) Save(region *models.Region) (*models.Region, error) {
 
 /* READ */
 
-func (s *RegionService) FindAllWithOptions(findOptions map[string]any) ([]models.Region, int64, error) {
-	regions, totalCount, err := s.regionRepo.FindAndCount(findOptions)
+// regionListFields are what the region list can be filtered and sorted by, see repositories.ListQuery
+var regionListFields = repositories.ListFields{
+	Filter:      []string{"id", "name", "root_domain_name", "country", "city", "tenant_count_capacity", "created_at", "updated_at", "deleted_at"},
+	Sort:        []string{"name", "root_domain_name", "tenant_count_capacity", "created_at", "updated_at"},
+	DefaultSort: "name",
+}
+
+// FindAllWithOptions returns the page of regions the list query parameters of requestURL ask for
+func (s *RegionService) FindAllWithOptions(requestURL *url.URL) (*repositories.ListPage[models.Region], error) {
+	listQuery, err := repositories.ParseListQuery(requestURL, regionListFields)
+	if err != nil {
+		return nil, err
+	}
+	page, err := s.regionRepo.FindPage(listQuery)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to get all regions with options: %w", err)
+		return nil, fmt.Errorf("failed to get all regions with options: %w", err)
 	}
-	return regions, totalCount, nil
+	return page, nil
 }
 
 func (s *RegionService) GetAllRegions() ([]models.Region, error) {
@@ -251,35 +285,78 @@ func (s *RegionService) GetTenantAssignableRegionsInfo() ([]models.Region, error
 
 
 /* DELETE */
-func (s *RegionService) Delete(regionId uint) error {
-	err := s.regionRepo.Delete(regionId)
+
+// Delete deletes the region provided it is still at version (0 for any version)
+func (s *RegionService) Delete(regionId uint, version uint) error {
+	err := s.regionRepo.DeleteVersion(regionId, version)
 	if err != nil {
 		return fmt.Errorf("failed to delete region: %w", err)
 	}
 	return nil
 }
 
+/* TRASH */
+
+// Restore takes a deleted region out of the trash
+func (s *RegionService) Restore(regionId uint) (*models.Region, error) {
+	region, err := s.regionRepo.Restore(regionId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore region: %w", err)
+	}
+	// Clear cache
+	if s.cache != nil {
+		s.clearRegionCache()
+	}
+
+	return region, nil
+}
+
+// Purge deletes a region in the trash for good
+func (s *RegionService) Purge(regionId uint) error {
+	if _, err := s.regionRepo.Purge(regionId); err != nil {
+		return fmt.Errorf("failed to purge region: %w", err)
+	}
+	return nil
+}
+
+// PurgeDeletedBefore purges regions put in the trash before cutoff, see trash.StartRetentionJob
+func (s *RegionService) PurgeDeletedBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	regions, err := s.regionRepo.WithContext(ctx).PurgeDeletedBefore(cutoff, global.TRASH_PURGE_BATCH_SIZE)
+	if err != nil {
+		return len(regions), fmt.Errorf("failed to purge deleted regions: %w", err)
+	}
+	return len(regions), nil
+}
+
 /* ASSOCIATION section */
-func (s *RegionService) AddTenantConfigDetailById(regionId uint, tenantConfigDetailId uint) error {
+
+// The tenant config details are versioned: they are added to and removed from a region provided
+// they are still at the version read (the ETag), whatever their version if 0
+
+// AddTenantConfigDetailById adds a tenant config detail at version to a region
+func (s *RegionService) AddTenantConfigDetailById(regionId uint, tenantConfigDetailId uint, version uint) (*models.TenantConfigDetail, error) {
 	// Get the region
 	region, err := s.regionRepo.FindByID(regionId)
 	if err != nil {
-		return fmt.Errorf("failed to find region: %w", err)
+		return nil, fmt.Errorf("failed to find region: %w", err)
 	}
 
 	// Get the tenant config detail
 	tenantConfigDetail, err := s.tenantConfigDetailRepo.FindByID(tenantConfigDetailId)
 	if err != nil {
-		return fmt.Errorf("failed to find tenant config detail: %w", err)
+		return nil, fmt.Errorf("failed to find tenant config detail: %w", err)
 	}
 
 	// Add association
-	tenantConfigDetail.RegionID = regionId
+	tenantConfigDetail.RegionID = &regionId
 	tenantConfigDetail.Region = *region
+	if version != 0 {
+		tenantConfigDetail.Version = version
+	}
 
 	err = s.tenantConfigDetailRepo.Update(tenantConfigDetail)
 	if err != nil {
-		return fmt.Errorf("failed to add tenant config detail to region: %w", err)
+		return nil, fmt.Errorf("failed to add tenant config detail to region: %w", err)
 	}
 
 	// Clear cache
@@ -287,106 +364,101 @@ func (s *RegionService) AddTenantConfigDetailById(regionId uint, tenantConfigDet
 		s.clearRegionCache()
 	}
 
-	return nil
+	return tenantConfigDetail, nil
 }
 
-
-func (s *RegionService) AddTenantConfigDetailsById(regionId uint, tenantConfigDetailIds []uint) ([]models.TenantConfigDetail, error) {
+// AddTenantConfigDetailsById adds tenant config details to a region, each at the version of the same index in versions
+func (s *RegionService) AddTenantConfigDetailsById(ctx context.Context, regionId uint, tenantConfigDetailIds []uint, versions []uint) ([]models.TenantConfigDetail, error) {
 	// Get the region to update
-    region, err := s.regionRepo.FindByID(regionId)
-    if err != nil {
-        return nil, fmt.Errorf("failed to find region: %w", err)
-    }
-
-    // Get the tenant config details to add
-    var tenantConfigDetailsToAdd []models.TenantConfigDetail
-	if len(tenantConfigDetailIds) > 0 {
-		err := s.tenantConfigDetailRepo.CreateQueryBuilder().Where("id IN ?", tenantConfigDetailIds).Find(&tenantConfigDetailsToAdd).Error
-
-		if err != nil {
-			return nil, fmt.Errorf("failed to find tenant config details: %w", err)
-		}
-
-		// Check if any tenant config details were found
-        if len(tenantConfigDetailsToAdd) == 0 {
-            return nil, fmt.Errorf("no tenant config details found for the provided IDs")
-        }
+	region, err := s.regionRepo.WithContext(ctx).FindByID(regionId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find region: %w", err)
 	}
 
 	// Apply the association in a transaction to ensure consistency
-    tx := s.tenantConfigDetailRepo.DB.Begin()
-    if tx.Error != nil {
-        return nil, fmt.Errorf("failed to start transaction: %w", tx.Error)
-    }
-
-    // Defer transaction rollback in case of error
-    defer func() {
-        if r := recover(); r != nil {
-            tx.Rollback()
-        }
-    }()
-
-	// Update each tenant config detail to associate with the region
-    for i := range tenantConfigDetailsToAdd {
-        tenantConfigDetailsToAdd[i].RegionID = regionId
-        tenantConfigDetailsToAdd[i].Region = *region
-
-        err := tx.Save(&tenantConfigDetailsToAdd[i]).Error
-        if err != nil {
-            tx.Rollback()
-            // Check for unique constraint violation
-            if strings.Contains(err.Error(), "duplicate key") || strings.Contains(err.Error(), "unique constraint") {
-                return nil, fmt.Errorf("tenant config detail already assigned to region: %w", err)
-            }
-            return nil, fmt.Errorf("failed to add tenant config detail to region: %w", err)
-        }
-    }
+	err = s.uow.Do(ctx, func(tx *gorm.DB) error {
+		tenantConfigDetailRepo := s.tenantConfigDetailRepo.WithTx(tx)
+
+		// Get the tenant config details to add
+		var tenantConfigDetailsToAdd []models.TenantConfigDetail
+		if len(tenantConfigDetailIds) > 0 {
+			if err := tenantConfigDetailRepo.CreateQueryBuilder().Where("id IN ?", tenantConfigDetailIds).Find(&tenantConfigDetailsToAdd).Error; err != nil {
+				return fmt.Errorf("failed to find tenant config details: %w", err)
+			}
+
+			// Check if any tenant config details were found
+			if len(tenantConfigDetailsToAdd) == 0 {
+				return fmt.Errorf("no tenant config details found for the provided IDs")
+			}
+		}
 
-	// Commit the transaction
-    if err := tx.Commit().Error; err != nil {
-        return nil, fmt.Errorf("failed to commit transaction: %w", err)
-    }
+		// Update each tenant config detail to associate with the region
+		versionsById := detailVersions(tenantConfigDetailIds, versions)
+		for i := range tenantConfigDetailsToAdd {
+			tenantConfigDetailsToAdd[i].RegionID = &regionId
+			tenantConfigDetailsToAdd[i].Region = *region
+			if version := versionsById[tenantConfigDetailsToAdd[i].ID]; version != 0 {
+				tenantConfigDetailsToAdd[i].Version = version
+			}
+
+			if err := tenantConfigDetailRepo.Update(&tenantConfigDetailsToAdd[i]); err != nil {
+				// Check for unique constraint violation
+				if strings.Contains(err.Error(), "duplicate key") || strings.Contains(err.Error(), "unique constraint") {
+					return fmt.Errorf("tenant config detail already assigned to region: %w", err)
+				}
+				return fmt.Errorf("failed to add tenant config detail to region: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-    // Fetch the updated tenant config details for the region
-    var tenantConfigDetails []models.TenantConfigDetail
-    err = s.tenantConfigDetailRepo.CreateQueryBuilder().
-        Where("region_id = ?", regionId).
-        Find(&tenantConfigDetails).Error
+	// Fetch the updated tenant config details for the region
+	var tenantConfigDetails []models.TenantConfigDetail
+	err = s.tenantConfigDetailRepo.WithContext(ctx).CreateQueryBuilder().
+		Where("region_id = ?", regionId).
+		Find(&tenantConfigDetails).Error
 
-    if err != nil {
-        return nil, fmt.Errorf("failed to get tenant config details after update: %w", err)
-    }
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tenant config details after update: %w", err)
+	}
 
-    // Clear cache
-    if s.cache != nil {
-        s.clearRegionCache()
-    }
+	// Clear cache
+	if s.cache != nil {
+		s.clearRegionCache()
+	}
 
-    return tenantConfigDetails, nil
+	return tenantConfigDetails, nil
 }
 
 
-func (s *RegionService) RemoveTenantConfigDetailById(regionId uint, tenantConfigDetailId uint) error {
+// RemoveTenantConfigDetailById removes a tenant config detail at version from a region
+func (s *RegionService) RemoveTenantConfigDetailById(regionId uint, tenantConfigDetailId uint, version uint) (*models.TenantConfigDetail, error) {
 	// Get the tenant config detail
     tenantConfigDetail, err := s.tenantConfigDetailRepo.FindByID(tenantConfigDetailId)
     if err != nil {
-        return fmt.Errorf("failed to find tenant config detail: %w", err)
+        return nil, fmt.Errorf("failed to find tenant config detail: %w", err)
     }
 
 	// Check if this tenant config detail belongs to the specified region
-    if tenantConfigDetail.RegionID != regionId {
-        return fmt.Errorf("tenant config detail is not assigned to this region")
+    if tenantConfigDetail.RegionID == nil || *tenantConfigDetail.RegionID != regionId {
+        return nil, fmt.Errorf("tenant config detail is not assigned to this region")
     }
 
 	 // Remove association by setting RegionID to null
-    tenantConfigDetail.RegionID = 0
+    tenantConfigDetail.RegionID = nil
     // Clear the relationship without deleting the actual record
     tenantConfigDetail.Region = models.Region{}
+    if version != 0 {
+        tenantConfigDetail.Version = version
+    }
 
 	// Update the tenant config detail
     err = s.tenantConfigDetailRepo.Update(tenantConfigDetail)
     if err != nil {
-        return fmt.Errorf("failed to remove tenant config detail from region: %w", err)
+        return nil, fmt.Errorf("failed to remove tenant config detail from region: %w", err)
     }
 
 	// Clear cache
@@ -394,58 +466,46 @@ func (s *RegionService) RemoveTenantConfigDetailById(regionId uint, tenantConfig
         s.clearRegionCache()
     }
 
-    return nil
+    return tenantConfigDetail, nil
 }
 
-func (s *RegionService) RemoveTenantConfigDetailsById(regionId uint, tenantConfigDetailIds []uint) error {
+// RemoveTenantConfigDetailsById removes tenant config details from a region, each at the version of the same index in versions
+func (s *RegionService) RemoveTenantConfigDetailsById(ctx context.Context, regionId uint, tenantConfigDetailIds []uint, versions []uint) error {
 	// Perform removal in a transaction to ensure consistency
-    tx := s.tenantConfigDetailRepo.DB.Begin()
-    if tx.Error != nil {
-        return fmt.Errorf("failed to start transaction: %w", tx.Error)
-    }
+	err := s.uow.Do(ctx, func(tx *gorm.DB) error {
+		tenantConfigDetailRepo := s.tenantConfigDetailRepo.WithTx(tx)
 
-    // Defer transaction rollback in case of error
-    defer func() {
-        if r := recover(); r != nil {
-            tx.Rollback()
-        }
-    }()
-
-    // Get the tenant config details to remove
-    var tenantConfigDetails []models.TenantConfigDetail
-    if err := tx.Where("id IN ? AND region_id = ?", tenantConfigDetailIds, regionId).Find(&tenantConfigDetails).Error; err != nil {
-        tx.Rollback()
-        return fmt.Errorf("failed to find tenant config details: %w", err)
-    }
-
-    // Skip if no tenant config details were found
-    if len(tenantConfigDetails) == 0 {
-        tx.Rollback() // No need to continue with transaction
-        return nil
-    }
-
-    // Remove associations by setting RegionID to 0
-    for i := range tenantConfigDetails {
-        tenantConfigDetails[i].RegionID = 0
-        tenantConfigDetails[i].Region = models.Region{}
-
-        if err := tx.Save(&tenantConfigDetails[i]).Error; err != nil {
-            tx.Rollback()
-            return fmt.Errorf("failed to remove association for tenant config detail %d: %w", tenantConfigDetails[i].ID, err)
-        }
-    }
+		// Get the tenant config details to remove; none found is nothing to do
+		var tenantConfigDetails []models.TenantConfigDetail
+		if err := tenantConfigDetailRepo.CreateQueryBuilder().Where("id IN ? AND region_id = ?", tenantConfigDetailIds, regionId).Find(&tenantConfigDetails).Error; err != nil {
+			return fmt.Errorf("failed to find tenant config details: %w", err)
+		}
 
-    // Commit the transaction
-    if err := tx.Commit().Error; err != nil {
-        return fmt.Errorf("failed to commit transaction: %w", err)
-    }
+		// Remove associations by setting RegionID to null
+		versionsById := detailVersions(tenantConfigDetailIds, versions)
+		for i := range tenantConfigDetails {
+			tenantConfigDetails[i].RegionID = nil
+			tenantConfigDetails[i].Region = models.Region{}
+			if version := versionsById[tenantConfigDetails[i].ID]; version != 0 {
+				tenantConfigDetails[i].Version = version
+			}
+
+			if err := tenantConfigDetailRepo.Update(&tenantConfigDetails[i]); err != nil {
+				return fmt.Errorf("failed to remove association for tenant config detail %d: %w", tenantConfigDetails[i].ID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-    // Clear cache
-    if s.cache != nil {
-        s.clearRegionCache()
-    }
+	// Clear cache
+	if s.cache != nil {
+		s.clearRegionCache()
+	}
 
-    return nil
+	return nil
 }
 
 
@@ -453,6 +513,17 @@ func (s *RegionService) RemoveTenantConfigDetailsById(regionId uint, tenantConfi
 
 /* Helper methods */
 
+// detailVersions pairs the IDs of tenant config details with the versions of the same index
+func detailVersions(tenantConfigDetailIds []uint, versions []uint) map[uint]uint {
+	versionsById := make(map[uint]uint, len(tenantConfigDetailIds))
+	for i, id := range tenantConfigDetailIds {
+		if i < len(versions) {
+			versionsById[id] = versions[i]
+		}
+	}
+	return versionsById
+}
+
 // encryptSensitiveData encrypts sensitive data in a region
 func (s *RegionService) encryptSensitiveData(region *models.Region) error {
 	// Only encrypt if content exists and isn't already encrypted
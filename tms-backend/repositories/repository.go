@@ -1,9 +1,11 @@
 package repositories
 
 import (
+	"context"
 	"errors"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // Generic Repository
@@ -17,20 +19,26 @@ func NewRepository[T any](db *gorm.DB) *Repository[T] {
 	return &Repository[T]{DB: db}
 }
 
+// WithTx returns the repository working in the transaction tx, e.g. the one of a UnitOfWork
+func (r *Repository[T]) WithTx(tx *gorm.DB) *Repository[T] {
+	return &Repository[T]{DB: tx}
+}
+
+// WithContext returns the repository running its queries with ctx, so they are cancelled with it
+func (r *Repository[T]) WithContext(ctx context.Context) *Repository[T] {
+	return &Repository[T]{DB: r.DB.WithContext(ctx)}
+}
+
 // Create a new record
 func (r *Repository[T]) Create(entity *T) (*T, error) {
-	err := r.DB.Create(&entity).Error
+	err := r.DB.Create(entity).Error
 	return entity, err
 }
 
-// Find a record by ID
+// Find a record by ID, gorm.ErrRecordNotFound if there is none
 func (r *Repository[T]) FindByID(id uint) (*T, error) {
 	var entity T
-	err := r.DB.First(&entity, id).Error
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, err // Return error to signal "not found"
-		}
+	if err := r.DB.First(&entity, id).Error; err != nil {
 		return nil, err
 	}
 	return &entity, nil
@@ -46,22 +54,52 @@ func (r *Repository[T]) FindAll() ([]T, error) {
 	return entities, nil
 }
 
-// FindOne - Find a single record based on conditions
+// FindOne - Find a single record based on conditions, gorm.ErrRecordNotFound if there is none
 func (r *Repository[T]) FindOne(condition map[string]any) (*T, error) {
 	var entity T
-	err := r.DB.Where(condition).First(&entity).Error
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, err
-		}
+	if err := r.DB.Where(condition).First(&entity).Error; err != nil {
 		return nil, err
 	}
 	return &entity, nil
 }
 
-// Update a record
+// Update writes every column of a record that was read before, zero values included (unlike gorm's
+// Updates with a struct, which skips them). Associations are left alone and the creation time is kept.
+// A versioned record must still be at the version it was read at, else it is a ConflictError.
 func (r *Repository[T]) Update(entity *T) error {
-	return r.DB.Model(&entity).Updates(entity).Error
+	return r.update(entity, nil)
+}
+
+// UpdateColumns writes only the given columns (field or column names) of a record, zero values included,
+// and leaves the others as they are in the database: a copy read before a password change, say, does not
+// write the old hash back. A versioned record is checked like with Update.
+func (r *Repository[T]) UpdateColumns(entity *T, columns ...string) error {
+	if len(columns) == 0 {
+		return errors.New("no column to update")
+	}
+	return r.update(entity, columns)
+}
+
+// update writes columns of entity, every column if there are none
+func (r *Repository[T]) update(entity *T, columns []string) error {
+	if versioned, ok := any(entity).(Versioned); ok {
+		return r.updateVersion(entity, versioned, columns)
+	}
+	result := r.updateQuery(entity, columns).Updates(entity)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *Repository[T]) updateQuery(entity *T, columns []string) *gorm.DB {
+	if len(columns) > 0 {
+		return r.DB.Model(entity).Select(columns)
+	}
+	return r.DB.Model(entity).Select("*").Omit(clause.Associations, "CreatedAt")
 }
 
 func (r *Repository[T]) Delete(id uint) error {
@@ -81,8 +119,17 @@ func (r *Repository[T]) CreateQueryBuilder() *gorm.DB {
 	return r.DB.Model(&entity)
 }
 
-// Save (Create or Update)
+// Save (Create or Update). A versioned record that exists goes through Update, for its version to be checked.
 func (r *Repository[T]) Save(entity *T) (*T, error) {
+	if _, ok := any(entity).(Versioned); ok {
+		id, err := r.primaryKey(entity)
+		if err != nil {
+			return entity, err
+		}
+		if id != nil {
+			return entity, r.Update(entity)
+		}
+	}
 	err := r.DB.Save(entity).Error
 	return entity, err
 }
@@ -102,9 +149,14 @@ func (r *Repository[T]) FindAndCount(condition map[string]any) ([]T, int64, erro
 	var entities []T
 	var count int64
 
-	query := r.DB.Where(condition)
-	err := query.Find(&entities).Count(&count).Error
-	if err != nil {
+	// Count and Find each get their own statement: chained, the count would reuse the finished find
+	filtered := func() *gorm.DB {
+		return r.CreateQueryBuilder().Where(condition)
+	}
+	if err := filtered().Count(&count).Error; err != nil {
+		return nil, 0, err
+	}
+	if err := filtered().Find(&entities).Error; err != nil {
 		return nil, 0, err
 	}
 	return entities, count, nil
@@ -0,0 +1,572 @@
+package repositories
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+/* LIST QUERIES */
+
+// ErrInvalidListQuery is returned for list query parameters that cannot be applied, e.g. a field
+// that is not allowed or a value that does not parse: a bad request
+var ErrInvalidListQuery = errors.New("invalid list query")
+
+// ListFields are the columns of a resource its list can be filtered and sorted by. Sort
+// columns should not be nullable: cursors compare them with = and <, which NULL fails.
+type ListFields struct {
+	Filter      []string
+	Sort        []string
+	DefaultSort string // e.g. "-created_at"; the id always breaks ties
+}
+
+// ListQuery is a list request, parsed by ParseListQuery from query parameters like
+//
+//	?filter[status]=active&filter[created_at][gte]=2024-01-01&sort=-created_at,name&page[size]=50&page[number]=2
+//
+// Filters are ANDed; their operators are eq (the default), ne, gt, gte, lt, lte, in and nin
+// (comma-separated values), contains (case-insensitive) and null (true or false).
+// Pages are numbered (page[number], offset pagination) or follow a cursor of a previous
+// page (page[after] or page[before], cursor pagination), page[size] long.
+// Soft-deleted rows are left out, unless ?withDeleted or ?onlyDeleted (the trash) ask for them.
+type ListQuery struct {
+	Filters []ListFilter
+	Sort    []ListSort
+	Size    int
+	Number  int    // 1-based, without a cursor
+	After   string // cursor of the last row of the previous page
+	Before  string // cursor of the first row of the next page
+	Deleted ListDeleted
+
+	url url.URL // of the request, for the links of the page
+}
+
+// ListDeleted is which soft-deleted rows a list shows
+type ListDeleted int
+
+const (
+	WithoutDeleted ListDeleted = iota
+	WithDeleted
+	OnlyDeleted
+)
+
+// The query parameters of ListDeleted, e.g. ?onlyDeleted or ?withDeleted=true
+const (
+	WithDeletedParam = "withDeleted"
+	OnlyDeletedParam = "onlyDeleted"
+)
+
+type ListFilter struct {
+	Column   string
+	Operator string
+	Value    string
+}
+
+type ListSort struct {
+	Column string
+	Desc   bool
+}
+
+// ListPage is the envelope of a page of a list
+type ListPage[T any] struct {
+	Data  []T       `json:"data"`
+	Meta  ListMeta  `json:"meta"`
+	Links ListLinks `json:"links"`
+}
+
+type ListMeta struct {
+	Total      int64  `json:"total"` // rows matching the filters, on every page
+	PageSize   int    `json:"pageSize"`
+	PageNumber int    `json:"pageNumber,omitempty"` // with offset pagination
+	NextCursor string `json:"nextCursor,omitempty"`
+	PrevCursor string `json:"prevCursor,omitempty"`
+}
+
+// ListLinks are the URLs of the page and its neighbours, relative to the host
+type ListLinks struct {
+	Self  string `json:"self"`
+	First string `json:"first"`
+	Next  string `json:"next,omitempty"`
+	Prev  string `json:"prev,omitempty"`
+}
+
+var (
+	filterParam   = regexp.MustCompile(`^filter\[([a-zA-Z0-9_]+)\](?:\[([a-z]+)\])?$`)
+	listOperators = []string{"eq", "ne", "gt", "gte", "lt", "lte", "in", "nin", "contains", "null"}
+)
+
+// ParseListQuery reads the list query parameters of a request, checking them against the allowed fields.
+// Errors wrap ErrInvalidListQuery.
+func ParseListQuery(requestURL *url.URL, fields ListFields) (*ListQuery, error) {
+	values := requestURL.Query()
+	listQuery := &ListQuery{Size: global.LIST_DEFAULT_PAGE_SIZE, Number: 1, url: *requestURL}
+
+	for key, filterValues := range values {
+		match := filterParam.FindStringSubmatch(key)
+		if match == nil {
+			if strings.HasPrefix(key, "filter[") {
+				return nil, fmt.Errorf("%w: %s", ErrInvalidListQuery, key)
+			}
+			continue
+		}
+		column, operator := match[1], match[2]
+		if operator == "" {
+			operator = "eq"
+		}
+		if !slices.Contains(fields.Filter, column) {
+			return nil, fmt.Errorf("%w: cannot filter by %s, only by %s", ErrInvalidListQuery, column, strings.Join(fields.Filter, ", "))
+		}
+		if !slices.Contains(listOperators, operator) {
+			return nil, fmt.Errorf("%w: unknown filter operator %s, use one of %s", ErrInvalidListQuery, operator, strings.Join(listOperators, ", "))
+		}
+		for _, value := range filterValues {
+			listQuery.Filters = append(listQuery.Filters, ListFilter{Column: column, Operator: operator, Value: value})
+		}
+	}
+	// Map order is random: keep the SQL, and the plans the database caches for it, the same
+	slices.SortFunc(listQuery.Filters, func(a, b ListFilter) int {
+		return strings.Compare(a.Column+"|"+a.Operator+"|"+a.Value, b.Column+"|"+b.Operator+"|"+b.Value)
+	})
+
+	sort := values.Get("sort")
+	if sort == "" {
+		sort = fields.DefaultSort
+	}
+	for _, field := range strings.Split(sort, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		listSort := ListSort{Column: strings.TrimPrefix(field, "-"), Desc: strings.HasPrefix(field, "-")}
+		if !slices.Contains(fields.Sort, listSort.Column) && listSort.Column != "id" {
+			return nil, fmt.Errorf("%w: cannot sort by %s, only by %s", ErrInvalidListQuery, listSort.Column, strings.Join(slices.Concat(fields.Sort, []string{"id"}), ", "))
+		}
+		listQuery.Sort = append(listQuery.Sort, listSort)
+	}
+
+	if size := values.Get("page[size]"); size != "" {
+		parsed, err := strconv.Atoi(size)
+		if err != nil || parsed < 1 {
+			return nil, fmt.Errorf("%w: page[size] must be a positive number", ErrInvalidListQuery)
+		}
+		listQuery.Size = min(parsed, global.LIST_MAX_PAGE_SIZE)
+	}
+	if number := values.Get("page[number]"); number != "" {
+		parsed, err := strconv.Atoi(number)
+		if err != nil || parsed < 1 {
+			return nil, fmt.Errorf("%w: page[number] must be a positive number", ErrInvalidListQuery)
+		}
+		listQuery.Number = parsed
+	}
+	listQuery.After, listQuery.Before = values.Get("page[after]"), values.Get("page[before]")
+	if listQuery.After != "" && listQuery.Before != "" {
+		return nil, fmt.Errorf("%w: page[after] and page[before] cannot be combined", ErrInvalidListQuery)
+	}
+
+	withDeleted, err := flagParam(values, WithDeletedParam)
+	if err != nil {
+		return nil, err
+	}
+	onlyDeleted, err := flagParam(values, OnlyDeletedParam)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case withDeleted && onlyDeleted:
+		return nil, fmt.Errorf("%w: %s and %s cannot be combined", ErrInvalidListQuery, WithDeletedParam, OnlyDeletedParam)
+	case withDeleted:
+		listQuery.Deleted = WithDeleted
+	case onlyDeleted:
+		listQuery.Deleted = OnlyDeleted
+	}
+	return listQuery, nil
+}
+
+// ListsDeleted tells whether the query parameters of a request ask for soft-deleted rows,
+// for routes to only allow it to some users
+func ListsDeleted(requestURL *url.URL) bool {
+	values := requestURL.Query()
+	return values.Has(WithDeletedParam) || values.Has(OnlyDeletedParam)
+}
+
+// flagParam reads a query parameter that is true when present without a value, e.g. ?onlyDeleted
+func flagParam(values url.Values, key string) (bool, error) {
+	if !values.Has(key) {
+		return false, nil
+	}
+	value := values.Get(key)
+	if value == "" {
+		return true, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%w: %s takes true or false", ErrInvalidListQuery, key)
+	}
+	return parsed, nil
+}
+
+// FindPage returns the page of a list query, with the total count and the cursors and links of the
+// neighbouring pages. scopes narrow the rows further, e.g. to those of a tenant.
+func (r *Repository[T]) FindPage(listQuery *ListQuery, scopes ...func(*gorm.DB) *gorm.DB) (*ListPage[T], error) {
+	entitySchema, err := r.schema()
+	if err != nil {
+		return nil, err
+	}
+	filters, err := listQuery.filterScope(r.DB, entitySchema)
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := listQuery.deletedScope(r.DB, entitySchema)
+	if err != nil {
+		return nil, err
+	}
+	filtered := func() *gorm.DB {
+		return r.CreateQueryBuilder().Scopes(scopes...).Scopes(filters, deleted)
+	}
+
+	var total int64
+	if err := filtered().Count(&total).Error; err != nil {
+		return nil, err
+	}
+
+	// The id breaks ties, so that rows have one order and cursors one position
+	sorts := listQuery.Sort
+	if !slices.ContainsFunc(sorts, func(s ListSort) bool { return s.Column == "id" }) {
+		sorts = append(slices.Clone(sorts), ListSort{Column: "id"})
+	}
+	fields := make([]*schema.Field, len(sorts))
+	for i, listSort := range sorts {
+		if fields[i] = entitySchema.LookUpField(listSort.Column); fields[i] == nil {
+			return nil, fmt.Errorf("%s has no column %s", entitySchema.Table, listSort.Column)
+		}
+	}
+
+	query := filtered()
+	backwards := listQuery.Before != ""
+	if cursor := listQuery.After + listQuery.Before; cursor != "" {
+		condition, args, err := keysetCondition(r.DB, entitySchema, sorts, fields, cursor, backwards)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where(condition, args...)
+	} else {
+		query = query.Offset((listQuery.Number - 1) * listQuery.Size)
+	}
+	for _, listSort := range sorts {
+		query = query.Order(clause.OrderByColumn{
+			Column: clause.Column{Table: entitySchema.Table, Name: listSort.Column},
+			Desc:   listSort.Desc != backwards,
+		})
+	}
+
+	// One more row tells whether there is a page after
+	var rows []T
+	if err := query.Limit(listQuery.Size + 1).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	more := len(rows) > listQuery.Size
+	if more {
+		rows = rows[:listQuery.Size]
+	}
+	if backwards {
+		slices.Reverse(rows)
+	}
+
+	page := &ListPage[T]{
+		Data: rows,
+		Meta: ListMeta{Total: total, PageSize: listQuery.Size},
+	}
+	var first, last string
+	if len(rows) > 0 {
+		sortSpec := sortSpec(sorts)
+		if first, err = encodeCursor(sortSpec, fields, rows[0]); err != nil {
+			return nil, err
+		}
+		if last, err = encodeCursor(sortSpec, fields, rows[len(rows)-1]); err != nil {
+			return nil, err
+		}
+	}
+
+	page.Links.Self = listQuery.link(nil)
+	page.Links.First = listQuery.link(map[string]string{})
+	switch {
+	case listQuery.After != "":
+		// Rows come after a cursor: there are rows before, on the page the cursor came from
+		page.Meta.PrevCursor = first
+		if more {
+			page.Meta.NextCursor = last
+		}
+	case backwards:
+		page.Meta.NextCursor = last
+		if more {
+			page.Meta.PrevCursor = first
+		}
+	default:
+		page.Meta.PageNumber = listQuery.Number
+		if more {
+			page.Meta.NextCursor = last
+			page.Links.Next = listQuery.link(map[string]string{"page[number]": strconv.Itoa(listQuery.Number + 1)})
+		}
+		if listQuery.Number > 1 {
+			page.Links.Prev = listQuery.link(map[string]string{"page[number]": strconv.Itoa(listQuery.Number - 1)})
+		}
+		return page, nil
+	}
+	if page.Meta.NextCursor != "" {
+		page.Links.Next = listQuery.link(map[string]string{"page[after]": page.Meta.NextCursor})
+	}
+	if page.Meta.PrevCursor != "" {
+		page.Links.Prev = listQuery.link(map[string]string{"page[before]": page.Meta.PrevCursor})
+	}
+	return page, nil
+}
+
+func (r *Repository[T]) schema() (*schema.Schema, error) {
+	var entity T
+	statement := &gorm.Statement{DB: r.DB}
+	if err := statement.Parse(&entity); err != nil {
+		return nil, fmt.Errorf("failed to parse model: %v", err)
+	}
+	return statement.Schema, nil
+}
+
+// filterScope is the WHERE clause of the filters of a list query
+func (listQuery *ListQuery) filterScope(db *gorm.DB, entitySchema *schema.Schema) (func(*gorm.DB) *gorm.DB, error) {
+	type condition struct {
+		query string
+		args  []any
+	}
+	conditions := make([]condition, 0, len(listQuery.Filters))
+	for _, filter := range listQuery.Filters {
+		field := entitySchema.LookUpField(filter.Column)
+		if field == nil {
+			return nil, fmt.Errorf("%s has no column %s", entitySchema.Table, filter.Column)
+		}
+		column := db.Statement.Quote(clause.Column{Table: entitySchema.Table, Name: filter.Column})
+
+		switch filter.Operator {
+		case "null":
+			isNull, err := strconv.ParseBool(filter.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: filter[%s][null] takes true or false", ErrInvalidListQuery, filter.Column)
+			}
+			if isNull {
+				conditions = append(conditions, condition{column + " IS NULL", nil})
+			} else {
+				conditions = append(conditions, condition{column + " IS NOT NULL", nil})
+			}
+		case "contains":
+			if fieldType(field).Kind() != reflect.String {
+				return nil, fmt.Errorf("%w: %s is not text, it cannot be filtered with contains", ErrInvalidListQuery, filter.Column)
+			}
+			like := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(filter.Value)
+			conditions = append(conditions, condition{column + "::text ILIKE ?", []any{"%" + like + "%"}})
+		case "in", "nin":
+			var values []any
+			for _, value := range strings.Split(filter.Value, ",") {
+				parsed, err := parseColumnValue(field, strings.TrimSpace(value))
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, parsed)
+			}
+			operator := map[string]string{"in": "IN", "nin": "NOT IN"}[filter.Operator]
+			conditions = append(conditions, condition{column + " " + operator + " ?", []any{values}})
+		default:
+			value, err := parseColumnValue(field, filter.Value)
+			if err != nil {
+				return nil, err
+			}
+			operator := map[string]string{"eq": "=", "ne": "<>", "gt": ">", "gte": ">=", "lt": "<", "lte": "<="}[filter.Operator]
+			conditions = append(conditions, condition{column + " " + operator + " ?", []any{value}})
+		}
+	}
+
+	return func(db *gorm.DB) *gorm.DB {
+		for _, condition := range conditions {
+			db = db.Where(condition.query, condition.args...)
+		}
+		return db
+	}, nil
+}
+
+// deletedScope lets the soft-deleted rows a list query asks for through
+func (listQuery *ListQuery) deletedScope(db *gorm.DB, entitySchema *schema.Schema) (func(*gorm.DB) *gorm.DB, error) {
+	if listQuery.Deleted == WithoutDeleted {
+		return func(db *gorm.DB) *gorm.DB { return db }, nil
+	}
+	if entitySchema.LookUpField("deleted_at") == nil {
+		return nil, fmt.Errorf("%w: %s are not soft-deleted", ErrInvalidListQuery, entitySchema.Table)
+	}
+	column := db.Statement.Quote(clause.Column{Table: entitySchema.Table, Name: "deleted_at"})
+	return func(db *gorm.DB) *gorm.DB {
+		db = db.Unscoped()
+		if listQuery.Deleted == OnlyDeleted {
+			db = db.Where(column + " IS NOT NULL")
+		}
+		return db
+	}, nil
+}
+
+// link is the URL of the request with its page parameters replaced by page (kept with nil)
+func (listQuery *ListQuery) link(page map[string]string) string {
+	link := listQuery.url
+	if page != nil {
+		values := link.Query()
+		for _, key := range []string{"page[number]", "page[after]", "page[before]"} {
+			values.Del(key)
+		}
+		for key, value := range page {
+			values.Set(key, value)
+		}
+		link.RawQuery = values.Encode()
+	}
+	link.Scheme, link.Host, link.User = "", "", nil
+	return link.RequestURI()
+}
+
+/* CURSORS */
+
+// listCursor is the position of a row in a sorted list: the values of its sort columns.
+// The sort is kept to refuse cursors of another order.
+type listCursor struct {
+	Sort   string   `json:"s"`
+	Values []string `json:"v"`
+}
+
+func sortSpec(sorts []ListSort) string {
+	spec := make([]string, len(sorts))
+	for i, listSort := range sorts {
+		spec[i] = listSort.Column
+		if listSort.Desc {
+			spec[i] = "-" + spec[i]
+		}
+	}
+	return strings.Join(spec, ",")
+}
+
+func encodeCursor[T any](sortSpec string, fields []*schema.Field, row T) (string, error) {
+	cursor := listCursor{Sort: sortSpec, Values: make([]string, len(fields))}
+	value := reflect.ValueOf(&row).Elem()
+	for i, field := range fields {
+		fieldValue, zero := field.ValueOf(context.Background(), value)
+		if reflected := reflect.ValueOf(fieldValue); !zero && reflected.Kind() == reflect.Pointer {
+			fieldValue = reflected.Elem().Interface()
+		}
+		switch fieldValue := fieldValue.(type) {
+		case time.Time:
+			cursor.Values[i] = fieldValue.Format(time.RFC3339Nano)
+		default:
+			cursor.Values[i] = fmt.Sprint(fieldValue)
+		}
+	}
+	encoded, err := json.Marshal(cursor)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode cursor: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(encoded), nil
+}
+
+// keysetCondition selects the rows after (or, backwards, before) the row of a cursor:
+// (a > x) OR (a = x AND b > y) OR ..., with < for descending columns
+func keysetCondition(db *gorm.DB, entitySchema *schema.Schema, sorts []ListSort, fields []*schema.Field, encoded string, backwards bool) (string, []any, error) {
+	var cursor listCursor
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err == nil {
+		err = json.Unmarshal(decoded, &cursor)
+	}
+	if err != nil || cursor.Sort != sortSpec(sorts) || len(cursor.Values) != len(sorts) {
+		return "", nil, fmt.Errorf("%w: the cursor is invalid or of another sort", ErrInvalidListQuery)
+	}
+
+	values := make([]any, len(fields))
+	for i, field := range fields {
+		if values[i], err = parseColumnValue(field, cursor.Values[i]); err != nil {
+			return "", nil, fmt.Errorf("%w: the cursor is invalid", ErrInvalidListQuery)
+		}
+	}
+
+	var alternatives []string
+	var args []any
+	for i, listSort := range sorts {
+		var terms []string
+		for j := 0; j < i; j++ {
+			terms = append(terms, db.Statement.Quote(clause.Column{Table: entitySchema.Table, Name: sorts[j].Column})+" = ?")
+			args = append(args, values[j])
+		}
+		operator := ">"
+		if listSort.Desc != backwards {
+			operator = "<"
+		}
+		terms = append(terms, db.Statement.Quote(clause.Column{Table: entitySchema.Table, Name: listSort.Column})+" "+operator+" ?")
+		args = append(args, values[i])
+		alternatives = append(alternatives, "("+strings.Join(terms, " AND ")+")")
+	}
+	return "(" + strings.Join(alternatives, " OR ") + ")", args, nil
+}
+
+// parseColumnValue converts a query parameter to the Go type of a column, for the driver to send it as such
+func parseColumnValue(field *schema.Field, value string) (any, error) {
+	invalid := func() error {
+		return fmt.Errorf("%w: %q is not a valid %s", ErrInvalidListQuery, value, field.DBName)
+	}
+	goType := fieldType(field)
+	if goType == reflect.TypeOf(time.Time{}) || goType == reflect.TypeOf(gorm.DeletedAt{}) {
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+			if parsed, err := time.Parse(layout, value); err == nil {
+				return parsed, nil
+			}
+		}
+		return nil, invalid()
+	}
+	switch goType.Kind() {
+	case reflect.String:
+		return value, nil
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, invalid()
+		}
+		return parsed, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, invalid()
+		}
+		return parsed, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, invalid()
+		}
+		return parsed, nil
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, invalid()
+		}
+		return parsed, nil
+	}
+	return nil, fmt.Errorf("%w: %s cannot be compared", ErrInvalidListQuery, field.DBName)
+}
+
+func fieldType(field *schema.Field) reflect.Type {
+	goType := field.FieldType
+	for goType.Kind() == reflect.Pointer {
+		goType = goType.Elem()
+	}
+	return goType
+}
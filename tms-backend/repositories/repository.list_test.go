@@ -0,0 +1,154 @@
+package repositories
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+var testListFields = ListFields{
+	Filter:      []string{"name", "count", "created_at"},
+	Sort:        []string{"name", "count", "created_at"},
+	DefaultSort: "-created_at",
+}
+
+func TestParseListQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  ListQuery
+	}{
+		{"", ListQuery{Sort: []ListSort{{"created_at", true}}, Size: global.LIST_DEFAULT_PAGE_SIZE, Number: 1}},
+		{"filter[name]=a&filter[count][gte]=2&filter[name][ne]=b&filter[name]=c", ListQuery{
+			Filters: []ListFilter{{"count", "gte", "2"}, {"name", "eq", "a"}, {"name", "eq", "c"}, {"name", "ne", "b"}},
+			Sort:    []ListSort{{"created_at", true}}, Size: global.LIST_DEFAULT_PAGE_SIZE, Number: 1,
+		}},
+		{"sort=name,-count,id&page[size]=5&page[number]=3", ListQuery{
+			Sort: []ListSort{{"name", false}, {"count", true}, {"id", false}}, Size: 5, Number: 3,
+		}},
+		{"sort= name , ,-id&page[size]=1000", ListQuery{Sort: []ListSort{{"name", false}, {"id", true}}, Size: global.LIST_MAX_PAGE_SIZE, Number: 1}},
+		{"page[after]=abc&other=1", ListQuery{Sort: []ListSort{{"created_at", true}}, Size: global.LIST_DEFAULT_PAGE_SIZE, Number: 1, After: "abc"}},
+		{"page[before]=abc", ListQuery{Sort: []ListSort{{"created_at", true}}, Size: global.LIST_DEFAULT_PAGE_SIZE, Number: 1, Before: "abc"}},
+		{"onlyDeleted", ListQuery{Sort: []ListSort{{"created_at", true}}, Size: global.LIST_DEFAULT_PAGE_SIZE, Number: 1, Deleted: OnlyDeleted}},
+		{"withDeleted=true&onlyDeleted=false", ListQuery{Sort: []ListSort{{"created_at", true}}, Size: global.LIST_DEFAULT_PAGE_SIZE, Number: 1, Deleted: WithDeleted}},
+	}
+	for _, test := range tests {
+		requestURL := &url.URL{Path: "/regions/", RawQuery: test.query}
+		got, err := ParseListQuery(requestURL, testListFields)
+		if err != nil {
+			t.Errorf("ParseListQuery(%s): %v", test.query, err)
+			continue
+		}
+		test.want.url = *requestURL
+		if !reflect.DeepEqual(*got, test.want) {
+			t.Errorf("ParseListQuery(%s) = %+v, want %+v", test.query, *got, test.want)
+		}
+	}
+}
+
+func TestParseListQueryRefuses(t *testing.T) {
+	for _, query := range []string{
+		"filter[password_hash]=x",
+		"filter[name][like]=x",
+		"filter[name]]=x",
+		"filter[na-me]=x",
+		"sort=password_hash",
+		"sort=-password_hash",
+		"page[size]=0",
+		"page[size]=ten",
+		"page[number]=-1",
+		"page[after]=a&page[before]=b",
+		"withDeleted=maybe",
+		"withDeleted&onlyDeleted",
+	} {
+		if _, err := ParseListQuery(&url.URL{RawQuery: query}, testListFields); !errors.Is(err, ErrInvalidListQuery) {
+			t.Errorf("ParseListQuery(%s) = %v, want ErrInvalidListQuery", query, err)
+		}
+	}
+}
+
+// testSchema is the schema of testDetail, parsed without a database: the Postgres dialect is only
+// used to quote the columns
+func testSchema(t *testing.T) (*gorm.DB, *schema.Schema) {
+	t.Helper()
+	db, err := gorm.Open(postgres.Open("host=localhost"), &gorm.Config{
+		DryRun:               true,
+		DisableAutomaticPing: true,
+		Logger:               logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repository := Repository[testDetail]{DB: db}
+	entitySchema, err := repository.schema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, entitySchema
+}
+
+func TestKeysetCondition(t *testing.T) {
+	db, entitySchema := testSchema(t)
+	sorts := []ListSort{{"name", false}, {"count", true}, {"id", false}}
+	fields := make([]*schema.Field, len(sorts))
+	for i, listSort := range sorts {
+		fields[i] = entitySchema.LookUpField(listSort.Column)
+	}
+	cursor, err := encodeCursor(sortSpec(sorts), fields, testDetail{ID: 7, Name: "b", Count: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		backwards bool
+		condition string
+	}{
+		{false, `(("test_details"."name" > ?) OR ("test_details"."name" = ? AND "test_details"."count" < ?) OR ("test_details"."name" = ? AND "test_details"."count" = ? AND "test_details"."id" > ?))`},
+		{true, `(("test_details"."name" < ?) OR ("test_details"."name" = ? AND "test_details"."count" > ?) OR ("test_details"."name" = ? AND "test_details"."count" = ? AND "test_details"."id" < ?))`},
+	}
+	wantArgs := []any{"b", "b", int64(3), "b", int64(3), uint64(7)}
+	for _, test := range tests {
+		condition, args, err := keysetCondition(db, entitySchema, sorts, fields, cursor, test.backwards)
+		if err != nil {
+			t.Errorf("backwards %v: %v", test.backwards, err)
+			continue
+		}
+		if condition != test.condition || !reflect.DeepEqual(args, wantArgs) {
+			t.Errorf("backwards %v: condition = %s %v, want %s %v", test.backwards, condition, args, test.condition, wantArgs)
+		}
+	}
+}
+
+func TestKeysetConditionRefuses(t *testing.T) {
+	db, entitySchema := testSchema(t)
+	sorts := []ListSort{{"created_at", true}, {"id", false}}
+	fields := []*schema.Field{entitySchema.LookUpField("created_at"), entitySchema.LookUpField("id")}
+	encode := func(cursor listCursor) string {
+		encoded, _ := json.Marshal(cursor)
+		return base64.RawURLEncoding.EncodeToString(encoded)
+	}
+	now := time.Now().Format(time.RFC3339Nano)
+
+	for name, cursor := range map[string]string{
+		"not base64":        "%%%",
+		"not JSON":          base64.RawURLEncoding.EncodeToString([]byte("cursor")),
+		"another sort":      encode(listCursor{Sort: "created_at,id", Values: []string{now, "7"}}),
+		"too few values":    encode(listCursor{Sort: "-created_at,id", Values: []string{now}}),
+		"not a time":        encode(listCursor{Sort: "-created_at,id", Values: []string{"yesterday", "7"}}),
+		"not a number":      encode(listCursor{Sort: "-created_at,id", Values: []string{now, "seven"}}),
+		"negative unsigned": encode(listCursor{Sort: "-created_at,id", Values: []string{now, "-7"}}),
+	} {
+		if _, _, err := keysetCondition(db, entitySchema, sorts, fields, cursor, false); !errors.Is(err, ErrInvalidListQuery) {
+			t.Errorf("%s: keysetCondition = %v, want ErrInvalidListQuery", name, err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package repositories
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+/* TRASH */
+
+// Records soft-deleted by Delete and Remove are in the trash: left out of queries, until they are
+// restored or purged (deleted for good)
+var (
+	ErrRestoreConflict = errors.New("a record with the same unique values exists, this one cannot be restored")
+	ErrStillReferenced = errors.New("the record is still referenced by others, it cannot be purged")
+)
+
+// FindDeletedByID finds a record in the trash, gorm.ErrRecordNotFound if it is not there
+func (r *Repository[T]) FindDeletedByID(id uint) (*T, error) {
+	var entity T
+	if err := r.DB.Unscoped().Where("deleted_at IS NOT NULL").First(&entity, id).Error; err != nil {
+		return nil, err
+	}
+	return &entity, nil
+}
+
+// Restore takes a record out of the trash. It is ErrRestoreConflict if a record created since
+// holds its unique values (e.g. a user who signed up again with the same email address).
+func (r *Repository[T]) Restore(id uint) (*T, error) {
+	result := r.DB.Unscoped().Model(new(T)).Where("id = ? AND deleted_at IS NOT NULL", id).Update("deleted_at", nil)
+	if result.Error != nil {
+		if isUniqueViolation(result.Error) {
+			return nil, fmt.Errorf("%w: %v", ErrRestoreConflict, result.Error)
+		}
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return r.FindByID(id)
+}
+
+// Purge deletes a record in the trash for good, with its rows in many-to-many join tables.
+// It returns the record purged; ErrStillReferenced if other records still point to it.
+func (r *Repository[T]) Purge(id uint) (*T, error) {
+	entity, err := r.FindDeletedByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.purge(entity); err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+
+// PurgeDeletedBefore purges at most limit records put in the trash before cutoff, in the order of
+// their IDs, and returns them. Records still referenced are skipped, to be purged once they are not:
+// it goes on past them, so they never hold back the others.
+func (r *Repository[T]) PurgeDeletedBefore(cutoff time.Time, limit int) ([]T, error) {
+	var purged []T
+	var lastSeen any = 0
+	for len(purged) < limit {
+		var entities []T
+		err := r.DB.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ? AND id > ?", cutoff, lastSeen).
+			Order("id").Limit(limit).Find(&entities).Error
+		if err != nil {
+			return purged, err
+		}
+
+		for i := 0; i < len(entities) && len(purged) < limit; i++ {
+			if err := r.purge(&entities[i]); err != nil {
+				if errors.Is(err, ErrStillReferenced) {
+					log.Printf("Warning: skipped purging %T: %v", entities[i], err)
+					continue
+				}
+				return purged, err
+			}
+			purged = append(purged, entities[i])
+		}
+		if len(entities) < limit {
+			break
+		}
+		if lastSeen, err = r.primaryKey(&entities[len(entities)-1]); err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+func (r *Repository[T]) purge(entity *T) error {
+	entitySchema, err := r.schema()
+	if err != nil {
+		return err
+	}
+	// Join rows only: Select would purge the records of other associations along
+	var joins []string
+	for _, relationship := range entitySchema.Relationships.Many2Many {
+		joins = append(joins, relationship.Name)
+	}
+
+	query := r.DB.Unscoped()
+	if len(joins) > 0 {
+		query = query.Select(joins)
+	}
+	if err := query.Delete(entity).Error; err != nil {
+		if isForeignKeyViolation(err) {
+			return fmt.Errorf("%w: %v", ErrStillReferenced, err)
+		}
+		return err
+	}
+	return nil
+}
+
+func isUniqueViolation(err error) bool {
+	return strings.Contains(err.Error(), "duplicate key") || strings.Contains(err.Error(), "unique constraint")
+}
+
+func isForeignKeyViolation(err error) bool {
+	return strings.Contains(err.Error(), "foreign key constraint")
+}
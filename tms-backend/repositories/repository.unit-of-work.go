@@ -0,0 +1,31 @@
+package repositories
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+)
+
+// UnitOfWork runs changes across several repositories atomically, e.g.
+//
+//	err := uow.Do(ctx, func(tx *gorm.DB) error {
+//		if _, err := userRepo.WithTx(tx).Create(user); err != nil {
+//			return err
+//		}
+//		_, err := teamRepo.WithTx(tx).Create(team)
+//		return err
+//	})
+type UnitOfWork struct {
+	DB *gorm.DB
+}
+
+func NewUnitOfWork(db *gorm.DB) *UnitOfWork {
+	return &UnitOfWork{DB: db}
+}
+
+// Do runs work in a transaction bound to ctx. The transaction is committed when work returns nil, and
+// rolled back when it returns an error or panics. Run inside another unit of work (a UnitOfWork on a
+// transaction), it uses a savepoint, so only its own changes are rolled back.
+func (u *UnitOfWork) Do(ctx context.Context, work func(tx *gorm.DB) error) error {
+	return u.DB.WithContext(ctx).Transaction(work)
+}
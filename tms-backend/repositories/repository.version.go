@@ -0,0 +1,113 @@
+package repositories
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm"
+)
+
+/* OPTIMISTIC CONCURRENCY */
+
+// Versioned records (those embedding models.Versioning) are updated only if they are still at the
+// version they were read at, so two people editing the same record cannot overwrite each other
+type Versioned interface {
+	GetVersion() uint
+	SetVersion(version uint)
+}
+
+// ConflictError is an update or delete of a versioned record made from a stale copy of it:
+// the record was changed by someone else since it was read
+type ConflictError struct {
+	Table          string
+	ID             any
+	Version        uint // the version the change was made from
+	CurrentVersion uint // the version of the record now
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s %v was changed by someone else (version %d, not %d), reload it and try again",
+		e.Table, e.ID, e.CurrentVersion, e.Version)
+}
+
+// NextVersion bumps the version of a versioned record updated column by column, e.g.
+//
+//	Updates(map[string]any{"logo": logo, "version": repositories.NextVersion})
+var NextVersion = gorm.Expr("version + 1")
+
+// DeleteVersion deletes a record like Delete, provided it is still at version: ConflictError if it is
+// not. Version 0 deletes it whatever its version.
+func (r *Repository[T]) DeleteVersion(id uint, version uint) error {
+	if version == 0 {
+		return r.Delete(id)
+	}
+	result := r.DB.Where("version = ?", version).Delete(new(T), id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return r.conflict(id, version)
+	}
+	return nil
+}
+
+// updateVersion is update for a versioned record: the version it was read at is checked and bumped
+func (r *Repository[T]) updateVersion(entity *T, versioned Versioned, columns []string) error {
+	id, err := r.primaryKey(entity)
+	if err != nil {
+		return err
+	}
+
+	version := versioned.GetVersion()
+	versioned.SetVersion(version + 1)
+	if len(columns) > 0 {
+		columns = append(columns[:len(columns):len(columns)], "Version")
+	}
+	result := r.updateQuery(entity, columns).Where("version = ?", version).Updates(entity)
+	if result.Error != nil || result.RowsAffected == 0 {
+		versioned.SetVersion(version)
+	}
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return r.conflict(id, version)
+	}
+	return nil
+}
+
+// conflict tells why a versioned change of record id touched no row: gorm.ErrRecordNotFound if the
+// record is gone, a ConflictError if it is at another version
+func (r *Repository[T]) conflict(id any, version uint) error {
+	entitySchema, err := r.schema()
+	if err != nil {
+		return err
+	}
+	var versions []uint
+	err = r.DB.Model(new(T)).Where(fmt.Sprintf("%q = ?", entitySchema.PrioritizedPrimaryField.DBName), id).
+		Pluck("version", &versions).Error
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return &ConflictError{Table: entitySchema.Table, ID: id, Version: version, CurrentVersion: versions[0]}
+}
+
+// primaryKey is the primary key of entity, nil if it is not set (a record not created yet)
+func (r *Repository[T]) primaryKey(entity *T) (any, error) {
+	entitySchema, err := r.schema()
+	if err != nil {
+		return nil, err
+	}
+	if entitySchema.PrioritizedPrimaryField == nil {
+		return nil, errors.New("versioned records need a primary key")
+	}
+	id, zero := entitySchema.PrioritizedPrimaryField.ValueOf(r.DB.Statement.Context, reflect.ValueOf(entity).Elem())
+	if zero {
+		return nil, nil
+	}
+	return id, nil
+}
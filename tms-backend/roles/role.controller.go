@@ -1,12 +1,16 @@
 package roles
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
 	dto "github.com/auditrakkr/tms-fullstack/tms-backend/dtos"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/etags"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/repositories"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 type RoleController struct {
@@ -46,17 +50,23 @@ func (rc *RoleController) UpdateRole(c *gin.Context) {
 		return
 	}
 
-	var updateRoleDto dto.UpdateUserDto
+	version, ok := etags.IfMatch(c)
+	if !ok {
+		return
+	}
+
+	var updateRoleDto dto.UpdateRoleDto
 	if err := c.ShouldBindJSON(&updateRoleDto); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
 		return
 	}
 
-	role, err := rc.roleService.Update(uint(roleId), &updateRoleDto)
+	role, err := rc.roleService.Update(uint(roleId), version, &updateRoleDto)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		etags.WriteChangeError(c, err, "Role")
 		return
 	}
+	etags.Set(c, role.Version)
 	c.JSON(http.StatusOK, gin.H{"role": role})
 }
 
@@ -67,22 +77,37 @@ func (rc *RoleController) SaveRole(c *gin.Context) {
 		return
 	}
 
-	role, err := rc.roleService.Save(role)
+	// Replacing a role needs If-Match, creating one does not
+	var version uint
+	if role != nil && role.ID != 0 {
+		var ok bool
+		if version, ok = etags.IfMatch(c); !ok {
+			return
+		}
+	}
+
+	role, err := rc.roleService.Save(role, version)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		etags.WriteChangeError(c, err, "Role")
 		return
 	}
+	etags.Set(c, role.Version)
 	c.JSON(http.StatusOK, gin.H{"role": role})	}
 
 
 /* FIND */
+// GetAllRoles lists a page of roles, filtered and sorted by the query parameters (see repositories.ListQuery)
 func (rc *RoleController) GetAllRoles(c *gin.Context) {
-	roles, err := rc.roleService.GetAllRoles()
+	roles, err := rc.roleService.FindAllWithOptions(c.Request.URL)
 	if err != nil {
+		if errors.Is(err, repositories.ErrInvalidListQuery) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"roles": roles})
+	c.JSON(http.StatusOK, roles)
 }
 
 
@@ -98,6 +123,7 @@ func (rc *RoleController) FindOne(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	etags.Set(c, role.Version)
 	c.JSON(http.StatusOK, gin.H{"role": role})
 }
 
@@ -109,10 +135,60 @@ func (rc *RoleController) DeleteRole(c *gin.Context) {
 		return
 	}
 
-	err = rc.roleService.Delete(uint(roleId))
+	version, ok := etags.IfMatch(c)
+	if !ok {
+		return
+	}
+
+	err = rc.roleService.Delete(uint(roleId), version)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		etags.WriteChangeError(c, err, "Role")
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"message": "Role deleted successfully"})
-}
\ No newline at end of file
+}
+
+/* TRASH */
+
+// RestoreRole takes a deleted role out of the trash
+func (rc *RoleController) RestoreRole(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role ID"})
+		return
+	}
+	role, err := rc.roleService.Restore(uint(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Role not found in the trash"})
+		case errors.Is(err, repositories.ErrRestoreConflict):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"role": role})
+}
+
+// PurgeRole deletes a role in the trash for good
+func (rc *RoleController) PurgeRole(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role ID"})
+		return
+	}
+	if err := rc.roleService.Purge(uint(id)); err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Role not found in the trash"})
+		case errors.Is(err, repositories.ErrStillReferenced):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -1,10 +1,14 @@
 package roles
 
 import (
+	"context"
 	"fmt"
+	"net/url"
+	"time"
 
 	"github.com/auditrakkr/tms-fullstack/tms-backend/database"
 	dto "github.com/auditrakkr/tms-fullstack/tms-backend/dtos"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/repositories"
 	"github.com/jinzhu/copier"
@@ -35,10 +39,15 @@ func (s *RoleService) CreateRole(createRoleDto *dto.CreateUserDto) (*models.Role
 }
 
 /* UPDATE */
-func (s *RoleService) Update(roleId uint, updateRoleDto *dto.UpdateUserDto) (*models.Role, error) {
+
+// Update changes the role provided it is still at version (the ETag read), whatever its version if 0
+func (s *RoleService) Update(roleId uint, version uint, updateRoleDto *dto.UpdateRoleDto) (*models.Role, error) {
 	role, err := s.roleRepo.FindByID(roleId)
 	if err != nil {
-		return nil, fmt.Errorf("failed to find role: %v", err)
+		return nil, fmt.Errorf("failed to find role: %w", err)
+	}
+	if version != 0 {
+		role.Version = version
 	}
 
 	if err := copier.Copy(role, updateRoleDto); err != nil {
@@ -47,25 +56,38 @@ func (s *RoleService) Update(roleId uint, updateRoleDto *dto.UpdateUserDto) (*mo
 
 	err = s.roleRepo.Update(role)
 	if err != nil {
-		return nil, fmt.Errorf("failed to update role: %v", err)
+		return nil, fmt.Errorf("failed to update role: %w", err)
 	}
 	return role, nil
 }
 
-func (s *RoleService) Save (role *models.Role) (*models.Role, error) {
+// Save creates the role, or replaces it provided it is still at version (0 for any version)
+func (s *RoleService) Save (role *models.Role, version uint) (*models.Role, error) {
+	if role != nil && role.ID != 0 {
+		if version == 0 {
+			current, err := s.roleRepo.FindByID(role.ID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to find role: %w", err)
+			}
+			version = current.Version
+		}
+		role.Version = version
+	}
+
 	role, err := s.roleRepo.Save(role)
 	if err != nil {
-		return nil, fmt.Errorf("failed to save role: %v", err)
+		return nil, fmt.Errorf("failed to save role: %w", err)
 	}
 	return role, nil
 }
 
 /* DELETE */
 
-func (s *RoleService) Delete(roleId uint) error {
-	err := s.roleRepo.Delete(roleId)
+// Delete deletes the role provided it is still at version (0 for any version)
+func (s *RoleService) Delete(roleId uint, version uint) error {
+	err := s.roleRepo.DeleteVersion(roleId, version)
 	if err != nil {
-		return fmt.Errorf("failed to delete role: %v", err)
+		return fmt.Errorf("failed to delete role: %w", err)
 	}
 	return nil
 }
@@ -78,13 +100,53 @@ func (s *RoleService) Remove (role *models.Role) (*models.Role, error) {
 	return &removedRole, nil
 }
 
+/* TRASH */
+
+// Restore takes a deleted role out of the trash
+func (s *RoleService) Restore(roleId uint) (*models.Role, error) {
+	role, err := s.roleRepo.Restore(roleId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore role: %w", err)
+	}
+	return role, nil
+}
+
+// Purge deletes a role in the trash for good
+func (s *RoleService) Purge(roleId uint) error {
+	if _, err := s.roleRepo.Purge(roleId); err != nil {
+		return fmt.Errorf("failed to purge role: %w", err)
+	}
+	return nil
+}
+
+// PurgeDeletedBefore purges roles put in the trash before cutoff, see trash.StartRetentionJob
+func (s *RoleService) PurgeDeletedBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	roles, err := s.roleRepo.WithContext(ctx).PurgeDeletedBefore(cutoff, global.TRASH_PURGE_BATCH_SIZE)
+	if err != nil {
+		return len(roles), fmt.Errorf("failed to purge deleted roles: %w", err)
+	}
+	return len(roles), nil
+}
+
 /* READ */
-func (s *RoleService) FindAllWithOptions(findOptions map[string]any) ([]models.Role, int64, error) {
-	roles, totalCount, err := s.roleRepo.FindAndCount(findOptions)
+// roleListFields are what the role list can be filtered and sorted by, see repositories.ListQuery
+var roleListFields = repositories.ListFields{
+	Filter:      []string{"id", "name", "landlord", "created_at", "updated_at", "deleted_at"},
+	Sort:        []string{"name", "created_at", "updated_at"},
+	DefaultSort: "name",
+}
+
+// FindAllWithOptions returns the page of roles the list query parameters of requestURL ask for
+func (s *RoleService) FindAllWithOptions(requestURL *url.URL) (*repositories.ListPage[models.Role], error) {
+	listQuery, err := repositories.ParseListQuery(requestURL, roleListFields)
+	if err != nil {
+		return nil, err
+	}
+	page, err := s.roleRepo.FindPage(listQuery)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to get all roles with options: %w", err)
+		return nil, fmt.Errorf("failed to get all roles with options: %w", err)
 	}
-	return roles, totalCount, nil
+	return page, nil
 }
 
 func (s *RoleService) GetAllRoles() ([]models.Role, error) {
@@ -1,8 +1,19 @@
 package main
 
 import (
+	"github.com/auditrakkr/tms-fullstack/tms-backend/apikeys"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/auth"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/auth/dtos"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/impersonations"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/keys"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/mail"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/regions"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/roles"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/scim"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/sessions"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/sso"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/storage"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/tenant-config-details"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/tenants"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/tenants/billings"
@@ -12,46 +23,169 @@ import (
 )
 
 func SetupTenantRoutes(router *gin.Engine) {
+	// Requests made while impersonating a user are recorded, whatever the route
+	router.Use(auth.AuditImpersonation())
+
 	tenantController := tenants.NewTenantController(tenants.NewTenantService())
 	themeController := themes.NewThemeController(themes.NewThemeService())
 	billingController := billings.NewBillingController(billings.NewBillingService())
+	apiKeyController := apikeys.NewApiKeyController(apikeys.NewApiKeyService())
+	impersonationController := impersonations.NewImpersonationController(impersonations.NewImpersonationService())
+	userService := users.NewUserService()
+	ssoController := sso.NewSSOController(sso.NewSSOService(userService))
 
 	tenantGroup := router.Group("/tenants")
 	{
-		tenantGroup.GET("/", tenantController.GetAllTenants)
-		tenantGroup.GET("/:id", tenantController.FindOne)
+		tenantGroup.GET("/", auth.RequireLandlordAdminForDeleted(), tenantController.GetAllTenants)
+		tenantGroup.GET("/:id", auth.RequireTenantMember(global.ScopeTenantsRead), tenantController.FindOne)
 		tenantGroup.GET("/get-active-tenants-in-region/:regionName", tenantController.FindActiveTenantsByRegionName)
 		tenantGroup.GET("/themes", themeController.FindAll)
-		tenantGroup.GET("/billings", billingController.FindAll)
+		tenantGroup.GET("/billings", auth.DenyImpersonation(), billingController.FindAll)
+		tenantGroup.GET("/:id/logo", storage.RequireSignedURL(), tenantController.GetTenantLogo)
+		tenantGroup.GET("/:id/logo-url", auth.RequireTenantMember(global.ScopeTenantsRead), tenantController.GetTenantLogoURL)
+		tenantGroup.GET("/:id/undeliverable-members", auth.RequireTenantAdmin(global.ScopeMailRead), tenantController.GetUndeliverableMembers)
 
-		tenantGroup.POST("/", tenantController.CreateTenant)
+		tenantGroup.POST("/", auth.DenyImpersonation(), auth.OptionalAuth(), tenantController.CreateTenant)
 		tenantGroup.POST("/themes", themeController.CreateTheme)
-		tenantGroup.POST("/billings", billingController.CreateBilling)
+		tenantGroup.POST("/billings", auth.DenyImpersonation(), billingController.CreateBilling)
+		tenantGroup.POST("/:id/logo", auth.RequireTenantAdmin(global.ScopeTenantsWrite), tenantController.SetTenantLogo)
+
+
+		tenantGroup.PATCH("/:id", auth.RequireTenantAdmin(global.ScopeTenantsWrite), tenantController.UpdateTenant)
+		tenantGroup.DELETE("/:id", auth.DenyImpersonation(), auth.RequireTenantAdmin(), tenantController.DeleteTenant)
+		tenantGroup.POST("/:id/restore", auth.DenyImpersonation(), auth.RequireLandlordAdmin(), tenantController.RestoreTenant)
+		tenantGroup.DELETE("/:id/purge", auth.DenyImpersonation(), auth.RequireLandlordAdmin(), tenantController.PurgeTenant)
+		tenantGroup.DELETE("/:id/logo", auth.RequireTenantAdmin(global.ScopeTenantsWrite), tenantController.DeleteTenantLogo)
+
+		// API keys of the tenant, for machine-to-machine access. Keys are shown once, by create and rotate
+		tenantGroup.GET("/:id/api-keys", auth.DenyImpersonation(), auth.RequireTenantAdmin(), apiKeyController.GetApiKeys)
+		tenantGroup.GET("/:id/api-keys/:apiKeyId", auth.DenyImpersonation(), auth.RequireTenantAdmin(), apiKeyController.GetApiKey)
+		tenantGroup.POST("/:id/api-keys", auth.DenyImpersonation(), auth.RequireTenantAdmin(), apiKeyController.CreateApiKey)
+		tenantGroup.POST("/:id/api-keys/:apiKeyId/rotate", auth.DenyImpersonation(), auth.RequireTenantAdmin(), apiKeyController.RotateApiKey)
+		tenantGroup.DELETE("/:id/api-keys/:apiKeyId", auth.DenyImpersonation(), auth.RequireTenantAdmin(), apiKeyController.DeleteApiKey)
 
+		// Who impersonated the tenant's users, and the requests they made
+		tenantGroup.GET("/:id/impersonations", auth.DenyImpersonation(), auth.RequireTenantAdmin(), impersonationController.GetTenantImpersonations)
+		tenantGroup.GET("/:id/impersonations/:impersonationId", auth.DenyImpersonation(), auth.RequireTenantAdmin(), impersonationController.GetTenantImpersonation)
 
-		tenantGroup.PATCH("/:id", tenantController.UpdateTenant)
-		tenantGroup.DELETE("/:id", tenantController.DeleteTenant)
+		// Single sign-on with the tenant's identity provider. GET also returns the URLs to configure the provider with
+		tenantGroup.GET("/:id/sso", auth.RequireTenantAdmin(), ssoController.GetSettings)
+		tenantGroup.PUT("/:id/sso", auth.DenyImpersonation(), auth.RequireTenantAdmin(), ssoController.UpdateSettings)
+		tenantGroup.DELETE("/:id/sso", auth.DenyImpersonation(), auth.RequireTenantAdmin(), ssoController.DeleteSettings)
+		tenantGroup.POST("/:id/sso/domains/:domain/verify", auth.DenyImpersonation(), auth.RequireTenantAdmin(), ssoController.VerifyDomain)
 	}
 
 
 	// Add other routes as needed
-	userController := users.NewUserController(users.NewUserService())
+	userController := users.NewUserController(userService)
+	sessionController := sessions.NewSessionController(sessions.NewSessionService())
+	authController := auth.NewAuthController(auth.NewAuthService(userService, auth.JwtConstants{}, dtos.GoogleProfileDto{}, dtos.FacebookProfileDto{}))
+	keyController := keys.NewKeyController()
+
+	authGroup := router.Group("/auth")
+	{
+		authGroup.POST("/login", authController.Login)
+		// Also the way in for users whose password must be changed
+		authGroup.POST("/change-password", auth.DenyImpersonation(), authController.ChangePassword)
+		authGroup.POST("/refresh", authController.Refresh)
+		authGroup.POST("/logout", auth.RequireAuth(), authController.Logout)
+
+		// Passwordless sign-in, for tenants with AuthEnabled.MagicLink. The emailed link opens
+		// the client app (global.MAGIC_LINK_CLIENT_PATH), which posts its token to verify
+		authGroup.POST("/magic-link", auth.DenyImpersonation(), authController.RequestMagicLink)
+		authGroup.POST("/magic-link/verify", authController.LoginWithMagicLink)
+		authGroup.POST("/keys/rotate", auth.RequireLandlordAdmin(), keyController.RotateKeys)
+
+		// Single sign-on with a tenant's identity provider (see sso.SSOController). The browser goes to
+		// login, the IdP sends it back to callback (OIDC) or acs (SAML), which sends it on to the client
+		// app (global.SSO_CLIENT_PATH) with a code the app posts to token
+		authGroup.GET("/sso/discover", ssoController.Discover)
+		authGroup.GET("/sso/:tenantId/login", ssoController.Login)
+		authGroup.GET("/sso/:tenantId/callback", ssoController.Callback)
+		authGroup.POST("/sso/:tenantId/saml/acs", ssoController.Callback)
+		authGroup.GET("/sso/:tenantId/saml/metadata", ssoController.Metadata)
+		authGroup.POST("/sso/token", authController.LoginWithSSO)
+
+		// Landlord support staff acting as a tenant user. Impersonation tokens are short-lived,
+		// recorded (see auth.AuditImpersonation) and kept from the routes with auth.DenyImpersonation
+		authGroup.POST("/impersonate", auth.DenyImpersonation(), auth.RequireAuth(), authController.Impersonate)
+		authGroup.POST("/impersonate/end", auth.RequireAuth(), authController.EndImpersonation)
+	}
+
+	// Public keys of access tokens, for other services to verify them
+	router.GET("/.well-known/jwks.json", keyController.GetJWKS)
+
+	// SCIM 2.0 provisioning of the team of a tenant by its identity provider, authenticated with
+	// a tenant API key holding the scim scope. Groups are the team roles (see scim.ScimService)
+	scimController := scim.NewScimController(scim.NewScimService(userService))
+	scimGroup := router.Group("/scim/v2", auth.RequireApiKey(global.ScopeSCIM))
+	{
+		scimGroup.GET("/ServiceProviderConfig", scimController.GetServiceProviderConfig)
+		scimGroup.GET("/ResourceTypes", scimController.GetResourceTypes)
+
+		scimGroup.GET("/Users", scimController.GetUsers)
+		scimGroup.GET("/Users/:id", scimController.GetUser)
+		scimGroup.POST("/Users", scimController.CreateUser)
+		scimGroup.PUT("/Users/:id", scimController.ReplaceUser)
+		scimGroup.PATCH("/Users/:id", scimController.PatchUser)
+		scimGroup.DELETE("/Users/:id", scimController.DeleteUser)
+
+		scimGroup.GET("/Groups", scimController.GetGroups)
+		scimGroup.GET("/Groups/:id", scimController.GetGroup)
+		scimGroup.POST("/Groups", scimController.CreateGroup)
+		scimGroup.PUT("/Groups/:id", scimController.ReplaceGroup)
+		scimGroup.PATCH("/Groups/:id", scimController.PatchGroup)
+		scimGroup.DELETE("/Groups/:id", scimController.DeleteGroup)
+	}
 
 	userGroup := router.Group("/users")
 	{
-		userGroup.GET("/", userController.GetAllUsers)
-		userGroup.GET("/:id", userController.FindOne)
+		// Signed-in devices of the caller
+		userGroup.GET("/me/sessions", auth.RequireAuth(), sessionController.GetMySessions)
+		userGroup.DELETE("/me/sessions", auth.DenyImpersonation(), auth.RequireAuth(), sessionController.DeleteMySessions)
+		userGroup.DELETE("/me/sessions/:sessionId", auth.DenyImpersonation(), auth.RequireAuth(), sessionController.DeleteMySession)
+
+		userGroup.GET("/", auth.RequireLandlordAdminForDeleted(), userController.GetAllUsers)
+		userGroup.GET("/:id", auth.RequireUserAccess(global.ScopeUsersRead), userController.FindOne)
+		userGroup.GET("/:id/photo", storage.RequireSignedURL(), userController.GetUserPhoto)
+		userGroup.GET("/:id/photo-url", auth.RequireUserAccess(global.ScopeUsersRead), userController.GetUserPhotoURL)
 
 		userGroup.POST("/", userController.CreateUser)
+		userGroup.POST("/:id/photo", auth.RequireUserAccess(global.ScopeUsersWrite), userController.SetUserPhoto)
+
+		// Email verification. The confirm routes are the links of the verification emails
+		userGroup.POST("/confirm-primary-email-request", auth.DenyImpersonation(), userController.ConfirmPrimaryEmailRequest)
+		userGroup.POST("/confirm-backup-email-request", auth.DenyImpersonation(), userController.ConfirmBackupEmailRequest)
+		userGroup.GET("/confirm-primary-email/:token", userController.ConfirmPrimaryEmail)
+		userGroup.GET("/confirm-backup-email/:token", userController.ConfirmBackupEmail)
+
+		// Password reset. The reset-password routes are the link of the email and its form
+		userGroup.POST("/reset-password-request", auth.DenyImpersonation(), userController.ResetPasswordRequest)
+		userGroup.GET("/reset-password/:token", userController.ResetPasswordForm)
+		userGroup.POST("/reset-password/:token", auth.DenyImpersonation(), userController.ResetPassword)
+
+		// Primary email address change. The confirm and revert routes are the links of the emails
+		userGroup.POST("/:id/change-email-request", auth.DenyImpersonation(), auth.RequireAuth(), userController.ChangeEmailRequest)
+		userGroup.GET("/confirm-email-change/:token", userController.ConfirmEmailChange)
+		userGroup.GET("/revert-email-change/:token", userController.RevertEmailChange)
 
-		userGroup.PATCH("/:id", userController.UpdateUser)
-		userGroup.DELETE("/:id", userController.DeleteUser)
+		// Lifts a lockout after failed sign-in attempts
+		userGroup.POST("/:id/unlock", auth.RequireLandlordAdmin(), userController.UnlockAccount)
+		// Signs every device of the user out
+		userGroup.DELETE("/:id/sessions", auth.RequireLandlordAdmin(), sessionController.DeleteUserSessions)
+
+		userGroup.PATCH("/:id", auth.DenyImpersonation(), auth.RequireUserAccess(global.ScopeUsersWrite), userController.UpdateUser)
+		userGroup.DELETE("/:id", auth.DenyImpersonation(), auth.RequireUserAccess(global.ScopeUsersWrite), userController.DeleteUser)
+		// Deleted users are in the trash (GET /users/?onlyDeleted), to be restored or purged for good
+		userGroup.POST("/:id/restore", auth.DenyImpersonation(), auth.RequireLandlordAdmin(), userController.RestoreUser)
+		userGroup.DELETE("/:id/purge", auth.DenyImpersonation(), auth.RequireLandlordAdmin(), userController.PurgeUser)
+		userGroup.DELETE("/:id/photo", auth.RequireUserAccess(global.ScopeUsersWrite), userController.DeleteUserPhoto)
 	}
 
 	regionController := regions.NewRegionController(regions.NewRegionService())
 	regionGroup := router.Group("/regions")
 	{
-		regionGroup.GET("/", regionController.GetAllRegions)
+		regionGroup.GET("/", auth.RequireLandlordAdminForDeleted(), regionController.GetAllRegions)
 		regionGroup.GET("/:regionId", regionController.FindOne)
 		regionGroup.GET("/by-name/:name", regionController.FindByName)
 		regionGroup.GET("/get-tenant-assignable-regions-info", regionController.GetTenantAssignableRegionsInfo)
@@ -62,6 +196,8 @@ func SetupTenantRoutes(router *gin.Engine) {
 		regionGroup.PATCH("/:regionId", regionController.UpdateRegion)
 		regionGroup.PUT("/", regionController.SaveRegion)
 		regionGroup.DELETE("/:regionId", regionController.DeleteRegion)
+		regionGroup.POST("/:regionId/restore", auth.DenyImpersonation(), auth.RequireLandlordAdmin(), regionController.RestoreRegion)
+		regionGroup.DELETE("/:regionId/purge", auth.DenyImpersonation(), auth.RequireLandlordAdmin(), regionController.PurgeRegion)
 
 		// Association endpoints
 		regionGroup.PATCH("/:regionId/tenant-config-detail/:tenantConfigDetailId", regionController.AddTenantConfigDetailById)
@@ -73,19 +209,21 @@ func SetupTenantRoutes(router *gin.Engine) {
 	tenantConfigDetailsController := tenantconfigdetails.NewTenantConfigDetailsController(tenantconfigdetails.NewTenantConfigDetailsService())
 	tenantConfigDetailsGroup := router.Group("/tenant-config-details")
 	{
-		tenantConfigDetailsGroup.GET("/", tenantConfigDetailsController.GetAllTenantConfigDetails)
+		tenantConfigDetailsGroup.GET("/", auth.RequireLandlordAdminForDeleted(), tenantConfigDetailsController.GetAllTenantConfigDetails)
 		tenantConfigDetailsGroup.GET("/:id", tenantConfigDetailsController.FindOne)
 
 		tenantConfigDetailsGroup.POST("/", tenantConfigDetailsController.CreateTenantConfigDetail)
 
 		tenantConfigDetailsGroup.PATCH("/:id", tenantConfigDetailsController.Update)
 		tenantConfigDetailsGroup.DELETE("/:id", tenantConfigDetailsController.Delete)
+		tenantConfigDetailsGroup.POST("/:id/restore", auth.DenyImpersonation(), auth.RequireLandlordAdmin(), tenantConfigDetailsController.RestoreTenantConfigDetail)
+		tenantConfigDetailsGroup.DELETE("/:id/purge", auth.DenyImpersonation(), auth.RequireLandlordAdmin(), tenantConfigDetailsController.PurgeTenantConfigDetail)
 	}
 
 	roleController := roles.NewRoleController(roles.NewRoleService())
 	roleGroup := router.Group("/roles")
 	{
-		roleGroup.GET("/", roleController.GetAllRoles)
+		roleGroup.GET("/", auth.RequireLandlordAdminForDeleted(), roleController.GetAllRoles)
 		roleGroup.GET("/:id", roleController.FindOne)
 
 		roleGroup.POST("/", roleController.CreateRole)
@@ -93,6 +231,26 @@ func SetupTenantRoutes(router *gin.Engine) {
 		roleGroup.PATCH("/:id", roleController.UpdateRole)
 		roleGroup.PUT("/", roleController.SaveRole)
 		roleGroup.DELETE("/:id", roleController.DeleteRole)
+		roleGroup.POST("/:id/restore", auth.DenyImpersonation(), auth.RequireLandlordAdmin(), roleController.RestoreRole)
+		roleGroup.DELETE("/:id/purge", auth.DenyImpersonation(), auth.RequireLandlordAdmin(), roleController.PurgeRole)
+	}
+
+	mailController := mail.NewMailController(mail.NewMailService())
+	mailGroup := router.Group("/mail")
+	{
+		// API keys with the mail scopes see the outbox of their tenant; suppressions span every tenant
+		mailGroup.GET("/templates", auth.RequireLandlordAdmin(), mailController.GetTemplates)
+		mailGroup.GET("/templates/:name/preview", auth.RequireLandlordAdmin(), mailController.PreviewTemplate)
+		mailGroup.GET("/outbox", auth.RequireLandlordAdmin(global.ScopeMailRead), mailController.GetOutboxEmails)
+		mailGroup.GET("/outbox/:id", auth.RequireLandlordAdmin(global.ScopeMailRead), mailController.GetOutboxEmail)
+
+		mailGroup.POST("/outbox/:id/resend", auth.DenyImpersonation(), auth.RequireLandlordAdmin(global.ScopeMailWrite), mailController.ResendEmail)
+
+		// Bounces and complaints
+		mailGroup.GET("/suppressions", auth.RequireLandlordAdmin(), mailController.GetSuppressions)
+		mailGroup.DELETE("/suppressions/:id", auth.DenyImpersonation(), auth.RequireLandlordAdmin(), mailController.LiftSuppression)
+		mailGroup.POST("/webhooks/dsn", mail.RequireWebhookToken(), mailController.HandleDSN)
+		mailGroup.POST("/webhooks/:provider", mail.RequireWebhookToken(), mailController.HandleWebhook)
 	}
 
 }
@@ -0,0 +1,287 @@
+package scim
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	dto "github.com/auditrakkr/tms-fullstack/tms-backend/dtos"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/gin-gonic/gin"
+)
+
+// ScimController serves SCIM 2.0 (RFC 7644) to the identity provider of a tenant, authenticated
+// with a tenant API key holding global.ScopeSCIM (see auth.RequireApiKey)
+type ScimController struct {
+	scimService *ScimService
+}
+
+func NewScimController(scimService *ScimService) *ScimController {
+	return &ScimController{
+		scimService: scimService,
+	}
+}
+
+/* DISCOVERY */
+
+// GetServiceProviderConfig tells identity providers what this SCIM service supports
+func (sc *ScimController) GetServiceProviderConfig(c *gin.Context) {
+	respond(c, http.StatusOK, gin.H{
+		"schemas":        []string{ServiceProviderConfigSchema},
+		"patch":          gin.H{"supported": true},
+		"bulk":           gin.H{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         gin.H{"supported": true, "maxResults": global.SCIM_MAX_PAGE_SIZE},
+		"changePassword": gin.H{"supported": false},
+		"sort":           gin.H{"supported": false},
+		"etag":           gin.H{"supported": false},
+		"authenticationSchemes": []gin.H{{
+			"type":        "oauthbearertoken",
+			"name":        "API key",
+			"description": "A tenant API key with the scim scope, as a bearer token",
+			"primary":     true,
+		}},
+	})
+}
+
+// GetResourceTypes lists the resources of this SCIM service
+func (sc *ScimController) GetResourceTypes(c *gin.Context) {
+	resourceTypes := []gin.H{
+		{"schemas": []string{ResourceTypeSchema}, "id": "User", "name": "User", "endpoint": "/Users", "schema": UserSchema},
+		{"schemas": []string{ResourceTypeSchema}, "id": "Group", "name": "Group", "endpoint": "/Groups", "schema": GroupSchema},
+	}
+	respond(c, http.StatusOK, listResponse(int64(len(resourceTypes)), 1, resourceTypes))
+}
+
+/* USERS */
+
+// GetUsers lists the users on the team of the tenant, e.g. with ?filter=userName eq "jane@example.com"
+func (sc *ScimController) GetUsers(c *gin.Context) {
+	startIndex, count, ok := pagination(c)
+	if !ok {
+		return
+	}
+	list, err := sc.scimService.FindUsers(c.GetUint(global.CONTEXT_TENANT_ID_KEY), c.Query("filter"), startIndex, count, c)
+	if err != nil {
+		errorResponse(c, err)
+		return
+	}
+	respond(c, http.StatusOK, list)
+}
+
+func (sc *ScimController) GetUser(c *gin.Context) {
+	user, err := sc.scimService.FindUser(c.GetUint(global.CONTEXT_TENANT_ID_KEY), c.Param("id"), c)
+	if err != nil {
+		errorResponse(c, err)
+		return
+	}
+	respond(c, http.StatusOK, user)
+}
+
+func (sc *ScimController) CreateUser(c *gin.Context) {
+	var userDto dto.ScimUserDto
+	if !bindJSON(c, &userDto) {
+		return
+	}
+	user, err := sc.scimService.CreateUser(c.GetUint(global.CONTEXT_TENANT_ID_KEY), &userDto, c)
+	if err != nil {
+		errorResponse(c, err)
+		return
+	}
+	c.Header("Location", user.Meta.Location)
+	respond(c, http.StatusCreated, user)
+}
+
+func (sc *ScimController) ReplaceUser(c *gin.Context) {
+	var userDto dto.ScimUserDto
+	if !bindJSON(c, &userDto) {
+		return
+	}
+	user, err := sc.scimService.ReplaceUser(c.GetUint(global.CONTEXT_TENANT_ID_KEY), c.Param("id"), &userDto, c)
+	if err != nil {
+		errorResponse(c, err)
+		return
+	}
+	respond(c, http.StatusOK, user)
+}
+
+// PatchUser changes some attributes of a user; "active": false deactivates the account
+func (sc *ScimController) PatchUser(c *gin.Context) {
+	var patchDto dto.ScimPatchDto
+	if !bindPatch(c, &patchDto) {
+		return
+	}
+	user, err := sc.scimService.PatchUser(c.GetUint(global.CONTEXT_TENANT_ID_KEY), c.Param("id"), &patchDto, c)
+	if err != nil {
+		errorResponse(c, err)
+		return
+	}
+	respond(c, http.StatusOK, user)
+}
+
+// DeleteUser removes the user from the team of the tenant
+func (sc *ScimController) DeleteUser(c *gin.Context) {
+	if err := sc.scimService.DeleteUser(c.GetUint(global.CONTEXT_TENANT_ID_KEY), c.Param("id")); err != nil {
+		errorResponse(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+/* GROUPS */
+
+// GetGroups lists the team roles of the tenant and their members, without them with ?excludedAttributes=members
+func (sc *ScimController) GetGroups(c *gin.Context) {
+	startIndex, count, ok := pagination(c)
+	if !ok {
+		return
+	}
+	list, err := sc.scimService.FindGroups(c.GetUint(global.CONTEXT_TENANT_ID_KEY), c.Query("filter"), startIndex, count, membersExcluded(c), c)
+	if err != nil {
+		errorResponse(c, err)
+		return
+	}
+	respond(c, http.StatusOK, list)
+}
+
+func (sc *ScimController) GetGroup(c *gin.Context) {
+	group, err := sc.scimService.FindGroup(c.GetUint(global.CONTEXT_TENANT_ID_KEY), c.Param("id"), membersExcluded(c), c)
+	if err != nil {
+		errorResponse(c, err)
+		return
+	}
+	respond(c, http.StatusOK, group)
+}
+
+func (sc *ScimController) CreateGroup(c *gin.Context) {
+	var groupDto dto.ScimGroupDto
+	if !bindJSON(c, &groupDto) {
+		return
+	}
+	group, err := sc.scimService.CreateGroup(c.GetUint(global.CONTEXT_TENANT_ID_KEY), &groupDto, c)
+	if err != nil {
+		errorResponse(c, err)
+		return
+	}
+	c.Header("Location", group.Meta.Location)
+	respond(c, http.StatusCreated, group)
+}
+
+func (sc *ScimController) ReplaceGroup(c *gin.Context) {
+	var groupDto dto.ScimGroupDto
+	if !bindJSON(c, &groupDto) {
+		return
+	}
+	group, err := sc.scimService.ReplaceGroup(c.GetUint(global.CONTEXT_TENANT_ID_KEY), c.Param("id"), &groupDto, c)
+	if err != nil {
+		errorResponse(c, err)
+		return
+	}
+	respond(c, http.StatusOK, group)
+}
+
+// PatchGroup adds and removes members. It answers without the group, whose members can be many.
+func (sc *ScimController) PatchGroup(c *gin.Context) {
+	var patchDto dto.ScimPatchDto
+	if !bindPatch(c, &patchDto) {
+		return
+	}
+	if err := sc.scimService.PatchGroup(c.GetUint(global.CONTEXT_TENANT_ID_KEY), c.Param("id"), &patchDto); err != nil {
+		errorResponse(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// DeleteGroup takes the role from every member
+func (sc *ScimController) DeleteGroup(c *gin.Context) {
+	if err := sc.scimService.DeleteGroup(c.GetUint(global.CONTEXT_TENANT_ID_KEY), c.Param("id")); err != nil {
+		errorResponse(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// respond writes a SCIM response: JSON, with the SCIM media type
+func respond(c *gin.Context, status int, body any) {
+	c.Header("Content-Type", ContentType)
+	c.JSON(status, body)
+}
+
+func errorResponse(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrUserNotFound), errors.Is(err, ErrGroupNotFound):
+		scimError(c, http.StatusNotFound, "", err.Error())
+	case errors.Is(err, ErrUniqueness), errors.Is(err, ErrForeignAccount):
+		scimError(c, http.StatusConflict, "uniqueness", err.Error())
+	case errors.Is(err, ErrInvalidFilter):
+		scimError(c, http.StatusBadRequest, "invalidFilter", err.Error())
+	case errors.Is(err, ErrInvalidValue):
+		scimError(c, http.StatusBadRequest, "invalidValue", err.Error())
+	case errors.Is(err, ErrInvalidPath):
+		scimError(c, http.StatusBadRequest, "invalidPath", err.Error())
+	case errors.Is(err, ErrMutability), errors.Is(err, ErrSharedAccount):
+		scimError(c, http.StatusBadRequest, "mutability", err.Error())
+	default:
+		log.Printf("Error serving SCIM request %s %s: %v", c.Request.Method, c.Request.URL.Path, err)
+		scimError(c, http.StatusInternalServerError, "", err.Error())
+	}
+}
+
+func scimError(c *gin.Context, status int, scimType string, detail string) {
+	respond(c, status, dto.ScimErrorDto{
+		Schemas:  []string{ErrorSchema},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	})
+}
+
+func bindJSON(c *gin.Context, body any) bool {
+	if err := c.ShouldBindJSON(body); err != nil {
+		scimError(c, http.StatusBadRequest, "invalidSyntax", "Invalid request payload: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func bindPatch(c *gin.Context, patchDto *dto.ScimPatchDto) bool {
+	if !bindJSON(c, patchDto) {
+		return false
+	}
+	if len(patchDto.Operations) == 0 {
+		scimError(c, http.StatusBadRequest, "invalidSyntax", "Invalid request payload: Operations are required")
+		return false
+	}
+	return true
+}
+
+// pagination reads the 1-based startIndex and the count of a list request
+func pagination(c *gin.Context) (int, int, bool) {
+	startIndex, count := 1, global.SCIM_DEFAULT_PAGE_SIZE
+	var err error
+	if value := c.Query("startIndex"); value != "" {
+		if startIndex, err = strconv.Atoi(value); err != nil {
+			scimError(c, http.StatusBadRequest, "invalidValue", "startIndex must be a number")
+			return 0, 0, false
+		}
+	}
+	if value := c.Query("count"); value != "" {
+		if count, err = strconv.Atoi(value); err != nil {
+			scimError(c, http.StatusBadRequest, "invalidValue", "count must be a number")
+			return 0, 0, false
+		}
+	}
+	// Out of range values are clamped, as RFC 7644 section 3.4.2.4 asks
+	return max(startIndex, 1), min(max(count, 0), global.SCIM_MAX_PAGE_SIZE), true
+}
+
+func membersExcluded(c *gin.Context) bool {
+	for _, attribute := range strings.Split(c.Query("excludedAttributes"), ",") {
+		if strings.EqualFold(strings.TrimSpace(attribute), "members") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/* FILTERS */
+
+// comparison is an attribute expression of a filter (RFC 7644 section 3.4.2.2), e.g. userName eq "bjensen"
+type comparison struct {
+	attribute string // lower-cased, without schema URN or value filter
+	operator  string // eq, ne, co, sw, ew or pr
+	value     any    // string, bool, float64 or nil
+}
+
+// parseFilter parses a filter of comparisons joined by "and", which is what identity providers send
+// to find users and groups. "or", "not" and grouping are refused with ErrInvalidFilter.
+func parseFilter(filter string) ([]comparison, error) {
+	var comparisons []comparison
+	rest := strings.TrimSpace(filter)
+	for rest != "" {
+		var attribute, operator string
+		attribute, rest = nextToken(rest)
+		operator, rest = nextToken(rest)
+		if attribute == "" || operator == "" || strings.HasPrefix(attribute, "(") || strings.EqualFold(attribute, "not") {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidFilter, filter)
+		}
+		cmp := comparison{attribute: normalizeAttribute(attribute), operator: strings.ToLower(operator)}
+		switch cmp.operator {
+		case "pr":
+		case "eq", "ne", "co", "sw", "ew":
+			var err error
+			if cmp.value, rest, err = nextValue(rest); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidFilter, err)
+			}
+		default:
+			return nil, fmt.Errorf("%w: unsupported operator %q", ErrInvalidFilter, operator)
+		}
+		comparisons = append(comparisons, cmp)
+
+		if rest == "" {
+			break
+		}
+		var join string
+		join, rest = nextToken(rest)
+		if !strings.EqualFold(join, "and") || rest == "" {
+			return nil, fmt.Errorf("%w: only comparisons joined by \"and\" are supported", ErrInvalidFilter)
+		}
+	}
+	return comparisons, nil
+}
+
+// nextToken returns the word s starts with, which runs to the first space outside brackets
+func nextToken(s string) (string, string) {
+	depth := 0
+	for i, r := range s {
+		switch {
+		case r == '[':
+			depth++
+		case r == ']':
+			depth--
+		case r == ' ' && depth == 0:
+			return s[:i], strings.TrimSpace(s[i:])
+		}
+	}
+	return s, ""
+}
+
+// nextValue returns the value s starts with: a JSON string, true, false, null or a number
+func nextValue(s string) (any, string, error) {
+	if strings.HasPrefix(s, `"`) {
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				var value string
+				if err := json.Unmarshal([]byte(s[:i+1]), &value); err != nil {
+					return nil, "", fmt.Errorf("invalid string %s", s[:i+1])
+				}
+				return value, strings.TrimSpace(s[i+1:]), nil
+			}
+		}
+		return nil, "", fmt.Errorf("unterminated string %s", s)
+	}
+
+	token, rest := nextToken(s)
+	switch strings.ToLower(token) {
+	case "true":
+		return true, rest, nil
+	case "false":
+		return false, rest, nil
+	case "null":
+		return nil, rest, nil
+	}
+	number, err := strconv.ParseFloat(token, 64)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid value %q", token)
+	}
+	return number, rest, nil
+}
+
+// normalizeAttribute lower-cases an attribute path and drops its schema URN and value filter:
+// urn:ietf:params:scim:schemas:core:2.0:User:emails[type eq "work"].value is emails.value
+func normalizeAttribute(attribute string) string {
+	if open := strings.Index(attribute, "["); open >= 0 {
+		if end := strings.LastIndex(attribute, "]"); end > open {
+			attribute = attribute[:open] + attribute[end+1:]
+		}
+	}
+	for _, schema := range []string{UserSchema, GroupSchema} {
+		if len(attribute) > len(schema) && strings.EqualFold(attribute[:len(schema)], schema) && attribute[len(schema)] == ':' {
+			attribute = attribute[len(schema)+1:]
+			break
+		}
+	}
+	return strings.ToLower(attribute)
+}
+
+// matches evaluates a string comparison, case-insensitively like the attributes it is used for
+func (cmp comparison) matches(actual string) bool {
+	if cmp.operator == "pr" {
+		return actual != ""
+	}
+	expected, ok := cmp.value.(string)
+	if !ok {
+		return false
+	}
+	actual, expected = strings.ToLower(actual), strings.ToLower(expected)
+	switch cmp.operator {
+	case "eq":
+		return actual == expected
+	case "ne":
+		return actual != expected
+	case "co":
+		return strings.Contains(actual, expected)
+	case "sw":
+		return strings.HasPrefix(actual, expected)
+	case "ew":
+		return strings.HasSuffix(actual, expected)
+	}
+	return false
+}
+
+// condition is the SQL condition of a string comparison on column, case-insensitive unless caseExact
+func (cmp comparison) condition(column string, caseExact bool) (string, []any, error) {
+	if cmp.operator == "pr" {
+		return fmt.Sprintf("COALESCE(%s, '') <> ''", column), nil, nil
+	}
+	value, ok := cmp.value.(string)
+	if !ok {
+		return "", nil, fmt.Errorf("%w: %s takes a string", ErrInvalidFilter, cmp.attribute)
+	}
+	if !caseExact {
+		column, value = "LOWER("+column+")", strings.ToLower(value)
+	}
+	like := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+	switch cmp.operator {
+	case "eq":
+		return column + " = ?", []any{value}, nil
+	case "ne":
+		return column + " <> ?", []any{value}, nil
+	case "co":
+		return column + " LIKE ?", []any{"%" + like + "%"}, nil
+	case "sw":
+		return column + " LIKE ?", []any{like + "%"}, nil
+	default:
+		return column + " LIKE ?", []any{"%" + like}, nil
+	}
+}
@@ -0,0 +1,104 @@
+package scim
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   []comparison
+	}{
+		{``, nil},
+		{`userName eq "bjensen@example.com"`, []comparison{{"username", "eq", "bjensen@example.com"}}},
+		{`userName Eq "b \"j\" jensen"`, []comparison{{"username", "eq", `b "j" jensen`}}},
+		{`externalId pr`, []comparison{{"externalid", "pr", nil}}},
+		{`active eq true and name.familyName sw "Jen"`, []comparison{{"active", "eq", true}, {"name.familyname", "sw", "Jen"}}},
+		{`emails[type eq "work"].value co "@example.com"`, []comparison{{"emails.value", "co", "@example.com"}}},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName ew ".com"`, []comparison{{"username", "ew", ".com"}}},
+		{`displayName ne null`, []comparison{{"displayname", "ne", nil}}},
+		{`meta.version eq 2`, []comparison{{"meta.version", "eq", float64(2)}}},
+	}
+	for _, test := range tests {
+		got, err := parseFilter(test.filter)
+		if err != nil {
+			t.Errorf("parseFilter(%s): %v", test.filter, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseFilter(%s) = %+v, want %+v", test.filter, got, test.want)
+		}
+	}
+}
+
+func TestParseFilterRefuses(t *testing.T) {
+	for _, filter := range []string{
+		`userName eq "a" or userName eq "b"`,
+		`not (userName eq "a")`,
+		`(userName eq "a")`,
+		`userName gt "a"`,
+		`userName eq`,
+		`userName eq "unterminated`,
+		`userName eq bjensen`,
+		`userName eq "a" and`,
+		`userName`,
+	} {
+		if _, err := parseFilter(filter); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("parseFilter(%s) = %v, want ErrInvalidFilter", filter, err)
+		}
+	}
+}
+
+func TestComparisonMatches(t *testing.T) {
+	tests := []struct {
+		cmp    comparison
+		actual string
+		want   bool
+	}{
+		{comparison{"username", "eq", "BJensen@example.com"}, "bjensen@example.com", true},
+		{comparison{"username", "ne", "bjensen@example.com"}, "bjensen@example.com", false},
+		{comparison{"username", "co", "jens"}, "bjensen@example.com", true},
+		{comparison{"username", "sw", "bj"}, "bjensen@example.com", true},
+		{comparison{"username", "ew", ".org"}, "bjensen@example.com", false},
+		{comparison{"externalid", "pr", nil}, "", false},
+		{comparison{"externalid", "pr", nil}, "42", true},
+		{comparison{"username", "eq", true}, "true", false},
+	}
+	for _, test := range tests {
+		if got := test.cmp.matches(test.actual); got != test.want {
+			t.Errorf("%+v matches %q = %v, want %v", test.cmp, test.actual, got, test.want)
+		}
+	}
+}
+
+func TestComparisonCondition(t *testing.T) {
+	tests := []struct {
+		cmp       comparison
+		caseExact bool
+		condition string
+		values    []any
+	}{
+		{comparison{"username", "eq", "BJensen"}, false, "LOWER(primary_email_address) = ?", []any{"bjensen"}},
+		{comparison{"externalid", "eq", "AbC"}, true, "primary_email_address = ?", []any{"AbC"}},
+		{comparison{"username", "co", "50%_off"}, false, "LOWER(primary_email_address) LIKE ?", []any{`%50\%\_off%`}},
+		{comparison{"username", "sw", "b"}, false, "LOWER(primary_email_address) LIKE ?", []any{"b%"}},
+		{comparison{"username", "ew", ".com"}, false, "LOWER(primary_email_address) LIKE ?", []any{"%.com"}},
+		{comparison{"username", "pr", nil}, false, "COALESCE(primary_email_address, '') <> ''", nil},
+	}
+	for _, test := range tests {
+		condition, values, err := test.cmp.condition("primary_email_address", test.caseExact)
+		if err != nil {
+			t.Errorf("%+v: %v", test.cmp, err)
+			continue
+		}
+		if condition != test.condition || !reflect.DeepEqual(values, test.values) {
+			t.Errorf("%+v condition = %q %v, want %q %v", test.cmp, condition, values, test.condition, test.values)
+		}
+	}
+
+	if _, _, err := (comparison{"active", "eq", true}).condition("is_active", false); !errors.Is(err, ErrInvalidFilter) {
+		t.Errorf("condition of a boolean = %v, want ErrInvalidFilter", err)
+	}
+}
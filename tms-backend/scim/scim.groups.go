@@ -0,0 +1,365 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	dto "github.com/auditrakkr/tms-fullstack/tms-backend/dtos"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+/* GROUPS */
+
+// teamRoles are the groups of every tenant, their ids and display names the role names
+var teamRoles = []global.TenantTeamRole{global.A, global.M, global.E}
+
+// groupMember is a user with a team role
+type groupMember struct {
+	ID        uint
+	FirstName string
+	LastName  string
+}
+
+// FindGroups lists the groups of a tenant, optionally filtered, with their members unless excludeMembers
+func (s *ScimService) FindGroups(tenantId uint, filter string, startIndex int, count int, excludeMembers bool, c *gin.Context) (*dto.ScimListResponseDto, error) {
+	comparisons, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	withMembers := !excludeMembers
+	for _, cmp := range comparisons {
+		switch cmp.attribute {
+		case "id", "displayname":
+		case "members", "members.value":
+			withMembers = true
+		default:
+			return nil, fmt.Errorf("%w: cannot filter groups by %s", ErrInvalidFilter, cmp.attribute)
+		}
+	}
+
+	groups := []dto.ScimGroupDto{}
+	for _, role := range teamRoles {
+		group, err := s.groupResource(tenantId, role, withMembers, c)
+		if err != nil {
+			return nil, err
+		}
+		if groupMatches(group, comparisons) {
+			if excludeMembers {
+				group.Members = nil
+			}
+			groups = append(groups, *group)
+		}
+	}
+
+	total := len(groups)
+	groups = groups[min(startIndex-1, total):min(startIndex-1+count, total)]
+	return listResponse(int64(total), startIndex, groups), nil
+}
+
+// FindGroup returns a group of a tenant, with its members unless excludeMembers
+func (s *ScimService) FindGroup(tenantId uint, id string, excludeMembers bool, c *gin.Context) (*dto.ScimGroupDto, error) {
+	role, err := findRole(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.groupResource(tenantId, role, !excludeMembers, c)
+}
+
+// CreateGroup sets the members of the group of its displayName: groups are the team roles and
+// cannot be created, but identity providers push their groups by creating them
+func (s *ScimService) CreateGroup(tenantId uint, groupDto *dto.ScimGroupDto, c *gin.Context) (*dto.ScimGroupDto, error) {
+	role, err := findRole(groupDto.DisplayName)
+	if err != nil {
+		return nil, fmt.Errorf("%w: groups are the team roles %v", ErrInvalidValue, teamRoles)
+	}
+	return s.ReplaceGroup(tenantId, string(role), groupDto, c)
+}
+
+// ReplaceGroup gives the role of a group to its members, and takes it from the other users on the team
+func (s *ScimService) ReplaceGroup(tenantId uint, id string, groupDto *dto.ScimGroupDto, c *gin.Context) (*dto.ScimGroupDto, error) {
+	role, err := findRole(id)
+	if err != nil {
+		return nil, err
+	}
+	if groupDto.DisplayName != "" && !strings.EqualFold(groupDto.DisplayName, string(role)) {
+		return nil, fmt.Errorf("%w: displayName", ErrMutability)
+	}
+	ids := make([]string, len(groupDto.Members))
+	for i, member := range groupDto.Members {
+		ids[i] = member.Value
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		return s.setMembers(tx, tenantId, role, ids)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.groupResource(tenantId, role, true, c)
+}
+
+// PatchGroup applies the operations of a PATCH request to the members of a group, all or none of them
+func (s *ScimService) PatchGroup(tenantId uint, id string, patchDto *dto.ScimPatchDto) error {
+	role, err := findRole(id)
+	if err != nil {
+		return err
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for _, operation := range patchDto.Operations {
+			if err := s.applyGroupOperation(tx, tenantId, role, operation); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteGroup takes the role of a group from every user on the team; the group itself stays
+func (s *ScimService) DeleteGroup(tenantId uint, id string) error {
+	role, err := findRole(id)
+	if err != nil {
+		return err
+	}
+	return s.removeMembers(s.db, tenantId, role, nil)
+}
+
+// applyGroupOperation applies an operation on the members of a group: add, replace or remove
+// them by a list, or remove one by path, e.g. members[value eq "12"]
+func (s *ScimService) applyGroupOperation(tx *gorm.DB, tenantId uint, role global.TenantTeamRole, operation dto.ScimPatchOperationDto) error {
+	op := strings.ToLower(operation.Op)
+	if op != "add" && op != "replace" && op != "remove" {
+		return fmt.Errorf("%w: unsupported op %q", ErrInvalidValue, operation.Op)
+	}
+
+	switch attribute := normalizeAttribute(operation.Path); attribute {
+	case "", "members":
+		if op == "remove" {
+			if attribute == "" {
+				return fmt.Errorf("%w: remove needs a path", ErrInvalidPath)
+			}
+			if selected, ok, err := selectedMember(operation.Path); err != nil {
+				return err
+			} else if ok {
+				return s.removeMembers(tx, tenantId, role, []string{selected})
+			}
+			if len(operation.Value) == 0 {
+				return s.removeMembers(tx, tenantId, role, nil)
+			}
+		}
+		if attribute == "" {
+			var group struct {
+				DisplayName *string              `json:"displayName"`
+				Members     *[]dto.ScimMemberDto `json:"members"`
+			}
+			if err := json.Unmarshal(operation.Value, &group); err != nil {
+				return fmt.Errorf("%w: an operation without a path takes an object", ErrInvalidValue)
+			}
+			if group.DisplayName != nil && !strings.EqualFold(*group.DisplayName, string(role)) {
+				return fmt.Errorf("%w: displayName", ErrMutability)
+			}
+			if group.Members == nil {
+				return nil
+			}
+		}
+		ids, err := memberIds(operation.Value)
+		if err != nil {
+			return err
+		}
+		switch op {
+		case "add":
+			return s.addMembers(tx, tenantId, role, ids)
+		case "replace":
+			return s.setMembers(tx, tenantId, role, ids)
+		default:
+			return s.removeMembers(tx, tenantId, role, ids)
+		}
+
+	case "displayname":
+		name, err := stringValue(attribute, operation.Value)
+		if err != nil || !strings.EqualFold(name, string(role)) {
+			return fmt.Errorf("%w: displayName", ErrMutability)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidPath, operation.Path)
+	}
+}
+
+// setMembers gives role to the users of ids, which must be on the team, and takes it from the others
+func (s *ScimService) setMembers(tx *gorm.DB, tenantId uint, role global.TenantTeamRole, ids []string) error {
+	userIds, err := s.teamUserIds(tx, tenantId, ids)
+	if err != nil {
+		return err
+	}
+	query := tx.Model(&models.TenantTeam{}).Where("tenant_id = ? AND ?::tenant_team_role = ANY(roles)", tenantId, string(role))
+	if len(userIds) > 0 {
+		query = query.Where("user_id NOT IN ?", userIds)
+	}
+	if err := query.Update("roles", gorm.Expr("array_remove(roles, ?::tenant_team_role)", string(role))).Error; err != nil {
+		return fmt.Errorf("failed to set tenant team roles: %v", err)
+	}
+	return s.grantRole(tx, tenantId, role, userIds)
+}
+
+// addMembers gives role to the users of ids, which must be on the team
+func (s *ScimService) addMembers(tx *gorm.DB, tenantId uint, role global.TenantTeamRole, ids []string) error {
+	userIds, err := s.teamUserIds(tx, tenantId, ids)
+	if err != nil {
+		return err
+	}
+	return s.grantRole(tx, tenantId, role, userIds)
+}
+
+// removeMembers takes role from the users of ids, from everyone with nil
+func (s *ScimService) removeMembers(tx *gorm.DB, tenantId uint, role global.TenantTeamRole, ids []string) error {
+	query := tx.Model(&models.TenantTeam{}).Where("tenant_id = ? AND ?::tenant_team_role = ANY(roles)", tenantId, string(role))
+	if ids != nil {
+		userIds, err := parseUserIds(ids)
+		if err != nil {
+			return err
+		}
+		if len(userIds) == 0 {
+			return nil
+		}
+		query = query.Where("user_id IN ?", userIds)
+	}
+	if err := query.Update("roles", gorm.Expr("array_remove(roles, ?::tenant_team_role)", string(role))).Error; err != nil {
+		return fmt.Errorf("failed to set tenant team roles: %v", err)
+	}
+	return nil
+}
+
+func (s *ScimService) grantRole(tx *gorm.DB, tenantId uint, role global.TenantTeamRole, userIds []uint) error {
+	if len(userIds) == 0 {
+		return nil
+	}
+	err := tx.Model(&models.TenantTeam{}).
+		Where("tenant_id = ? AND user_id IN ? AND NOT (?::tenant_team_role = ANY(COALESCE(roles, '{}')))", tenantId, userIds, string(role)).
+		Update("roles", gorm.Expr("array_append(roles, ?::tenant_team_role)", string(role))).Error
+	if err != nil {
+		return fmt.Errorf("failed to set tenant team roles: %v", err)
+	}
+	return nil
+}
+
+// teamUserIds parses the member ids of a group, which must be users on the team
+func (s *ScimService) teamUserIds(tx *gorm.DB, tenantId uint, ids []string) ([]uint, error) {
+	userIds, err := parseUserIds(ids)
+	if err != nil || len(userIds) == 0 {
+		return userIds, err
+	}
+	var count int64
+	err = tx.Model(&models.TenantTeam{}).Where("tenant_id = ? AND user_id IN ?", tenantId, userIds).Count(&count).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to check tenant team: %v", err)
+	}
+	if int(count) != len(userIds) {
+		return nil, fmt.Errorf("%w: members must be users on the team", ErrInvalidValue)
+	}
+	return userIds, nil
+}
+
+func (s *ScimService) groupResource(tenantId uint, role global.TenantTeamRole, withMembers bool, c *gin.Context) (*dto.ScimGroupDto, error) {
+	group := &dto.ScimGroupDto{
+		Schemas:     []string{GroupSchema},
+		ID:          string(role),
+		DisplayName: string(role),
+		Members:     []dto.ScimMemberDto{},
+		Meta: &dto.ScimMetaDto{
+			ResourceType: "Group",
+			Location:     location(c, "/Groups/"+string(role)),
+		},
+	}
+	if !withMembers {
+		return group, nil
+	}
+
+	var members []groupMember
+	err := s.memberQuery(tenantId).
+		Select("users.id, users.first_name, users.last_name").
+		Where("?::tenant_team_role = ANY(tenant_teams.roles)", string(role)).
+		Order("users.id").
+		Scan(&members).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to find group members: %v", err)
+	}
+	for _, member := range members {
+		id := strconv.FormatUint(uint64(member.ID), 10)
+		group.Members = append(group.Members, dto.ScimMemberDto{
+			Value:   id,
+			Display: strings.TrimSpace(member.FirstName + " " + member.LastName),
+			Ref:     location(c, "/Users/"+id),
+		})
+	}
+	return group, nil
+}
+
+// groupMatches evaluates the comparisons of a groups filter
+func groupMatches(group *dto.ScimGroupDto, comparisons []comparison) bool {
+	for _, cmp := range comparisons {
+		matched := false
+		switch cmp.attribute {
+		case "id", "displayname":
+			matched = cmp.matches(group.DisplayName)
+		default:
+			matched = cmp.operator == "pr" && len(group.Members) > 0
+			for _, member := range group.Members {
+				matched = matched || (cmp.operator != "pr" && cmp.matches(member.Value))
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// selectedMember returns the member id of a path like members[value eq "12"], if it selects one
+func selectedMember(path string) (string, bool, error) {
+	open, end := strings.Index(path, "["), strings.LastIndex(path, "]")
+	if open < 0 || end < open {
+		return "", false, nil
+	}
+	comparisons, err := parseFilter(path[open+1 : end])
+	if err != nil {
+		return "", false, fmt.Errorf("%w: %s", ErrInvalidPath, path)
+	}
+	if len(comparisons) != 1 || comparisons[0].attribute != "value" || comparisons[0].operator != "eq" {
+		return "", false, fmt.Errorf("%w: members can only be selected by value eq", ErrInvalidPath)
+	}
+	id, ok := comparisons[0].value.(string)
+	if !ok {
+		return "", false, fmt.Errorf("%w: %s", ErrInvalidPath, path)
+	}
+	return id, true, nil
+}
+
+func findRole(id string) (global.TenantTeamRole, error) {
+	for _, role := range teamRoles {
+		if strings.EqualFold(id, string(role)) {
+			return role, nil
+		}
+	}
+	return "", ErrGroupNotFound
+}
+
+func parseUserIds(ids []string) ([]uint, error) {
+	userIds := make([]uint, 0, len(ids))
+	seen := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		userId, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid member %q", ErrInvalidValue, id)
+		}
+		if !seen[uint(userId)] {
+			seen[uint(userId)] = true
+			userIds = append(userIds, uint(userId))
+		}
+	}
+	return userIds, nil
+}
@@ -0,0 +1,197 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	dto "github.com/auditrakkr/tms-fullstack/tms-backend/dtos"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+)
+
+/* PATCH */
+
+// userChanges are the changes a replace or patch makes to a user, nil for unchanged
+type userChanges struct {
+	externalID *string
+	firstName  *string
+	middleName *string
+	lastName   *string
+	active     *bool
+}
+
+// applyUserOperation adds an operation of a PATCH request to changes. Without a path, the value holds
+// the attributes to add or replace. Attributes this application does not keep (phone numbers, titles,
+// the enterprise extension...) are ignored, as identity providers expect; immutable ones are refused.
+func applyUserOperation(changes *userChanges, user *models.User, operation dto.ScimPatchOperationDto) error {
+	op := strings.ToLower(operation.Op)
+	if op != "add" && op != "replace" && op != "remove" {
+		return fmt.Errorf("%w: unsupported op %q", ErrInvalidValue, operation.Op)
+	}
+	if operation.Path != "" {
+		return applyUserAttribute(changes, user, op, normalizeAttribute(operation.Path), operation.Value)
+	}
+	if op == "remove" {
+		return fmt.Errorf("%w: remove needs a path", ErrInvalidPath)
+	}
+
+	var attributes map[string]json.RawMessage
+	if err := json.Unmarshal(operation.Value, &attributes); err != nil {
+		return fmt.Errorf("%w: an operation without a path takes an object", ErrInvalidValue)
+	}
+	paths := make([]string, 0, len(attributes))
+	for path := range attributes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := applyUserAttribute(changes, user, op, normalizeAttribute(path), attributes[path]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyUserAttribute(changes *userChanges, user *models.User, op string, attribute string, value json.RawMessage) error {
+	remove := op == "remove"
+	switch attribute {
+	case "active":
+		if remove {
+			return fmt.Errorf("%w: active cannot be removed", ErrInvalidValue)
+		}
+		active, err := boolValue(value)
+		if err != nil {
+			return err
+		}
+		changes.active = &active
+
+	case "externalid":
+		externalID := ""
+		if !remove {
+			var err error
+			if externalID, err = stringValue(attribute, value); err != nil {
+				return err
+			}
+		}
+		changes.externalID = &externalID
+
+	case "name.middlename":
+		middleName := ""
+		if !remove {
+			var err error
+			if middleName, err = stringValue(attribute, value); err != nil {
+				return err
+			}
+		}
+		changes.middleName = &middleName
+
+	case "name.givenname", "name.familyname":
+		if remove {
+			return fmt.Errorf("%w: %s cannot be removed", ErrInvalidValue, attribute)
+		}
+		name, err := stringValue(attribute, value)
+		if err != nil {
+			return err
+		}
+		if attribute == "name.givenname" {
+			changes.firstName = &name
+		} else {
+			changes.lastName = &name
+		}
+
+	case "name":
+		if remove {
+			return fmt.Errorf("%w: name cannot be removed", ErrInvalidValue)
+		}
+		var name dto.ScimNameDto
+		if err := json.Unmarshal(value, &name); err != nil {
+			return fmt.Errorf("%w: name takes an object", ErrInvalidValue)
+		}
+		if name.GivenName != "" {
+			changes.firstName = &name.GivenName
+		}
+		if name.MiddleName != "" {
+			changes.middleName = &name.MiddleName
+		}
+		if name.FamilyName != "" {
+			changes.lastName = &name.FamilyName
+		}
+
+	case "username", "emails", "emails.value":
+		// Identity providers send them back unchanged with the rest of a user
+		if remove {
+			return fmt.Errorf("%w: %s", ErrMutability, attribute)
+		}
+		email, err := emailValue(attribute, value)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(strings.TrimSpace(email), user.PrimaryEmailAddress) {
+			return fmt.Errorf("%w: %s", ErrMutability, attribute)
+		}
+
+	case "id", "groups", "meta":
+		return fmt.Errorf("%w: %s", ErrMutability, attribute)
+	}
+	return nil
+}
+
+// boolValue reads a boolean, which some identity providers send as a string ("False")
+func boolValue(value json.RawMessage) (bool, error) {
+	var parsed any
+	if err := json.Unmarshal(value, &parsed); err == nil {
+		switch parsed := parsed.(type) {
+		case bool:
+			return parsed, nil
+		case string:
+			if active, err := strconv.ParseBool(parsed); err == nil {
+				return active, nil
+			}
+		}
+	}
+	return false, fmt.Errorf("%w: active takes a boolean", ErrInvalidValue)
+}
+
+func stringValue(attribute string, value json.RawMessage) (string, error) {
+	var parsed string
+	if err := json.Unmarshal(value, &parsed); err != nil {
+		return "", fmt.Errorf("%w: %s takes a string", ErrInvalidValue, attribute)
+	}
+	return parsed, nil
+}
+
+// emailValue reads an address, or the primary one of a list of emails
+func emailValue(attribute string, value json.RawMessage) (string, error) {
+	if email, err := stringValue(attribute, value); err == nil {
+		return email, nil
+	}
+	var emails []dto.ScimEmailDto
+	if err := json.Unmarshal(value, &emails); err != nil || len(emails) == 0 {
+		return "", fmt.Errorf("%w: %s takes an address or a list of emails", ErrInvalidValue, attribute)
+	}
+	for _, email := range emails {
+		if email.Primary {
+			return email.Value, nil
+		}
+	}
+	return emails[0].Value, nil
+}
+
+// memberIds reads the members of a group operation: a list of members, or the members attribute of an object
+func memberIds(value json.RawMessage) ([]string, error) {
+	var members []dto.ScimMemberDto
+	if err := json.Unmarshal(value, &members); err != nil {
+		var group dto.ScimGroupDto
+		if err := json.Unmarshal(value, &group); err != nil {
+			return nil, fmt.Errorf("%w: members takes a list of members", ErrInvalidValue)
+		}
+		members = group.Members
+	}
+	ids := make([]string, len(members))
+	for i, member := range members {
+		ids[i] = member.Value
+	}
+	return ids, nil
+}
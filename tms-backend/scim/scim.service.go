@@ -0,0 +1,515 @@
+package scim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	netmail "net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/database"
+	dto "github.com/auditrakkr/tms-fullstack/tms-backend/dtos"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/repositories"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/users"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Schemas of the resources and messages, see RFC 7643 and RFC 7644
+const (
+	UserSchema                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	GroupSchema                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	ListResponseSchema          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	PatchOpSchema               = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	ErrorSchema                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+	ServiceProviderConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	ResourceTypeSchema          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+
+	// ContentType is the media type of SCIM requests and responses
+	ContentType = "application/scim+json"
+)
+
+const basePath = "/scim/v2"
+
+var (
+	ErrUserNotFound   = errors.New("user not found")
+	ErrGroupNotFound  = errors.New("group not found")
+	ErrUniqueness     = errors.New("the user is already on the team")
+	ErrInvalidFilter  = errors.New("invalid filter")
+	ErrInvalidValue   = errors.New("invalid value")
+	ErrInvalidPath    = errors.New("invalid path")
+	ErrMutability     = errors.New("the attribute cannot be changed")
+	ErrSharedAccount  = errors.New("the user is on the team of another tenant: the account cannot be changed, only removed from the team")
+	ErrForeignAccount = errors.New("an account with this userName exists outside the tenant's verified domains, it cannot be added to the team")
+)
+
+// membership is the team membership of a user, as SCIM sees it
+type membership struct {
+	UserID     uint
+	ExternalID string
+	RoleNames  string // comma-separated
+}
+
+func (m membership) roles() []global.TenantTeamRole {
+	var roles []global.TenantTeamRole
+	for _, name := range strings.Split(m.RoleNames, ",") {
+		if name != "" {
+			roles = append(roles, global.TenantTeamRole(name))
+		}
+	}
+	return roles
+}
+
+// ScimService provisions the team of a tenant from its identity provider. SCIM users are the
+// users on the team, userName their primary email address; SCIM groups are the team roles.
+// Accounts are shared by the teams a user is on, so only a tenant whose team alone the user is on
+// can change the names or deactivate the account (see models.User.IsActive). Deleting a SCIM user
+// removes it from the team, never the account.
+type ScimService struct {
+	userRepo       repositories.Repository[models.User]
+	tenantRepo     repositories.Repository[models.Tenant]
+	tenantTeamRepo repositories.Repository[models.TenantTeam]
+	userService    *users.UserService
+	db             *gorm.DB
+}
+
+func NewScimService(userService *users.UserService) *ScimService {
+	return &ScimService{
+		userRepo:       repositories.Repository[models.User]{DB: database.DB},
+		tenantRepo:     repositories.Repository[models.Tenant]{DB: database.DB},
+		tenantTeamRepo: repositories.Repository[models.TenantTeam]{DB: database.DB},
+		userService:    userService,
+		db:             database.DB,
+	}
+}
+
+/* USERS */
+
+// FindUsers lists a page of the team of a tenant, optionally filtered. startIndex is 1-based.
+func (s *ScimService) FindUsers(tenantId uint, filter string, startIndex int, count int, c *gin.Context) (*dto.ScimListResponseDto, error) {
+	comparisons, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var conditions []func(*gorm.DB) *gorm.DB
+	for _, cmp := range comparisons {
+		condition, err := userCondition(cmp)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+	filtered := func() *gorm.DB {
+		return s.memberQuery(tenantId).Scopes(conditions...)
+	}
+
+	var total int64
+	if err := filtered().Count(&total).Error; err != nil {
+		return nil, fmt.Errorf("failed to count users: %v", err)
+	}
+	var members []models.User
+	if count > 0 {
+		err := filtered().Order("users.id").Offset(startIndex - 1).Limit(count).Find(&members).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to find users: %v", err)
+		}
+	}
+
+	resources, err := s.userResources(tenantId, members, c)
+	if err != nil {
+		return nil, err
+	}
+	return listResponse(total, startIndex, resources), nil
+}
+
+// FindUser returns a user on the team of a tenant
+func (s *ScimService) FindUser(tenantId uint, id string, c *gin.Context) (*dto.ScimUserDto, error) {
+	user, err := s.findMember(tenantId, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.userResource(tenantId, user, c)
+}
+
+// CreateUser puts a user on the team of a tenant, with the Employee role. Users without an account
+// get a passwordless one (see users.UserService.ProvisionUser): they sign in with the tenant's
+// identity provider or reset their password. The account of an existing user is left as it is, and
+// only put on the team if its address is in a domain the tenant verified (see sso.SSOService.VerifyDomain)
+// and it is not a landlord account: its owner never agreed to join the team.
+func (s *ScimService) CreateUser(tenantId uint, userDto *dto.ScimUserDto, c *gin.Context) (*dto.ScimUserDto, error) {
+	email, err := userEmail(userDto)
+	if err != nil {
+		return nil, err
+	}
+	tenant, err := s.tenantRepo.FindByID(tenantId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find tenant: %v", err)
+	}
+
+	var user models.User
+	err = s.userRepo.CreateQueryBuilder().Where("LOWER(primary_email_address) = ?", email).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		firstName, middleName, lastName := userNames(userDto)
+		created, err := s.userService.ProvisionUser(email, firstName, lastName)
+		if err != nil {
+			return nil, err
+		}
+		if middleName != "" || (userDto.Active != nil && !*userDto.Active) {
+			if created, err = s.userService.UpdateProvisionedUser(created.ID, firstName, middleName, lastName, userDto.Active == nil || *userDto.Active); err != nil {
+				return nil, err
+			}
+		}
+		log.Printf("Provisioned user %d by SCIM for tenant %d", created.ID, tenantId)
+		user = *created
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to find user: %v", err)
+	} else if err := s.checkExistingAccount(tenantId, &user, email); err != nil {
+		return nil, err
+	}
+
+	var team models.TenantTeam
+	err = s.tenantTeamRepo.CreateQueryBuilder().Unscoped().Where("user_id = ? AND tenant_id = ?", user.ID, tenantId).First(&team).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		team = models.TenantTeam{TenantID: tenantId, UserID: user.ID, TenantUniqueName: tenant.Subdomain, TenantUniqueID: tenantId, ExternalID: userDto.ExternalID}
+		if err := s.tenantTeamRepo.CreateQueryBuilder().Omit("Roles", "Tenant", "User").Create(&team).Error; err != nil {
+			return nil, fmt.Errorf("failed to add user to tenant team: %v", err)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("failed to find tenant team: %v", err)
+	case !team.DeletedAt.Valid:
+		return nil, fmt.Errorf("%w: %s", ErrUniqueness, email)
+	}
+
+	// New and restored memberships start over as Employee; the groups of the user follow
+	err = s.tenantTeamRepo.CreateQueryBuilder().Unscoped().Where("id = ?", team.ID).Updates(map[string]any{
+		"roles":       models.TeamRolesExpr([]global.TenantTeamRole{global.E}),
+		"external_id": userDto.ExternalID,
+		"deleted_at":  nil,
+	}).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to set tenant team roles: %v", err)
+	}
+	return s.userResource(tenantId, &user, c)
+}
+
+// checkExistingAccount tells whether an existing account may be put on the team of a tenant: the
+// tenant must have verified the domain of its address, and it must not be a landlord account.
+// Members already on the team get ErrUniqueness.
+func (s *ScimService) checkExistingAccount(tenantId uint, user *models.User, email string) error {
+	var members int64
+	err := s.tenantTeamRepo.CreateQueryBuilder().Where("user_id = ? AND tenant_id = ?", user.ID, tenantId).Count(&members).Error
+	if err != nil {
+		return fmt.Errorf("failed to find tenant team: %v", err)
+	}
+	if members > 0 {
+		return fmt.Errorf("%w: %s", ErrUniqueness, email)
+	}
+	if user.Landlord {
+		return fmt.Errorf("%w: %s", ErrForeignAccount, email)
+	}
+
+	domain, _ := json.Marshal([]string{email[strings.LastIndex(email, "@")+1:]})
+	var verified int64
+	err = s.db.Model(&models.TenantConfigDetail{}).
+		Where("tenant_id = ? AND sso->'verified_domains' @> ?::jsonb", tenantId, string(domain)).
+		Count(&verified).Error
+	if err != nil {
+		return fmt.Errorf("failed to check the verified domains: %v", err)
+	}
+	if verified == 0 {
+		return fmt.Errorf("%w: %s", ErrForeignAccount, email)
+	}
+	return nil
+}
+
+// ReplaceUser sets the externalId, names and active of a user on the team of a tenant. The userName
+// must stay the same: the primary address of an account only changes when its owner confirms it.
+func (s *ScimService) ReplaceUser(tenantId uint, id string, userDto *dto.ScimUserDto, c *gin.Context) (*dto.ScimUserDto, error) {
+	user, err := s.findMember(tenantId, id)
+	if err != nil {
+		return nil, err
+	}
+	if email, err := userEmail(userDto); err != nil {
+		return nil, err
+	} else if !strings.EqualFold(email, user.PrimaryEmailAddress) {
+		return nil, fmt.Errorf("%w: userName", ErrMutability)
+	}
+
+	changes := userChanges{externalID: &userDto.ExternalID, active: userDto.Active}
+	firstName, middleName, lastName := userNames(userDto)
+	changes.firstName, changes.middleName, changes.lastName = &firstName, &middleName, &lastName
+	if userDto.Active == nil {
+		active := true
+		changes.active = &active
+	}
+	return s.applyUserChanges(tenantId, user, &changes, c)
+}
+
+// PatchUser applies the operations of a PATCH request to a user on the team of a tenant, see applyUserOperation
+func (s *ScimService) PatchUser(tenantId uint, id string, patchDto *dto.ScimPatchDto, c *gin.Context) (*dto.ScimUserDto, error) {
+	user, err := s.findMember(tenantId, id)
+	if err != nil {
+		return nil, err
+	}
+	var changes userChanges
+	for _, operation := range patchDto.Operations {
+		if err := applyUserOperation(&changes, user, operation); err != nil {
+			return nil, err
+		}
+	}
+	return s.applyUserChanges(tenantId, user, &changes, c)
+}
+
+// DeleteUser removes a user from the team of a tenant. The account stays, with the user's other teams.
+func (s *ScimService) DeleteUser(tenantId uint, id string) error {
+	user, err := s.findMember(tenantId, id)
+	if err != nil {
+		return err
+	}
+	err = s.tenantTeamRepo.CreateQueryBuilder().Where("user_id = ? AND tenant_id = ?", user.ID, tenantId).Delete(&models.TenantTeam{}).Error
+	if err != nil {
+		return fmt.Errorf("failed to remove user from tenant team: %v", err)
+	}
+	log.Printf("Removed user %d from the team of tenant %d by SCIM", user.ID, tenantId)
+	return nil
+}
+
+// applyUserChanges saves the changes of a replace or patch. The account itself, unlike the
+// membership's externalId, is only changed for users on no other team (see ErrSharedAccount).
+func (s *ScimService) applyUserChanges(tenantId uint, user *models.User, changes *userChanges, c *gin.Context) (*dto.ScimUserDto, error) {
+	if changes.externalID != nil {
+		err := s.tenantTeamRepo.CreateQueryBuilder().Where("user_id = ? AND tenant_id = ?", user.ID, tenantId).Update("external_id", *changes.externalID).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to update tenant team: %v", err)
+		}
+	}
+
+	firstName, middleName, lastName, active := user.FirstName, user.MiddleName, user.LastName, user.IsActive
+	if changes.firstName != nil && *changes.firstName != "" {
+		firstName = *changes.firstName
+	}
+	if changes.middleName != nil {
+		middleName = *changes.middleName
+	}
+	if changes.lastName != nil && *changes.lastName != "" {
+		lastName = *changes.lastName
+	}
+	if changes.active != nil {
+		active = *changes.active
+	}
+	if firstName == user.FirstName && middleName == user.MiddleName && lastName == user.LastName && active == user.IsActive {
+		return s.userResource(tenantId, user, c)
+	}
+
+	var otherTeams int64
+	err := s.tenantTeamRepo.CreateQueryBuilder().Where("user_id = ? AND tenant_id <> ?", user.ID, tenantId).Count(&otherTeams).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to check tenant teams: %v", err)
+	}
+	if otherTeams > 0 || user.Landlord {
+		return nil, ErrSharedAccount
+	}
+	updated, err := s.userService.UpdateProvisionedUser(user.ID, firstName, middleName, lastName, active)
+	if err != nil {
+		return nil, err
+	}
+	if active != user.IsActive {
+		log.Printf("Set user %d active=%t by SCIM for tenant %d", user.ID, active, tenantId)
+	}
+	return s.userResource(tenantId, updated, c)
+}
+
+// memberQuery selects the users on the team of a tenant
+func (s *ScimService) memberQuery(tenantId uint) *gorm.DB {
+	return s.userRepo.CreateQueryBuilder().
+		Joins("JOIN tenant_teams ON tenant_teams.user_id = users.id AND tenant_teams.deleted_at IS NULL AND tenant_teams.tenant_id = ?", tenantId)
+}
+
+// findMember returns the user of a SCIM id, if it is on the team of the tenant
+func (s *ScimService) findMember(tenantId uint, id string) (*models.User, error) {
+	userId, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return nil, ErrUserNotFound
+	}
+	var user models.User
+	err = s.memberQuery(tenantId).Where("users.id = ?", userId).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find user: %v", err)
+	}
+	return &user, nil
+}
+
+// memberships returns the team memberships of users in a tenant, by user
+func (s *ScimService) memberships(tenantId uint, userIds []uint) (map[uint]membership, error) {
+	var rows []membership
+	err := s.tenantTeamRepo.CreateQueryBuilder().
+		Select("user_id, external_id, array_to_string(roles, ',') AS role_names").
+		Where("tenant_id = ? AND user_id IN ?", tenantId, userIds).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to find tenant team: %v", err)
+	}
+	byUser := make(map[uint]membership, len(rows))
+	for _, row := range rows {
+		byUser[row.UserID] = row
+	}
+	return byUser, nil
+}
+
+func (s *ScimService) userResource(tenantId uint, user *models.User, c *gin.Context) (*dto.ScimUserDto, error) {
+	resources, err := s.userResources(tenantId, []models.User{*user}, c)
+	if err != nil {
+		return nil, err
+	}
+	return &resources[0], nil
+}
+
+func (s *ScimService) userResources(tenantId uint, members []models.User, c *gin.Context) ([]dto.ScimUserDto, error) {
+	resources := make([]dto.ScimUserDto, 0, len(members))
+	if len(members) == 0 {
+		return resources, nil
+	}
+	userIds := make([]uint, len(members))
+	for i, user := range members {
+		userIds[i] = user.ID
+	}
+	byUser, err := s.memberships(tenantId, userIds)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range members {
+		active := user.IsActive
+		id := strconv.FormatUint(uint64(user.ID), 10)
+		resource := dto.ScimUserDto{
+			Schemas:    []string{UserSchema},
+			ID:         id,
+			ExternalID: byUser[user.ID].ExternalID,
+			UserName:   user.PrimaryEmailAddress,
+			Name: &dto.ScimNameDto{
+				Formatted:  strings.Join(strings.Fields(user.FirstName+" "+user.MiddleName+" "+user.LastName), " "),
+				GivenName:  user.FirstName,
+				MiddleName: user.MiddleName,
+				FamilyName: user.LastName,
+			},
+			DisplayName: strings.TrimSpace(user.FirstName + " " + user.LastName),
+			Emails:      []dto.ScimEmailDto{{Value: user.PrimaryEmailAddress, Type: "work", Primary: true}},
+			Active:      &active,
+			Meta: &dto.ScimMetaDto{
+				ResourceType: "User",
+				Created:      &user.CreatedAt,
+				LastModified: &user.UpdatedAt,
+				Location:     location(c, "/Users/"+id),
+			},
+		}
+		for _, role := range byUser[user.ID].roles() {
+			resource.Groups = append(resource.Groups, dto.ScimMemberDto{Value: string(role), Display: string(role), Ref: location(c, "/Groups/"+string(role))})
+		}
+		resources = append(resources, resource)
+	}
+	return resources, nil
+}
+
+// userCondition is the SQL condition of a comparison of a users filter
+func userCondition(cmp comparison) (func(*gorm.DB) *gorm.DB, error) {
+	var query string
+	var args []any
+	var err error
+	switch cmp.attribute {
+	case "username", "emails", "emails.value":
+		query, args, err = cmp.condition("users.primary_email_address", false)
+	case "externalid":
+		query, args, err = cmp.condition("tenant_teams.external_id", true)
+	case "name.givenname":
+		query, args, err = cmp.condition("users.first_name", false)
+	case "name.familyname":
+		query, args, err = cmp.condition("users.last_name", false)
+	case "id":
+		id, ok := cmp.value.(string)
+		userId, parseErr := strconv.ParseUint(id, 10, 32)
+		if !ok || parseErr != nil || (cmp.operator != "eq" && cmp.operator != "ne") {
+			return nil, fmt.Errorf("%w: id takes eq or ne and a user id", ErrInvalidFilter)
+		}
+		query, args = "users.id "+map[string]string{"eq": "=", "ne": "<>"}[cmp.operator]+" ?", []any{userId}
+	case "active":
+		active, ok := cmp.value.(bool)
+		if !ok || (cmp.operator != "eq" && cmp.operator != "ne") {
+			return nil, fmt.Errorf("%w: active takes eq or ne and a boolean", ErrInvalidFilter)
+		}
+		query, args = "users.is_active = ?", []any{active == (cmp.operator == "eq")}
+	default:
+		return nil, fmt.Errorf("%w: cannot filter users by %s", ErrInvalidFilter, cmp.attribute)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where(query, args...)
+	}, nil
+}
+
+// userEmail is the address of a SCIM user: its userName, or its primary email when the identity
+// provider's user names are not addresses
+func userEmail(userDto *dto.ScimUserDto) (string, error) {
+	candidates := []string{userDto.UserName}
+	for _, email := range userDto.Emails {
+		if email.Primary {
+			candidates = append(candidates, email.Value)
+		}
+	}
+	for _, email := range userDto.Emails {
+		candidates = append(candidates, email.Value)
+	}
+	for _, candidate := range candidates {
+		if address, err := netmail.ParseAddress(strings.TrimSpace(candidate)); err == nil && address.Address == strings.TrimSpace(candidate) {
+			return strings.ToLower(address.Address), nil
+		}
+	}
+	return "", fmt.Errorf("%w: userName must be an email address", ErrInvalidValue)
+}
+
+// userNames are the first, middle and last names of a SCIM user, from its displayName without a name
+func userNames(userDto *dto.ScimUserDto) (string, string, string) {
+	if userDto.Name != nil && (userDto.Name.GivenName != "" || userDto.Name.FamilyName != "") {
+		return userDto.Name.GivenName, userDto.Name.MiddleName, userDto.Name.FamilyName
+	}
+	displayName := userDto.DisplayName
+	if displayName == "" && userDto.Name != nil {
+		displayName = userDto.Name.Formatted
+	}
+	firstName, lastName, _ := strings.Cut(strings.TrimSpace(displayName), " ")
+	return firstName, "", strings.TrimSpace(lastName)
+}
+
+// location is the absolute URL of a resource, relative without a configured application URL
+func location(c *gin.Context, path string) string {
+	if url, err := users.AppURL(c, basePath+path); err == nil {
+		return url
+	}
+	return basePath + path
+}
+
+func listResponse(total int64, startIndex int, resources any) *dto.ScimListResponseDto {
+	itemsPerPage := 0
+	switch list := resources.(type) {
+	case []dto.ScimUserDto:
+		itemsPerPage = len(list)
+	case []dto.ScimGroupDto:
+		itemsPerPage = len(list)
+	}
+	return &dto.ScimListResponseDto{
+		Schemas:      []string{ListResponseSchema},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: itemsPerPage,
+		Resources:    resources,
+	}
+}
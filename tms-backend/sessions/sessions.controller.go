@@ -0,0 +1,74 @@
+package sessions
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/gin-gonic/gin"
+)
+
+type SessionController struct {
+	sessionService *SessionService
+}
+
+func NewSessionController(sessionService *SessionService) *SessionController {
+	return &SessionController{
+		sessionService: sessionService,
+	}
+}
+
+// GetMySessions lists the signed-in devices of the caller
+func (sc *SessionController) GetMySessions(c *gin.Context) {
+	sessions, err := sc.sessionService.FindAllActive(c.GetUint(global.CONTEXT_USER_ID_KEY), c.GetUint(global.CONTEXT_SESSION_ID_KEY))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// DeleteMySession signs one of the caller's devices out
+func (sc *SessionController) DeleteMySession(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("sessionId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+	err = sc.sessionService.Revoke(c.GetUint(global.CONTEXT_USER_ID_KEY), uint(id), RevokedByUser)
+	if errors.Is(err, ErrSessionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Session signed out"})
+}
+
+// DeleteMySessions signs every device of the caller out but the one making the request
+func (sc *SessionController) DeleteMySessions(c *gin.Context) {
+	count, err := sc.sessionService.RevokeAll(c.GetUint(global.CONTEXT_USER_ID_KEY), c.GetUint(global.CONTEXT_SESSION_ID_KEY), RevokedByUser)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"revoked": count})
+}
+
+// DeleteUserSessions signs every device of a user out. Landlord admins only
+func (sc *SessionController) DeleteUserSessions(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	count, err := sc.sessionService.RevokeAll(uint(id), 0, RevokedByAdmin)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"revoked": count})
+}
@@ -0,0 +1,259 @@
+package sessions
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/config"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/database"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/repositories"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/utils"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSessionNotFound    = errors.New("session not found")
+	ErrSessionEnded       = errors.New("session has been signed out or has expired")
+	ErrRefreshTokenReused = errors.New("refresh token was already used: the session has been signed out")
+)
+
+// Revocation reasons
+const (
+	RevokedBySignOut      = "sign-out"
+	RevokedByUser         = "revoked by the user"
+	RevokedByAdmin        = "revoked by an administrator"
+	RevokedByReuse        = "refresh token reuse"
+	RevokedByPasswordSet  = "password changed"
+	RevokedByEmailChanged = "email address changed"
+	RevokedByDeactivation = "account deactivated"
+)
+
+type SessionService struct {
+	sessionRepo repositories.Repository[models.Session]
+}
+
+func NewSessionService() *SessionService {
+	return &SessionService{
+		sessionRepo: repositories.Repository[models.Session]{DB: database.DB},
+	}
+}
+
+// Lifetime returns how long a session lasts without a refresh
+func Lifetime() time.Duration {
+	if config.AppConfig != nil && config.AppConfig.JWT.RefreshSecretKeyExpiration > 0 {
+		return time.Duration(config.AppConfig.JWT.RefreshSecretKeyExpiration) * time.Second
+	}
+	return global.SESSION_DEFAULT_EXPIRATION
+}
+
+/* CREATE */
+
+// Create starts a session for a user signing in. device names the client; without it
+// it is guessed from the user agent. The refresh token is set with Rotate.
+func (s *SessionService) Create(userId uint, tenantId *uint, device string, c *gin.Context) (*models.Session, error) {
+	userAgent := c.Request.UserAgent()
+	if device = strings.TrimSpace(device); device == "" {
+		device = DeviceName(userAgent)
+	}
+	now := time.Now()
+	session, err := s.sessionRepo.Create(&models.Session{
+		UserID:     userId,
+		TenantID:   tenantId,
+		Device:     truncate(device, 255),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  userAgent,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(Lifetime()),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+	return session, nil
+}
+
+/* REFRESH */
+
+// Rotate makes refreshToken the only valid refresh token of a session and extends it.
+// The update is conditional on the session still having the token that was presented,
+// so of two refreshes with the same token only one succeeds; the other is reuse.
+func (s *SessionService) Rotate(session *models.Session, refreshToken string, c *gin.Context) error {
+	now := time.Now()
+	result := s.sessionRepo.CreateQueryBuilder().
+		Where("id = ? AND refresh_token_hash = ? AND revoked_at IS NULL", session.ID, session.RefreshTokenHash).
+		Updates(map[string]any{
+			"refresh_token_hash": utils.HashToken(refreshToken),
+			"last_seen_at":       now,
+			"expires_at":         now.Add(Lifetime()),
+			"ip_address":         c.ClientIP(),
+			"user_agent":         c.Request.UserAgent(),
+		})
+	if result.Error != nil {
+		return fmt.Errorf("failed to rotate refresh token: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		s.Revoke(session.UserID, session.ID, RevokedByReuse)
+		return ErrRefreshTokenReused
+	}
+	session.RefreshTokenHash = utils.HashToken(refreshToken)
+	return nil
+}
+
+// UseRefreshToken returns the session a refresh token belongs to, if the token is its
+// current one. A token that was already rotated out is reuse, which means it leaked:
+// the session is revoked and ErrRefreshTokenReused returned.
+func (s *SessionService) UseRefreshToken(sessionId uint, refreshToken string) (*models.Session, error) {
+	var session models.Session
+	if err := s.sessionRepo.CreateQueryBuilder().First(&session, sessionId).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, fmt.Errorf("failed to find session: %v", err)
+	}
+	if !isActive(&session) {
+		return nil, ErrSessionEnded
+	}
+	if session.RefreshTokenHash != utils.HashToken(refreshToken) {
+		if err := s.Revoke(session.UserID, session.ID, RevokedByReuse); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	return &session, nil
+}
+
+/* FIND */
+
+// FindActive returns a session of a user that is neither revoked nor expired
+func (s *SessionService) FindActive(userId uint, sessionId uint) (*models.Session, error) {
+	var session models.Session
+	err := s.sessionRepo.CreateQueryBuilder().Where("id = ? AND user_id = ?", sessionId, userId).First(&session).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, fmt.Errorf("failed to find session: %v", err)
+	}
+	if !isActive(&session) {
+		return nil, ErrSessionEnded
+	}
+	return &session, nil
+}
+
+// FindAllActive returns the signed-in devices of a user, most recently seen first.
+// currentSessionId is flagged as Current.
+func (s *SessionService) FindAllActive(userId uint, currentSessionId uint) ([]models.Session, error) {
+	var sessions []models.Session
+	err := s.sessionRepo.CreateQueryBuilder().
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userId, time.Now()).
+		Order("last_seen_at DESC").
+		Find(&sessions).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to find sessions: %v", err)
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentSessionId
+	}
+	return sessions, nil
+}
+
+// Touch records that a session was just used, at most every global.SESSION_TOUCH_INTERVAL
+func (s *SessionService) Touch(session *models.Session, c *gin.Context) error {
+	if time.Since(session.LastSeenAt) < global.SESSION_TOUCH_INTERVAL {
+		return nil
+	}
+	err := s.sessionRepo.CreateQueryBuilder().Where("id = ?", session.ID).Updates(map[string]any{
+		"last_seen_at": time.Now(),
+		"ip_address":   c.ClientIP(),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("failed to update session: %v", err)
+	}
+	return nil
+}
+
+/* REVOKE */
+
+// Revoke signs a session of a user out
+func (s *SessionService) Revoke(userId uint, sessionId uint, reason string) error {
+	result := s.sessionRepo.CreateQueryBuilder().
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", sessionId, userId).
+		Updates(map[string]any{"revoked_at": time.Now(), "revoked_reason": reason})
+	if result.Error != nil {
+		return fmt.Errorf("failed to revoke session: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeAll signs every session of a user out but exceptSessionId (0 for none) and returns how many there were
+func (s *SessionService) RevokeAll(userId uint, exceptSessionId uint, reason string) (int64, error) {
+	return RevokeAllTx(s.sessionRepo.DB, userId, exceptSessionId, reason)
+}
+
+// RevokeAllTx is RevokeAll within a transaction
+func RevokeAllTx(tx *gorm.DB, userId uint, exceptSessionId uint, reason string) (int64, error) {
+	result := tx.Model(&models.Session{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userId, exceptSessionId).
+		Updates(map[string]any{"revoked_at": time.Now(), "revoked_reason": reason})
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to revoke sessions: %v", result.Error)
+	}
+	return result.RowsAffected, nil
+}
+
+func isActive(session *models.Session) bool {
+	return session.RevokedAt == nil && session.ExpiresAt.After(time.Now())
+}
+
+// DeviceName guesses a readable name like "Chrome on Windows" from a user agent
+func DeviceName(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown device"
+	}
+	browsers := []struct{ token, name string }{
+		// Order matters: Edge and Opera claim to be Chrome, Chrome claims to be Safari
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"},
+		{"Safari/", "Safari"}, {"curl/", "curl"}, {"PostmanRuntime/", "Postman"}, {"okhttp/", "Android app"},
+	}
+	systems := []struct{ token, name string }{
+		{"Windows", "Windows"}, {"iPhone", "iPhone"}, {"iPad", "iPad"}, {"Android", "Android"},
+		{"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	}
+
+	browser, system := "", ""
+	for _, b := range browsers {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, o := range systems {
+		if strings.Contains(userAgent, o.token) {
+			system = o.name
+			break
+		}
+	}
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	}
+	return truncate(userAgent, 60)
+}
+
+func truncate(s string, length int) string {
+	if len(s) <= length {
+		return s
+	}
+	return strings.ToValidUTF8(s[:length], "")
+}
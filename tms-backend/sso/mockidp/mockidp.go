@@ -0,0 +1,420 @@
+// Package mockidp is an identity provider for trying out and testing tenant single sign-on locally
+// (see cmd/mock-idp). It speaks OpenID Connect and SAML 2.0 and signs in whoever is typed into its
+// form, or when created with auto the user it was given, without asking.
+package mockidp
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	codeExpiration  = time.Minute
+	tokenExpiration = 5 * time.Minute
+	keyID           = "mock-idp"
+)
+
+// Identity is who the mock IdP signs in
+type Identity struct {
+	Email      string
+	GivenName  string
+	FamilyName string
+	Groups     []string
+}
+
+// authorization is an issued OpenID Connect authorization code, waiting to be exchanged
+type authorization struct {
+	clientID      string
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+	identity      Identity
+	expiresAt     time.Time
+}
+
+// IdP is a mock identity provider, served by its Handler
+type IdP struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	auto         bool
+	user         Identity
+	key          *rsa.PrivateKey
+	certificate  *x509.Certificate
+
+	mutex sync.Mutex
+	codes map[string]authorization
+}
+
+// New makes a mock identity provider at issuer, its base URL. Keys are generated at every call.
+func New(issuer, clientID, clientSecret string, auto bool, user Identity) (*IdP, error) {
+	return newMockIdP(strings.TrimRight(issuer, "/"), clientID, clientSecret, auto, user)
+}
+
+// Handler serves the OpenID Connect endpoints (discovery, JWKS, authorize and token) and the SAML
+// metadata and single sign-on endpoints
+func (idp *IdP) Handler() (http.Handler, error) {
+	samlIdP, err := idp.samlIdentityProvider()
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	mux.HandleFunc("/saml/metadata", samlIdP.ServeMetadata)
+	mux.HandleFunc("/saml/sso", samlIdP.ServeSSO)
+	return mux, nil
+}
+
+// Issuer is the base URL of the identity provider, and the issuer of its ID tokens
+func (idp *IdP) Issuer() string {
+	return idp.issuer
+}
+
+func newMockIdP(issuer, clientID, clientSecret string, auto bool, user Identity) (*IdP, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	// SAML signs with a certificate: a self-signed one will do
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mock-idp"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &IdP{
+		issuer:       issuer,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		auto:         auto,
+		user:         user,
+		key:          key,
+		certificate:  certificate,
+		codes:        map[string]authorization{},
+	}, nil
+}
+
+/* OPENID CONNECT */
+
+func (idp *IdP) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                idp.issuer,
+		"authorization_endpoint":                idp.issuer + "/authorize",
+		"token_endpoint":                        idp.issuer + "/token",
+		"jwks_uri":                              idp.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "email", "profile", "groups"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "email", "email_verified", "given_name", "family_name", "name", "groups", "nonce"},
+	})
+}
+
+func (idp *IdP) jwks(w http.ResponseWriter, r *http.Request) {
+	encode := base64.RawURLEncoding.EncodeToString
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": keyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   encode(idp.key.N.Bytes()),
+			"e":   encode(big.NewInt(int64(idp.key.E)).Bytes()),
+		}},
+	})
+}
+
+// authorize shows the sign-in form, then sends the browser back to the client with an authorization code
+func (idp *IdP) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI := query.Get("redirect_uri")
+	if query.Get("client_id") != idp.clientID || query.Get("response_type") != "code" || redirectURI == "" {
+		http.Error(w, "unknown client_id, or response_type is not code, or no redirect_uri", http.StatusBadRequest)
+		return
+	}
+	user, ok := idp.signIn(w, r, "/authorize")
+	if !ok {
+		return
+	}
+
+	code, err := randomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	idp.mutex.Lock()
+	idp.codes[code] = authorization{
+		clientID:      idp.clientID,
+		redirectURI:   redirectURI,
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+		identity:      user,
+		expiresAt:     time.Now().Add(codeExpiration),
+	}
+	idp.mutex.Unlock()
+
+	location, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	values := location.Query()
+	values.Set("code", code)
+	values.Set("state", query.Get("state"))
+	location.RawQuery = values.Encode()
+	http.Redirect(w, r, location.String(), http.StatusFound)
+}
+
+// token exchanges an authorization code for an ID token
+func (idp *IdP) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != idp.clientID || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(idp.clientSecret)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	idp.mutex.Lock()
+	grant, found := idp.codes[code]
+	delete(idp.codes, code)
+	idp.mutex.Unlock()
+	if !found || time.Now().After(grant.expiresAt) || grant.redirectURI != r.PostForm.Get("redirect_uri") || !verifierMatches(grant.codeChallenge, r.PostForm.Get("code_verifier")) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            idp.issuer,
+		"sub":            grant.identity.Email,
+		"aud":            grant.clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(tokenExpiration).Unix(),
+		"email":          grant.identity.Email,
+		"email_verified": true,
+		"given_name":     grant.identity.GivenName,
+		"family_name":    grant.identity.FamilyName,
+		"name":           strings.TrimSpace(grant.identity.GivenName + " " + grant.identity.FamilyName),
+		"groups":         grant.identity.Groups,
+	}
+	if grant.nonce != "" {
+		claims["nonce"] = grant.nonce
+	}
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	idToken.Header["kid"] = keyID
+	signed, err := idToken.SignedString(idp.key)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	accessToken, err := randomString()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(tokenExpiration.Seconds()),
+		"id_token":     signed,
+	})
+}
+
+// verifierMatches checks the PKCE code verifier of a code requested with an S256 challenge
+func verifierMatches(challenge, verifier string) bool {
+	if challenge == "" {
+		return true
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:]) == challenge
+}
+
+/* SAML */
+
+func (idp *IdP) samlIdentityProvider() (*saml.IdentityProvider, error) {
+	metadataURL, err := url.Parse(idp.issuer + "/saml/metadata")
+	if err != nil {
+		return nil, err
+	}
+	ssoURL, err := url.Parse(idp.issuer + "/saml/sso")
+	if err != nil {
+		return nil, err
+	}
+	return &saml.IdentityProvider{
+		Key:                     idp.key,
+		Certificate:             idp.certificate,
+		MetadataURL:             *metadataURL,
+		SSOURL:                  *ssoURL,
+		ServiceProviderProvider: serviceProviders{},
+		SessionProvider:         idp,
+	}, nil
+}
+
+// GetSession signs the user in for a SAML authentication request
+func (idp *IdP) GetSession(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest) *saml.Session {
+	user, ok := idp.signIn(w, r, "/saml/sso")
+	if !ok {
+		return nil
+	}
+	id, err := randomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	return &saml.Session{
+		ID:             id,
+		CreateTime:     saml.TimeNow(),
+		ExpireTime:     saml.TimeNow().Add(time.Hour),
+		Index:          id,
+		NameID:         user.Email,
+		NameIDFormat:   string(saml.EmailAddressNameIDFormat),
+		UserEmail:      user.Email,
+		UserGivenName:  user.GivenName,
+		UserSurname:    user.FamilyName,
+		UserCommonName: strings.TrimSpace(user.GivenName + " " + user.FamilyName),
+		CustomAttributes: []saml.Attribute{
+			samlAttribute("email", user.Email),
+			samlAttribute("groups", user.Groups...),
+		},
+	}
+}
+
+// serviceProviders trusts any service provider, reading its metadata from its entity ID, which
+// for this application is the metadata URL
+type serviceProviders struct{}
+
+func (serviceProviders) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+	location, err := url.Parse(serviceProviderID)
+	if err != nil || (location.Scheme != "http" && location.Scheme != "https") {
+		return nil, os.ErrNotExist
+	}
+	metadata, err := samlsp.FetchMetadata(r.Context(), http.DefaultClient, *location)
+	if err != nil {
+		log.Printf("Failed to fetch metadata of service provider %s: %v", serviceProviderID, err)
+		return nil, os.ErrNotExist
+	}
+	return metadata, nil
+}
+
+func samlAttribute(name string, values ...string) saml.Attribute {
+	attribute := saml.Attribute{Name: name, NameFormat: "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"}
+	for _, value := range values {
+		attribute.Values = append(attribute.Values, saml.AttributeValue{Type: "xs:string", Value: value})
+	}
+	return attribute
+}
+
+/* SIGN-IN FORM */
+
+var signInForm = template.Must(template.New("sign-in").Parse(`<!DOCTYPE html>
+<html><head><title>Mock identity provider</title></head>
+<body>
+<h1>Mock identity provider</h1>
+<form method="get" action="{{.Action}}">
+{{range $name, $values := .Query}}{{range $values}}<input type="hidden" name="{{$name}}" value="{{.}}">
+{{end}}{{end}}<p><label>Email <input name="email" value="{{.User.Email}}"></label></p>
+<p><label>First name <input name="given_name" value="{{.User.GivenName}}"></label></p>
+<p><label>Last name <input name="family_name" value="{{.User.FamilyName}}"></label></p>
+<p><label>Groups <input name="groups" value="{{.Groups}}"> (comma separated)</label></p>
+<input type="hidden" name="mock_sign_in" value="1">
+<p><button type="submit">Sign in</button></p>
+</form>
+</body></html>
+`))
+
+// signIn returns the user to sign in: the one of the flags with -auto, else the one submitted
+// with the form. Without a submission, it shows the form, which resubmits the request's query.
+func (idp *IdP) signIn(w http.ResponseWriter, r *http.Request, action string) (Identity, bool) {
+	if idp.auto {
+		return idp.user, true
+	}
+	query := r.URL.Query()
+	if query.Get("mock_sign_in") != "" {
+		return Identity{
+			Email:      strings.TrimSpace(query.Get("email")),
+			GivenName:  strings.TrimSpace(query.Get("given_name")),
+			FamilyName: strings.TrimSpace(query.Get("family_name")),
+			Groups:     SplitGroups(query.Get("groups")),
+		}, true
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := signInForm.Execute(w, map[string]any{
+		"Action": action,
+		"Query":  query,
+		"User":   idp.user,
+		"Groups": strings.Join(idp.user.Groups, ","),
+	})
+	if err != nil {
+		log.Printf("Failed to render sign-in form: %v", err)
+	}
+	return Identity{}, false
+}
+
+// SplitGroups reads a comma separated list of groups
+func SplitGroups(groups string) []string {
+	var split []string
+	for _, group := range strings.Split(groups, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			split = append(split, group)
+		}
+	}
+	return split
+}
+
+func randomString() (string, error) {
+	bytes := make([]byte, 24)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package sso
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	dto "github.com/auditrakkr/tms-fullstack/tms-backend/dtos"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/users"
+	"github.com/gin-gonic/gin"
+)
+
+type SSOController struct {
+	ssoService *SSOService
+}
+
+func NewSSOController(ssoService *SSOService) *SSOController {
+	return &SSOController{
+		ssoService: ssoService,
+	}
+}
+
+/* SETTINGS */
+
+// GetSettings returns the single sign-on settings of the tenant, without the client secret,
+// the URLs to configure its identity provider with and the TXT records verifying its domains
+func (sc *SSOController) GetSettings(c *gin.Context) {
+	tenantId, ok := idParam(c, "id")
+	if !ok {
+		return
+	}
+	settings, err := sc.ssoService.FindSettings(tenantId)
+	if err != nil {
+		sc.errorResponse(c, err)
+		return
+	}
+	serviceProvider, err := sc.ssoService.ServiceProviderURLs(tenantId, c)
+	if err != nil {
+		sc.errorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sso": redacted(settings), "serviceProvider": serviceProvider, "domainVerification": DomainChallenges(settings)})
+}
+
+// UpdateSettings replaces the single sign-on settings of the tenant. New domains have to be
+// verified (see VerifyDomain) before their users sign in with it.
+func (sc *SSOController) UpdateSettings(c *gin.Context) {
+	tenantId, ok := idParam(c, "id")
+	if !ok {
+		return
+	}
+	var updateDto dto.UpdateSSOSettingsDto
+	if err := c.ShouldBindJSON(&updateDto); err != nil || updateDto.Protocol == "" || len(updateDto.Domains) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: protocol and domains are required"})
+		return
+	}
+	settings, err := sc.ssoService.UpdateSettings(tenantId, &updateDto)
+	if err != nil {
+		sc.errorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sso": redacted(settings), "domainVerification": DomainChallenges(settings)})
+}
+
+// VerifyDomain checks the TXT record of a single sign-on domain of the tenant
+func (sc *SSOController) VerifyDomain(c *gin.Context) {
+	tenantId, ok := idParam(c, "id")
+	if !ok {
+		return
+	}
+	settings, err := sc.ssoService.VerifyDomain(c.Request.Context(), tenantId, c.Param("domain"))
+	if err != nil {
+		sc.errorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sso": redacted(settings), "domainVerification": DomainChallenges(settings)})
+}
+
+// DeleteSettings turns single sign-on off for the tenant
+func (sc *SSOController) DeleteSettings(c *gin.Context) {
+	tenantId, ok := idParam(c, "id")
+	if !ok {
+		return
+	}
+	if err := sc.ssoService.DeleteSettings(tenantId); err != nil {
+		sc.errorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Single sign-on removed"})
+}
+
+/* SIGN-IN */
+
+// Discover tells the login page whether an email address signs in with the identity provider of a tenant
+func (sc *SSOController) Discover(c *gin.Context) {
+	tenantId, enforced, err := sc.ssoService.FindTenantByEmail(c.Query("email"))
+	if err != nil {
+		sc.errorResponse(c, err)
+		return
+	}
+	if tenantId == 0 {
+		c.JSON(http.StatusOK, gin.H{"sso": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sso": true, "tenantId": tenantId, "enforced": enforced, "loginUrl": loginPath(tenantId)})
+}
+
+// Login sends the browser to the identity provider of the tenant
+func (sc *SSOController) Login(c *gin.Context) {
+	tenantId, ok := idParam(c, "tenantId")
+	if !ok {
+		return
+	}
+	location, err := sc.ssoService.BeginLogin(tenantId, c.Query("device"), c)
+	if err != nil {
+		sc.errorResponse(c, err)
+		return
+	}
+	c.Redirect(http.StatusFound, location)
+}
+
+// Callback is where the identity provider sends the browser back: the OpenID Connect redirect URI
+// and the SAML assertion consumer service. It sends the browser on to the client app, with the
+// code to exchange for tokens at /auth/sso/token or the reason the sign-in failed.
+func (sc *SSOController) Callback(c *gin.Context) {
+	tenantId, ok := idParam(c, "tenantId")
+	if !ok {
+		return
+	}
+	query := url.Values{}
+	code, err := sc.ssoService.CompleteLogin(tenantId, c)
+	switch {
+	case err == nil:
+		query.Set("code", code)
+	case errors.Is(err, ErrSSONotEnabled), errors.Is(err, ErrInvalidLogin), errors.Is(err, ErrIdentityProvider),
+		errors.Is(err, ErrDomainNotAllowed), errors.Is(err, ErrNotProvisioned), errors.Is(err, ErrMissingEmailClaim),
+		errors.Is(err, ErrUnverifiedDomain), errors.Is(err, ErrLandlordAccount):
+		query.Set("error", err.Error())
+	default:
+		log.Printf("Error completing single sign-on of tenant %d: %v", tenantId, err)
+		query.Set("error", "single sign-on failed")
+	}
+
+	location, err := users.AppURL(c, global.SSO_CLIENT_PATH+"?"+query.Encode())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Redirect(http.StatusFound, location)
+}
+
+// Metadata is the SAML metadata of this application, for the identity provider of the tenant
+func (sc *SSOController) Metadata(c *gin.Context) {
+	tenantId, ok := idParam(c, "tenantId")
+	if !ok {
+		return
+	}
+	metadata, err := sc.ssoService.ServiceProviderMetadata(tenantId, c)
+	if err != nil {
+		sc.errorResponse(c, err)
+		return
+	}
+	c.XML(http.StatusOK, metadata)
+}
+
+func (sc *SSOController) errorResponse(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrTenantNotFound), errors.Is(err, ErrSSONotEnabled), errors.Is(err, ErrUnknownDomain):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrInvalidSettings), errors.Is(err, ErrDomainNotVerified):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrDomainInUse):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// redacted are settings without the OIDC client secret, nor the domain tokens which are in the
+// domain verification
+func redacted(settings *models.SSOSettings) *models.SSOSettings {
+	if settings == nil {
+		return settings
+	}
+	copied := *settings
+	copied.DomainTokens = nil
+	if settings.OIDC != nil {
+		oidcSettings := *settings.OIDC
+		oidcSettings.ClientSecret = nil
+		copied.OIDC = &oidcSettings
+	}
+	return &copied
+}
+
+func idParam(c *gin.Context, name string) (uint, bool) {
+	id, err := strconv.ParseUint(c.Params.ByName(name), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return 0, false
+	}
+	return uint(id), true
+}
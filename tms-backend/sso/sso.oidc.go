@@ -0,0 +1,139 @@
+package sso
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/users"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/utils"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+/* OPENID CONNECT */
+
+// beginOIDCLogin prepares an authorization code request to the OpenID Connect provider of a tenant.
+// The nonce binds the ID token to the sign-in, PKCE the authorization code.
+func (s *SSOService) beginOIDCLogin(tenantId uint, settings *models.SSOSettings, login *models.SSOLogin, c *gin.Context) (func(string) (string, error), error) {
+	_, config, err := s.oidcClient(tenantId, settings, c)
+	if err != nil {
+		return nil, err
+	}
+	if login.Nonce, err = randomToken(16); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	login.CodeVerifier = oauth2.GenerateVerifier()
+	return func(state string) (string, error) {
+		return config.AuthCodeURL(state, oidc.Nonce(login.Nonce), oauth2.S256ChallengeOption(login.CodeVerifier)), nil
+	}, nil
+}
+
+// completeOIDCLogin exchanges the authorization code of the provider's redirect and verifies the ID token
+func (s *SSOService) completeOIDCLogin(tenantId uint, settings *models.SSOSettings, login *models.SSOLogin, c *gin.Context) (*Identity, error) {
+	if errorCode := c.Query("error"); errorCode != "" {
+		return nil, fmt.Errorf("%w: %s %s", ErrIdentityProvider, errorCode, c.Query("error_description"))
+	}
+	code := c.Query("code")
+	if code == "" {
+		return nil, fmt.Errorf("%w: no authorization code", ErrIdentityProvider)
+	}
+
+	provider, config, err := s.oidcClient(tenantId, settings, c)
+	if err != nil {
+		return nil, err
+	}
+	ctx := oidc.ClientContext(c.Request.Context(), s.httpClient)
+	token, err := config.Exchange(ctx, code, oauth2.VerifierOption(login.CodeVerifier))
+	if err != nil {
+		log.Printf("Error exchanging authorization code of tenant %d: %v", tenantId, err)
+		return nil, fmt.Errorf("%w: the authorization code was refused", ErrIdentityProvider)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: no ID token", ErrIdentityProvider)
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: settings.OIDC.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		log.Printf("Error verifying ID token of tenant %d: %v", tenantId, err)
+		return nil, fmt.Errorf("%w: invalid ID token", ErrIdentityProvider)
+	}
+	if idToken.Nonce != login.Nonce {
+		return nil, fmt.Errorf("%w: invalid ID token nonce", ErrIdentityProvider)
+	}
+
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("%w: invalid ID token claims", ErrIdentityProvider)
+	}
+	return oidcIdentity(settings, claims)
+}
+
+// oidcClient discovers the OpenID Connect provider of a tenant and returns it with the OAuth 2.0 client
+func (s *SSOService) oidcClient(tenantId uint, settings *models.SSOSettings, c *gin.Context) (*oidc.Provider, *oauth2.Config, error) {
+	if settings.OIDC == nil {
+		return nil, nil, ErrSSONotEnabled
+	}
+	issuer := strings.TrimSuffix(strings.TrimRight(settings.OIDC.DiscoveryURL, "/"), "/.well-known/openid-configuration")
+	provider, err := oidc.NewProvider(oidc.ClientContext(context.Background(), s.httpClient), issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to discover the OpenID Connect provider: %v", err)
+	}
+
+	clientSecret := ""
+	if secret := settings.OIDC.ClientSecret; secret != nil && secret.IV != nil && secret.Content != nil {
+		clientSecret, err = utils.Decrypt(&struct {
+			IV      string `json:"iv"`
+			Content string `json:"content"`
+		}{
+			IV:      *secret.IV,
+			Content: *secret.Content,
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt client secret: %v", err)
+		}
+	}
+	redirectURL, err := users.AppURL(c, callbackPath(tenantId))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return provider, &oauth2.Config{
+		ClientID:     settings.OIDC.ClientID,
+		ClientSecret: clientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  redirectURL,
+		Scopes:       append([]string{oidc.ScopeOpenID, "email", "profile"}, settings.OIDC.Scopes...),
+	}, nil
+}
+
+// oidcIdentity reads who signed in from the claims of an ID token. Addresses the provider
+// says are unverified are refused.
+func oidcIdentity(settings *models.SSOSettings, claims map[string]any) (*Identity, error) {
+	email, _ := claims["email"].(string)
+	if verified, ok := claims["email_verified"].(bool); email == "" || (ok && !verified) {
+		return nil, ErrMissingEmailClaim
+	}
+	identity := &Identity{Email: email}
+	identity.FirstName, _ = claims["given_name"].(string)
+	identity.LastName, _ = claims["family_name"].(string)
+	if identity.FirstName == "" && identity.LastName == "" {
+		name, _ := claims["name"].(string)
+		identity.FirstName, identity.LastName, _ = strings.Cut(strings.TrimSpace(name), " ")
+	}
+
+	switch groups := claims[roleClaim(settings)].(type) {
+	case string:
+		identity.Groups = []string{groups}
+	case []any:
+		for _, group := range groups {
+			if name, ok := group.(string); ok {
+				identity.Groups = append(identity.Groups, name)
+			}
+		}
+	}
+	return identity, nil
+}
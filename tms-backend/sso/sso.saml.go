@@ -0,0 +1,186 @@
+package sso
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/users"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/gin-gonic/gin"
+)
+
+/* SAML 2.0 */
+
+// Attributes identity providers commonly name the address and names of users with
+var (
+	samlEmailAttributes     = []string{"email", "mail", "emailaddress"}
+	samlFirstNameAttributes = []string{"givenname", "firstname", "first_name"}
+	samlLastNameAttributes  = []string{"sn", "surname", "lastname", "last_name"}
+)
+
+// beginSAMLLogin prepares an AuthnRequest to the SAML identity provider of a tenant, sent with the
+// HTTP-Redirect binding; the provider posts its response to the ACS URL
+func (s *SSOService) beginSAMLLogin(tenantId uint, settings *models.SSOSettings, login *models.SSOLogin, c *gin.Context) (func(string) (string, error), error) {
+	sp, err := s.serviceProvider(tenantId, settings, c)
+	if err != nil {
+		return nil, err
+	}
+	request, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make SAML authentication request: %v", err)
+	}
+	login.RequestID = request.ID
+	return func(state string) (string, error) {
+		redirectURL, err := request.Redirect(state, sp)
+		if err != nil {
+			return "", fmt.Errorf("failed to make SAML authentication request: %v", err)
+		}
+		return redirectURL.String(), nil
+	}, nil
+}
+
+// completeSAMLLogin verifies the assertion the identity provider posted, which must answer the sign-in's request
+func (s *SSOService) completeSAMLLogin(tenantId uint, settings *models.SSOSettings, login *models.SSOLogin, c *gin.Context) (*Identity, error) {
+	sp, err := s.serviceProvider(tenantId, settings, c)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Request.ParseForm(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIdentityProvider, err)
+	}
+	assertion, err := sp.ParseResponse(c.Request, []string{login.RequestID})
+	if err != nil {
+		// The reason is only logged: it can help forge a response
+		var invalid *saml.InvalidResponseError
+		if errors.As(err, &invalid) {
+			err = invalid.PrivateErr
+		}
+		log.Printf("Error verifying SAML response of tenant %d: %v", tenantId, err)
+		return nil, fmt.Errorf("%w: invalid SAML response", ErrIdentityProvider)
+	}
+	return samlIdentity(settings, assertion), nil
+}
+
+// serviceProvider is this application as the SAML service provider of a tenant. It has no key:
+// requests are not signed and assertions must not be encrypted, which the metadata tells.
+func (s *SSOService) serviceProvider(tenantId uint, settings *models.SSOSettings, c *gin.Context) (*saml.ServiceProvider, error) {
+	if settings.SAML == nil {
+		return nil, ErrSSONotEnabled
+	}
+	metadataURL, err := s.appURL(c, samlMetadataPath(tenantId))
+	if err != nil {
+		return nil, err
+	}
+	acsURL, err := s.appURL(c, samlACSPath(tenantId))
+	if err != nil {
+		return nil, err
+	}
+
+	var idpMetadata *saml.EntityDescriptor
+	if settings.SAML.IDPMetadataURL != "" {
+		metadataLocation, err := url.Parse(settings.SAML.IDPMetadataURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SAML metadata URL: %v", err)
+		}
+		idpMetadata, err = samlsp.FetchMetadata(context.Background(), s.httpClient, *metadataLocation)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch SAML identity provider metadata: %v", err)
+		}
+	} else {
+		idpMetadata, err = parseIDPMetadata([]byte(settings.SAML.IDPMetadata))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SAML identity provider metadata: %v", err)
+		}
+	}
+
+	return &saml.ServiceProvider{
+		EntityID:          metadataURL.String(),
+		MetadataURL:       *metadataURL,
+		AcsURL:            *acsURL,
+		IDPMetadata:       idpMetadata,
+		AuthnNameIDFormat: saml.UnspecifiedNameIDFormat,
+		HTTPClient:        s.httpClient,
+	}, nil
+}
+
+// ServiceProviderMetadata is the SAML metadata of this application for the identity provider of a tenant
+func (s *SSOService) ServiceProviderMetadata(tenantId uint, c *gin.Context) (*saml.EntityDescriptor, error) {
+	settings, err := s.enabledSettings(tenantId)
+	if err != nil {
+		return nil, err
+	}
+	sp, err := s.serviceProvider(tenantId, settings, c)
+	if err != nil {
+		return nil, err
+	}
+	return sp.Metadata(), nil
+}
+
+func (s *SSOService) appURL(c *gin.Context, path string) (*url.URL, error) {
+	location, err := users.AppURL(c, path)
+	if err != nil {
+		return nil, err
+	}
+	return url.Parse(location)
+}
+
+func parseIDPMetadata(data []byte) (*saml.EntityDescriptor, error) {
+	metadata, err := samlsp.ParseMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(metadata.IDPSSODescriptors) == 0 {
+		return nil, errors.New("no IDPSSODescriptor")
+	}
+	return metadata, nil
+}
+
+// samlIdentity reads who signed in from the attributes of an assertion. Without an email
+// attribute, the NameID is the address if it looks like one.
+func samlIdentity(settings *models.SSOSettings, assertion *saml.Assertion) *Identity {
+	identity := &Identity{
+		Email:     firstValue(samlAttribute(assertion, samlEmailAttributes...)),
+		FirstName: firstValue(samlAttribute(assertion, samlFirstNameAttributes...)),
+		LastName:  firstValue(samlAttribute(assertion, samlLastNameAttributes...)),
+		Groups:    samlAttribute(assertion, roleClaim(settings)),
+	}
+	if identity.Email == "" && assertion.Subject != nil && assertion.Subject.NameID != nil && strings.Contains(assertion.Subject.NameID.Value, "@") {
+		identity.Email = assertion.Subject.NameID.Value
+	}
+	return identity
+}
+
+// samlAttribute returns the values of the first attribute with one of names, compared case-insensitively
+// with its name, friendly name and, for URI names like http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress, last segment
+func samlAttribute(assertion *saml.Assertion, names ...string) []string {
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			candidates := []string{attribute.Name, attribute.FriendlyName, attribute.Name[strings.LastIndex(attribute.Name, "/")+1:]}
+			for _, name := range names {
+				for _, candidate := range candidates {
+					if candidate != "" && strings.EqualFold(candidate, name) {
+						var values []string
+						for _, value := range attribute.Values {
+							values = append(values, value.Value)
+						}
+						return values
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func firstValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,744 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/database"
+	dto "github.com/auditrakkr/tms-fullstack/tms-backend/dtos"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/repositories"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/users"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/utils"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSSONotEnabled     = errors.New("single sign-on is not enabled for this tenant")
+	ErrTenantNotFound    = errors.New("tenant not found")
+	ErrInvalidSettings   = errors.New("invalid single sign-on settings")
+	ErrDomainInUse       = errors.New("the email domain is verified by another tenant")
+	ErrUnknownDomain     = errors.New("the email domain is not one of the tenant's single sign-on domains")
+	ErrDomainNotVerified = errors.New("the TXT record proving the ownership of the email domain was not found")
+	ErrInvalidLogin      = errors.New("invalid, expired or already completed single sign-on")
+	ErrInvalidCode       = errors.New("invalid, expired or already used single sign-on code")
+	ErrIdentityProvider  = errors.New("the identity provider did not sign the user in")
+	ErrDomainNotAllowed  = errors.New("the identity provider signed in an address outside the tenant's domains")
+	ErrNotProvisioned    = errors.New("the user is not on the tenant's team and provisioning is off")
+	ErrMissingEmailClaim = errors.New("the identity provider did not give a verified email address")
+	ErrUnverifiedDomain  = errors.New("the email domain is not verified yet, its users cannot sign in with the identity provider")
+	ErrLandlordAccount   = errors.New("landlord accounts cannot sign in with the identity provider of a tenant")
+)
+
+// Identity is who an identity provider signed in
+type Identity struct {
+	Email     string
+	FirstName string
+	LastName  string
+	Groups    []string // of the role claim, see models.SSOSettings
+}
+
+type SSOService struct {
+	tenantRepo             repositories.Repository[models.Tenant]
+	tenantConfigDetailRepo repositories.Repository[models.TenantConfigDetail]
+	tenantTeamRepo         repositories.Repository[models.TenantTeam]
+	userRepo               repositories.Repository[models.User]
+	ssoLoginRepo           repositories.Repository[models.SSOLogin]
+	userService            *users.UserService
+	httpClient             *http.Client
+	lookupTXT              func(ctx context.Context, name string) ([]string, error)
+}
+
+func NewSSOService(userService *users.UserService) *SSOService {
+	return &SSOService{
+		tenantRepo:             repositories.Repository[models.Tenant]{DB: database.DB},
+		tenantConfigDetailRepo: repositories.Repository[models.TenantConfigDetail]{DB: database.DB},
+		tenantTeamRepo:         repositories.Repository[models.TenantTeam]{DB: database.DB},
+		userRepo:               repositories.Repository[models.User]{DB: database.DB},
+		ssoLoginRepo:           repositories.Repository[models.SSOLogin]{DB: database.DB},
+		userService:            userService,
+		httpClient:             &http.Client{Timeout: 10 * time.Second},
+		lookupTXT:              net.DefaultResolver.LookupTXT,
+	}
+}
+
+/* SETTINGS */
+
+// FindSettings returns the single sign-on settings of a tenant, nil if it has none
+func (s *SSOService) FindSettings(tenantId uint) (*models.SSOSettings, error) {
+	configDetail, err := s.findConfigDetail(tenantId)
+	if err != nil {
+		return nil, err
+	}
+	return configDetail.SSO, nil
+}
+
+// UpdateSettings replaces the single sign-on settings of a tenant. The OIDC client secret is
+// stored encrypted; without a new one, the current one is kept.
+func (s *SSOService) UpdateSettings(tenantId uint, updateDto *dto.UpdateSSOSettingsDto) (*models.SSOSettings, error) {
+	configDetail, err := s.findConfigDetail(tenantId)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := &models.SSOSettings{
+		Enabled:         updateDto.Enabled,
+		Protocol:        updateDto.Protocol,
+		EnforceSSO:      updateDto.EnforceSSO,
+		JITProvisioning: updateDto.JITProvisioning,
+		RoleClaim:       strings.TrimSpace(updateDto.RoleClaim),
+		RoleMapping:     updateDto.RoleMapping,
+		DefaultRoles:    updateDto.DefaultRoles,
+	}
+	if settings.Domains, err = normalizeDomains(updateDto.Domains); err != nil {
+		return nil, err
+	}
+	if settings.DomainTokens, settings.VerifiedDomains, err = claimDomains(settings.Domains, configDetail.SSO); err != nil {
+		return nil, err
+	}
+	if err := validateRoles(settings); err != nil {
+		return nil, err
+	}
+
+	switch updateDto.Protocol {
+	case global.SSOProtocolOIDC:
+		if settings.OIDC, err = oidcSettings(updateDto.OIDC, configDetail.SSO); err != nil {
+			return nil, err
+		}
+	case global.SSOProtocolSAML:
+		if settings.SAML, err = samlSettings(updateDto.SAML); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: protocol must be %s or %s", ErrInvalidSettings, global.SSOProtocolOIDC, global.SSOProtocolSAML)
+	}
+
+	// A domain signs in with a single tenant's identity provider: the one that proved it owns it
+	for _, domain := range settings.Domains {
+		if err := s.checkDomainFree(tenantId, domain); err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.tenantConfigDetailRepo.CreateQueryBuilder().Where("id = ?", configDetail.ID).
+		Updates(map[string]any{"sso": settings, "version": repositories.NextVersion}).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to update single sign-on settings: %v", err)
+	}
+	return settings, nil
+}
+
+// DeleteSettings removes the single sign-on settings of a tenant, which turns it off
+func (s *SSOService) DeleteSettings(tenantId uint) error {
+	configDetail, err := s.findConfigDetail(tenantId)
+	if err != nil {
+		return err
+	}
+	err = s.tenantConfigDetailRepo.CreateQueryBuilder().Where("id = ?", configDetail.ID).
+		Updates(map[string]any{"sso": gorm.Expr("NULL"), "version": repositories.NextVersion}).Error
+	if err != nil {
+		return fmt.Errorf("failed to delete single sign-on settings: %v", err)
+	}
+	return nil
+}
+
+// VerifyDomain checks the TXT record proving that a tenant owns one of its single sign-on domains
+// (see DomainChallenges) and, if it is there, makes the domain a verified one
+func (s *SSOService) VerifyDomain(ctx context.Context, tenantId uint, domain string) (*models.SSOSettings, error) {
+	configDetail, err := s.findConfigDetail(tenantId)
+	if err != nil {
+		return nil, err
+	}
+	settings := configDetail.SSO
+	if settings == nil {
+		return nil, ErrSSONotEnabled
+	}
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	token := settings.DomainTokens[domain]
+	if token == "" {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownDomain, domain)
+	}
+	if domainVerified(settings, domain) {
+		return settings, nil
+	}
+
+	if err := checkDomainTXT(ctx, s.lookupTXT, domain, token); err != nil {
+		return nil, err
+	}
+	if err := s.checkDomainFree(tenantId, domain); err != nil {
+		return nil, err
+	}
+	settings.VerifiedDomains = append(settings.VerifiedDomains, domain)
+	err = s.tenantConfigDetailRepo.CreateQueryBuilder().Where("id = ?", configDetail.ID).
+		Updates(map[string]any{"sso": settings, "version": repositories.NextVersion}).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to update single sign-on settings: %v", err)
+	}
+	log.Printf("Tenant %d verified the email domain %s", tenantId, domain)
+	return settings, nil
+}
+
+// DomainChallenge is the TXT record proving that a tenant owns one of its single sign-on domains
+type DomainChallenge struct {
+	Domain      string `json:"domain"`
+	RecordName  string `json:"recordName"`
+	RecordValue string `json:"recordValue"`
+	Verified    bool   `json:"verified"`
+}
+
+// DomainChallenges are the TXT records of the single sign-on domains of a tenant
+func DomainChallenges(settings *models.SSOSettings) []DomainChallenge {
+	challenges := []DomainChallenge{}
+	if settings == nil {
+		return challenges
+	}
+	for _, domain := range settings.Domains {
+		challenges = append(challenges, DomainChallenge{
+			Domain:      domain,
+			RecordName:  global.SSO_DOMAIN_TXT_LABEL + "." + domain,
+			RecordValue: global.SSO_DOMAIN_TXT_PREFIX + settings.DomainTokens[domain],
+			Verified:    domainVerified(settings, domain),
+		})
+	}
+	return challenges
+}
+
+// checkDomainFree returns ErrDomainInUse if another tenant verified a domain
+func (s *SSOService) checkDomainFree(tenantId uint, domain string) error {
+	var count int64
+	err := s.tenantConfigDetailRepo.CreateQueryBuilder().
+		Where("tenant_id <> ? AND sso->'verified_domains' @> ?::jsonb", tenantId, domainsJSON(domain)).
+		Count(&count).Error
+	if err != nil {
+		return fmt.Errorf("failed to check email domains: %v", err)
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: %s", ErrDomainInUse, domain)
+	}
+	return nil
+}
+
+func (s *SSOService) findConfigDetail(tenantId uint) (*models.TenantConfigDetail, error) {
+	var configDetail models.TenantConfigDetail
+	err := s.tenantConfigDetailRepo.CreateQueryBuilder().Where("tenant_id = ?", tenantId).First(&configDetail).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrTenantNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find tenant config detail: %v", err)
+	}
+	return &configDetail, nil
+}
+
+/* DOMAINS */
+
+// FindTenantByEmail returns the ID of the tenant whose identity provider signs in an email address,
+// and whether it enforces single sign-on. 0 if no tenant has single sign-on for its domain, or
+// none verified it.
+func (s *SSOService) FindTenantByEmail(email string) (uint, bool, error) {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return 0, false, nil
+	}
+	domain := strings.ToLower(strings.TrimSpace(email[at+1:]))
+	if domain == "" {
+		return 0, false, nil
+	}
+
+	var configDetail models.TenantConfigDetail
+	err := s.tenantConfigDetailRepo.CreateQueryBuilder().
+		Where("(sso->>'enabled')::boolean AND sso->'verified_domains' @> ?::jsonb", domainsJSON(domain)).
+		First(&configDetail).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to find single sign-on of email domain: %v", err)
+	}
+	return configDetail.TenantID, configDetail.SSO.EnforceSSO, nil
+}
+
+// IsEnforced tells whether an email address must sign in with the identity provider of its tenant
+func (s *SSOService) IsEnforced(email string) (bool, error) {
+	tenantId, enforced, err := s.FindTenantByEmail(email)
+	return tenantId != 0 && enforced, err
+}
+
+/* SIGN-IN */
+
+// BeginLogin starts a sign-in with the identity provider of a tenant and returns the URL to send the user to
+func (s *SSOService) BeginLogin(tenantId uint, device string, c *gin.Context) (string, error) {
+	settings, err := s.enabledSettings(tenantId)
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate state: %v", err)
+	}
+	login := &models.SSOLogin{
+		TenantID:  tenantId,
+		StateHash: utils.HashToken(secret),
+		Device:    device,
+		ExpiresAt: time.Now().Add(global.SSO_LOGIN_EXPIRATION),
+		IPAddress: c.ClientIP(),
+	}
+
+	var redirect func(state string) (string, error)
+	switch settings.Protocol {
+	case global.SSOProtocolOIDC:
+		redirect, err = s.beginOIDCLogin(tenantId, settings, login, c)
+	case global.SSOProtocolSAML:
+		redirect, err = s.beginSAMLLogin(tenantId, settings, login, c)
+	default:
+		err = ErrSSONotEnabled
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := s.ssoLoginRepo.Create(login); err != nil {
+		return "", fmt.Errorf("failed to save single sign-on: %v", err)
+	}
+	// The state names its sign-in so the hash can be compared in constant time rather than looked up
+	return redirect(fmt.Sprintf("%d.%s", login.ID, secret))
+}
+
+// CompleteLogin handles the response of the identity provider of a tenant: the redirect of an
+// OpenID Connect provider or the assertion a SAML provider posts. It signs in, provisioning the
+// user if need be, and returns the code the client app exchanges for tokens (see UseCode).
+func (s *SSOService) CompleteLogin(tenantId uint, c *gin.Context) (string, error) {
+	settings, err := s.enabledSettings(tenantId)
+	if err != nil {
+		return "", err
+	}
+
+	var login *models.SSOLogin
+	var identity *Identity
+	switch settings.Protocol {
+	case global.SSOProtocolOIDC:
+		if login, err = s.findLogin(tenantId, c.Query("state")); err != nil {
+			return "", err
+		}
+		identity, err = s.completeOIDCLogin(tenantId, settings, login, c)
+	case global.SSOProtocolSAML:
+		if login, err = s.findLogin(tenantId, c.PostForm("RelayState")); err != nil {
+			return "", err
+		}
+		identity, err = s.completeSAMLLogin(tenantId, settings, login, c)
+	default:
+		err = ErrSSONotEnabled
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var tenant models.Tenant
+	if err := s.tenantRepo.CreateQueryBuilder().First(&tenant, tenantId).Error; err != nil {
+		return "", fmt.Errorf("failed to find tenant: %v", err)
+	}
+	user, err := s.provision(&tenant, settings, identity)
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate code: %v", err)
+	}
+	// Conditional, so a response replayed to the callback cannot complete the sign-in twice
+	result := s.ssoLoginRepo.CreateQueryBuilder().Where("id = ? AND user_id IS NULL", login.ID).Updates(map[string]any{
+		"user_id":    user.ID,
+		"code_hash":  utils.HashToken(secret),
+		"expires_at": time.Now().Add(global.SSO_CODE_EXPIRATION),
+	})
+	if result.Error != nil {
+		return "", fmt.Errorf("failed to complete single sign-on: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return "", ErrInvalidLogin
+	}
+	return fmt.Sprintf("%d.%s", login.ID, secret), nil
+}
+
+// UseCode uses up the code of a completed sign-in and returns the sign-in, with its user and tenant
+func (s *SSOService) UseCode(code string) (*models.SSOLogin, error) {
+	login, secret, err := s.findByToken(code)
+	if err != nil {
+		return nil, ErrInvalidCode
+	}
+	if login.CodeHash == "" || login.UserID == nil || login.UsedAt != nil || !login.ExpiresAt.After(time.Now()) ||
+		subtle.ConstantTimeCompare([]byte(utils.HashToken(secret)), []byte(login.CodeHash)) != 1 {
+		return nil, ErrInvalidCode
+	}
+
+	result := s.ssoLoginRepo.CreateQueryBuilder().Where("id = ? AND used_at IS NULL", login.ID).Update("used_at", time.Now())
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to use single sign-on code: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrInvalidCode
+	}
+	return login, nil
+}
+
+// ServiceProviderURLs are what the identity provider of a tenant is configured with
+func (s *SSOService) ServiceProviderURLs(tenantId uint, c *gin.Context) (map[string]string, error) {
+	urls := map[string]string{}
+	paths := map[string]string{
+		"oidcRedirectUrl": callbackPath(tenantId),
+		"samlMetadataUrl": samlMetadataPath(tenantId),
+		"samlAcsUrl":      samlACSPath(tenantId),
+		"loginUrl":        loginPath(tenantId),
+	}
+	for name, path := range paths {
+		u, err := users.AppURL(c, path)
+		if err != nil {
+			return nil, err
+		}
+		urls[name] = u
+	}
+	return urls, nil
+}
+
+func (s *SSOService) enabledSettings(tenantId uint) (*models.SSOSettings, error) {
+	settings, err := s.FindSettings(tenantId)
+	if errors.Is(err, ErrTenantNotFound) {
+		return nil, ErrSSONotEnabled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if settings == nil || !settings.Enabled {
+		return nil, ErrSSONotEnabled
+	}
+	return settings, nil
+}
+
+// findLogin returns the sign-in of a state, if it is of the tenant and still waits for the identity provider
+func (s *SSOService) findLogin(tenantId uint, state string) (*models.SSOLogin, error) {
+	login, secret, err := s.findByToken(state)
+	if err != nil {
+		return nil, err
+	}
+	if login.TenantID != tenantId || login.UserID != nil || !login.ExpiresAt.After(time.Now()) ||
+		subtle.ConstantTimeCompare([]byte(utils.HashToken(secret)), []byte(login.StateHash)) != 1 {
+		return nil, ErrInvalidLogin
+	}
+	return login, nil
+}
+
+// findByToken returns the sign-in a state or code names, and the secret of the token
+func (s *SSOService) findByToken(token string) (*models.SSOLogin, string, error) {
+	separator := strings.Index(token, ".")
+	if separator <= 0 {
+		return nil, "", ErrInvalidLogin
+	}
+	loginId, err := strconv.ParseUint(token[:separator], 10, 32)
+	if err != nil {
+		return nil, "", ErrInvalidLogin
+	}
+	var login models.SSOLogin
+	if err := s.ssoLoginRepo.CreateQueryBuilder().First(&login, uint(loginId)).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, "", ErrInvalidLogin
+		}
+		return nil, "", fmt.Errorf("failed to find single sign-on: %v", err)
+	}
+	return &login, token[separator+1:], nil
+}
+
+/* PROVISIONING */
+
+// provision returns the account of the user an identity provider signed in, on the tenant's team.
+// With JITProvisioning, users without an account or not on the team are created or added.
+// With a role mapping, the team roles are those of the user's groups at every sign-in.
+//
+// Its identity provider signs in nobody until the tenant verified the domain of the address: anyone
+// could claim a domain, and put any account on its team (e.g. over SCIM). Landlord accounts never
+// sign in with the identity provider of a tenant.
+func (s *SSOService) provision(tenant *models.Tenant, settings *models.SSOSettings, identity *Identity) (*models.User, error) {
+	email := strings.ToLower(strings.TrimSpace(identity.Email))
+	if email == "" {
+		return nil, ErrMissingEmailClaim
+	}
+	if err := checkDomain(settings, email); err != nil {
+		return nil, err
+	}
+	provisioning := settings.JITProvisioning
+
+	var user models.User
+	err := s.userRepo.CreateQueryBuilder().Where("LOWER(primary_email_address) = ?", email).First(&user).Error
+	if err == nil && user.Landlord {
+		return nil, ErrLandlordAccount
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if !provisioning {
+			return nil, ErrNotProvisioned
+		}
+		created, err := s.userService.ProvisionUser(email, identity.FirstName, identity.LastName)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Provisioned user %d from the identity provider of tenant %d", created.ID, tenant.ID)
+		user = *created
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to find user: %v", err)
+	}
+
+	roles, mapped := mapRoles(settings, identity.Groups)
+	var team models.TenantTeam
+	err = s.tenantTeamRepo.CreateQueryBuilder().Unscoped().Where("user_id = ? AND tenant_id = ?", user.ID, tenant.ID).First(&team).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		if !provisioning {
+			return nil, ErrNotProvisioned
+		}
+		team = models.TenantTeam{TenantID: tenant.ID, UserID: user.ID, TenantUniqueName: tenant.Subdomain, TenantUniqueID: tenant.ID}
+		if err := s.tenantTeamRepo.CreateQueryBuilder().Omit("Roles", "Tenant", "User").Create(&team).Error; err != nil {
+			return nil, fmt.Errorf("failed to add user to tenant team: %v", err)
+		}
+		return &user, s.setTeamRoles(team.ID, roles, false)
+	case err != nil:
+		return nil, fmt.Errorf("failed to find tenant team: %v", err)
+	case team.DeletedAt.Valid:
+		// Removed from the team: back only by provisioning
+		if !provisioning {
+			return nil, ErrNotProvisioned
+		}
+		return &user, s.setTeamRoles(team.ID, roles, true)
+	case mapped:
+		return &user, s.setTeamRoles(team.ID, roles, false)
+	}
+	return &user, nil
+}
+
+// setTeamRoles sets the roles of a team membership, restoring it if it was deleted
+func (s *SSOService) setTeamRoles(teamId uint, roles []global.TenantTeamRole, restore bool) error {
+	updates := map[string]any{"roles": models.TeamRolesExpr(roles)}
+	if restore {
+		updates["deleted_at"] = nil
+	}
+	err := s.tenantTeamRepo.CreateQueryBuilder().Unscoped().Where("id = ?", teamId).Updates(updates).Error
+	if err != nil {
+		return fmt.Errorf("failed to set tenant team roles: %v", err)
+	}
+	return nil
+}
+
+// mapRoles returns the team roles of the groups of a user, and whether the settings map groups to roles at all.
+// Users in none of the mapped groups get DefaultRoles, Employee without them.
+func mapRoles(settings *models.SSOSettings, groups []string) ([]global.TenantTeamRole, bool) {
+	var roles []global.TenantTeamRole
+	seen := map[global.TenantTeamRole]bool{}
+	for _, group := range groups {
+		for _, role := range settings.RoleMapping[group] {
+			if !seen[role] {
+				seen[role] = true
+				roles = append(roles, role)
+			}
+		}
+	}
+	if len(roles) == 0 {
+		roles = settings.DefaultRoles
+	}
+	if len(roles) == 0 {
+		roles = []global.TenantTeamRole{global.E}
+	}
+	return roles, len(settings.RoleMapping) > 0
+}
+
+// roleClaim is the OIDC claim or SAML attribute listing the groups of a user
+func roleClaim(settings *models.SSOSettings) string {
+	if settings.RoleClaim != "" {
+		return settings.RoleClaim
+	}
+	return global.SSO_DEFAULT_ROLE_CLAIM
+}
+
+// checkDomain checks that the domain of an address the identity provider signed in is a verified
+// domain of the tenant. ErrDomainNotAllowed if it is not a domain of the tenant at all: otherwise the
+// IdP of a tenant could sign in the users of any other; ErrUnverifiedDomain if it is not verified.
+func checkDomain(settings *models.SSOSettings, email string) error {
+	domain := email[strings.LastIndex(email, "@")+1:]
+	for _, allowed := range settings.Domains {
+		if domain == allowed {
+			if !domainVerified(settings, domain) {
+				return ErrUnverifiedDomain
+			}
+			return nil
+		}
+	}
+	return ErrDomainNotAllowed
+}
+
+func domainVerified(settings *models.SSOSettings, domain string) bool {
+	for _, verified := range settings.VerifiedDomains {
+		if domain == verified {
+			return true
+		}
+	}
+	return false
+}
+
+// claimDomains returns the tokens and verified domains of new single sign-on domains: those the
+// current settings had keep their token and verification, the others get a new token
+func claimDomains(domains []string, current *models.SSOSettings) (map[string]string, []string, error) {
+	tokens := map[string]string{}
+	var verified []string
+	for _, domain := range domains {
+		if current != nil && current.DomainTokens[domain] != "" {
+			tokens[domain] = current.DomainTokens[domain]
+			if domainVerified(current, domain) {
+				verified = append(verified, domain)
+			}
+			continue
+		}
+		token, err := randomToken(16)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate domain token: %v", err)
+		}
+		tokens[domain] = token
+	}
+	return tokens, verified, nil
+}
+
+// checkDomainTXT looks for the TXT record proving the ownership of a domain, ErrDomainNotVerified if there is none
+func checkDomainTXT(ctx context.Context, lookupTXT func(ctx context.Context, name string) ([]string, error), domain string, token string) error {
+	records, err := lookupTXT(ctx, global.SSO_DOMAIN_TXT_LABEL+"."+domain)
+	var dnsError *net.DNSError
+	if err != nil && !(errors.As(err, &dnsError) && dnsError.IsNotFound) {
+		return fmt.Errorf("failed to look up the TXT records of %s: %v", domain, err)
+	}
+	want := global.SSO_DOMAIN_TXT_PREFIX + token
+	for _, record := range records {
+		if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(record)), []byte(want)) == 1 {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrDomainNotVerified, global.SSO_DOMAIN_TXT_LABEL+"."+domain)
+}
+
+/* VALIDATION */
+
+func normalizeDomains(domains []string) ([]string, error) {
+	var normalized []string
+	seen := map[string]bool{}
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" || strings.ContainsAny(domain, "@/ ") || !strings.Contains(domain, ".") {
+			return nil, fmt.Errorf("%w: invalid email domain %q", ErrInvalidSettings, domain)
+		}
+		if !seen[domain] {
+			seen[domain] = true
+			normalized = append(normalized, domain)
+		}
+	}
+	if len(normalized) == 0 {
+		return nil, fmt.Errorf("%w: at least one email domain is required", ErrInvalidSettings)
+	}
+	return normalized, nil
+}
+
+func validateRoles(settings *models.SSOSettings) error {
+	valid := func(roles []global.TenantTeamRole) error {
+		for _, role := range roles {
+			if role != global.A && role != global.M && role != global.E {
+				return fmt.Errorf("%w: unknown team role %q", ErrInvalidSettings, role)
+			}
+		}
+		return nil
+	}
+	for _, roles := range settings.RoleMapping {
+		if err := valid(roles); err != nil {
+			return err
+		}
+	}
+	return valid(settings.DefaultRoles)
+}
+
+func oidcSettings(oidcDto *dto.OIDCSettingsDto, current *models.SSOSettings) (*models.OIDCSettings, error) {
+	if oidcDto == nil || oidcDto.ClientID == "" {
+		return nil, fmt.Errorf("%w: oidc.clientId is required", ErrInvalidSettings)
+	}
+	if parsed, err := url.Parse(oidcDto.DiscoveryURL); err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return nil, fmt.Errorf("%w: oidc.discoveryUrl must be an http(s) URL", ErrInvalidSettings)
+	}
+	settings := &models.OIDCSettings{
+		DiscoveryURL: strings.TrimSpace(oidcDto.DiscoveryURL),
+		ClientID:     oidcDto.ClientID,
+		Scopes:       oidcDto.Scopes,
+	}
+	switch {
+	case oidcDto.ClientSecret != nil && *oidcDto.ClientSecret != "":
+		encrypted, err := utils.Encrypt(*oidcDto.ClientSecret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt client secret: %v", err)
+		}
+		settings.ClientSecret = encrypted
+	case current != nil && current.OIDC != nil && current.OIDC.ClientID == oidcDto.ClientID:
+		settings.ClientSecret = current.OIDC.ClientSecret
+	default:
+		return nil, fmt.Errorf("%w: oidc.clientSecret is required", ErrInvalidSettings)
+	}
+	return settings, nil
+}
+
+func samlSettings(samlDto *dto.SAMLSettingsDto) (*models.SAMLSettings, error) {
+	if samlDto == nil || (samlDto.IDPMetadataURL == "" && samlDto.IDPMetadata == "") {
+		return nil, fmt.Errorf("%w: saml.idpMetadataUrl or saml.idpMetadata is required", ErrInvalidSettings)
+	}
+	if samlDto.IDPMetadataURL == "" {
+		if _, err := parseIDPMetadata([]byte(samlDto.IDPMetadata)); err != nil {
+			return nil, fmt.Errorf("%w: saml.idpMetadata: %v", ErrInvalidSettings, err)
+		}
+	} else if parsed, err := url.Parse(samlDto.IDPMetadataURL); err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return nil, fmt.Errorf("%w: saml.idpMetadataUrl must be an http(s) URL", ErrInvalidSettings)
+	}
+	return &models.SAMLSettings{IDPMetadataURL: samlDto.IDPMetadataURL, IDPMetadata: samlDto.IDPMetadata}, nil
+}
+
+// domainsJSON is a JSON array of a domain, to match the domains of SSO settings with @>
+func domainsJSON(domain string) string {
+	encoded, _ := json.Marshal([]string{domain})
+	return string(encoded)
+}
+
+func randomToken(length int) (string, error) {
+	bytes := make([]byte, length)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+func loginPath(tenantId uint) string {
+	return fmt.Sprintf("/auth/sso/%d/login", tenantId)
+}
+
+func callbackPath(tenantId uint) string {
+	return fmt.Sprintf("/auth/sso/%d/callback", tenantId)
+}
+
+func samlMetadataPath(tenantId uint) string {
+	return fmt.Sprintf("/auth/sso/%d/saml/metadata", tenantId)
+}
+
+func samlACSPath(tenantId uint) string {
+	return fmt.Sprintf("/auth/sso/%d/saml/acs", tenantId)
+}
@@ -0,0 +1,198 @@
+package sso
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/config"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/sso/mockidp"
+	"github.com/gin-gonic/gin"
+)
+
+func TestClaimDomains(t *testing.T) {
+	current := &models.SSOSettings{
+		Domains:         []string{"example.com", "example.org"},
+		VerifiedDomains: []string{"example.com"},
+		DomainTokens:    map[string]string{"example.com": "com-token", "example.org": "org-token"},
+	}
+	tokens, verified, err := claimDomains([]string{"example.com", "example.net"}, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens["example.com"] != "com-token" {
+		t.Errorf("token of a kept domain = %q, want com-token", tokens["example.com"])
+	}
+	if tokens["example.net"] == "" {
+		t.Error("a new domain has no token")
+	}
+	if _, ok := tokens["example.org"]; ok {
+		t.Error("a removed domain kept its token")
+	}
+	if !reflect.DeepEqual(verified, []string{"example.com"}) {
+		t.Errorf("verified = %v, want [example.com]", verified)
+	}
+
+	tokens, verified, err = claimDomains([]string{"example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens["example.com"] == "" || len(verified) != 0 {
+		t.Errorf("without settings: tokens = %v, verified = %v, want a new token and no verified domain", tokens, verified)
+	}
+}
+
+func TestCheckDomain(t *testing.T) {
+	settings := &models.SSOSettings{
+		Domains:         []string{"example.com", "example.org"},
+		VerifiedDomains: []string{"example.com"},
+	}
+	tests := []struct {
+		email string
+		err   error
+	}{
+		{"jane.doe@example.com", nil},
+		{"jane.doe@example.org", ErrUnverifiedDomain},
+		{"jane.doe@gmail.com", ErrDomainNotAllowed},
+		{"jane.doe@sub.example.com", ErrDomainNotAllowed},
+	}
+	for _, test := range tests {
+		if err := checkDomain(settings, test.email); !errors.Is(err, test.err) {
+			t.Errorf("checkDomain(%s) = %v, want %v", test.email, err, test.err)
+		}
+	}
+}
+
+func TestCheckDomainTXT(t *testing.T) {
+	records := map[string][]string{
+		global.SSO_DOMAIN_TXT_LABEL + ".example.com": {"v=spf1 -all", global.SSO_DOMAIN_TXT_PREFIX + "token"},
+		global.SSO_DOMAIN_TXT_LABEL + ".example.org": {global.SSO_DOMAIN_TXT_PREFIX + "another-token"},
+	}
+	lookupTXT := func(ctx context.Context, name string) ([]string, error) {
+		if values, ok := records[name]; ok {
+			return values, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	if err := checkDomainTXT(context.Background(), lookupTXT, "example.com", "token"); err != nil {
+		t.Errorf("with the record: %v", err)
+	}
+	if err := checkDomainTXT(context.Background(), lookupTXT, "example.org", "token"); !errors.Is(err, ErrDomainNotVerified) {
+		t.Errorf("with another token: %v, want ErrDomainNotVerified", err)
+	}
+	if err := checkDomainTXT(context.Background(), lookupTXT, "example.net", "token"); !errors.Is(err, ErrDomainNotVerified) {
+		t.Errorf("without a record: %v, want ErrDomainNotVerified", err)
+	}
+
+	failing := func(ctx context.Context, name string) ([]string, error) {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	if err := checkDomainTXT(context.Background(), failing, "example.com", "token"); err == nil || errors.Is(err, ErrDomainNotVerified) {
+		t.Errorf("with a failing resolver: %v, want a lookup error", err)
+	}
+}
+
+func TestDomainChallenges(t *testing.T) {
+	settings := &models.SSOSettings{
+		Domains:         []string{"example.com", "example.org"},
+		VerifiedDomains: []string{"example.com"},
+		DomainTokens:    map[string]string{"example.com": "com-token", "example.org": "org-token"},
+	}
+	want := []DomainChallenge{
+		{Domain: "example.com", RecordName: global.SSO_DOMAIN_TXT_LABEL + ".example.com", RecordValue: global.SSO_DOMAIN_TXT_PREFIX + "com-token", Verified: true},
+		{Domain: "example.org", RecordName: global.SSO_DOMAIN_TXT_LABEL + ".example.org", RecordValue: global.SSO_DOMAIN_TXT_PREFIX + "org-token"},
+	}
+	if got := DomainChallenges(settings); !reflect.DeepEqual(got, want) {
+		t.Errorf("DomainChallenges = %+v, want %+v", got, want)
+	}
+	if redacted(settings).DomainTokens != nil {
+		t.Error("redacted settings have the domain tokens")
+	}
+}
+
+// TestOIDCLogin signs in with the mock identity provider, from the authorization request to the
+// verified ID token
+func TestOIDCLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	previous := config.AppConfig
+	t.Cleanup(func() { config.AppConfig = previous })
+	config.AppConfig = &config.Config{}
+	config.AppConfig.App.RootURL = "http://tms.test"
+
+	server := httptest.NewUnstartedServer(nil)
+	idp, err := mockidp.New("http://"+server.Listener.Addr().String(), "tms", "", true, mockidp.Identity{
+		Email:      "jane.doe@example.com",
+		GivenName:  "Jane",
+		FamilyName: "Doe",
+		Groups:     []string{"admins"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Config.Handler, err = idp.Handler(); err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Close()
+
+	service := &SSOService{httpClient: server.Client()}
+	settings := &models.SSOSettings{
+		Enabled:  true,
+		Protocol: global.SSOProtocolOIDC,
+		Domains:  []string{"example.com"},
+		OIDC:     &models.OIDCSettings{DiscoveryURL: idp.Issuer(), ClientID: "tms"},
+	}
+	login := &models.SSOLogin{TenantID: 1}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, loginPath(1), nil)
+	redirect, err := service.beginOIDCLogin(1, settings, login, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizeURL, err := redirect("1.state")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	browser := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	response, err := browser.Get(authorizeURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	location, err := url.Parse(response.Header.Get("Location"))
+	if err != nil || response.StatusCode != http.StatusFound {
+		t.Fatalf("authorize = %d to %q, want a redirect", response.StatusCode, response.Header.Get("Location"))
+	}
+	if location.Path != callbackPath(1) || location.Query().Get("state") != "1.state" {
+		t.Fatalf("redirect to %s, want %s with the state", location, callbackPath(1))
+	}
+
+	callback := func() (*Identity, error) {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, location.RequestURI(), nil)
+		return service.completeOIDCLogin(1, settings, login, c)
+	}
+	identity, err := callback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Identity{Email: "jane.doe@example.com", FirstName: "Jane", LastName: "Doe", Groups: []string{"admins"}}
+	if !reflect.DeepEqual(identity, want) {
+		t.Errorf("identity = %+v, want %+v", identity, want)
+	}
+
+	// An authorization code is used once
+	if _, err := callback(); !errors.Is(err, ErrIdentityProvider) {
+		t.Errorf("reused code: %v, want ErrIdentityProvider", err)
+	}
+}
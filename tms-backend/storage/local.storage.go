@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// LocalStorage stores files on the local (or a mounted network) file system under Root
+type LocalStorage struct {
+	Root string
+}
+
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{Root: root}
+}
+
+func (s *LocalStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	dest, err := s.resolve(key)
+	if err != nil {
+		return err
+	}
+
+	// Ensure the destination directory exists
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	// Write to a temporary file first so readers never see a partially written file
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create destination file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to copy file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return fmt.Errorf("failed to move file into place: %v", err)
+	}
+
+	return nil
+}
+
+func (s *LocalStorage) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	filePath, _ := s.resolve(key)
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, fmt.Errorf("failed to open file: %v", err)
+	}
+
+	return file, info, nil
+}
+
+func (s *LocalStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	filePath, err := s.resolve(key)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to stat file: %v", err)
+	}
+	if stat.IsDir() {
+		return nil, ErrNotFound
+	}
+
+	return localObjectInfo(cleanKey(key), stat), nil
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, key string) error {
+	filePath, err := s.resolve(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete file: %v", err)
+	}
+	return nil
+}
+
+func (s *LocalStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	prefix = strings.TrimPrefix(prefix, "/")
+
+	// Only walk the directory the prefix is in, not the files of every other tenant under Root.
+	// A directory that does not exist holds no files.
+	dir := prefix
+	if !strings.HasSuffix(dir, "/") {
+		dir = path.Dir(dir)
+	}
+	start := filepath.Join(s.Root, filepath.FromSlash(cleanKey(dir)))
+
+	err := filepath.WalkDir(start, func(walkPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.Root, walkPath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		stat, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, *localObjectInfo(key, stat))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %v", err)
+	}
+
+	return objects, nil
+}
+
+// resolve maps a key onto a path under Root. cleanKey roots the key before
+// cleaning it, so ".." segments can never escape Root
+func (s *LocalStorage) resolve(key string) (string, error) {
+	key = cleanKey(key)
+	if key == "" {
+		return "", fmt.Errorf("invalid file key: %q", key)
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(key)), nil
+}
+
+func cleanKey(key string) string {
+	return strings.TrimPrefix(path.Clean("/"+key), "/")
+}
+
+func localObjectInfo(key string, stat fs.FileInfo) *ObjectInfo {
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         stat.Size(),
+		ContentType:  contentType,
+		LastModified: stat.ModTime(),
+		ETag:         fmt.Sprintf("%x-%x", stat.ModTime().UnixNano(), stat.Size()),
+	}
+}
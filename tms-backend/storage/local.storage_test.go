@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestLocalStorageList(t *testing.T) {
+	ctx := context.Background()
+	store := NewLocalStorage(t.TempDir())
+	for _, key := range []string{"tenant-a/logos/original.png", "tenant-a/logos/small.png", "tenant-a/photos/1.jpg", "tenant-b/logos/original.png"} {
+		if err := store.Put(ctx, key, strings.NewReader("x"), 1, "image/png"); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"tenant-a/logos/", []string{"tenant-a/logos/original.png", "tenant-a/logos/small.png"}},
+		{"tenant-a/logos/sm", []string{"tenant-a/logos/small.png"}},
+		{"tenant-a/", []string{"tenant-a/logos/original.png", "tenant-a/logos/small.png", "tenant-a/photos/1.jpg"}},
+		{"tenant-c/logos/", nil},
+		{"../tenant-b/", nil},
+	}
+	for _, test := range tests {
+		objects, err := store.List(ctx, test.prefix)
+		if err != nil {
+			t.Errorf("List(%q): %v", test.prefix, err)
+			continue
+		}
+		var keys []string
+		for _, object := range objects {
+			keys = append(keys, object.Key)
+		}
+		sort.Strings(keys)
+		if !reflect.DeepEqual(keys, test.want) {
+			t.Errorf("List(%q) = %v, want %v", test.prefix, keys, test.want)
+		}
+	}
+}
+
+func TestLocalStorageListOnlyWalksThePrefix(t *testing.T) {
+	root := t.TempDir()
+	store := NewLocalStorage(root)
+	if err := store.Put(context.Background(), "tenant-a/logos/original.png", strings.NewReader("x"), 1, "image/png"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	// A directory that cannot be read fails any walk that enters it
+	locked := filepath.Join(root, "tenant-b")
+	if err := os.MkdirAll(filepath.Join(locked, "logos"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(locked, 0755)
+	if _, err := os.ReadDir(locked); err == nil {
+		t.Skip("directory permissions are not enforced (running as root?)")
+	}
+
+	if _, err := store.List(context.Background(), "tenant-a/logos/"); err != nil {
+		t.Errorf("List walked outside the prefix: %v", err)
+	}
+}
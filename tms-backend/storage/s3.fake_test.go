@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a MinIO-style object store in memory, speaking just enough of the S3 API
+// (path style PUT, GET, HEAD, DELETE and ListObjectsV2) for S3Storage
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string]fakeObject
+}
+
+type fakeObject struct {
+	data         []byte
+	contentType  string
+	lastModified time.Time
+}
+
+type fakeListResult struct {
+	XMLName     xml.Name          `xml:"ListBucketResult"`
+	Name        string            `xml:"Name"`
+	Prefix      string            `xml:"Prefix"`
+	KeyCount    int               `xml:"KeyCount"`
+	MaxKeys     int               `xml:"MaxKeys"`
+	IsTruncated bool              `xml:"IsTruncated"`
+	Contents    []fakeListContent `xml:"Contents"`
+}
+
+type fakeListContent struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+// newFakeS3 starts the fake over TLS and returns an S3Storage on it, trusting its certificate
+// through S3Config.CA as a self-hosted MinIO would be configured
+func newFakeS3(t *testing.T, prefix string) (*fakeS3, *S3Storage) {
+	t.Helper()
+	fake := &fakeS3{bucket: "tms", objects: map[string]fakeObject{}}
+	server := httptest.NewTLSServer(fake)
+	t.Cleanup(server.Close)
+
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	store, err := NewS3Storage(S3Config{
+		Endpoint:  strings.TrimPrefix(server.URL, "https://"),
+		Secure:    true,
+		Bucket:    fake.bucket,
+		Prefix:    prefix,
+		AccessKey: "minio",
+		SecretKey: "minio-secret",
+		Region:    "us-east-1",
+		CA:        &ca,
+	})
+	if err != nil {
+		t.Fatalf("NewS3Storage: %v", err)
+	}
+	return fake, store
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		f.writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, r.URL.Query().Get("prefix"))
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			f.writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		object := fakeObject{data: data, contentType: r.Header.Get("Content-Type"), lastModified: time.Now().UTC().Truncate(time.Second)}
+		f.objects[key] = object
+		w.Header().Set("ETag", object.etag())
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := f.objects[key]
+		if !ok {
+			f.writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Type", object.contentType)
+		w.Header().Set("Content-Length", fmt.Sprint(len(object.data)))
+		w.Header().Set("Last-Modified", object.lastModified.Format(http.TimeFormat))
+		w.Header().Set("ETag", object.etag())
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(object.data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	result := fakeListResult{Name: f.bucket, Prefix: prefix, MaxKeys: 1000}
+	for key, object := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		result.Contents = append(result.Contents, fakeListContent{
+			Key:          key,
+			LastModified: object.lastModified.Format("2006-01-02T15:04:05.000Z"),
+			ETag:         object.etag(),
+			Size:         int64(len(object.data)),
+			StorageClass: "STANDARD",
+		})
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeS3) writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (o fakeObject) etag() string {
+	return fmt.Sprintf(`"%x"`, len(o.data))
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config holds the connection details for an S3 compatible object store (AWS S3, MinIO, etc.)
+type S3Config struct {
+	Endpoint  string // host[:port], without scheme
+	Secure    bool
+	Bucket    string
+	Prefix    string // optional key prefix inside the bucket
+	AccessKey string
+	SecretKey string
+	Region    string
+	CA        *string // optional PEM encoded CA for self signed endpoints
+}
+
+// S3Storage stores files in a bucket of an S3 compatible object store
+type S3Storage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func NewS3Storage(cfg S3Config) (*S3Storage, error) {
+	options := &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.Secure,
+		Region: cfg.Region,
+	}
+
+	if cfg.CA != nil && *cfg.CA != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(*cfg.CA)) {
+			return nil, fmt.Errorf("failed to parse object store CA certificate")
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+		options.Transport = transport
+	}
+
+	client, err := minio.New(cfg.Endpoint, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create object store client: %v", err)
+	}
+
+	return &S3Storage{
+		client: client,
+		bucket: cfg.Bucket,
+		prefix: strings.Trim(cfg.Prefix, "/"),
+	}, nil
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, s.objectName(key), r, size, minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload file: %v", err)
+	}
+	return nil
+}
+
+func (s *S3Storage) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	// Stat first so a missing object is reported before any bytes are streamed
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	object, err := s.client.GetObject(ctx, s.bucket, s.objectName(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to download file: %v", err)
+	}
+
+	return object, info, nil
+}
+
+func (s *S3Storage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	stat, err := s.client.StatObject(ctx, s.bucket, s.objectName(key), minio.StatObjectOptions{})
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to stat file: %v", err)
+	}
+
+	return &ObjectInfo{
+		Key:          cleanKey(key),
+		Size:         stat.Size,
+		ContentType:  stat.ContentType,
+		LastModified: stat.LastModified,
+		ETag:         stat.ETag,
+	}, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	err := s.client.RemoveObject(ctx, s.bucket, s.objectName(key), minio.RemoveObjectOptions{})
+	if err != nil && !isS3NotFound(err) {
+		return fmt.Errorf("failed to delete file: %v", err)
+	}
+	return nil
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	// Prefixes are matched literally, so they are not cleaned like keys
+	listPrefix := strings.TrimPrefix(prefix, "/")
+	if s.prefix != "" {
+		listPrefix = s.prefix + "/" + listPrefix
+	}
+
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: listPrefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, fmt.Errorf("failed to list files: %v", object.Err)
+		}
+		objects = append(objects, ObjectInfo{
+			Key:          strings.TrimPrefix(object.Key, s.prefix+"/"),
+			Size:         object.Size,
+			ContentType:  object.ContentType,
+			LastModified: object.LastModified,
+			ETag:         object.ETag,
+		})
+	}
+
+	return objects, nil
+}
+
+func (s *S3Storage) objectName(key string) string {
+	key = cleanKey(key)
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+func isS3NotFound(err error) bool {
+	var response minio.ErrorResponse
+	if errors.As(err, &response) {
+		return response.StatusCode == http.StatusNotFound || response.Code == "NoSuchKey"
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestS3StoragePutGetStatDelete(t *testing.T) {
+	ctx := context.Background()
+	fake, store := newFakeS3(t, "uploads")
+
+	content := "<svg></svg>"
+	if err := store.Put(ctx, "logos/original.svg", strings.NewReader(content), int64(len(content)), "image/svg+xml"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got, want := fake.keys(), []string{"uploads/logos/original.svg"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("stored keys = %v, want %v", got, want)
+	}
+
+	info, err := store.Stat(ctx, "logos/original.svg")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Key != "logos/original.svg" || info.Size != int64(len(content)) || info.ContentType != "image/svg+xml" {
+		t.Errorf("Stat = %+v", info)
+	}
+
+	reader, _, err := store.Get(ctx, "logos/original.svg")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != content {
+		t.Errorf("Get read %q, %v; want %q", data, err, content)
+	}
+
+	if err := store.Delete(ctx, "logos/original.svg"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Stat(ctx, "logos/original.svg"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat after Delete = %v, want ErrNotFound", err)
+	}
+	if _, _, err := store.Get(ctx, "logos/original.svg"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete = %v, want ErrNotFound", err)
+	}
+	if err := store.Delete(ctx, "logos/original.svg"); err != nil {
+		t.Errorf("Delete of a missing file = %v, want nil", err)
+	}
+}
+
+func TestS3StorageKeysCannotEscapePrefix(t *testing.T) {
+	ctx := context.Background()
+	fake, store := newFakeS3(t, "uploads")
+
+	if err := store.Put(ctx, "../../other/file.txt", strings.NewReader("x"), 1, "text/plain"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got, want := fake.keys(), []string{"uploads/other/file.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stored keys = %v, want %v", got, want)
+	}
+}
+
+func TestTenantStorageListAndDeletePrefix(t *testing.T) {
+	ctx := context.Background()
+	fake, backend := newFakeS3(t, "")
+	tenant := WithPrefix(backend, "tenant-a")
+	other := WithPrefix(backend, "tenant-b")
+
+	for _, key := range []string{"logos/original.png", "logos/small.png", "photos/1.jpg"} {
+		if err := tenant.Put(ctx, key, strings.NewReader("x"), 1, "image/png"); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+	if err := other.Put(ctx, "logos/original.png", strings.NewReader("x"), 1, "image/png"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	objects, err := tenant.List(ctx, "logos/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	if want := []string{"logos/original.png", "logos/small.png"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("List keys = %v, want %v", keys, want)
+	}
+
+	if err := DeletePrefix(ctx, tenant, "logos/"); err != nil {
+		t.Fatalf("DeletePrefix: %v", err)
+	}
+	want := []string{"tenant-a/photos/1.jpg", "tenant-b/logos/original.png"}
+	if got := fake.keys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("keys after DeletePrefix = %v, want %v", got, want)
+	}
+}
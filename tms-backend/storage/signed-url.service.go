@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/config"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/utils"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrURLExpired          = errors.New("link has expired")
+	ErrURLInvalidSignature = errors.New("invalid link signature")
+)
+
+// Query parameters added to a signed URL. They are reserved: a URL being signed must not already use them
+const (
+	signedURLExpiresParam = "exp"
+	signedURLKeyIDParam   = "kid"
+	signedURLSigParam     = "sig"
+)
+
+const defaultSignedURLExpiration = 15 * time.Minute
+
+type signingKey struct {
+	id     string
+	secret []byte
+}
+
+// URLSigner issues and verifies HMAC-SHA256 signed, expiring URLs.
+// Several keys can be configured for rotation: the first signs new URLs, all of
+// them verify. Links signed with a key that has been removed fail as expired.
+type URLSigner struct {
+	keys       []signingKey
+	expiration time.Duration
+}
+
+// SignOptions controls the lifetime of a signed URL. Links are not bound to a caller: they are
+// used where no Authorization header is sent (img tags, emails), so whoever holds one may use it
+// until it expires. Only issue them to callers allowed to see the file.
+type SignOptions struct {
+	Expiration time.Duration // 0 uses the configured default
+}
+
+var (
+	defaultSigner     *URLSigner
+	defaultSignerOnce sync.Once
+)
+
+// DefaultSigner returns the signer built from config.AppConfig.FileURLSigning
+func DefaultSigner() *URLSigner {
+	defaultSignerOnce.Do(func() {
+		keys, expiration := "", 0
+		if config.AppConfig != nil {
+			keys = config.AppConfig.FileURLSigning.Keys
+			expiration = config.AppConfig.FileURLSigning.Expiration
+		}
+		signer, err := NewURLSigner(keys, time.Duration(expiration)*time.Second)
+		if err != nil {
+			log.Printf("Warning: invalid FILE_URL_SIGNING_KEYS (%v). Falling back to a key derived from the encryption secret", err)
+			signer, _ = NewURLSigner("", time.Duration(expiration)*time.Second)
+		}
+		defaultSigner = signer
+	})
+	return defaultSigner
+}
+
+// NewURLSigner parses comma separated kid:secret pairs, newest first.
+// With no keys configured a key derived from the application encryption secret is used.
+func NewURLSigner(keys string, expiration time.Duration) (*URLSigner, error) {
+	signer := &URLSigner{expiration: expiration}
+	if signer.expiration <= 0 {
+		signer.expiration = defaultSignedURLExpiration
+	}
+
+	for _, pair := range strings.Split(keys, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(pair, ":")
+		if !ok || id == "" || len(secret) < 16 {
+			return nil, fmt.Errorf("signing key %q must be kid:secret with a secret of at least 16 characters", id)
+		}
+		signer.keys = append(signer.keys, signingKey{id: id, secret: []byte(secret)})
+	}
+
+	if len(signer.keys) == 0 {
+		mac := hmac.New(sha256.New, utils.SecretKey)
+		mac.Write([]byte("file-url-signing"))
+		signer.keys = []signingKey{{id: "default", secret: mac.Sum(nil)}}
+	}
+
+	return signer, nil
+}
+
+// Sign returns path with its query extended by the expiry, key id and signature,
+// together with the time the URL expires
+func (s *URLSigner) Sign(path string, query url.Values, opts SignOptions) (string, time.Time) {
+	expiration := opts.Expiration
+	if expiration <= 0 {
+		expiration = s.expiration
+	}
+
+	signed := url.Values{}
+	for name, values := range query {
+		signed[name] = values
+	}
+	key := s.keys[0]
+	expiresAt := time.Now().Add(expiration).Truncate(time.Second)
+	signed.Set(signedURLExpiresParam, strconv.FormatInt(expiresAt.Unix(), 10))
+	signed.Set(signedURLKeyIDParam, key.id)
+	signed.Set(signedURLSigParam, signature(key.secret, path, signed))
+
+	return path + "?" + signed.Encode(), expiresAt
+}
+
+// Verify checks the signature and expiry of a signed URL
+func (s *URLSigner) Verify(path string, query url.Values) error {
+	var key *signingKey
+	for i := range s.keys {
+		if s.keys[i].id == query.Get(signedURLKeyIDParam) {
+			key = &s.keys[i]
+			break
+		}
+	}
+	if key == nil {
+		// The key has been rotated out: treat the link as expired rather than forged
+		return ErrURLExpired
+	}
+
+	expected := signature(key.secret, path, query)
+	if !hmac.Equal([]byte(expected), []byte(query.Get(signedURLSigParam))) {
+		return ErrURLInvalidSignature
+	}
+
+	expires, err := strconv.ParseInt(query.Get(signedURLExpiresParam), 10, 64)
+	if err != nil {
+		return ErrURLInvalidSignature
+	}
+	if time.Now().Unix() > expires {
+		return ErrURLExpired
+	}
+
+	return nil
+}
+
+// signature computes the base64url HMAC of the path and every query parameter except sig,
+// in a canonical (sorted) order
+func signature(secret []byte, path string, query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		if name != signedURLSigParam {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(path))
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			mac.Write([]byte("\n" + url.QueryEscape(name) + "=" + url.QueryEscape(value)))
+		}
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// RequireSignedURL rejects requests whose URL does not carry a valid signature.
+// Expired links (including those signed with a retired key) get 410 Gone so
+// clients can request a fresh link.
+func RequireSignedURL() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := DefaultSigner().Verify(c.Request.URL.Path, c.Request.URL.Query())
+		switch {
+		case err == nil:
+			c.Next()
+		case errors.Is(err, ErrURLExpired):
+			c.AbortWithStatusJSON(http.StatusGone, gin.H{"error": "This link has expired. Please request a new one"})
+		default:
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		}
+	}
+}
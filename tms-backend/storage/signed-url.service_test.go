@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func testSigner(t *testing.T, keys string) *URLSigner {
+	t.Helper()
+	signer, err := NewURLSigner(keys, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// verify splits a signed URL and checks it with signer
+func verify(t *testing.T, signer *URLSigner, signed string) error {
+	t.Helper()
+	parsed, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer.Verify(parsed.Path, parsed.Query())
+}
+
+// expiredLink signs path with an expiry in the past, which Sign never issues
+func expiredLink(signer *URLSigner, path string) string {
+	query := url.Values{}
+	query.Set(signedURLExpiresParam, strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10))
+	query.Set(signedURLKeyIDParam, signer.keys[0].id)
+	query.Set(signedURLSigParam, signature(signer.keys[0].secret, path, query))
+	return path + "?" + query.Encode()
+}
+
+func TestSignAndVerify(t *testing.T) {
+	signer := testSigner(t, "2024-02:second-secret-value,2024-01:first-secret-value")
+	signed, expiresAt := signer.Sign("/users/1/photo", url.Values{"size": {"small"}}, SignOptions{})
+	if err := verify(t, signer, signed); err != nil {
+		t.Errorf("Verify of a fresh link: %v", err)
+	}
+	if until := time.Until(expiresAt); until <= 0 || until > time.Minute {
+		t.Errorf("link expires in %v, want within the configured minute", until)
+	}
+	if query, _ := url.Parse(signed); query.Query().Get(signedURLKeyIDParam) != "2024-02" {
+		t.Errorf("link signed with key %q, want the newest", query.Query().Get(signedURLKeyIDParam))
+	}
+
+	// A link signed before a rotation keeps working while its key is still configured
+	rotated := testSigner(t, "2024-03:third-secret-value,2024-02:second-secret-value")
+	if err := verify(t, rotated, signed); err != nil {
+		t.Errorf("Verify with a retained key: %v", err)
+	}
+}
+
+func TestVerifyRefuses(t *testing.T) {
+	signer := testSigner(t, "2024-02:second-secret-value,2024-01:first-secret-value")
+	signed, _ := signer.Sign("/users/1/photo", url.Values{"size": {"small"}}, SignOptions{})
+	expired := expiredLink(signer, "/users/1/photo")
+
+	tamper := func(change func(path string, query url.Values) string) string {
+		parsed, _ := url.Parse(signed)
+		query := parsed.Query()
+		path := change(parsed.Path, query)
+		return path + "?" + query.Encode()
+	}
+	tests := []struct {
+		name   string
+		signer *URLSigner
+		signed string
+		err    error
+	}{
+		{"expired", signer, expired, ErrURLExpired},
+		{"rotated out key", testSigner(t, "2024-03:third-secret-value"), signed, ErrURLExpired},
+		{"changed query", signer, tamper(func(path string, query url.Values) string {
+			query.Set("size", "original")
+			return path
+		}), ErrURLInvalidSignature},
+		{"added query", signer, tamper(func(path string, query url.Values) string {
+			query.Add("size", "original")
+			return path
+		}), ErrURLInvalidSignature},
+		{"extended expiry", signer, tamper(func(path string, query url.Values) string {
+			query.Set(signedURLExpiresParam, "4102444800")
+			return path
+		}), ErrURLInvalidSignature},
+		{"other path", signer, tamper(func(path string, query url.Values) string {
+			return "/users/2/photo"
+		}), ErrURLInvalidSignature},
+		{"no signature", signer, tamper(func(path string, query url.Values) string {
+			query.Del(signedURLSigParam)
+			return path
+		}), ErrURLInvalidSignature},
+		{"same key id, other secret", testSigner(t, "2024-02:forged-secret-value"), signed, ErrURLInvalidSignature},
+	}
+	for _, test := range tests {
+		if err := verify(t, test.signer, test.signed); !errors.Is(err, test.err) {
+			t.Errorf("%s: Verify = %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestNewURLSignerRefusesInvalidKeys(t *testing.T) {
+	for _, keys := range []string{"no-secret", ":without-a-key-id-value", "kid:too-short", "kid:long-enough-secret,other"} {
+		if _, err := NewURLSigner(keys, 0); err == nil {
+			t.Errorf("NewURLSigner(%q) accepted the keys", keys)
+		}
+	}
+	signer, err := NewURLSigner(" , ", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signer.keys) != 1 || signer.keys[0].id != "default" || signer.expiration != defaultSignedURLExpiration {
+		t.Errorf("without keys: %d keys, expiration %v, want the derived key and the default expiration", len(signer.keys), signer.expiration)
+	}
+}
+
+func TestRequireSignedURL(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	previous := DefaultSigner()
+	t.Cleanup(func() { defaultSigner = previous })
+	signer := testSigner(t, "2024-02:second-secret-value")
+	defaultSigner = signer
+
+	router := gin.New()
+	router.GET("/users/:id/photo", RequireSignedURL(), func(c *gin.Context) { c.Status(http.StatusOK) })
+	get := func(target string) int {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+		return recorder.Code
+	}
+
+	signed, _ := signer.Sign("/users/1/photo", nil, SignOptions{})
+	expired := expiredLink(signer, "/users/1/photo")
+	if code := get(signed); code != http.StatusOK {
+		t.Errorf("valid link = %d, want 200", code)
+	}
+	if code := get(expired); code != http.StatusGone {
+		t.Errorf("expired link = %d, want 410", code)
+	}
+
+	defaultSigner = testSigner(t, "2024-03:third-secret-value")
+	if code := get(signed); code != http.StatusGone {
+		t.Errorf("link of a rotated out key = %d, want 410", code)
+	}
+	defaultSigner = signer
+	if code := get(signed + "&size=original"); code != http.StatusForbidden {
+		t.Errorf("tampered link = %d, want 403", code)
+	}
+}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned when the requested file does not exist in the backend
+var ErrNotFound = errors.New("file not found")
+
+// ObjectInfo describes a stored file
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"contentType"`
+	LastModified time.Time `json:"lastModified"`
+	ETag         string    `json:"etag"`
+}
+
+// Storage is implemented by every file storage backend (local disk, S3 compatible object stores).
+// Keys are slash separated paths relative to the root of the backend.
+type Storage interface {
+	// Put stores the content of r under key, replacing any existing file
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens the file for streaming. The caller must close the returned reader
+	Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error)
+	// Stat returns the file's metadata without reading its content
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	// Delete removes the file. Deleting a missing file is not an error
+	Delete(ctx context.Context, key string) error
+	// List returns all files whose key starts with prefix
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
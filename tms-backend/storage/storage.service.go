@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/utils"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	defaultStorage     Storage
+	defaultStorageOnce sync.Once
+	// backends caches one client per configured root file system
+	backends sync.Map
+)
+
+// Default returns the application wide storage used when no tenant or region
+// root file system is configured
+func Default() Storage {
+	defaultStorageOnce.Do(func() {
+		defaultStorage = NewLocalStorage(global.UPLOAD_DIRECTORY)
+	})
+	return defaultStorage
+}
+
+// ForTenant returns the storage for a tenant's files. The tenant's own root file
+// system takes precedence over the region's; both fall back to Default.
+// Every tenant's files live under a prefix based on the tenant's UUID.
+func ForTenant(tenant *models.Tenant, region *models.Region) (Storage, error) {
+	rootFileSystem := tenant.TenantConfigDetail.RootFileSystem
+	if (rootFileSystem == nil || rootFileSystem.Path == "") && region != nil {
+		rootFileSystem = region.RootFileSystem
+	}
+
+	backend, err := FromRootFileSystem(rootFileSystem)
+	if err != nil {
+		return nil, err
+	}
+
+	return WithPrefix(backend, tenant.UUID.String()), nil
+}
+
+// FromRootFileSystem builds (or reuses) the backend described by a RootFileSystem setting.
+//
+// Path formats:
+//   - s3://bucket[/prefix][?region=eu-west-1]          AWS S3
+//   - https://host[:port]/bucket[/prefix][?region=...]  any S3 compatible store e.g. MinIO
+//   - /any/local/path                                  local or mounted file system
+//
+// For object stores Username is the access key and Password the (encrypted) secret key.
+func FromRootFileSystem(rootFileSystem *models.RootFileSystem) (Storage, error) {
+	if rootFileSystem == nil || rootFileSystem.Path == "" {
+		return Default(), nil
+	}
+
+	cacheKey, err := backendCacheKey(rootFileSystem)
+	if err != nil {
+		return nil, err
+	}
+	if backend, ok := backends.Load(cacheKey); ok {
+		return backend.(Storage), nil
+	}
+
+	var backend Storage
+	path := rootFileSystem.Path
+	if strings.HasPrefix(path, "s3://") || strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		cfg, err := s3ConfigFromRootFileSystem(rootFileSystem)
+		if err != nil {
+			return nil, err
+		}
+		backend, err = NewS3Storage(*cfg)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		backend = NewLocalStorage(path)
+	}
+
+	actual, _ := backends.LoadOrStore(cacheKey, backend)
+	return actual.(Storage), nil
+}
+
+// backendCacheKey identifies a root file system by all of its settings, credentials included, so a
+// rotated secret key or CA gets a new client instead of the stale one. It is hashed to keep the
+// secret out of the key.
+func backendCacheKey(rootFileSystem *models.RootFileSystem) (string, error) {
+	settings, err := json.Marshal(rootFileSystem)
+	if err != nil {
+		return "", fmt.Errorf("failed to read root file system settings: %v", err)
+	}
+	sum := sha256.Sum256(settings)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func s3ConfigFromRootFileSystem(rootFileSystem *models.RootFileSystem) (*S3Config, error) {
+	parsed, err := url.Parse(rootFileSystem.Path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid root file system path: %v", err)
+	}
+
+	cfg := &S3Config{
+		Region: parsed.Query().Get("region"),
+		CA:     rootFileSystem.CA,
+	}
+
+	segments := strings.SplitN(strings.Trim(parsed.Path, "/"), "/", 2)
+	if parsed.Scheme == "s3" {
+		// s3://bucket/prefix: the bucket is the host part
+		cfg.Endpoint = "s3.amazonaws.com"
+		cfg.Secure = true
+		cfg.Bucket = parsed.Host
+		cfg.Prefix = strings.Trim(parsed.Path, "/")
+	} else {
+		// http(s)://endpoint/bucket/prefix: path style addressing
+		cfg.Endpoint = parsed.Host
+		cfg.Secure = parsed.Scheme == "https"
+		cfg.Bucket = segments[0]
+		if len(segments) > 1 {
+			cfg.Prefix = segments[1]
+		}
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("root file system path %q has no bucket", rootFileSystem.Path)
+	}
+
+	if rootFileSystem.Username != nil {
+		cfg.AccessKey = *rootFileSystem.Username
+	}
+	if rootFileSystem.Password != nil && rootFileSystem.Password.IV != nil && rootFileSystem.Password.Content != nil {
+		secret, err := utils.Decrypt(&struct {
+			IV      string `json:"iv"`
+			Content string `json:"content"`
+		}{
+			IV:      *rootFileSystem.Password.IV,
+			Content: *rootFileSystem.Password.Content,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt root file system password: %v", err)
+		}
+		cfg.SecretKey = secret
+	}
+
+	return cfg, nil
+}
+
+// prefixedStorage scopes another backend to a key prefix
+type prefixedStorage struct {
+	backend Storage
+	prefix  string
+}
+
+// WithPrefix returns a Storage that reads and writes all keys under prefix in backend
+func WithPrefix(backend Storage, prefix string) Storage {
+	return &prefixedStorage{backend: backend, prefix: strings.Trim(prefix, "/") + "/"}
+}
+
+func (s *prefixedStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	return s.backend.Put(ctx, s.prefix+cleanKey(key), r, size, contentType)
+}
+
+func (s *prefixedStorage) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	reader, info, err := s.backend.Get(ctx, s.prefix+cleanKey(key))
+	if info != nil {
+		info.Key = strings.TrimPrefix(info.Key, s.prefix)
+	}
+	return reader, info, err
+}
+
+func (s *prefixedStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	info, err := s.backend.Stat(ctx, s.prefix+cleanKey(key))
+	if info != nil {
+		info.Key = strings.TrimPrefix(info.Key, s.prefix)
+	}
+	return info, err
+}
+
+func (s *prefixedStorage) Delete(ctx context.Context, key string) error {
+	return s.backend.Delete(ctx, s.prefix+cleanKey(key))
+}
+
+func (s *prefixedStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects, err := s.backend.List(ctx, s.prefix+strings.TrimPrefix(prefix, "/"))
+	for i := range objects {
+		objects[i].Key = strings.TrimPrefix(objects[i].Key, s.prefix)
+	}
+	return objects, err
+}
+
+// DeletePrefix removes every file whose key starts with prefix
+func DeletePrefix(ctx context.Context, store Storage, prefix string) error {
+	objects, err := store.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err := store.Delete(ctx, object.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeFile streams a stored file to the client, answering conditional requests
+// with 304 Not Modified. Returns ErrNotFound (and writes nothing) if the file is missing.
+func ServeFile(c *gin.Context, store Storage, key string, contentType string) error {
+	reader, info, err := store.Get(c.Request.Context(), key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	etag := `"` + strings.Trim(info.ETag, `"`) + `"`
+	c.Header("ETag", etag)
+	if !info.LastModified.IsZero() {
+		c.Header("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if match := c.GetHeader("If-None-Match"); match != "" && (match == etag || match == "*") {
+		c.Status(http.StatusNotModified)
+		return nil
+	}
+
+	if contentType == "" {
+		contentType = info.ContentType
+	}
+	c.DataFromReader(http.StatusOK, info.Size, contentType, reader, nil)
+	return nil
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+)
+
+func TestFromRootFileSystemRenewsBackendOnNewCredentials(t *testing.T) {
+	path := t.TempDir()
+	username := "minio"
+	iv, first, second := "iv", "first", "second"
+	settings := func(content *string) *models.RootFileSystem {
+		rootFileSystem := &models.RootFileSystem{Path: path, Username: &username}
+		rootFileSystem.Password = &struct {
+			IV      *string `json:"iv"`
+			Content *string `json:"content"`
+		}{IV: &iv, Content: content}
+		return rootFileSystem
+	}
+
+	backend, err := FromRootFileSystem(settings(&first))
+	if err != nil {
+		t.Fatalf("FromRootFileSystem: %v", err)
+	}
+	same, err := FromRootFileSystem(settings(&first))
+	if err != nil {
+		t.Fatalf("FromRootFileSystem: %v", err)
+	}
+	if same != backend {
+		t.Errorf("the same settings built a new backend")
+	}
+	rotated, err := FromRootFileSystem(settings(&second))
+	if err != nil {
+		t.Fatalf("FromRootFileSystem: %v", err)
+	}
+	if rotated == backend {
+		t.Errorf("a rotated password reused the backend built with the old one")
+	}
+}
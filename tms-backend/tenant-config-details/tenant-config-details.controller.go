@@ -1,10 +1,14 @@
 package tenantconfigdetails
 
 import (
+	"errors"
 	"strconv"
 
 	dto "github.com/auditrakkr/tms-fullstack/tms-backend/dtos"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/etags"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/repositories"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 
@@ -41,28 +45,38 @@ func (tc *TenantConfigDetailsController) Update(c *gin.Context) {
 		c.JSON(400, gin.H{"error": "Invalid tenant config detail ID"})
 		return
 	}
+	version, ok := etags.IfMatch(c)
+	if !ok {
+		return
+	}
 	var updateTenantConfigDetailDto dto.CreateTenantConfigDetailDto
 	if err := c.ShouldBindJSON(&updateTenantConfigDetailDto); err != nil {
 		c.JSON(400, gin.H{"error": "Invalid request payload"})
 		return
 	}
-	tenantConfigDetail, err := tc.tenantConfigDetailsService.Update(uint(id), &updateTenantConfigDetailDto)
+	tenantConfigDetail, err := tc.tenantConfigDetailsService.Update(uint(id), version, &updateTenantConfigDetailDto)
 	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+		etags.WriteChangeError(c, err, "Tenant config detail")
 		return
 	}
+	etags.Set(c, tenantConfigDetail.Version)
 	c.JSON(200, gin.H{"tenantConfigDetail": tenantConfigDetail})
 
 }
 
 /* FIND */
+// GetAllTenantConfigDetails lists a page of tenant config details, filtered and sorted by the query parameters (see repositories.ListQuery)
 func (tc *TenantConfigDetailsController) GetAllTenantConfigDetails (c *gin.Context) {
-	tenantConfigDetails, err := tc.tenantConfigDetailsService.GetAllTenantConfigDetails()
+	tenantConfigDetails, err := tc.tenantConfigDetailsService.FindAllWithOptions(c.Request.URL)
 	if err != nil {
+		if errors.Is(err, repositories.ErrInvalidListQuery) {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(200, gin.H{"tenantConfigDetails": tenantConfigDetails})
+	c.JSON(200, tenantConfigDetails)
 }
 
 func (tc *TenantConfigDetailsController) FindOne(c *gin.Context) {
@@ -76,6 +90,7 @@ func (tc *TenantConfigDetailsController) FindOne(c *gin.Context) {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
+	etags.Set(c, tenantConfigDetail.Version)
 	c.JSON(200, gin.H{"tenantConfigDetail": tenantConfigDetail})
 }
 
@@ -86,10 +101,59 @@ func (tc *TenantConfigDetailsController) Delete(c *gin.Context) {
 		c.JSON(400, gin.H{"error": "Invalid tenant config detail ID"})
 		return
 	}
-	err = tc.tenantConfigDetailsService.Delete(uint(id))
+	version, ok := etags.IfMatch(c)
+	if !ok {
+		return
+	}
+	err = tc.tenantConfigDetailsService.Delete(uint(id), version)
 	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+		etags.WriteChangeError(c, err, "Tenant config detail")
 		return
 	}
 	c.JSON(200, gin.H{"message": "Tenant config detail deleted successfully"})
-}
\ No newline at end of file
+}
+
+/* TRASH */
+
+// RestoreTenantConfigDetail takes a deleted tenant config detail out of the trash
+func (tc *TenantConfigDetailsController) RestoreTenantConfigDetail(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid tenant config detail ID"})
+		return
+	}
+	tenantConfigDetail, err := tc.tenantConfigDetailsService.Restore(uint(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(404, gin.H{"error": "Tenant config detail not found in the trash"})
+		case errors.Is(err, repositories.ErrRestoreConflict):
+			c.JSON(409, gin.H{"error": err.Error()})
+		default:
+			c.JSON(500, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(200, gin.H{"tenantConfigDetail": tenantConfigDetail})
+}
+
+// PurgeTenantConfigDetail deletes a tenant config detail in the trash for good
+func (tc *TenantConfigDetailsController) PurgeTenantConfigDetail(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid tenant config detail ID"})
+		return
+	}
+	if err := tc.tenantConfigDetailsService.Purge(uint(id)); err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(404, gin.H{"error": "Tenant config detail not found in the trash"})
+		case errors.Is(err, repositories.ErrStillReferenced):
+			c.JSON(409, gin.H{"error": err.Error()})
+		default:
+			c.JSON(500, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.Status(204)
+}
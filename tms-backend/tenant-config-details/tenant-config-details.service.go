@@ -1,10 +1,14 @@
 package tenantconfigdetails
 
 import (
+	"context"
 	"fmt"
+	"net/url"
+	"time"
 
 	"github.com/auditrakkr/tms-fullstack/tms-backend/database"
 	dto "github.com/auditrakkr/tms-fullstack/tms-backend/dtos"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/repositories"
 	"github.com/jinzhu/copier"
@@ -38,17 +42,21 @@ func (s *TenantConfigDetailsService) CreateTenantConfigDetail(createTenantConfig
 
 /* UPDATE */
 
-func (s *TenantConfigDetailsService) Update(id uint, tenantConfigDetail *dto.CreateTenantConfigDetailDto) (*models.TenantConfigDetail, error) {
+// Update changes the tenant config detail provided it is still at version (the ETag read), whatever its version if 0
+func (s *TenantConfigDetailsService) Update(id uint, version uint, tenantConfigDetail *dto.CreateTenantConfigDetailDto) (*models.TenantConfigDetail, error) {
 	tenantConfigDetailToUpdate, err := s.tenantConfigDetailsRepo.FindByID(id)
 	if err != nil {
-		return nil, fmt.Errorf("failed to find tenant config detail: %v", err)
+		return nil, fmt.Errorf("failed to find tenant config detail: %w", err)
+	}
+	if version != 0 {
+		tenantConfigDetailToUpdate.Version = version
 	}
 	if err := copier.Copy(tenantConfigDetailToUpdate, tenantConfigDetail); err != nil {
 		return nil, fmt.Errorf("failed to map dto: %v", err)
 	}
 	err = s.tenantConfigDetailsRepo.Update(tenantConfigDetailToUpdate)
 	if err != nil {
-		return nil, fmt.Errorf("failed to update tenant config detail: %v", err)
+		return nil, fmt.Errorf("failed to update tenant config detail: %w", err)
 	}
 	return tenantConfigDetailToUpdate, nil
 }
@@ -56,19 +64,31 @@ func (s *TenantConfigDetailsService) Update(id uint, tenantConfigDetail *dto.Cre
 func (s *TenantConfigDetailsService) Save (tenantConfigDetail *models.TenantConfigDetail) (*models.TenantConfigDetail, error) {
 	tenantConfigDetail, err := s.tenantConfigDetailsRepo.Save(tenantConfigDetail)
 	if err != nil {
-		return nil, fmt.Errorf("failed to save tenant config detail: %v", err)
+		return nil, fmt.Errorf("failed to save tenant config detail: %w", err)
 	}
 	return tenantConfigDetail, nil
 }
 
 /* READ */
 
-func (s *TenantConfigDetailsService) FindAllWithOptions(findOptions map[string]any) ([]models.TenantConfigDetail, int64, error) {
-	tenantConfigDetails, totalCount, err := s.tenantConfigDetailsRepo.FindAndCount(findOptions)
+// tenantConfigDetailListFields are what the tenant config detail list can be filtered and sorted by, see repositories.ListQuery
+var tenantConfigDetailListFields = repositories.ListFields{
+	Filter:      []string{"id", "tenant_id", "region_id", "db_schema", "created_at", "updated_at", "deleted_at"},
+	Sort:        []string{"tenant_id", "region_id", "created_at", "updated_at"},
+	DefaultSort: "-created_at",
+}
+
+// FindAllWithOptions returns the page of tenant config details the list query parameters of requestURL ask for
+func (s *TenantConfigDetailsService) FindAllWithOptions(requestURL *url.URL) (*repositories.ListPage[models.TenantConfigDetail], error) {
+	listQuery, err := repositories.ParseListQuery(requestURL, tenantConfigDetailListFields)
+	if err != nil {
+		return nil, err
+	}
+	page, err := s.tenantConfigDetailsRepo.FindPage(listQuery)
 	if err != nil {
-		return nil,0,fmt.Errorf("failed to find tenant config details: %v", err)
+		return nil, fmt.Errorf("failed to find tenant config details: %w", err)
 	}
-	return tenantConfigDetails,totalCount,  nil
+	return page, nil
 }
 
 func (s *TenantConfigDetailsService) GetAllTenantConfigDetails() ([]models.TenantConfigDetail, error) {
@@ -92,10 +112,40 @@ func (s *TenantConfigDetailsService) FindOne(id uint) (*models.TenantConfigDetai
 
 
 /* DELETE */
-func (s *TenantConfigDetailsService) Delete(id uint) error {
-	err := s.tenantConfigDetailsRepo.Delete(id)
+
+// Delete deletes the tenant config detail provided it is still at version (0 for any version)
+func (s *TenantConfigDetailsService) Delete(id uint, version uint) error {
+	err := s.tenantConfigDetailsRepo.DeleteVersion(id, version)
 	if err != nil {
 		return fmt.Errorf("failed to delete tenant config detail: %w", err)
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+/* TRASH */
+
+// Restore takes a deleted tenant config detail out of the trash
+func (s *TenantConfigDetailsService) Restore(id uint) (*models.TenantConfigDetail, error) {
+	tenantConfigDetail, err := s.tenantConfigDetailsRepo.Restore(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore tenant config detail: %w", err)
+	}
+	return tenantConfigDetail, nil
+}
+
+// Purge deletes a tenant config detail in the trash for good
+func (s *TenantConfigDetailsService) Purge(id uint) error {
+	if _, err := s.tenantConfigDetailsRepo.Purge(id); err != nil {
+		return fmt.Errorf("failed to purge tenant config detail: %w", err)
+	}
+	return nil
+}
+
+// PurgeDeletedBefore purges tenant config details put in the trash before cutoff, see trash.StartRetentionJob
+func (s *TenantConfigDetailsService) PurgeDeletedBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	tenantconfigdetails, err := s.tenantConfigDetailsRepo.WithContext(ctx).PurgeDeletedBefore(cutoff, global.TRASH_PURGE_BATCH_SIZE)
+	if err != nil {
+		return len(tenantconfigdetails), fmt.Errorf("failed to purge deleted tenant config details: %w", err)
+	}
+	return len(tenantconfigdetails), nil
+}
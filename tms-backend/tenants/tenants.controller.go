@@ -1,11 +1,16 @@
 package tenants
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
 	dto "github.com/auditrakkr/tms-fullstack/tms-backend/dtos"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/etags"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/repositories"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/throttle"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 type TenantController struct {
@@ -33,33 +38,58 @@ func NewTenantController(tenantService *TenantService) *TenantController {
  */
 
  func (tc *TenantController) CreateTenant(c *gin.Context) {
-	var req Request
+	req := Request{Context: c}
 	var createTenantDto dto.CreateTenantDto
 	if err := c.ShouldBindBodyWithJSON(&createTenantDto); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
 	}
 
 	createPrimaryContact, err := strconv.ParseUint(c.Query("createPrimaryContact"), 10, 32)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid createPrimaryContact value"})
+		return
 	}
 
 	tenant, err := tc.tenantService.CreateTenant(&createTenantDto, uint(createPrimaryContact), req)
 	if err != nil {
+		if throttle.WriteLimitError(c, err) {
+			return
+		}
+		switch {
+		case errors.Is(err, ErrPrimaryContactNotCaller):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		case errors.Is(err, ErrPrimaryContactNotVerified):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		case errors.Is(err, ErrPrimaryContactRequired):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		case errors.Is(err, ErrPrimaryContactNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
 	c.JSON(http.StatusCreated, gin.H{"tenant": tenant})
 }
 
+// GetAllTenants lists a page of tenants, filtered and sorted by the query parameters (see repositories.ListQuery)
 func (tc *TenantController) GetAllTenants(c *gin.Context) {
-	tenants, err := tc.tenantService.GetAllTenants()
+	tenants, err := tc.tenantService.FindAllWithOptions(c.Request.URL)
 	if err != nil {
+		if errors.Is(err, repositories.ErrInvalidListQuery) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"tenants": tenants})
+	c.JSON(http.StatusOK, tenants)
 }
 
 func (tc *TenantController) FindOne(c *gin.Context) {
@@ -78,6 +108,7 @@ func (tc *TenantController) FindOne(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
 		return
 	}
+	etags.Set(c, tenant.Version)
 	c.JSON(http.StatusOK, gin.H{"tenant": tenant})
 
 }
@@ -113,9 +144,13 @@ func (tc *TenantController) DeleteTenant(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
 		return
 	}
-	err = tc.tenantService.Delete(uint(id))
+	version, ok := etags.IfMatch(c)
+	if !ok {
+		return
+	}
+	err = tc.tenantService.Delete(uint(id), version)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		etags.WriteChangeError(c, err, "Tenant")
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"message": "Tenant deleted successfully"})
@@ -132,17 +167,165 @@ func (tc *TenantController) UpdateTenant(c *gin.Context) {
 		return
 	}
 
+	version, ok := etags.IfMatch(c)
+	if !ok {
+		return
+	}
+
 	var updateTenantDto dto.UpdateTenantDto
 	if err := c.ShouldBindJSON(&updateTenantDto); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
 		return
 	}
 
-	tenant, err := tc.tenantService.Update(uint(id), &updateTenantDto)
+	tenant, err := tc.tenantService.Update(uint(id), version, &updateTenantDto)
+	if err != nil {
+		etags.WriteChangeError(c, err, "Tenant")
+		return
+	}
+	etags.Set(c, tenant.Version)
+	c.JSON(http.StatusOK, gin.H{"tenant": tenant, "message": "Tenant updated successfully"})
+}
+
+
+/* LOGO */
+
+// SetTenantLogo handles POST request for uploading a tenant's logo
+func (tc *TenantController) SetTenantLogo(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing logo file"})
+		return
+	}
+
+	tenant, err := tc.tenantService.SetTenantLogo(uint(id), file, c.Request.Context())
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrLogoTooLarge):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrUnsupportedLogoType):
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tenant": tenant})
+}
+
+// GetUndeliverableMembers lists the team members whose email addresses bounced or complained
+func (tc *TenantController) GetUndeliverableMembers(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	members, err := tc.tenantService.FindUndeliverableMembers(uint(id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"members": members})
+}
+
+// GetTenantLogo handles GET request for a tenant's logo. Optional query ?size=small|medium|large|original
+func (tc *TenantController) GetTenantLogo(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	err = tc.tenantService.GetTenantLogo(uint(id), c.DefaultQuery("size", "original"), c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// GetTenantLogoURL returns a signed, expiring URL for a tenant's logo. Optional query ?size=small|medium|large|original
+func (tc *TenantController) GetTenantLogoURL(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	url, expiresAt, err := tc.tenantService.GetTenantLogoURL(uint(id), c.DefaultQuery("size", "original"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"url": url, "expiresAt": expiresAt})
+}
+
+// DeleteTenantLogo handles DELETE request for removing a tenant's logo
+func (tc *TenantController) DeleteTenantLogo(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	tenant, err := tc.tenantService.DeleteTenantLogo(uint(id), c.Request.Context())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"tenant": tenant})
-	c.JSON(http.StatusOK, gin.H{"message": "Tenant updated successfully"})
-}
\ No newline at end of file
+}
+
+/* TRASH */
+
+// RestoreTenant takes a deleted tenant out of the trash
+func (tc *TenantController) RestoreTenant(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+	tenant, err := tc.tenantService.Restore(uint(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found in the trash"})
+		case errors.Is(err, repositories.ErrRestoreConflict):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tenant": tenant})
+}
+
+// PurgeTenant deletes a tenant in the trash for good
+func (tc *TenantController) PurgeTenant(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+	if err := tc.tenantService.Purge(uint(id)); err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found in the trash"})
+		case errors.Is(err, repositories.ErrStillReferenced):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -1,17 +1,39 @@
 package tenants
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"sync"
+	"time"
 
 	"github.com/auditrakkr/tms-fullstack/tms-backend/database"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/dtos"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/regions"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/repositories"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/storage"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/throttle"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/users"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrLogoTooLarge              = errors.New("logo file too large")
+	ErrUnsupportedLogoType       = errors.New("unsupported logo file type")
+	ErrPrimaryContactNotVerified = errors.New("the primary email address of the primary contact is not verified")
+	ErrPrimaryContactRequired    = errors.New("the primary contact and their primary email address are required")
+	ErrPrimaryContactNotFound    = errors.New("primary contact not found")
+	ErrPrimaryContactNotCaller   = errors.New("sign in as the primary contact to create a tenant for an existing account")
 )
 
 //initialize the repositories for Tenant
@@ -38,6 +60,7 @@ type TenantService struct {
 	regionService  *regions.RegionService
 	tenantTeamRepo repositories.Repository[models.TenantTeam]
 	userRepo       repositories.Repository[models.User]
+	userService    *users.UserService
 	redisClients   sync.Map
 }
 
@@ -48,6 +71,7 @@ func NewTenantService() *TenantService {
 		regionRepo:    repositories.Repository[models.Region]{DB: database.DB},
 		regionService: regions.NewRegionService(),
 		userRepo: repositories.Repository[models.User]{DB: database.DB},
+		userService: users.NewUserService(),
 		tenantTeamRepo: repositories.Repository[models.TenantTeam]{DB: database.DB},
 		redisClients: sync.Map{},
 	}
@@ -75,7 +99,6 @@ func (s *TenantService) CreateTenant(createTenantDto *dto.CreateTenantDto, creat
 	newTenant := &models.Tenant{}
 	err := newTenant.MapFromCreateTenantDto(createTenantDto)
 	if err != nil {
-		http.Error(req.Context.Writer, "failed to map tenant DTO", http.StatusInternalServerError)
 		return nil, fmt.Errorf("failed to map tenant DTO: %w", err)
 	}
 
@@ -86,37 +109,29 @@ func (s *TenantService) CreateTenant(createTenantDto *dto.CreateTenantDto, creat
 	}
 	newTenant.RegionRootDomain = region.RootDomainName
 
-	if createPrimaryContact != 1 {
-		primaryContact, err := s.userRepo.FindOne(map[string]any{"primary_email_address": createTenantDto.PrimaryContact.PrimaryEmailAddress})
-		if err != nil {
-			http.Error(req.Context.Writer, "failed to find primary contact", http.StatusInternalServerError)
-			return nil, fmt.Errorf("failed to find primary contact: %w", err)
-		}
-		if primaryContact == nil {
-			http.Error(req.Context.Writer, "primary contact not found", http.StatusNotFound)
-			return nil, fmt.Errorf("primary contact not found")
+	primaryContact, created, err := s.findOrCreatePrimaryContact(createTenantDto.PrimaryContact, createPrimaryContact == 1, req.Context)
+	if err != nil {
+		return nil, err
+	}
+	// Tenants are only created for people we know can receive their mail: an unverified primary
+	// contact is sent a verification email, and the tenant can be created once it is confirmed
+	if !primaryContact.IsPrimaryEmailVerified {
+		// CreateUser has already sent it to a new user
+		if !created || !global.AUTO_SEND_CONFIRM_EMAIL {
+			if err := throttle.LimitMailRequest(fmt.Sprintf("user-%d", primaryContact.ID), req.Context); err != nil {
+				return nil, err
+			}
+			if _, err := s.userService.ConfirmEmailRequest(nil, primaryContact.ID, true, req.Context); err != nil {
+				return nil, fmt.Errorf("failed to send verification email to primary contact: %w", err)
+			}
 		}
-		newTenant.PrimaryContactID = primaryContact.ID
-	} else {
-		//TODO: Create a new primary contact user and hash the password
-		fmt.Println("Creating new primary contact user")
+		return nil, fmt.Errorf("%w: a verification email was sent, create the tenant again once it is confirmed", ErrPrimaryContactNotVerified)
 	}
+	newTenant.PrimaryContactID = primaryContact.ID
 
 	tenant, err := s.tenantRepo.Save(newTenant)
 	if err != nil {
-		http.Error(req.Context.Writer, "failed to create tenant", http.StatusInternalServerError)
-		return nil, fmt.Errorf("failed to create tenant")
-	}
-
-	if createPrimaryContact == 1 {
-		user, err := s.userRepo.FindOne(map[string]any{"primary_email_address": tenant.PrimaryContact.PrimaryEmailAddress})
-		if err != nil || user == nil {
-			http.Error(req.Context.Writer, "failed to find primary contact", http.StatusInternalServerError)
-			return nil, fmt.Errorf("failed to find primary contact: %w", err)
-		}
-		if err == nil && !tenant.PrimaryContact.IsPrimaryEmailVerified{
-			// TODO: Send email to primary contact for verification
-		}
+		return nil, fmt.Errorf("failed to create tenant: %w", err)
 	}
 
 	// Create tenantConfigDetail if primary email address is verified
@@ -130,22 +145,71 @@ func (s *TenantService) CreateTenant(createTenantDto *dto.CreateTenantDto, creat
 	return tenant, nil
 }
 
+// findOrCreatePrimaryContact finds the user with the primary email address of contact, or creates
+// them if create is set. It reports whether the user was created. An existing account is only made
+// the primary contact by itself: the caller must be signed in as that user.
+func (s *TenantService) findOrCreatePrimaryContact(contact *dto.CreateUserDto, create bool, c *gin.Context) (*models.User, bool, error) {
+	if contact == nil || contact.PrimaryEmailAddress == "" {
+		return nil, false, ErrPrimaryContactRequired
+	}
+
+	primaryContact, err := s.userRepo.FindOne(map[string]any{"primary_email_address": contact.PrimaryEmailAddress})
+	if err == nil {
+		if callerId := c.GetUint(global.CONTEXT_USER_ID_KEY); callerId == 0 || callerId != primaryContact.ID {
+			return nil, false, ErrPrimaryContactNotCaller
+		}
+		return primaryContact, false, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, fmt.Errorf("failed to find primary contact: %w", err)
+	}
+	if !create {
+		return nil, false, ErrPrimaryContactNotFound
+	}
+
+	// The new account is sent a verification email
+	if err := throttle.LimitMailRequest(contact.PrimaryEmailAddress, c); err != nil {
+		return nil, false, err
+	}
+	primaryContact, err = s.userService.CreateUser(c, contact)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create primary contact: %w", err)
+	}
+	return primaryContact, true, nil
+}
+
 /* Update Section */
 
-func (s *TenantService) Update(tenantId uint, updateTenantDto *dto.UpdateTenantDto) (*models.Tenant, error) {
+// Update changes the tenant provided it is still at version (the ETag read), whatever its version if 0
+func (s *TenantService) Update(tenantId uint, version uint, updateTenantDto *dto.UpdateTenantDto) (*models.Tenant, error) {
 	// Find the tenant by ID
 	tenant, err := s.tenantRepo.FindByID(tenantId)
 	if err != nil {
 		return nil, fmt.Errorf("failed to find tenant: %w", err)
 	}
+	if version != 0 {
+		tenant.Version = version
+	}
 
-	// Update the tenant fields
-	tenant.Name = *updateTenantDto.Name
-	tenant.Address = *updateTenantDto.Address
-	tenant.MoreInfo = *updateTenantDto.MoreInfo
-	tenant.Logo = *updateTenantDto.Logo
-	tenant.LogoMimeType = *updateTenantDto.LogoMimeType
-	tenant.Status = *updateTenantDto.Status
+	// Update the tenant fields given, the others are kept
+	if updateTenantDto.Name != nil {
+		tenant.Name = *updateTenantDto.Name
+	}
+	if updateTenantDto.Address != nil {
+		tenant.Address = *updateTenantDto.Address
+	}
+	if updateTenantDto.MoreInfo != nil {
+		tenant.MoreInfo = *updateTenantDto.MoreInfo
+	}
+	if updateTenantDto.Logo != nil {
+		tenant.Logo = *updateTenantDto.Logo
+	}
+	if updateTenantDto.LogoMimeType != nil {
+		tenant.LogoMimeType = *updateTenantDto.LogoMimeType
+	}
+	if updateTenantDto.Status != nil {
+		tenant.Status = *updateTenantDto.Status
+	}
 
 	err = s.tenantRepo.Update(tenant)
 	if err != nil {
@@ -158,8 +222,9 @@ func (s *TenantService) Update(tenantId uint, updateTenantDto *dto.UpdateTenantD
 
 /* Delete Section */
 
-func (s *TenantService) Delete(tenantId uint) error {
-	err := s.tenantRepo.Delete(tenantId)
+// Delete deletes the tenant provided it is still at version (0 for any version)
+func (s *TenantService) Delete(tenantId uint, version uint) error {
+	err := s.tenantRepo.DeleteVersion(tenantId, version)
 	if err != nil {
 		return fmt.Errorf("failed to delete tenant: %w", err)
 	}
@@ -178,6 +243,34 @@ func (s *TenantService) Remove(tenant *models.Tenant) (*models.Tenant, error) {
 }
 
 
+/* TRASH */
+
+// Restore takes a deleted tenant out of the trash
+func (s *TenantService) Restore(tenantId uint) (*models.Tenant, error) {
+	tenant, err := s.tenantRepo.Restore(tenantId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore tenant: %w", err)
+	}
+	return tenant, nil
+}
+
+// Purge deletes a tenant in the trash for good
+func (s *TenantService) Purge(tenantId uint) error {
+	if _, err := s.tenantRepo.Purge(tenantId); err != nil {
+		return fmt.Errorf("failed to purge tenant: %w", err)
+	}
+	return nil
+}
+
+// PurgeDeletedBefore purges tenants put in the trash before cutoff, see trash.StartRetentionJob
+func (s *TenantService) PurgeDeletedBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	tenants, err := s.tenantRepo.WithContext(ctx).PurgeDeletedBefore(cutoff, global.TRASH_PURGE_BATCH_SIZE)
+	if err != nil {
+		return len(tenants), fmt.Errorf("failed to purge deleted tenants: %w", err)
+	}
+	return len(tenants), nil
+}
+
 /* Read Section */
 
 func (s *TenantService) GetAllTenants() ([]models.Tenant, error) {
@@ -188,12 +281,24 @@ func (s *TenantService) GetAllTenants() ([]models.Tenant, error) {
 	return tenants, nil
 }
 
-func (s *TenantService) FindAllWithOptions(findOptions map[string]any) ([]models.Tenant, int64, error) {
-	tenants, totalCount, err := s.tenantRepo.FindAndCount(findOptions)
+// tenantListFields are what the tenant list can be filtered and sorted by, see repositories.ListQuery
+var tenantListFields = repositories.ListFields{
+	Filter:      []string{"id", "name", "subdomain", "status", "active", "region_name", "primary_contact_id", "created_at", "updated_at", "deleted_at"},
+	Sort:        []string{"name", "subdomain", "status", "region_name", "created_at", "updated_at"},
+	DefaultSort: "-created_at",
+}
+
+// FindAllWithOptions returns the page of tenants the list query parameters of requestURL ask for
+func (s *TenantService) FindAllWithOptions(requestURL *url.URL) (*repositories.ListPage[models.Tenant], error) {
+	listQuery, err := repositories.ParseListQuery(requestURL, tenantListFields)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to get all tenants with options: %w", err)
+		return nil, err
 	}
-	return tenants, totalCount, nil
+	page, err := s.tenantRepo.FindPage(listQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get all tenants with options: %w", err)
+	}
+	return page, nil
 }
 
 
@@ -231,6 +336,297 @@ func (s *TenantService) FindTenantsByRegionName(regionName string) (*[]models.Te
 
 
 
+/* Team deliverability */
+
+// UndeliverableMember is a team member one of whose email addresses bounced or complained
+type UndeliverableMember struct {
+	UserID                     uint                       `json:"userId"`
+	FirstName                  string                     `json:"firstName"`
+	LastName                   string                     `json:"lastName"`
+	PrimaryEmailAddress        string                     `json:"primaryEmailAddress"`
+	PrimaryEmailDeliverability global.EmailDeliverability `json:"primaryEmailDeliverability"`
+	BackupEmailAddress         string                     `json:"backupEmailAddress"`
+	BackupEmailDeliverability  global.EmailDeliverability `json:"backupEmailDeliverability"`
+}
+
+// FindUndeliverableMembers lists the members of a tenant's team who cannot receive some or all of its mail
+func (s *TenantService) FindUndeliverableMembers(tenantId uint) ([]UndeliverableMember, error) {
+	var members []UndeliverableMember
+	err := s.tenantTeamRepo.CreateQueryBuilder().
+		Select("users.id AS user_id, users.first_name, users.last_name, "+
+			"users.primary_email_address, users.primary_email_deliverability, "+
+			"users.backup_email_address, users.backup_email_deliverability").
+		Joins("JOIN users ON users.id = tenant_teams.user_id AND users.deleted_at IS NULL").
+		Where("tenant_teams.tenant_id = ?", tenantId).
+		Where("users.primary_email_deliverability <> ? OR (users.backup_email_address <> '' AND users.backup_email_deliverability <> ?)",
+			global.EmailDeliverable, global.EmailDeliverable).
+		Order("users.last_name, users.first_name").
+		Scan(&members).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to find undeliverable team members: %w", err)
+	}
+	return members, nil
+}
+
+/* Logo */
+
+// SetTenantLogo validates, sanitizes and stores a tenant's logo together with
+// its PNG derivatives (see global.LOGO_SIZES)
+func (s *TenantService) SetTenantLogo(tenantId uint, file *multipart.FileHeader, ctx context.Context) (*models.Tenant, error) {
+	tenant, err := s.findWithConfigDetail(tenantId)
+	if err != nil {
+		return nil, err
+	}
+	region := s.tenantRegion(tenant)
+
+	sizeLimit := logoFileSizeLimit(tenant, region)
+	if file.Size > int64(sizeLimit) {
+		return nil, fmt.Errorf("%w (max %d bytes)", ErrLogoTooLarge, sizeLimit)
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open uploaded file: %v", err)
+	}
+	defer src.Close()
+
+	// Read one byte past the limit so a lying multipart header cannot slip a larger file through
+	data, err := io.ReadAll(io.LimitReader(src, int64(sizeLimit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read uploaded file: %v", err)
+	}
+	if len(data) > sizeLimit {
+		return nil, fmt.Errorf("%w (max %d bytes)", ErrLogoTooLarge, sizeLimit)
+	}
+
+	mimeType := utils.DetectMimeType(data)
+	derivatives := map[string][]byte{}
+	var fileName string
+
+	switch {
+	case mimeType == "image/svg+xml":
+		data, err = utils.SanitizeSVG(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnsupportedLogoType, err)
+		}
+		// Not every client can show an SVG (e.g. mail clients): the sizes are PNG as for raster logos
+		for sizeName, maxSize := range global.LOGO_SIZES {
+			img, err := utils.RasterizeSVG(data, maxSize)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrUnsupportedLogoType, err)
+			}
+			derivative, err := utils.EncodePNG(img)
+			if err != nil {
+				return nil, err
+			}
+			derivatives[sizeName] = derivative
+		}
+		fileName = "original.svg"
+	case utils.IsRasterImage(mimeType):
+		img, err := utils.DecodeImage(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnsupportedLogoType, err)
+		}
+		for sizeName, maxSize := range global.LOGO_SIZES {
+			derivative, err := utils.EncodePNG(utils.ResizeToFit(img, maxSize))
+			if err != nil {
+				return nil, err
+			}
+			derivatives[sizeName] = derivative
+		}
+		// Re-encoding the original drops any metadata and anything appended after the image data
+		data, err = utils.EncodePNG(img)
+		if err != nil {
+			return nil, err
+		}
+		mimeType = "image/png"
+		fileName = "original.png"
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedLogoType, mimeType)
+	}
+
+	store, err := storage.ForTenant(tenant, region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tenant storage: %v", err)
+	}
+
+	// Remove derivatives of any previous logo so stale sizes are never served
+	if err := storage.DeletePrefix(ctx, store, logoKeyPrefix); err != nil {
+		return nil, fmt.Errorf("failed to clear previous logo: %v", err)
+	}
+	if err := store.Put(ctx, logoKeyPrefix+fileName, bytes.NewReader(data), int64(len(data)), mimeType); err != nil {
+		return nil, fmt.Errorf("failed to save logo: %v", err)
+	}
+	for sizeName, derivative := range derivatives {
+		err := store.Put(ctx, logoKeyPrefix+sizeName+".png", bytes.NewReader(derivative), int64(len(derivative)), "image/png")
+		if err != nil {
+			return nil, fmt.Errorf("failed to save %s logo: %v", sizeName, err)
+		}
+	}
+
+	if err := s.setLogoInfo(tenant, fileName, mimeType); err != nil {
+		return nil, err
+	}
+
+	return tenant, nil
+}
+
+// GetTenantLogo serves a tenant's logo in the requested size.
+// size is one of the keys of global.LOGO_SIZES (a PNG) or "original" (the sanitized
+// SVG of a vector logo).
+func (s *TenantService) GetTenantLogo(tenantId uint, size string, c *gin.Context) error {
+	tenant, err := s.findWithConfigDetail(tenantId)
+	if err != nil {
+		return err
+	}
+
+	// Logos change rarely; let browsers cache them and revalidate with the ETag.
+	// The URL is signed and short lived, so keep it out of shared caches
+	c.Header("Cache-Control", "private, max-age=86400")
+
+	// If no logo, use default
+	if tenant.Logo == "" {
+		return serveDefaultLogo(c)
+	}
+
+	store, err := storage.ForTenant(tenant, s.tenantRegion(tenant))
+	if err != nil {
+		return fmt.Errorf("failed to get tenant storage: %v", err)
+	}
+
+	key := logoKeyPrefix + tenant.Logo
+	mimeType := tenant.LogoMimeType
+	if _, ok := global.LOGO_SIZES[size]; ok {
+		key = logoKeyPrefix + size + ".png"
+		mimeType = "image/png"
+	}
+	if mimeType == "image/svg+xml" {
+		// Defence in depth in case the SVG is opened directly in the browser
+		c.Header("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	}
+
+	err = storage.ServeFile(c, store, key, mimeType)
+	if errors.Is(err, storage.ErrNotFound) {
+		// File doesn't exist, use default
+		return serveDefaultLogo(c)
+	}
+	return err
+}
+
+// GetTenantLogoURL returns a signed, expiring URL for a tenant's logo in the requested size
+func (s *TenantService) GetTenantLogoURL(tenantId uint, size string) (string, time.Time, error) {
+	if _, err := s.tenantRepo.FindByID(tenantId); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to find tenant: %w", err)
+	}
+
+	logoURL, expiresAt := storage.DefaultSigner().Sign(fmt.Sprintf("/tenants/%d/logo", tenantId),
+		url.Values{"size": {size}}, storage.SignOptions{})
+	return logoURL, expiresAt, nil
+}
+
+// DeleteTenantLogo removes a tenant's logo files and clears the logo info
+func (s *TenantService) DeleteTenantLogo(tenantId uint, ctx context.Context) (*models.Tenant, error) {
+	tenant, err := s.findWithConfigDetail(tenantId)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := storage.ForTenant(tenant, s.tenantRegion(tenant))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tenant storage: %v", err)
+	}
+	if err := storage.DeletePrefix(ctx, store, logoKeyPrefix); err != nil {
+		return nil, fmt.Errorf("failed to delete logo: %v", err)
+	}
+
+	if err := s.setLogoInfo(tenant, "", ""); err != nil {
+		return nil, err
+	}
+	return tenant, nil
+}
+
+// setLogoInfo records the logo file name and type on the tenant and its config detail
+func (s *TenantService) setLogoInfo(tenant *models.Tenant, fileName string, mimeType string) error {
+	err := s.tenantRepo.CreateQueryBuilder().
+		Where("id = ?", tenant.ID).
+		Updates(map[string]any{"logo": fileName, "logo_mime_type": mimeType, "version": repositories.NextVersion}).Error
+	if err != nil {
+		return fmt.Errorf("failed to update tenant logo info: %v", err)
+	}
+	tenant.Logo = fileName
+	tenant.LogoMimeType = mimeType
+	tenant.Version++
+
+	if tenant.TenantConfigDetail.ID != 0 {
+		var logo *models.Logo
+		if fileName != "" {
+			logo = &models.Logo{FileName: fileName, MimeType: mimeType}
+		}
+		err = s.tenantRepo.DB.Model(&tenant.TenantConfigDetail).
+			Updates(map[string]any{"logo": logo, "version": repositories.NextVersion}).Error
+		if err != nil {
+			return fmt.Errorf("failed to update tenant config detail logo: %v", err)
+		}
+		tenant.TenantConfigDetail.Logo = logo
+		tenant.TenantConfigDetail.Version++
+	}
+
+	return nil
+}
+
+// findWithConfigDetail loads a tenant together with its config detail and region
+func (s *TenantService) findWithConfigDetail(tenantId uint) (*models.Tenant, error) {
+	var tenant models.Tenant
+	err := s.tenantRepo.CreateQueryBuilder().
+		Preload("TenantConfigDetail.Region").
+		Where("id = ?", tenantId).
+		First(&tenant).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to find tenant: %v", err)
+	}
+	return &tenant, nil
+}
+
+// tenantRegion returns the region of a tenant loaded with findWithConfigDetail,
+// falling back to the denormalized region name. Returns nil if none can be found.
+func (s *TenantService) tenantRegion(tenant *models.Tenant) *models.Region {
+	if tenant.TenantConfigDetail.Region.ID != 0 {
+		return &tenant.TenantConfigDetail.Region
+	}
+	if tenant.RegionName != "" {
+		if region, err := s.regionService.FindByRegionName(tenant.RegionName); err == nil {
+			return region
+		}
+	}
+	return nil
+}
+
+// logoFileSizeLimit returns the tenant's configured logo size limit, falling back
+// to the region's and then to the global default
+func logoFileSizeLimit(tenant *models.Tenant, region *models.Region) int {
+	sizeLimits := tenant.TenantConfigDetail.SizeLimits
+	if sizeLimits != nil && sizeLimits.LogoFileSizeLimit > 0 {
+		return sizeLimits.LogoFileSizeLimit
+	}
+	if region != nil && region.SizeLimits != nil && region.SizeLimits.LogoFileSizeLimit > 0 {
+		return region.SizeLimits.LogoFileSizeLimit
+	}
+	return global.LOGO_FILE_SIZE_LIMIT
+}
+
+// logoKeyPrefix is where logo files live inside a tenant's storage
+const logoKeyPrefix = "logos/"
+
+func serveDefaultLogo(c *gin.Context) error {
+	err := storage.ServeFile(c, storage.Default(), "logos/defaultLogo.png", "image/png")
+	if errors.Is(err, storage.ErrNotFound) {
+		c.Status(http.StatusNotFound)
+		return nil
+	}
+	return err
+}
+
+
 /* Redis */
 
 func (s *TenantService) getRedisClient(name string, redisProperties redis.Options) (*redis.Client, error) {
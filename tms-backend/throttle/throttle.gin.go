@@ -0,0 +1,31 @@
+package throttle
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LimitMailRequest counts a request sending an email (password reset, verification, ...)
+// about key, an address or a user, and from the client's IP address
+func LimitMailRequest(key string, c *gin.Context) error {
+	if err := MailRequestIPs.Allow(c.ClientIP()); err != nil {
+		return err
+	}
+	return MailRequests.Allow(key)
+}
+
+// WriteLimitError answers a *LimitError with 429 and a Retry-After header.
+// It reports whether err was one.
+func WriteLimitError(c *gin.Context, err error) bool {
+	var limitError *LimitError
+	if !errors.As(err, &limitError) {
+		return false
+	}
+	c.Header("Retry-After", fmt.Sprint(int(math.Ceil(limitError.RetryAfter.Seconds()))))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": limitError.Error(), "locked": limitError.Locked})
+	return true
+}
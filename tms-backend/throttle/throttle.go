@@ -0,0 +1,176 @@
+package throttle
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+)
+
+var ErrTooManyAttempts = errors.New("too many attempts")
+
+// LimitError is returned for an attempt made while a key is delayed or locked out
+type LimitError struct {
+	RetryAfter time.Duration
+	Locked     bool // locked out, as opposed to delayed after a few failures
+}
+
+func (e *LimitError) Error() string {
+	retryAfter := e.RetryAfter.Round(time.Second)
+	if e.Locked {
+		return fmt.Sprintf("%v: locked out, try again in %v", ErrTooManyAttempts, retryAfter)
+	}
+	return fmt.Sprintf("%v: try again in %v", ErrTooManyAttempts, retryAfter)
+}
+
+func (e *LimitError) Unwrap() error {
+	return ErrTooManyAttempts
+}
+
+// Limiter counts failed attempts per key (an account, an IP address, ...). After FreeFailures
+// failures within Window every further attempt must wait a delay doubling from BaseDelay up
+// to MaxDelay; after MaxFailures the key is locked out for Lockout.
+type Limiter struct {
+	Name         string
+	MaxFailures  int
+	FreeFailures int
+	Window       time.Duration
+	Lockout      time.Duration
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+}
+
+var (
+	// Failed logins per account, locking the account out
+	LoginAccounts = &Limiter{
+		Name:         "login-account",
+		MaxFailures:  global.LOGIN_MAX_FAILED_ATTEMPTS,
+		FreeFailures: global.LOGIN_FREE_FAILED_ATTEMPTS,
+		Window:       global.LOGIN_FAILURE_WINDOW,
+		Lockout:      global.LOGIN_LOCKOUT_DURATION,
+		BaseDelay:    global.THROTTLE_BASE_DELAY,
+		MaxDelay:     global.THROTTLE_MAX_DELAY,
+	}
+	// Failed logins per IP address, against one client trying many accounts
+	LoginIPs = &Limiter{
+		Name:         "login-ip",
+		MaxFailures:  global.LOGIN_IP_MAX_FAILED_ATTEMPTS,
+		FreeFailures: global.LOGIN_IP_FREE_FAILED_ATTEMPTS,
+		Window:       global.LOGIN_FAILURE_WINDOW,
+		Lockout:      global.LOGIN_LOCKOUT_DURATION,
+		BaseDelay:    global.THROTTLE_BASE_DELAY,
+		MaxDelay:     global.THROTTLE_MAX_DELAY,
+	}
+	// Requests sending an email (password reset, email verification, ...) per address.
+	// Every request counts
+	MailRequests = &Limiter{
+		Name:         "mail-request",
+		MaxFailures:  global.MAIL_REQUEST_LIMIT,
+		FreeFailures: global.MAIL_REQUEST_FREE_LIMIT,
+		Window:       global.MAIL_REQUEST_WINDOW,
+		Lockout:      global.MAIL_REQUEST_WINDOW,
+		BaseDelay:    global.THROTTLE_BASE_DELAY,
+		MaxDelay:     global.THROTTLE_MAX_DELAY,
+	}
+	// Requests sending an email per IP address
+	MailRequestIPs = &Limiter{
+		Name:         "mail-request-ip",
+		MaxFailures:  global.MAIL_REQUEST_IP_LIMIT,
+		FreeFailures: global.MAIL_REQUEST_IP_FREE_LIMIT,
+		Window:       global.MAIL_REQUEST_WINDOW,
+		Lockout:      global.MAIL_REQUEST_WINDOW,
+		BaseDelay:    global.THROTTLE_BASE_DELAY,
+		MaxDelay:     global.THROTTLE_MAX_DELAY,
+	}
+)
+
+// Check returns a *LimitError if the key must not make an attempt now
+func (l *Limiter) Check(key string) error {
+	s := currentStore()
+	for _, k := range []struct {
+		name   string
+		locked bool
+	}{{l.key(key, "locked"), true}, {l.key(key, "next"), false}} {
+		until, ok, err := s.get(k.name)
+		if err != nil {
+			return fmt.Errorf("failed to check attempts: %v", err)
+		}
+		if retryAfter := time.Until(time.UnixMilli(until)); ok && retryAfter > 0 {
+			return &LimitError{RetryAfter: retryAfter, Locked: k.locked}
+		}
+	}
+	return nil
+}
+
+// Fail records a failed attempt. locked is true for the failure that locks the key out.
+func (l *Limiter) Fail(key string) (locked bool, err error) {
+	s := currentStore()
+	failures, err := s.incr(l.key(key, "failures"), l.Window)
+	if err != nil {
+		return false, fmt.Errorf("failed to record attempt: %v", err)
+	}
+
+	if failures >= int64(l.MaxFailures) {
+		until := time.Now().Add(l.Lockout)
+		if err := s.set(l.key(key, "locked"), until.UnixMilli(), l.Lockout); err != nil {
+			return false, fmt.Errorf("failed to lock out: %v", err)
+		}
+		// Counting starts over after the lockout
+		s.delete(l.key(key, "failures"), l.key(key, "next"))
+		return true, nil
+	}
+	if delay := l.delay(int(failures)); delay > 0 {
+		if err := s.set(l.key(key, "next"), time.Now().Add(delay).UnixMilli(), delay); err != nil {
+			return false, fmt.Errorf("failed to record attempt: %v", err)
+		}
+	}
+	return false, nil
+}
+
+// Allow checks and counts an attempt in one go, for limits on every request rather than failures
+func (l *Limiter) Allow(key string) error {
+	if err := l.Check(key); err != nil {
+		return err
+	}
+	_, err := l.Fail(key)
+	return err
+}
+
+// Reset forgets the failures of a key and lifts its lockout
+func (l *Limiter) Reset(key string) error {
+	err := currentStore().delete(l.key(key, "failures"), l.key(key, "next"), l.key(key, "locked"))
+	if err != nil {
+		return fmt.Errorf("failed to reset attempts: %v", err)
+	}
+	return nil
+}
+
+// LockedUntil returns when the lockout of a key ends, the zero time if it is not locked out
+func (l *Limiter) LockedUntil(key string) (time.Time, error) {
+	until, ok, err := currentStore().get(l.key(key, "locked"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to check lockout: %v", err)
+	}
+	if !ok || time.UnixMilli(until).Before(time.Now()) {
+		return time.Time{}, nil
+	}
+	return time.UnixMilli(until), nil
+}
+
+// delay returns how long to wait after the given number of failures
+func (l *Limiter) delay(failures int) time.Duration {
+	if failures <= l.FreeFailures || l.BaseDelay <= 0 {
+		return 0
+	}
+	delay := l.BaseDelay
+	for i := l.FreeFailures + 1; i < failures && delay < l.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, l.MaxDelay)
+}
+
+func (l *Limiter) key(key string, kind string) string {
+	return fmt.Sprintf("throttle:%s:%s:%s", l.Name, strings.ToLower(strings.TrimSpace(key)), kind)
+}
@@ -0,0 +1,179 @@
+package throttle
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/database"
+	"github.com/redis/go-redis/v9"
+)
+
+// store keeps expiring counters. Values are int64: failure counts or unix milliseconds.
+type store interface {
+	incr(key string, ttl time.Duration) (int64, error)
+	get(key string) (int64, bool, error)
+	set(key string, value int64, ttl time.Duration) error
+	delete(keys ...string) error
+}
+
+// memory is used without Redis, and when Redis fails. Its counters are per process.
+var memory = &memoryStore{entries: map[string]memoryEntry{}}
+
+// currentStore returns Redis if it is connected, the in-memory store otherwise
+func currentStore() store {
+	if database.Redis != nil {
+		return fallbackStore{primary: redisStore{client: database.Redis}, secondary: memory}
+	}
+	return memory
+}
+
+/* REDIS */
+
+type redisStore struct {
+	client *redis.Client
+}
+
+func (s redisStore) incr(key string, ttl time.Duration) (int64, error) {
+	ctx := context.Background()
+	count, err := s.client.Incr(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	// The window starts with the first failure
+	if count == 1 {
+		if err := s.client.PExpire(ctx, key, ttl).Err(); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+func (s redisStore) get(key string) (int64, bool, error) {
+	value, err := s.client.Get(context.Background(), key).Int64()
+	if err == redis.Nil {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return value, true, nil
+}
+
+func (s redisStore) set(key string, value int64, ttl time.Duration) error {
+	return s.client.Set(context.Background(), key, value, ttl).Err()
+}
+
+func (s redisStore) delete(keys ...string) error {
+	return s.client.Del(context.Background(), keys...).Err()
+}
+
+/* IN-MEMORY */
+
+type memoryEntry struct {
+	value     int64
+	expiresAt time.Time
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+// memorySweepSize is the number of entries above which expired ones are dropped
+const memorySweepSize = 10000
+
+func (s *memoryStore) incr(key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		s.sweep()
+		entry = memoryEntry{expiresAt: time.Now().Add(ttl)}
+	}
+	entry.value++
+	s.entries[key] = entry
+	return entry.value, nil
+}
+
+func (s *memoryStore) get(key string) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return 0, false, nil
+	}
+	return entry.value, true, nil
+}
+
+func (s *memoryStore) set(key string, value int64, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep()
+	s.entries[key] = memoryEntry{value: value, expiresAt: time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *memoryStore) delete(keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		delete(s.entries, key)
+	}
+	return nil
+}
+
+// sweep drops the expired entries once the map is large. The caller holds the lock.
+func (s *memoryStore) sweep() {
+	if len(s.entries) < memorySweepSize {
+		return
+	}
+	now := time.Now()
+	for key, entry := range s.entries {
+		if now.After(entry.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+/* FALLBACK */
+
+// fallbackStore uses secondary for the calls primary fails
+type fallbackStore struct {
+	primary   store
+	secondary store
+}
+
+func (s fallbackStore) incr(key string, ttl time.Duration) (int64, error) {
+	count, err := s.primary.incr(key, ttl)
+	if err != nil {
+		log.Printf("Warning: throttle store failed, using memory: %v", err)
+		return s.secondary.incr(key, ttl)
+	}
+	return count, nil
+}
+
+func (s fallbackStore) get(key string) (int64, bool, error) {
+	value, ok, err := s.primary.get(key)
+	if err != nil {
+		log.Printf("Warning: throttle store failed, using memory: %v", err)
+		return s.secondary.get(key)
+	}
+	return value, ok, nil
+}
+
+func (s fallbackStore) set(key string, value int64, ttl time.Duration) error {
+	if err := s.primary.set(key, value, ttl); err != nil {
+		log.Printf("Warning: throttle store failed, using memory: %v", err)
+		return s.secondary.set(key, value, ttl)
+	}
+	return nil
+}
+
+func (s fallbackStore) delete(keys ...string) error {
+	// Both: what was counted in memory during an outage must go too
+	err := s.primary.delete(keys...)
+	s.secondary.delete(keys...)
+	return err
+}
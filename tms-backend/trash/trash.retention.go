@@ -0,0 +1,70 @@
+package trash
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/database"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+)
+
+// Purger purges the records of a resource that were put in the trash before cutoff, at most
+// global.TRASH_PURGE_BATCH_SIZE at once, and tells how many it purged
+type Purger interface {
+	PurgeDeletedBefore(ctx context.Context, cutoff time.Time) (int, error)
+}
+
+var startRetentionOnce sync.Once
+
+// StartRetentionJob purges, every global.TRASH_PURGE_INTERVAL, the records that have been in the trash
+// longer than retention (never if it is 0 or less). Purgers run in order: those of records referencing
+// others first. It stops when ctx is done.
+func StartRetentionJob(ctx context.Context, retention time.Duration, purgers ...Purger) {
+	if retention <= 0 {
+		log.Println("Trash retention is disabled, deleted records are kept until purged")
+		return
+	}
+	startRetentionOnce.Do(func() {
+		go retentionJob(ctx, retention, purgers)
+		log.Printf("Started purging records deleted more than %s ago", retention)
+	})
+}
+
+func retentionJob(ctx context.Context, retention time.Duration, purgers []Purger) {
+	ticker := time.NewTicker(global.TRASH_PURGE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		purgeExpired(ctx, time.Now().Add(-retention), purgers)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func purgeExpired(ctx context.Context, cutoff time.Time, purgers []Purger) {
+	if database.DB == nil {
+		return
+	}
+	for _, purger := range purgers {
+		// Batch after batch, until one is not full: what is left is still referenced, or newer
+		for ctx.Err() == nil {
+			purged, err := purger.PurgeDeletedBefore(ctx, cutoff)
+			if err != nil {
+				log.Printf("Error purging the trash: %v", err)
+				break
+			}
+			if purged > 0 {
+				log.Printf("Purged %d records from the trash with %T", purged, purger)
+			}
+			if purged < global.TRASH_PURGE_BATCH_SIZE {
+				break
+			}
+		}
+	}
+}
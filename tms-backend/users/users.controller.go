@@ -1,11 +1,19 @@
 package users
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 
 	dto "github.com/auditrakkr/tms-fullstack/tms-backend/dtos"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/etags"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/passwords"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/repositories"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/throttle"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 
@@ -24,33 +32,49 @@ func (uc *UserController) CreateUser(c *gin.Context) {
 	var createUserDto dto.CreateUserDto
 	if err := c.ShouldBindJSON(&createUserDto); err != nil {
 		c.JSON(400, gin.H{"error": "Invalid request payload"})
+		return
 	}
 	user, err := uc.userService.CreateUser(c, &createUserDto)
+	var policyError *passwords.PolicyError
+	if errors.As(err, &policyError) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "violations": policyError.Violations})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 	c.JSON(http.StatusCreated, gin.H{"user": user})
 }
 
 
 /* FIND */
+// GetAllUsers lists a page of users, filtered and sorted by the query parameters (see repositories.ListQuery)
 func (uc *UserController) GetAllUsers(c *gin.Context) {
-	users, err := uc.userService.GetAllUsers()
+	users, err := uc.userService.FindAllWithOptions(c.Request.URL)
 	if err != nil {
+		if errors.Is(err, repositories.ErrInvalidListQuery) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
-	c.JSON(http.StatusOK, gin.H{"users": users})
+	c.JSON(http.StatusOK, users)
 }
 
 func (uc *UserController) FindOne(c *gin.Context) {
 	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
 	}
 	user, err := uc.userService.FindOne(uint(id))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
+	etags.Set(c, user.Version)
 	c.JSON(http.StatusOK, gin.H{"user": user})
 }
 
@@ -59,10 +83,18 @@ func (uc *UserController) DeleteUser(c *gin.Context) {
 	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	version, ok := etags.IfMatch(c)
+	if !ok {
+		return
 	}
-	err = uc.userService.DeleteUser(uint(id))
+
+	err = uc.userService.DeleteUser(uint(id), version)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		etags.WriteChangeError(c, err, "User")
+		return
 	}
 	c.JSON(http.StatusOK, gin.H{"message": "User deleted successfully"})
 }
@@ -73,15 +105,352 @@ func (uc *UserController) UpdateUser(c *gin.Context) {
 	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
 	}
+
+	version, ok := etags.IfMatch(c)
+	if !ok {
+		return
+	}
+
 	var updateUserDto dto.UpdateUserDto
 	if err := c.ShouldBindJSON(&updateUserDto); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+	user, err := uc.userService.Update(uint(id), version, &updateUserDto)
+	if err != nil {
+		if errors.Is(err, ErrEmailChangeNotConfirmed) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		etags.WriteChangeError(c, err, "User")
+		return
+	}
+	etags.Set(c, user.Version)
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+
+/* EMAIL VERIFICATION */
+
+// ConfirmPrimaryEmailRequest sends a verification link to a user's primary email address
+func (uc *UserController) ConfirmPrimaryEmailRequest(c *gin.Context) {
+	uc.confirmEmailRequest(c, true)
+}
+
+// ConfirmBackupEmailRequest sends a verification link to a user's backup email address
+func (uc *UserController) ConfirmBackupEmailRequest(c *gin.Context) {
+	uc.confirmEmailRequest(c, false)
+}
+
+func (uc *UserController) confirmEmailRequest(c *gin.Context, isPrimary bool) {
+	var requestDto dto.EmailVerificationRequestDto
+	if err := c.ShouldBindJSON(&requestDto); err != nil || (requestDto.Email == nil && requestDto.UserID == 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+	throttleKey := fmt.Sprintf("user-%d", requestDto.UserID)
+	if requestDto.Email != nil {
+		throttleKey = *requestDto.Email
+	}
+	if err := throttle.LimitMailRequest(throttleKey, c); err != nil {
+		if !throttle.WriteLimitError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
 	}
-	user, err := uc.userService.Update(uint(id), &updateUserDto)
+	notification, err := uc.userService.ConfirmEmailRequest(requestDto.Email, requestDto.UserID, isPrimary, c)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, notification)
+}
+
+// ConfirmPrimaryEmail verifies a primary email address with the token of its verification link
+func (uc *UserController) ConfirmPrimaryEmail(c *gin.Context) {
+	uc.confirmEmail(c, true)
+}
+
+// ConfirmBackupEmail verifies a backup email address with the token of its verification link
+func (uc *UserController) ConfirmBackupEmail(c *gin.Context) {
+	uc.confirmEmail(c, false)
+}
+
+func (uc *UserController) confirmEmail(c *gin.Context, isPrimary bool) {
+	err := uc.userService.ConfirmEmail(c.Params.ByName("token"), isPrimary, c)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidVerificationToken):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrVerificationTokenExpired):
+			c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, global.GenericNotificationResponse{
+		NotificationClass:   "is-success",
+		NotificationMessage: "Your email address is verified",
+	})
+}
+
+
+/* PASSWORD RESET */
+
+// ResetPasswordRequest sends a password reset link to a user's primary email address
+func (uc *UserController) ResetPasswordRequest(c *gin.Context) {
+	var requestDto dto.ResetPasswordRequestDto
+	if err := c.ShouldBindJSON(&requestDto); err != nil || requestDto.Email == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+	if err := throttle.LimitMailRequest(requestDto.Email, c); err != nil {
+		if !throttle.WriteLimitError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	notification, err := uc.userService.ResetPasswordRequest(requestDto.Email, requestDto.TenantID, c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, notification)
+}
+
+// ResetPasswordForm renders the form of a password reset link
+func (uc *UserController) ResetPasswordForm(c *gin.Context) {
+	if err := uc.userService.ResetPassword(c.Params.ByName("token"), nil, c); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// ResetPassword sets the new password posted by the reset form
+func (uc *UserController) ResetPassword(c *gin.Context) {
+	password := c.PostForm("password")
+	if password == "" || password != c.PostForm("passwordConfirm") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Passwords are missing or do not match"})
+		return
+	}
+	err := uc.userService.ResetPassword(c.Params.ByName("token"), &password, c)
+	if err != nil {
+		if errors.Is(err, ErrInvalidResetToken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+/* LOCKOUT */
+
+// UnlockAccount lifts the lockout of an account after failed sign-in attempts. Landlord admins only
+func (uc *UserController) UnlockAccount(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	user, err := uc.userService.UnlockAccount(uint(id), c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 	c.JSON(http.StatusOK, gin.H{"user": user})
-	c.JSON(http.StatusOK, gin.H{"message": "User updated successfully"})
+}
+
+/* EMAIL CHANGE */
+
+// ChangeEmailRequest starts changing a user's primary email address, to newEmailAddress or to the backup address
+func (uc *UserController) ChangeEmailRequest(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	// Only the signed in user may change their own address
+	if c.GetUint(global.CONTEXT_USER_ID_KEY) != uint(id) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only change your own email address"})
+		return
+	}
+	var requestDto dto.ChangeEmailRequestDto
+	if err := c.ShouldBindJSON(&requestDto); err != nil || requestDto.CurrentPassword == "" || (requestDto.NewEmailAddress == nil && !requestDto.PromoteBackup) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+	newEmail := ""
+	if requestDto.NewEmailAddress != nil {
+		newEmail = *requestDto.NewEmailAddress
+	}
+
+	if err := throttle.LimitMailRequest(fmt.Sprintf("user-%d", id), c); err != nil {
+		if !throttle.WriteLimitError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	notification, err := uc.userService.ChangeEmailRequest(uint(id), requestDto.CurrentPassword, newEmail, requestDto.PromoteBackup, c)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrWrongPassword):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrInvalidEmailAddress):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrEmailAddressInUse):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, notification)
+}
+
+// ConfirmEmailChange completes an email change; it is the link sent to the new address
+func (uc *UserController) ConfirmEmailChange(c *gin.Context) {
+	user, err := uc.userService.ConfirmEmailChange(c.Params.ByName("token"))
+	uc.emailChangeResponse(c, user, err)
+}
+
+// RevertEmailChange cancels or undoes an email change; it is the link sent to the old address
+func (uc *UserController) RevertEmailChange(c *gin.Context) {
+	user, err := uc.userService.RevertEmailChange(c.Params.ByName("token"))
+	uc.emailChangeResponse(c, user, err)
+}
+
+func (uc *UserController) emailChangeResponse(c *gin.Context, user any, err error) {
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidVerificationToken):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrVerificationTokenExpired):
+			c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+
+/* PHOTO */
+func (uc *UserController) SetUserPhoto(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	file, err := c.FormFile("photo")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing photo file"})
+		return
+	}
+	user, err := uc.userService.SetUserPhoto(uint(id), file, c)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrPhotoTooLarge):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrUnsupportedPhotoType):
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+// GetUserPhoto serves a user's photo. Optional query ?size=thumb|medium|large|original
+func (uc *UserController) GetUserPhoto(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	err = uc.userService.GetUserPhoto(uint(id), c.DefaultQuery("size", "original"), c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// GetUserPhotoURL returns a signed, expiring URL for a user's photo. Optional query ?size=thumb|medium|large|original
+func (uc *UserController) GetUserPhotoURL(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	url, expiresAt, err := uc.userService.GetUserPhotoURL(uint(id), c.DefaultQuery("size", "original"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"url": url, "expiresAt": expiresAt})
+}
+
+func (uc *UserController) DeleteUserPhoto(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	err = uc.userService.DeleteUserPhoto(uint(id), c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Photo deleted successfully"})
+}
+
+/* TRASH */
+
+// RestoreUser takes a deleted user out of the trash
+func (uc *UserController) RestoreUser(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	user, err := uc.userService.Restore(uint(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found in the trash"})
+		case errors.Is(err, repositories.ErrRestoreConflict):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+// PurgeUser deletes a user in the trash for good
+func (uc *UserController) PurgeUser(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Params.ByName("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	if err := uc.userService.Purge(uint(id)); err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found in the trash"})
+		case errors.Is(err, repositories.ErrStillReferenced):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.Status(http.StatusNoContent)
 }
@@ -1,25 +1,39 @@
 package users
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"image"
 	"io"
+	"log"
 	"mime/multipart"
 	"net/http"
-	"os"
-	"path/filepath"
+	netmail "net/mail"
+	"net/url"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	auth_dto "github.com/auditrakkr/tms-fullstack/tms-backend/auth/dtos"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/config"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/database"
 	dto "github.com/auditrakkr/tms-fullstack/tms-backend/dtos"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/global"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/mail"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/passwords"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/repositories"
 	"github.com/auditrakkr/tms-fullstack/tms-backend/search"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/sessions"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/storage"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/throttle"
+	"github.com/auditrakkr/tms-fullstack/tms-backend/utils"
 	"github.com/gin-gonic/gin"
 
 	"github.com/jinzhu/copier"
@@ -27,12 +41,30 @@ import (
 	"gorm.io/gorm"
 )
 
+var (
+	ErrPhotoTooLarge            = errors.New("photo file too large")
+	ErrUnsupportedPhotoType     = errors.New("unsupported photo file type")
+	ErrInvalidVerificationToken = errors.New("invalid verification token")
+	ErrVerificationTokenExpired = errors.New("verification token expired")
+	ErrInvalidEmailAddress      = errors.New("invalid email address")
+	ErrEmailAddressInUse        = errors.New("email address is already in use")
+	ErrWrongPassword            = errors.New("the current password is wrong")
+	ErrEmailChangeNotConfirmed  = errors.New("the primary email address can only be changed with a confirmed change-email-request")
+	ErrInvalidResetToken        = errors.New("invalid password reset token")
+	ErrResetTokenExpired        = errors.New("password reset token expired")
+	ErrNoTrustedURL             = errors.New("APP_ROOT_HTTP_URL is not configured: cannot build links for emails")
+	ErrMagicLinkDisabled        = errors.New("sign-in links are not enabled for this tenant")
+	ErrInvalidMagicLink         = errors.New("invalid or already used sign-in link")
+	ErrMagicLinkExpired         = errors.New("sign-in link expired")
+)
+
 type UserService struct {
 	userRepo                 repositories.Repository[models.User]
 	roleRepo                 repositories.Repository[models.Role]
 	tenantRepo               repositories.Repository[models.Tenant]
 	tenantTeamRepo           repositories.Repository[models.TenantTeam]
 	tenantAccountOfficerRepo repositories.Repository[models.TenantAccountOfficer]
+	magicLinkRepo            repositories.Repository[models.MagicLink]
 	usersSearchService       *search.UsersSearchService
 	db                       *gorm.DB
 }
@@ -51,6 +83,7 @@ func NewUserService() *UserService {
 		tenantRepo:               repositories.Repository[models.Tenant]{DB: database.DB},
 		tenantTeamRepo:           repositories.Repository[models.TenantTeam]{DB: database.DB},
 		tenantAccountOfficerRepo: repositories.Repository[models.TenantAccountOfficer]{DB: database.DB},
+		magicLinkRepo:            repositories.Repository[models.MagicLink]{DB: database.DB},
 		usersSearchService:       searchService,
 		db:                       database.DB,
 	}
@@ -63,21 +96,23 @@ func (s *UserService) CreateUser(c *gin.Context, createUserDto *dto.CreateUserDt
 	if err := copier.Copy(newUser, createUserDto); err != nil {
 		return nil, fmt.Errorf("failed to map dto: %v", err)
 	}
-	newUser, err := s.userRepo.Create(newUser)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create user: %v", err)
-	}
 
-	// Hash the password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newUser.PasswordHash), bcrypt.DefaultCost)
+	// The password is only ever stored hashed. A new user is on no team yet: the default policy applies
+	if err := passwords.DefaultPolicy().Validate(createUserDto.Password, personalWords(newUser)...); err != nil {
+		return nil, err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(createUserDto.Password), bcrypt.DefaultCost)
 	if err != nil {
 		return nil, fmt.Errorf("failed to hash password: %v", err)
 	}
 	newUser.PasswordHash = string(hashedPassword)
+	// The addresses may have bounced before, e.g. for an account that was deleted
+	newUser.PrimaryEmailDeliverability = mail.DeliverabilityOf(newUser.PrimaryEmailAddress)
+	newUser.BackupEmailDeliverability = mail.DeliverabilityOf(newUser.BackupEmailAddress)
 
-	user, err := s.userRepo.Save(newUser)
+	user, err := s.userRepo.Create(newUser)
 	if err != nil {
-		return nil, fmt.Errorf("failed to save user: %v", err)
+		return nil, fmt.Errorf("failed to create user: %v", err)
 	}
 
 	//add to elastic search
@@ -91,26 +126,121 @@ func (s *UserService) CreateUser(c *gin.Context, createUserDto *dto.CreateUserDt
 
 	// Send confirmation email if enabled
 	if global.AUTO_SEND_CONFIRM_EMAIL {
-		s.ConfirmEmailRequest(&createUserDto.PrimaryEmailAddress, 0, true, c)
+		// The account exists either way: a failed send can be retried with confirm-primary-email-request
+		if _, err := s.ConfirmEmailRequest(nil, user.ID, true, c); err != nil {
+			log.Printf("Error sending verification email to user %d: %v", user.ID, err)
+		}
+		if user.BackupEmailAddress != "" {
+			if _, err := s.ConfirmEmailRequest(nil, user.ID, false, c); err != nil {
+				log.Printf("Error sending verification email to user %d: %v", user.ID, err)
+			}
+		}
+	}
+
+	return user, nil
+}
+
+// ProvisionUser creates the account of a user a tenant's identity provider signs in for the first
+// time (see the sso package). It has no password: the user signs in with the identity provider.
+// The provider vouches for the address, so it counts as verified and no confirmation is sent.
+func (s *UserService) ProvisionUser(email, firstName, lastName string) (*models.User, error) {
+	user := &models.User{
+		FirstName:                  firstName,
+		LastName:                   lastName,
+		PrimaryEmailAddress:        email,
+		IsPrimaryEmailVerified:     true,
+		PrimaryEmailDeliverability: mail.DeliverabilityOf(email),
+		BackupEmailDeliverability:  global.EmailDeliverable,
+	}
+	// Without a backup address: NULL, not an empty string, which is unique
+	if err := s.userRepo.CreateQueryBuilder().Omit("BackupEmailAddress").Create(user).Error; err != nil {
+		return nil, fmt.Errorf("failed to create user: %v", err)
 	}
 
+	if s.usersSearchService != nil {
+		if err := s.usersSearchService.IndexUser(context.Background(), *user); err != nil {
+			log.Printf("Error adding user %d to search index: %v", user.ID, err)
+		}
+	}
+	return user, nil
+}
+
+// UpdateProvisionedUser sets the names and status of a user kept by a tenant's identity provider
+// (see the scim package). Deactivated users cannot sign in and are signed out of every device.
+func (s *UserService) UpdateProvisionedUser(userId uint, firstName, middleName, lastName string, active bool) (*models.User, error) {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.User{}).
+			Where("id = ?", userId).
+			Updates(map[string]any{
+				"first_name":  firstName,
+				"middle_name": middleName,
+				"last_name":   lastName,
+				"is_active":   active,
+			}).Error
+		if err != nil {
+			return fmt.Errorf("failed to update user: %v", err)
+		}
+		if !active {
+			if _, err := sessions.RevokeAllTx(tx, userId, 0, sessions.RevokedByDeactivation); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.FindById(userId)
+	if err != nil {
+		return nil, err
+	}
+	if s.usersSearchService != nil {
+		if err := s.usersSearchService.Update(context.Background(), *user); err != nil {
+			log.Printf("Error updating user %d in search index: %v", user.ID, err)
+		}
+	}
 	return user, nil
 }
 
 /*UPDATE section  */
-func (s *UserService) Update(userId uint, updateUserDto *dto.UpdateUserDto) (*models.User, error) {
+
+// profileColumns are the columns of a user that UpdateUserDto changes
+var profileColumns = []string{"FirstName", "MiddleName", "LastName", "CommonName", "HomeAddress", "Gender",
+	"DateOfBirth", "Nationality", "StateOfOrigin", "BackupEmailAddress"}
+
+// Update changes the profile of a user, provided it is still at version (0 for any version)
+func (s *UserService) Update(userId uint, version uint, updateUserDto *dto.UpdateUserDto) (*models.User, error) {
 	user, err := s.userRepo.FindByID(userId)
 	if err != nil {
-		return nil, fmt.Errorf("failed to find user: %v", err)
+		return nil, fmt.Errorf("failed to find user: %w", err)
+	}
+	if version != 0 {
+		user.Version = version
+	}
+
+	// The primary address is where password resets go: it only changes through ChangeEmailRequest
+	if updateUserDto.PrimaryEmailAddress != nil && !strings.EqualFold(*updateUserDto.PrimaryEmailAddress, user.PrimaryEmailAddress) {
+		return nil, ErrEmailChangeNotConfirmed
 	}
+	backupEmailAddress := user.BackupEmailAddress
 
 	if err := copier.Copy(user, updateUserDto); err != nil {
 		return nil, fmt.Errorf("failed to map dto: %v", err)
 	}
+	columns := profileColumns
+	if !strings.EqualFold(user.BackupEmailAddress, backupEmailAddress) {
+		// A new backup address must be verified again before it can be promoted
+		user.IsBackupEmailVerified = false
+		user.BackupEmailVerificationToken = ""
+		user.BackupEmailDeliverability = mail.DeliverabilityOf(user.BackupEmailAddress)
+		columns = append(columns[:len(columns):len(columns)], "IsBackupEmailVerified", "BackupEmailVerificationToken", "BackupEmailDeliverability")
+	}
 
-	err = s.userRepo.Update(user)
+	// Only the profile is written: the password, tokens and flags may have changed since the user was read
+	err = s.userRepo.UpdateColumns(user, columns...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to update user: %v", err)
+		return nil, fmt.Errorf("failed to update user: %w", err)
 
 	}
 
@@ -128,9 +258,14 @@ func (s *UserService) Update(userId uint, updateUserDto *dto.UpdateUserDto) (*mo
 
 /* Delete */
 
-func (s *UserService) DeleteUser(userId uint) error {
+// DeleteUser deletes a user, provided it is still at version (0 for any version)
+func (s *UserService) DeleteUser(userId uint, version uint) error {
+	err := s.userRepo.DeleteVersion(userId, version)
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
 
-	// Remove from search index first
+	// Remove from the search index once it is gone from the database
 	if s.usersSearchService != nil {
 		ctx := context.Background()
 		err := s.usersSearchService.Remove(ctx, int(userId))
@@ -138,12 +273,6 @@ func (s *UserService) DeleteUser(userId uint) error {
 			fmt.Printf("Warning: failed to remove user from search index: %v\n", err)
 		}
 	}
-
-	// Delete the user from the database
-	err := s.userRepo.Delete(userId)
-	if err != nil {
-		return fmt.Errorf("failed to delete user: %v", err)
-	}
 	return nil
 }
 
@@ -155,14 +284,73 @@ func (s *UserService) RemoveUser(user *models.User) (*models.User, error) {
 	return &removedUser, nil
 }
 
+/* TRASH */
+
+// Restore takes a deleted user out of the trash
+func (s *UserService) Restore(userId uint) (*models.User, error) {
+	user, err := s.userRepo.Restore(userId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore user: %w", err)
+	}
+	// Put the user back in the search index
+	if s.usersSearchService != nil {
+		if err := s.usersSearchService.IndexUser(context.Background(), *user); err != nil {
+			log.Printf("Warning: failed to index restored user %d: %v", user.ID, err)
+		}
+	}
+	user.Sanitize()
+	return user, nil
+}
+
+// Purge deletes a user in the trash for good
+func (s *UserService) Purge(userId uint) error {
+	user, err := s.userRepo.Purge(userId)
+	if err != nil {
+		return fmt.Errorf("failed to purge user: %w", err)
+	}
+	if err := s.deletePhotoFiles(context.Background(), user, ""); err != nil {
+		log.Printf("Warning: failed to delete photo files of purged user %d: %v", user.ID, err)
+	}
+	return nil
+}
+
+// PurgeDeletedBefore purges users put in the trash before cutoff, see trash.StartRetentionJob
+func (s *UserService) PurgeDeletedBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	users, err := s.userRepo.WithContext(ctx).PurgeDeletedBefore(cutoff, global.TRASH_PURGE_BATCH_SIZE)
+	for i := range users {
+		if err := s.deletePhotoFiles(ctx, &users[i], ""); err != nil {
+			log.Printf("Warning: failed to delete photo files of purged user %d: %v", users[i].ID, err)
+		}
+	}
+	if err != nil {
+		return len(users), fmt.Errorf("failed to purge deleted users: %w", err)
+	}
+	return len(users), nil
+}
+
 /* Read Section */
 
-func (s *UserService) FindAllWithOptions(findOptions map[string]any) ([]models.User, int64, error) {
-	users, totalCount, err := s.userRepo.FindAndCount(findOptions)
+// userListFields are what the user list can be filtered and sorted by, see repositories.ListQuery
+var userListFields = repositories.ListFields{
+	Filter:      []string{"id", "first_name", "last_name", "primary_email_address", "landlord", "is_active", "gender", "nationality", "is_primary_email_verified", "created_at", "updated_at", "deleted_at"},
+	Sort:        []string{"first_name", "last_name", "primary_email_address", "created_at", "updated_at"},
+	DefaultSort: "-created_at",
+}
+
+// FindAllWithOptions returns the page of users the list query parameters of requestURL ask for, sanitized
+func (s *UserService) FindAllWithOptions(requestURL *url.URL) (*repositories.ListPage[models.User], error) {
+	listQuery, err := repositories.ParseListQuery(requestURL, userListFields)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to find all users with options: %v", err)
+		return nil, err
 	}
-	return users, totalCount, nil
+	page, err := s.userRepo.FindPage(listQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find all users with options: %w", err)
+	}
+	for i := range page.Data {
+		page.Data[i].Sanitize()
+	}
+	return page, nil
 }
 
 func (s *UserService) GetAllUsers() ([]models.User, error) {
@@ -197,35 +385,32 @@ func (s *UserService) FindOne(userId uint) (*models.User, error) {
 //1. Roles
 // CreateAndAddRole creates a new role and assigns it to a user in a transaction
 func (s *UserService) CreateAndAddRole(userId uint, createRoleDto *dto.CreateRoleDto) error {
-	// Start a transaction
-	tx := s.db.Begin()
-	if tx.Error != nil {
-		return fmt.Errorf("failed to start transaction: %v", tx.Error)
+	// Create the new role
+	newRole := &models.Role{}
+	if err := copier.Copy(newRole, createRoleDto); err != nil {
+		return fmt.Errorf("failed to map dto: %v", err)
 	}
 
-	// Defer either commit or rollback based on success/failure
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
+	return repositories.NewUnitOfWork(s.db).Do(context.Background(), func(tx *gorm.DB) error {
+		user, err := s.userRepo.WithTx(tx).FindByID(userId)
+		if err != nil {
+			return fmt.Errorf("failed to find user: %v", err)
 		}
-	}()
 
-	// Create the new role
-	newRole := &models.Role{}
-	if err := copier.Copy(newRole, createRoleDto); err != nil {}
-
-	// Save the new role in the transaction
-    if err := tx.Create(newRole).Error; err != nil {
-        tx.Rollback()
-        // Check for unique constraint violation
-        if strings.Contains(err.Error(), "duplicate key") || strings.Contains(err.Error(), "unique constraint") {
-            return fmt.Errorf("role with this name already exists: %v", err)
-        }
-        return fmt.Errorf("failed to create role: %v", err)
-    }
-
-	return nil
+		// Save the new role in the transaction
+		if _, err := s.roleRepo.WithTx(tx).Create(newRole); err != nil {
+			// Check for unique constraint violation
+			if strings.Contains(err.Error(), "duplicate key") || strings.Contains(err.Error(), "unique constraint") {
+				return fmt.Errorf("role with this name already exists: %v", err)
+			}
+			return fmt.Errorf("failed to create role: %v", err)
+		}
 
+		if err := tx.Model(user).Association("Roles").Append(newRole); err != nil {
+			return fmt.Errorf("failed to add role to user: %v", err)
+		}
+		return nil
+	})
 }
 
 func (s *UserService) AddRoleById(userId uint, roleId uint) error {
@@ -371,25 +556,25 @@ func (s *UserService) FindByConfirmedPrimaryEmailAddress(primaryEmailAddress str
 	return &user, nil
 }
 
+// FindByResetPassToken finds the user a still valid password reset link was sent to
 func (s *UserService) FindByResetPassToken(resetPasswordToken string) (*models.User, error) {
-	var user models.User
-	err := s.userRepo.CreateQueryBuilder().
-		Where("reset_password_token = ?", resetPasswordToken).
-		First(&user).Error
+	user, err := s.findByResetPasswordToken(resetPasswordToken)
 	if err != nil {
-		if err == gorm.ErrRecordNotFound {
+		if errors.Is(err, ErrInvalidResetToken) || errors.Is(err, ErrResetTokenExpired) {
 			return nil, fmt.Errorf("user not found")
 		}
 		return nil, fmt.Errorf("failed to find user by reset password token: %v", err)
 	}
 
-	return &user, nil
+	return user, nil
 }
 
+// FindByPrimaryEmailVerificationToken finds the user a primary email verification link was sent to.
+// The token is the one of the link; it is compared by hash
 func (s *UserService) FindByPrimaryEmailVerificationToken(primaryEmailVerificationToken string) (*models.User, error) {
     var user models.User
     err := s.userRepo.CreateQueryBuilder().
-        Where("primary_email_verification_token = ?", primaryEmailVerificationToken).
+        Where("primary_email_verification_token = ?", utils.HashToken(primaryEmailVerificationToken)).
         First(&user).Error
 
     if err != nil {
@@ -402,10 +587,11 @@ func (s *UserService) FindByPrimaryEmailVerificationToken(primaryEmailVerificati
     return &user, nil
 }
 
+// FindByBackupEmailVerificationToken finds the user a backup email verification link was sent to
 func (s *UserService) FindByBackupEmailVerificationToken(backupEmailVerificationToken string) (*models.User, error) {
     var user models.User
     err := s.userRepo.CreateQueryBuilder().
-        Where("backup_email_verification_token = ?", backupEmailVerificationToken).
+        Where("backup_email_verification_token = ?", utils.HashToken(backupEmailVerificationToken)).
         First(&user).Error
 
     if err != nil {
@@ -480,25 +666,6 @@ func (s *UserService) FindByFacebookId(facebookId string) (*models.User, error)
 	return &user, nil
 }
 
-/* Invoked to setRefreshTokenHash after successful login. */
-func (s *UserService) SetRefreshTokenHash(userId uint, refreshTokenHash string) error {
-	// Hash the refresh token
-	hashedRefreshToken, err := bcrypt.GenerateFromPassword([]byte(refreshTokenHash), bcrypt.DefaultCost)
-	if err != nil {
-		return fmt.Errorf("failed to hash refresh token: %v", err)
-	}
-
-	// Update only the RefreshTokenHash field
-	err = s.userRepo.CreateQueryBuilder().
-		Where("id = ?", userId).
-		Update("refresh_token_hash", string(hashedRefreshToken)).Error
-	if err != nil {
-		return fmt.Errorf("failed to update refresh token hash: %v", err)
-	}
-
-	return nil
-}
-
 func (s *UserService) SetGoogleProfile(userId uint, googleProfile *auth_dto.GoogleProfileDto) (*models.User, error) {
 	newGoogleProfile := &models.GoogleProfile{}
 	if err := copier.Copy(newGoogleProfile, googleProfile); err != nil {
@@ -543,108 +710,373 @@ func (s *UserService) SetFacebookProfile(userId uint, facebookProfile *auth_dto.
 	return user, nil
 }
 
-// SetUserPassword sets a user's password
+// SetUserPassword sets a user's password after checking it against the user's password
+// policy and password history. A failed check returns a *passwords.PolicyError.
+// It clears IsPasswordChangeRequired and signs every session of the user out.
 func (s *UserService) SetUserPassword(userId uint, password string) (bool, error) {
-	// Hash the password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	user, err := s.FindById(userId)
+	if err != nil {
+		return false, err
+	}
+	hashedPassword, policy, err := s.hashNewPassword(user, password)
 	if err != nil {
-		return false, fmt.Errorf("failed to hash password: %v", err)
+		return false, err
 	}
 
-	// Update the user's password
-	err = s.userRepo.CreateQueryBuilder().
-		Where("id = ?", userId).
-		Update("password_hash", string(hashedPassword)).Error
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.User{}).
+			Where("id = ?", userId).
+			Updates(map[string]any{
+				"password_hash":               hashedPassword,
+				"is_password_change_required": false,
+			}).Error
+		if err != nil {
+			return fmt.Errorf("failed to update user password: %v", err)
+		}
+		if _, err := sessions.RevokeAllTx(tx, userId, 0, sessions.RevokedByPasswordSet); err != nil {
+			return err
+		}
+		return recordPasswordHistory(tx, user, policy.HistorySize)
+	})
 	if err != nil {
-		return false, fmt.Errorf("failed to update user password: %v", err)
+		return false, err
 	}
 
 	return true, nil
 }
 
-// SetUserPhoto handles uploading user's profile photo
-func (s *UserService) SetUserPhoto(userId uint, file *multipart.FileHeader, c *gin.Context) error {
-	user, err := s.userRepo.FindByID(userId)
+// PasswordPolicyFor returns the password policy of a user: the strictest combination of
+// the default policy and the policies of the tenants the user is a team member of
+func (s *UserService) PasswordPolicyFor(userId uint) (passwords.Policy, error) {
+	var tenantIds []uint
+	err := s.tenantTeamRepo.CreateQueryBuilder().Where("user_id = ?", userId).Pluck("tenant_id", &tenantIds).Error
 	if err != nil {
-		return fmt.Errorf("failed to find user: %v", err)
+		return passwords.Policy{}, fmt.Errorf("failed to find user tenants: %v", err)
+	}
+	if len(tenantIds) == 0 {
+		return passwords.DefaultPolicy(), nil
 	}
 
-	// check file size
-	if file.Size > global.PHOTO_FILE_SIZE_LIMIT {
-		return fmt.Errorf("file too large (max %d bytes)", global.PHOTO_FILE_SIZE_LIMIT)
+	var configDetails []models.TenantConfigDetail
+	err = s.db.Model(&models.TenantConfigDetail{}).Where("tenant_id IN ?", tenantIds).Find(&configDetails).Error
+	if err != nil {
+		return passwords.Policy{}, fmt.Errorf("failed to find tenant config details: %v", err)
+	}
+	var tenantPolicies []*models.PasswordPolicy
+	for _, configDetail := range configDetails {
+		if configDetail.OtherUserOptions != nil {
+			tenantPolicies = append(tenantPolicies, configDetail.OtherUserOptions.PasswordPolicy)
+		}
 	}
+	return passwords.MergePolicies(tenantPolicies...), nil
+}
 
-	// generate unique filename
-	var fileName string
-	if user.Photo != "" {
-		fileName = user.Photo
-	} else {
-		fileName = fmt.Sprintf("%d_%s", user.ID, file.Filename)
+// hashNewPassword validates a new password of a user and returns its hash with the policy applied.
+// The current password and the last policy.HistorySize-1 ones cannot be reused.
+func (s *UserService) hashNewPassword(user *models.User, password string) (string, passwords.Policy, error) {
+	policy, err := s.PasswordPolicyFor(user.ID)
+	if err != nil {
+		return "", policy, err
+	}
+	if err := policy.Validate(password, personalWords(user)...); err != nil {
+		return "", policy, err
+	}
+
+	previousHashes := []string{user.PasswordHash}
+	if policy.HistorySize > 1 {
+		var history []string
+		err := s.db.Model(&models.PasswordHistory{}).
+			Where("user_id = ?", user.ID).
+			Order("id DESC").Limit(policy.HistorySize-1).
+			Pluck("password_hash", &history).Error
+		if err != nil {
+			return "", policy, fmt.Errorf("failed to find password history: %v", err)
+		}
+		previousHashes = append(previousHashes, history...)
+	}
+	for _, previousHash := range previousHashes {
+		if previousHash != "" && bcrypt.CompareHashAndPassword([]byte(previousHash), []byte(password)) == nil {
+			return "", policy, &passwords.PolicyError{
+				Violations: []string{fmt.Sprintf("must not be one of your last %d passwords", max(policy.HistorySize, 1))},
+			}
+		}
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", policy, fmt.Errorf("failed to hash password: %v", err)
+	}
+	return string(hashedPassword), policy, nil
+}
+
+// recordPasswordHistory keeps the password a user is replacing and drops what the history no longer needs
+func recordPasswordHistory(tx *gorm.DB, user *models.User, historySize int) error {
+	if user.PasswordHash != "" {
+		if err := tx.Create(&models.PasswordHistory{UserID: user.ID, PasswordHash: user.PasswordHash}).Error; err != nil {
+			return fmt.Errorf("failed to record password history: %v", err)
+		}
+	}
+
+	var keptIds []uint
+	err := tx.Model(&models.PasswordHistory{}).
+		Where("user_id = ?", user.ID).
+		Order("id DESC").Limit(max(historySize-1, 0)).
+		Pluck("id", &keptIds).Error
+	if err == nil {
+		query := tx.Unscoped().Where("user_id = ?", user.ID)
+		if len(keptIds) > 0 {
+			query = query.Where("id NOT IN ?", keptIds)
+		}
+		err = query.Delete(&models.PasswordHistory{}).Error
+	}
+	if err != nil {
+		return fmt.Errorf("failed to prune password history: %v", err)
+	}
+	return nil
+}
+
+// personalWords returns what a user's password must not contain
+func personalWords(user *models.User) []string {
+	return []string{user.FirstName, user.MiddleName, user.LastName, user.CommonName, user.PrimaryEmailAddress, user.BackupEmailAddress}
+}
+
+// SetUserPhoto handles uploading user's profile photo.
+// The upload is decoded and re-encoded (which strips EXIF and any other metadata)
+// and thumb, medium and large renditions are generated (see global.PHOTO_SIZES).
+func (s *UserService) SetUserPhoto(userId uint, file *multipart.FileHeader, c *gin.Context) (*models.User, error) {
+	user, err := s.userRepo.FindByID(userId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find user: %v", err)
 	}
 
-	//Ensure the upload directory exists
-	uploadDir := filepath.Join(global.UPLOAD_DIRECTORY, "photos")
-	if err :=  os.MkdirAll(uploadDir, 0755); err != nil {
-		return fmt.Errorf("failed to create upload directory: %v", err)
+	// check file size
+	if file.Size > global.PHOTO_FILE_SIZE_LIMIT {
+		return nil, fmt.Errorf("%w (max %d bytes)", ErrPhotoTooLarge, global.PHOTO_FILE_SIZE_LIMIT)
 	}
 
-	// Save the file
-	dest := filepath.Join(uploadDir, fileName)
 	src, err := file.Open()
 	if err != nil {
-		return fmt.Errorf("failed to open uploaded file: %v", err)
+		return nil, fmt.Errorf("failed to open uploaded file: %v", err)
 	}
 	defer src.Close()
 
-	out, err := os.Create(dest)
+	data, err := io.ReadAll(io.LimitReader(src, global.PHOTO_FILE_SIZE_LIMIT+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read uploaded file: %v", err)
+	}
+	if len(data) > global.PHOTO_FILE_SIZE_LIMIT {
+		return nil, fmt.Errorf("%w (max %d bytes)", ErrPhotoTooLarge, global.PHOTO_FILE_SIZE_LIMIT)
+	}
+
+	// Never trust the client supplied Content-Type
+	detectedType := utils.DetectMimeType(data)
+	if !utils.IsRasterImage(detectedType) {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedPhotoType, detectedType)
+	}
+
+	img, err := utils.DecodeImage(data)
 	if err != nil {
-		return fmt.Errorf("failed to create destination file: %v", err)
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedPhotoType, err)
+	}
+
+	// Photos are stored as JPEG unless the source may carry transparency
+	mimeType, extension := "image/jpeg", ".jpg"
+	encode := func(img image.Image) ([]byte, error) { return utils.EncodeJPEG(img, 85) }
+	if detectedType != "image/jpeg" {
+		mimeType, extension = "image/png", ".png"
+		encode = utils.EncodePNG
 	}
-	defer out.Close()
 
-	_, err = io.Copy(out, src)
+	// Every upload gets a fresh version directory so cached renditions of the old photo are never served
+	version, err := generateRandomToken(8)
 	if err != nil {
-		return fmt.Errorf("failed to copy file: %v", err)
+		return nil, fmt.Errorf("failed to generate photo version: %v", err)
+	}
+	userPrefix := fmt.Sprintf("%s%d/", photoKeyPrefix, user.ID)
+	versionPrefix := userPrefix + version + "/"
+
+	renditions := map[string]int{"original": global.PHOTO_MAX_DIMENSION}
+	for sizeName, maxSize := range global.PHOTO_SIZES {
+		renditions[sizeName] = maxSize
+	}
+
+	store := storage.Default()
+	ctx := c.Request.Context()
+	keys := map[string]string{}
+	for sizeName, maxSize := range renditions {
+		encoded, err := encode(utils.ResizeToFit(img, maxSize))
+		if err != nil {
+			return nil, err
+		}
+		key := versionPrefix + sizeName + extension
+		if err := store.Put(ctx, key, bytes.NewReader(encoded), int64(len(encoded)), mimeType); err != nil {
+			return nil, fmt.Errorf("failed to save %s photo: %v", sizeName, err)
+		}
+		keys[sizeName] = key
 	}
 
 	// Update user record
-	user.Photo = fileName
-	user.PhotoMimeType = file.Header.Get("Content-Type")
-	err = s.userRepo.Update(user)
+	err = s.userRepo.CreateQueryBuilder().
+		Where("id = ?", user.ID).
+		Updates(map[string]any{
+			"photo":              keys["original"],
+			"photo_mime_type":    mimeType,
+			"photo_thumb_url":    keys["thumb"],
+			"photo_medium_url":   keys["medium"],
+			"photo_large_url":    keys["large"],
+			"photo_original_url": keys["original"],
+		}).Error
 	if err != nil {
-		return fmt.Errorf("failed to update user photo info: %v", err)
+		return nil, fmt.Errorf("failed to update user photo info: %v", err)
 	}
 
-	return nil
+	// Clean up renditions of previous photos
+	if err := s.deletePhotoFiles(ctx, user, versionPrefix); err != nil {
+		fmt.Printf("Warning: failed to remove previous photos of user %d: %v\n", user.ID, err)
+	}
 
+	user.Photo = keys["original"]
+	user.PhotoMimeType = mimeType
+	user.PhotoThumbURL = keys["thumb"]
+	user.PhotoMediumURL = keys["medium"]
+	user.PhotoLargeURL = keys["large"]
+	user.PhotoOriginalURL = keys["original"]
+
+	return user, nil
 }
 
-// GetUserPhoto serves a user's photo
-func (s *UserService) GetUserPhoto(userId uint, c *gin.Context) error {
+// GetUserPhoto serves a user's photo in the requested size (thumb, medium, large or original)
+func (s *UserService) GetUserPhoto(userId uint, size string, c *gin.Context) error {
 	user, err := s.userRepo.FindByID(userId)
 	if err != nil {
 		return fmt.Errorf("failed to find user: %v", err)
 	}
 
+	// The URL is signed and short lived, so keep it out of shared caches
+	c.Header("Cache-Control", "private, max-age=3600")
+
 	// If no photo, use default
-	if user.Photo == "" {
-		c.File(filepath.Join(global.UPLOAD_DIRECTORY, "photos", "blankPhotoAvatar.png"))
-		return nil
+	key := photoKey(user, size)
+	if key == "" {
+		return serveDefaultPhoto(c)
 	}
 
-	// Serve photo file
-	photoPath := filepath.Join(global.UPLOAD_DIRECTORY, "photos", user.Photo)
-	if _, err := os.Stat(photoPath); os.IsNotExist(err) {
+	// Serve photo file. Conditional requests are answered with 304 using the stored ETag
+	err = storage.ServeFile(c, storage.Default(), key, user.PhotoMimeType)
+	if errors.Is(err, storage.ErrNotFound) {
 		// File doesn't exist, use default
-		c.File(filepath.Join(global.UPLOAD_DIRECTORY, "photos", "blankPhotoAvatar.png"))
-		return nil
+		return serveDefaultPhoto(c)
+	}
+	return err
+}
+
+// GetUserPhotoURL returns a signed, expiring URL for a user's photo in the requested size
+func (s *UserService) GetUserPhotoURL(userId uint, size string) (string, time.Time, error) {
+	if _, err := s.userRepo.FindByID(userId); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to find user: %w", err)
+	}
+
+	photoURL, expiresAt := storage.DefaultSigner().Sign(fmt.Sprintf("/users/%d/photo", userId),
+		url.Values{"size": {size}}, storage.SignOptions{})
+	return photoURL, expiresAt, nil
+}
+
+// DeleteUserPhoto removes a user's photos and clears the photo info
+func (s *UserService) DeleteUserPhoto(userId uint, c *gin.Context) error {
+	user, err := s.userRepo.FindByID(userId)
+	if err != nil {
+		return fmt.Errorf("failed to find user: %v", err)
+	}
+
+	if err := s.deletePhotoFiles(c.Request.Context(), user, ""); err != nil {
+		return fmt.Errorf("failed to delete photo: %v", err)
+	}
+
+	err = s.userRepo.CreateQueryBuilder().
+		Where("id = ?", userId).
+		Updates(map[string]any{
+			"photo":              "",
+			"photo_mime_type":    "",
+			"photo_thumb_url":    "",
+			"photo_medium_url":   "",
+			"photo_large_url":    "",
+			"photo_original_url": "",
+		}).Error
+	if err != nil {
+		return fmt.Errorf("failed to update user photo info: %v", err)
+	}
+
+	return nil
+}
+
+// deletePhotoFiles removes all stored photo files of a user except those under keepPrefix
+func (s *UserService) deletePhotoFiles(ctx context.Context, user *models.User, keepPrefix string) error {
+	store := storage.Default()
+
+	if key := legacyPhotoKey(user); key != "" {
+		if err := store.Delete(ctx, key); err != nil {
+			return err
+		}
 	}
 
-	c.Header("Content-Type", user.PhotoMimeType)
-	c.File(photoPath)
+	objects, err := store.List(ctx, fmt.Sprintf("%s%d/", photoKeyPrefix, user.ID))
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if keepPrefix != "" && strings.HasPrefix(object.Key, keepPrefix) {
+			continue
+		}
+		if err := store.Delete(ctx, object.Key); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// photoKey returns the storage key of the requested photo size, or "" if the user has no photo
+func photoKey(user *models.User, size string) string {
+	var key string
+	switch size {
+	case "thumb":
+		key = user.PhotoThumbURL
+	case "medium":
+		key = user.PhotoMediumURL
+	case "large":
+		key = user.PhotoLargeURL
+	}
+	if key == "" {
+		key = user.PhotoOriginalURL
+	}
+	if key == "" {
+		key = legacyPhotoKey(user)
+	}
+	return key
+}
+
+// legacyPhotoKey returns the storage key of a photo uploaded before renditions were introduced, or ""
+// if there is none. Those live directly under photoKeyPrefix and Photo is their file name: anything
+// else in it (a path, "..") is not a photo of ours.
+func legacyPhotoKey(user *models.User) string {
+	name := user.Photo
+	if name == "" || name == "." || name == ".." || name != path.Base(name) || strings.Contains(name, "\\") {
+		return ""
+	}
+	return photoKeyPrefix + name
+}
+
+// photoKeyPrefix is where user photos live in storage
+const photoKeyPrefix = "photos/"
+
+func serveDefaultPhoto(c *gin.Context) error {
+	err := storage.ServeFile(c, storage.Default(), photoKeyPrefix+"blankPhotoAvatar.png", "image/png")
+	if errors.Is(err, storage.ErrNotFound) {
+		c.Status(http.StatusNotFound)
+		return nil
+	}
+	return err
+}
+
 // generateRandomToken generates a random token for password reset or email verification
 func generateRandomToken(length int) (string, error) {
 	b := make([]byte, length)
@@ -656,323 +1088,894 @@ func generateRandomToken(length int) (string, error) {
 }
 
 
-// ResetPasswordRequest sends a password reset link to the user's email
-func (s *UserService) ResetPasswordRequest(email string, c *gin.Context) (*global.GenericNotificationResponse, error) {
-	user, err := s.FindByPrimaryEmailAddress(email)
+// ResetPasswordRequest sends a password reset link to a user's primary email address.
+// The link expires after the PasswordResetExpiration of the user's tenant (tenantId, or the
+// only tenant the user belongs to), global.PASSWORD_RESET_EXPIRATION otherwise.
+func (s *UserService) ResetPasswordRequest(email string, tenantId uint, c *gin.Context) (*global.GenericNotificationResponse, error) {
+	notification := &global.GenericNotificationResponse{
+		NotificationClass:   "is-success",
+		NotificationMessage: fmt.Sprintf("If your email %s is found, you will receive email shortly for password reset", email),
+	}
+
+	var user models.User
+	err := s.userRepo.CreateQueryBuilder().Where("primary_email_address = ?", email).First(&user).Error
 	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// Don't reveal if user exists
+			return notification, nil
+		}
 		return nil, fmt.Errorf("failed to find user: %v", err)
 	}
 
-	if user == nil {
-		return &global.GenericNotificationResponse{
-			NotificationClass:   "is-success",
-			NotificationMessage: fmt.Sprintf("If your email %s is found, you will receive email shortly for password reset", email),
-		}, nil
+	tenant := s.resetPasswordTenant(user.ID, tenantId)
+	expiration := global.PASSWORD_RESET_EXPIRATION
+	if tenant != nil && tenant.TenantConfigDetail.OtherUserOptions != nil && tenant.TenantConfigDetail.OtherUserOptions.PasswordResetExpiration > 0 {
+		expiration = time.Duration(tenant.TenantConfigDetail.OtherUserOptions.PasswordResetExpiration) * time.Second
 	}
 
-	// Generate reset token
-	token, err := generateRandomToken(32)
+	// The token names its user so the hash can be compared in constant time rather than looked up
+	secret, err := generateRandomToken(32)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate token: %v", err)
 	}
+	token := fmt.Sprintf("%d.%s", user.ID, secret)
 
-	// Set token and expiration
-	user.ResetPasswordToken = token
-	user.ResetPasswordExpiration = time.Now().Add(global.PASSWORD_RESET_EXPIRATION)
-
-	// Save user with new token
-	err = s.userRepo.Update(user)
+	// Only the hash is stored; a new request invalidates the previous link
+	err = s.userRepo.CreateQueryBuilder().Where("id = ?", user.ID).Updates(map[string]any{
+		"reset_password_token":      utils.HashToken(token),
+		"reset_password_expiration": time.Now().Add(expiration),
+	}).Error
 	if err != nil {
 		return nil, fmt.Errorf("failed to save reset token: %v", err)
 	}
 
 	// Build reset URL with proper protocol and URL structure
-    var globalPrefixUrl string
-    if global.USE_API_VERSION_IN_URL {
-        globalPrefixUrl = fmt.Sprintf("/%s", global.API_VERSION)
-    } else {
-        globalPrefixUrl = ""
-    }
+	var globalPrefixUrl string
+	if global.USE_API_VERSION_IN_URL {
+		globalPrefixUrl = fmt.Sprintf("/%s", global.API_VERSION)
+	}
+	resetURL, err := AppURL(c, fmt.Sprintf("%s/users/reset-password/%s", globalPrefixUrl, token))
+	if err != nil {
+		return nil, err
+	}
 
-    // Use protocol from request or fallback to configured protocol
-    protocol := c.Request.URL.Scheme
-    if protocol == "" {
-        protocol = global.PROTOCOL // Fallback to default protocol
-    }
+	// Prepare email content, branded for the tenant if there is one
+	locale := mail.LocaleFromRequest(c)
+	scope := mail.Scope{Locale: locale}
+	if tenant != nil {
+		if tenantScope, err := mail.NewMailService().ScopeForTenantId(tenant.ID, locale); err == nil {
+			scope = tenantScope
+		}
+	}
+	err = sendTemplatedMail("reset-password", user.PrimaryEmailAddress, scope, map[string]any{
+		"FirstName": user.FirstName,
+		"URL":       resetURL,
+		"ExpiresIn": mail.FormatDuration(expiration, locale),
+	})
+	// An address that bounced gets the same answer as any other: don't tell who has an account
+	if err != nil && !errors.Is(err, mail.ErrRecipientsSuppressed) {
+		return nil, err
+	}
 
-    resetURL := fmt.Sprintf("%s://%s%s/users/reset-password/%s",
-        protocol,
-        c.Request.Host,
-        globalPrefixUrl,
-        token)
+	return notification, nil
+}
 
-	// Prepare email content
-	mailText := strings.Replace(global.ResetPasswordMailOptionSettings.TextTemplate, "{url}", resetURL, -1)
+/* Magic link sign-in */
 
-	// Configure mail options
-    mailOptions := global.MailOptions{
-        To:      user.PrimaryEmailAddress,
-        From:    global.ResetPasswordMailOptionSettings.From,
-        Subject: global.ResetPasswordMailOptionSettings.Subject,
-        Text:    mailText,
-    }
+// MagicLinkRequest emails a user a single-use link to sign in to a tenant without a password,
+// if the tenant has AuthEnabled.MagicLink. tenantId may be 0 for users on a single team.
+// Like ResetPasswordRequest, the answer does not tell whether the address has an account.
+// A new request invalidates the previous link.
+func (s *UserService) MagicLinkRequest(email string, tenantId uint, c *gin.Context) (*global.GenericNotificationResponse, error) {
+	notification := &global.GenericNotificationResponse{
+		NotificationClass:   "is-success",
+		NotificationMessage: fmt.Sprintf("If your email %s is found, you will receive a sign-in link shortly", email),
+	}
+
+	// Whether a tenant allows it is no secret, unlike who has an account
+	if tenantId != 0 {
+		var tenant models.Tenant
+		if err := s.tenantRepo.CreateQueryBuilder().Preload("TenantConfigDetail").First(&tenant, tenantId).Error; err != nil || !magicLinkEnabled(&tenant) {
+			return nil, ErrMagicLinkDisabled
+		}
+	}
+
+	var user models.User
+	err := s.userRepo.CreateQueryBuilder().Where("primary_email_address = ?", email).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return notification, nil
+		}
+		return nil, fmt.Errorf("failed to find user: %v", err)
+	}
+	tenant := s.resetPasswordTenant(user.ID, tenantId)
+	if tenant == nil || !magicLinkEnabled(tenant) {
+		return notification, nil
+	}
+
+	secret, err := generateRandomToken(32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %v", err)
+	}
+	now := time.Now()
+	link := &models.MagicLink{
+		UserID:    user.ID,
+		TenantID:  tenant.ID,
+		TokenHash: utils.HashToken(secret),
+		ExpiresAt: now.Add(global.MAGIC_LINK_EXPIRATION),
+		IPAddress: c.ClientIP(),
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.MagicLink{}).
+			Where("user_id = ? AND used_at IS NULL AND expires_at > ?", user.ID, now).
+			Update("expires_at", now).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(link).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save sign-in link: %v", err)
+	}
 
-	// Send email asynchronously
-    global.SendMailAsync(mailOptions)
+	// The token names its link so the hash can be compared in constant time rather than looked up
+	token := fmt.Sprintf("%d.%s", link.ID, secret)
+	linkURL, err := AppURL(c, global.MAGIC_LINK_CLIENT_PATH+"?token="+url.QueryEscape(token))
+	if err != nil {
+		return nil, err
+	}
+
+	locale := mail.LocaleFromRequest(c)
+	scope := mail.Scope{Locale: locale}
+	if tenantScope, err := mail.NewMailService().ScopeForTenantId(tenant.ID, locale); err == nil {
+		scope = tenantScope
+	}
+	err = sendTemplatedMail("magic-link", user.PrimaryEmailAddress, scope, map[string]any{
+		"FirstName": user.FirstName,
+		"URL":       linkURL,
+		"ExpiresIn": mail.FormatDuration(global.MAGIC_LINK_EXPIRATION, locale),
+	})
+	if err != nil && !errors.Is(err, mail.ErrRecipientsSuppressed) {
+		return nil, err
+	}
 
-    return &global.GenericNotificationResponse{
-        NotificationClass:   "is-success",
-        NotificationMessage: fmt.Sprintf("If your email %s is found, you will receive email shortly for password reset", email),
-    }, nil
+	return notification, nil
 }
 
-// ResetPassword handles the password reset process
-func (s *UserService) ResetPassword(token string, newPassword *string,  c *gin.Context)  error {
-	// Find user by reset token
-	var user models.User
+// UseMagicLink uses up a sign-in link and returns its user and the tenant it signs in to
+func (s *UserService) UseMagicLink(token string) (*models.User, uint, error) {
+	separator := strings.Index(token, ".")
+	if separator <= 0 {
+		return nil, 0, ErrInvalidMagicLink
+	}
+	linkId, err := strconv.ParseUint(token[:separator], 10, 32)
+	if err != nil {
+		return nil, 0, ErrInvalidMagicLink
+	}
+
+	var link models.MagicLink
+	if err := s.magicLinkRepo.CreateQueryBuilder().First(&link, uint(linkId)).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, 0, ErrInvalidMagicLink
+		}
+		return nil, 0, fmt.Errorf("failed to find sign-in link: %v", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(utils.HashToken(token[separator+1:])), []byte(link.TokenHash)) != 1 || link.UsedAt != nil {
+		return nil, 0, ErrInvalidMagicLink
+	}
+	if !link.ExpiresAt.After(time.Now()) {
+		return nil, 0, ErrMagicLinkExpired
+	}
+
+	// Conditional, so two concurrent uses cannot both sign in
+	result := s.magicLinkRepo.CreateQueryBuilder().Where("id = ? AND used_at IS NULL", link.ID).Update("used_at", time.Now())
+	if result.Error != nil {
+		return nil, 0, fmt.Errorf("failed to use sign-in link: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, 0, ErrInvalidMagicLink
+	}
+
+	// The tenant may have turned sign-in links off since it was sent
+	var tenant models.Tenant
+	if err := s.tenantRepo.CreateQueryBuilder().Preload("TenantConfigDetail").First(&tenant, link.TenantID).Error; err != nil || !magicLinkEnabled(&tenant) {
+		return nil, 0, ErrMagicLinkDisabled
+	}
+	user, err := s.FindById(link.UserID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return user, link.TenantID, nil
+}
+
+func magicLinkEnabled(tenant *models.Tenant) bool {
+	return tenant.TenantConfigDetail.AuthEnabled != nil && tenant.TenantConfigDetail.AuthEnabled.MagicLink
+}
+
+// resetPasswordTenant returns the tenant whose settings apply to a user's password reset:
+// tenantId if the user is on its team, else the user's only tenant. nil if there is none.
+func (s *UserService) resetPasswordTenant(userId uint, tenantId uint) *models.Tenant {
+	var tenantIds []uint
+	err := s.tenantTeamRepo.CreateQueryBuilder().Where("user_id = ?", userId).Pluck("tenant_id", &tenantIds).Error
+	if err != nil {
+		return nil
+	}
+
+	selected := uint(0)
+	for _, id := range tenantIds {
+		if id == tenantId {
+			selected = id
+		}
+	}
+	if selected == 0 && tenantId == 0 && len(tenantIds) == 1 {
+		selected = tenantIds[0]
+	}
+	if selected == 0 {
+		return nil
+	}
+
+	var tenant models.Tenant
+	if err := s.tenantRepo.CreateQueryBuilder().Preload("TenantConfigDetail").First(&tenant, selected).Error; err != nil {
+		return nil
+	}
+	return &tenant
+}
+
+// IsTeamMember tells whether a user is on the team of a tenant
+func (s *UserService) IsTeamMember(userId uint, tenantId uint) (bool, error) {
+	var count int64
+	err := s.tenantTeamRepo.CreateQueryBuilder().Where("user_id = ? AND tenant_id = ?", userId, tenantId).Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("failed to check tenant team: %v", err)
+	}
+	return count > 0, nil
+}
+
+// HasTenantRole tells whether a user is on the team of a tenant with a role
+func (s *UserService) HasTenantRole(userId uint, tenantId uint, role global.TenantTeamRole) (bool, error) {
+	var count int64
+	err := s.tenantTeamRepo.CreateQueryBuilder().
+		Where("user_id = ? AND tenant_id = ? AND ?::tenant_team_role = ANY(roles)", userId, tenantId, string(role)).
+		Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("failed to check tenant team: %v", err)
+	}
+	return count > 0, nil
+}
+
+// HasAccountOfficerRole tells whether a user is an account officer of a tenant with a role
+func (s *UserService) HasAccountOfficerRole(userId uint, tenantId uint, role global.TenantAccountOfficerRole) (bool, error) {
+	var count int64
+	err := s.tenantAccountOfficerRepo.CreateQueryBuilder().
+		Where("user_id = ? AND tenant_id = ? AND ?::tenant_account_officer_role = ANY(roles)", userId, tenantId, string(role)).
+		Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("failed to check tenant account officers: %v", err)
+	}
+	return count > 0, nil
+}
+
+// FindTenantAdmins returns the users on the team of a tenant with the Admin role
+func (s *UserService) FindTenantAdmins(tenantId uint) ([]models.User, error) {
+	var admins []models.User
 	err := s.userRepo.CreateQueryBuilder().
-		Where("reset_password_token = ?", token).First(&user).Error
+		Joins("JOIN tenant_teams ON tenant_teams.user_id = users.id AND tenant_teams.deleted_at IS NULL").
+		Where("tenant_teams.tenant_id = ? AND ?::tenant_team_role = ANY(tenant_teams.roles)", tenantId, string(global.A)).
+		Find(&admins).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to find tenant admins: %v", err)
+	}
+	return admins, nil
+}
 
+// findByResetPasswordToken returns the user a reset token was issued to, if it is still valid.
+// The stored hash is compared in constant time.
+func (s *UserService) findByResetPasswordToken(token string) (*models.User, error) {
+	separator := strings.Index(token, ".")
+	if separator <= 0 {
+		return nil, ErrInvalidResetToken
+	}
+	userId, err := strconv.ParseUint(token[:separator], 10, 32)
 	if err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return fmt.Errorf("invalid token")
+		return nil, ErrInvalidResetToken
+	}
+
+	var user models.User
+	if err := s.userRepo.CreateQueryBuilder().First(&user, uint(userId)).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidResetToken
 		}
-		return fmt.Errorf("error finding user: %v", err)
+		return nil, fmt.Errorf("error finding user: %v", err)
+	}
+	if user.ResetPasswordToken == "" ||
+		subtle.ConstantTimeCompare([]byte(utils.HashToken(token)), []byte(user.ResetPasswordToken)) != 1 {
+		return nil, ErrInvalidResetToken
+	}
+	if user.ResetPasswordExpiration.Before(time.Now()) {
+		return nil, ErrResetTokenExpired
 	}
+	return &user, nil
+}
 
-	// Check token expiration
-    if user.ResetPasswordExpiration.Before(time.Now()) {
-        // Token expired - render view with error message
-        c.HTML(http.StatusOK, "users/reset-password.html", gin.H{
-            "title":                fmt.Sprintf("%s - Reset Password", global.APP_NAME),
-            "sendForm":             false,
-            "notificationVisibility": "",
-            "notificationClass":    "is-danger",
-            "notificationMessage":  "Invalid token: expired",
-        })
-        return nil
-    }
+// ResetPassword handles the password reset process: without newPassword it renders the
+// reset form, with it it sets the new password. The token can only be used once; every
+// session of the user is signed out.
+func (s *UserService) ResetPassword(token string, newPassword *string, c *gin.Context) error {
+	user, err := s.findByResetPasswordToken(token)
+	if errors.Is(err, ErrInvalidResetToken) || errors.Is(err, ErrResetTokenExpired) {
+		c.HTML(http.StatusOK, "users/reset-password.html", gin.H{
+			"title":                  fmt.Sprintf("%s - Reset Password", global.APP_NAME),
+			"sendForm":               false,
+			"notificationVisibility": "",
+			"notificationClass":      "is-danger",
+			"notificationMessage":    fmt.Sprintf("Invalid token: %v", err),
+		})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// The form posts back to the link
+	var globalPrefixUrl string
+	if global.USE_API_VERSION_IN_URL {
+		globalPrefixUrl = fmt.Sprintf("/%s", global.API_VERSION)
+	}
+	returnUrl := fmt.Sprintf("%s/users/reset-password/%s", globalPrefixUrl, token)
 
 	// If newPassword is provided, update user's password
-    if newPassword != nil {
-        // Hash the new password
-        hashedPassword, err := bcrypt.GenerateFromPassword([]byte(*newPassword), bcrypt.DefaultCost)
-        if err != nil {
-            return fmt.Errorf("failed to hash password: %v", err)
-        }
+	if newPassword != nil {
+		hashedPassword, policy, err := s.hashNewPassword(user, *newPassword)
+		var policyError *passwords.PolicyError
+		if errors.As(err, &policyError) {
+			// Show the form again with what is wrong with the password
+			c.HTML(http.StatusOK, "users/reset-password.html", gin.H{
+				"title":                  fmt.Sprintf("%s - Reset Password", global.APP_NAME),
+				"sendForm":               true,
+				"returnUrl":              returnUrl,
+				"notificationVisibility": "",
+				"notificationClass":      "is-danger",
+				"notificationMessage":    fmt.Sprintf("The new password %s", strings.Join(policyError.Violations, ", ")),
+			})
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = s.db.Transaction(func(tx *gorm.DB) error {
+			// Conditional on the token so two submissions of the same link cannot both succeed
+			result := tx.Model(&models.User{}).
+				Where("id = ? AND reset_password_token = ?", user.ID, user.ResetPasswordToken).
+				Updates(map[string]any{
+					"password_hash":               hashedPassword,
+					"reset_password_token":        "",
+					"reset_password_expiration":   time.Time{},
+					"is_password_change_required": false,
+				})
+			if result.Error != nil {
+				return fmt.Errorf("failed to update user password: %v", result.Error)
+			}
+			if result.RowsAffected == 0 {
+				return ErrInvalidResetToken
+			}
+			if _, err := sessions.RevokeAllTx(tx, user.ID, 0, sessions.RevokedByPasswordSet); err != nil {
+				return err
+			}
+			return recordPasswordHistory(tx, user, policy.HistorySize)
+		})
+		if err != nil {
+			return err
+		}
+		// The reset proves the user owns the account: lift a lockout after failed sign-ins
+		if err := throttle.LoginAccounts.Reset(user.PrimaryEmailAddress); err != nil {
+			log.Printf("Error unlocking user %d after password reset: %v", user.ID, err)
+		}
 
-        // Update user with new password and clear reset token fields
-        user.PasswordHash = string(hashedPassword)
-        user.ResetPasswordToken = ""
-        user.ResetPasswordExpiration = time.Time{} // Clear expiration
+		// Password successfully changed - render success view
+		c.HTML(http.StatusOK, "users/reset-password.html", gin.H{
+			"title":                  fmt.Sprintf("%s - Reset Password", global.APP_NAME),
+			"sendForm":               false,
+			"notificationVisibility": "",
+			"notificationClass":      "is-success",
+			"notificationMessage":    "New password successfully saved",
+		})
+		return nil
+	}
 
-        err = s.userRepo.Update(&user)
-        if err != nil {
-            return fmt.Errorf("failed to update user password: %v", err)
-        }
+	// No password provided yet, show the password reset form
+	c.HTML(http.StatusOK, "users/reset-password.html", gin.H{
+		"title":                  fmt.Sprintf("%s - Reset Password", global.APP_NAME),
+		"sendForm":               true,
+		"returnUrl":              returnUrl,
+		"notificationVisibility": "is-hidden",
+	})
 
-        // Password successfully changed - render success view
-        c.HTML(http.StatusOK, "users/reset-password.html", gin.H{
-            "title":                fmt.Sprintf("%s - Reset Password", global.APP_NAME),
-            "sendForm":             false,
-            "notificationVisibility": "",
-            "notificationClass":    "is-success",
-            "notificationMessage":  "New password successfully saved",
-        })
+	return nil
+}
 
-        // Consider sending confirmation email here (optional)
-        // s.sendPasswordChangedConfirmation(user.PrimaryEmailAddress, c)
+/* LOCKOUT */
 
-        return nil
-    }
+// NotifyAccountLocked tells a user the account was locked out after too many failed sign-in attempts
+func (s *UserService) NotifyAccountLocked(user *models.User, lockedFor time.Duration, c *gin.Context) error {
+	locale := mail.LocaleFromRequest(c)
+	err := sendTemplatedMail("account-locked", user.PrimaryEmailAddress, mail.Scope{Locale: locale}, map[string]any{
+		"FirstName": user.FirstName,
+		"IPAddress": c.ClientIP(),
+		"LockedFor": mail.FormatDuration(lockedFor, locale),
+	})
+	if err != nil && !errors.Is(err, mail.ErrRecipientsSuppressed) {
+		return err
+	}
+	return nil
+}
 
-	// No password provided yet, show the password reset form
-    var globalPrefixUrl string
-    if global.USE_API_VERSION_IN_URL {
-        globalPrefixUrl = fmt.Sprintf("/%s", global.API_VERSION)
-    } else {
-        globalPrefixUrl = ""
-    }
+// NotifyImpersonation tells the admins of the tenant that a landlord user started impersonating one of its users
+func (s *UserService) NotifyImpersonation(impersonation *models.Impersonation, impersonator *models.User, user *models.User, c *gin.Context) error {
+	admins, err := s.FindTenantAdmins(impersonation.TenantID)
+	if err != nil {
+		return err
+	}
+	locale := mail.LocaleFromRequest(c)
+	scope := mail.Scope{Locale: locale}
+	if tenantScope, err := mail.NewMailService().ScopeForTenantId(impersonation.TenantID, locale); err == nil {
+		scope = tenantScope
+	}
+	for _, admin := range admins {
+		err := sendTemplatedMail("impersonation-started", admin.PrimaryEmailAddress, scope, map[string]any{
+			"FirstName":         admin.FirstName,
+			"ImpersonatorName":  strings.TrimSpace(impersonator.FirstName + " " + impersonator.LastName),
+			"ImpersonatorEmail": impersonator.PrimaryEmailAddress,
+			"UserName":          strings.TrimSpace(user.FirstName + " " + user.LastName),
+			"UserEmail":         user.PrimaryEmailAddress,
+			"Reason":            impersonation.Reason,
+			"ExpiresIn":         mail.FormatDuration(time.Until(impersonation.ExpiresAt).Round(time.Minute), locale),
+		})
+		if err != nil && !errors.Is(err, mail.ErrRecipientsSuppressed) {
+			return err
+		}
+	}
+	return nil
+}
 
-    returnUrl := fmt.Sprintf("%s/users/reset-password/%s", globalPrefixUrl, token)
+// UnlockAccount lifts the lockout of a user's account and tells the user
+func (s *UserService) UnlockAccount(userId uint, c *gin.Context) (*models.User, error) {
+	user, err := s.userRepo.FindByID(userId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find user: %v", err)
+	}
+	lockedUntil, err := throttle.LoginAccounts.LockedUntil(user.PrimaryEmailAddress)
+	if err != nil {
+		return nil, err
+	}
+	if err := throttle.LoginAccounts.Reset(user.PrimaryEmailAddress); err != nil {
+		return nil, err
+	}
 
-    c.HTML(http.StatusOK, "users/reset-password.html", gin.H{
-        "title":                fmt.Sprintf("%s - Reset Password", global.APP_NAME),
-        "sendForm":             true,
-        "returnUrl":            returnUrl,
-        "notificationVisibility": "is-hidden",
-    })
+	if !lockedUntil.IsZero() {
+		err = sendTemplatedMail("account-unlocked", user.PrimaryEmailAddress, mail.Scope{Locale: mail.LocaleFromRequest(c)}, map[string]any{
+			"FirstName": user.FirstName,
+		})
+		if err != nil && !errors.Is(err, mail.ErrRecipientsSuppressed) {
+			log.Printf("Error sending unlock notice to user %d: %v", user.ID, err)
+		}
+	}
 
-    return nil
+	user.Sanitize()
+	return user, nil
 }
 
 
-// ConfirmEmailRequest sends an email verification link
+// ConfirmEmailRequest sends a verification link to a user's primary or backup email address.
+// The user is found by userId if it is not 0, otherwise by the address itself.
+// Only the hash of the token is stored; the link carries the token.
 func (s *UserService) ConfirmEmailRequest(email *string, userId uint, isPrimary bool, c *gin.Context) (*global.GenericNotificationResponse, error) {
-	var user *models.User
-	var err error
+	notification := &global.GenericNotificationResponse{
+		NotificationClass:   "is-info",
+		NotificationMessage: "If valid user, you will receive email shortly for verification",
+	}
 
-	// Find user by ID or email
-    if userId > 0 {
-        user, err = s.userRepo.FindByID(userId)
-    } else if email != nil {
-        if isPrimary {
-            user, err = s.FindByPrimaryEmailAddress(*email)
-        } else {
-            // Find by backup email address
-            var foundUser models.User
-            err = s.userRepo.CreateQueryBuilder().
-                Where("backup_email_address = ?", *email).
-                First(&foundUser).Error
-            if err == nil {
-                user = &foundUser
-            }
-        }
-    } else {
-        return nil, fmt.Errorf("either email or userId must be provided")
-    }
-	if err != nil {
-        return nil, fmt.Errorf("error finding user: %v", err)
-    }
+	var user models.User
+	query := s.userRepo.CreateQueryBuilder()
+	switch {
+	case userId > 0:
+		query = query.Where("id = ?", userId)
+	case email != nil && isPrimary:
+		query = query.Where("primary_email_address = ?", *email)
+	case email != nil:
+		query = query.Where("backup_email_address = ?", *email)
+	default:
+		return nil, fmt.Errorf("either email or userId must be provided")
+	}
+	if err := query.First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// Don't reveal if user exists
+			return notification, nil
+		}
+		return nil, fmt.Errorf("error finding user: %v", err)
+	}
 
-	if user == nil {
-        // Don't reveal if user exists
-        return &global.GenericNotificationResponse{
-            NotificationClass:   "is-info",
-            NotificationMessage: "If valid user, you will receive email shortly for verification",
-        }, nil
-    }
+	recipientEmail, endpoint := user.PrimaryEmailAddress, "confirm-primary-email"
+	alreadyVerified := user.IsPrimaryEmailVerified
+	if !isPrimary {
+		recipientEmail, endpoint = user.BackupEmailAddress, "confirm-backup-email"
+		alreadyVerified = user.IsBackupEmailVerified
+	}
+	if recipientEmail == "" || alreadyVerified {
+		return notification, nil
+	}
 
 	// Generate verification token
-    token, err := generateRandomToken(32)
-    if err != nil {
-        return nil, fmt.Errorf("failed to generate token: %v", err)
-    }
+	token, err := generateRandomToken(32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %v", err)
+	}
 
-	if isPrimary {
-        user.PrimaryEmailVerificationToken = token
-    } else {
-        user.BackupEmailVerificationToken = token
-    }
+	expiration := time.Now().Add(global.EMAIL_VERIFICATION_EXPIRATION)
+	updates := map[string]any{
+		"primary_email_verification_token":    utils.HashToken(token),
+		"email_verification_token_expiration": expiration,
+	}
+	if !isPrimary {
+		updates = map[string]any{
+			"backup_email_verification_token":            utils.HashToken(token),
+			"backup_email_verification_token_expiration": expiration,
+		}
+	}
+	if err := s.userRepo.CreateQueryBuilder().Where("id = ?", user.ID).Updates(updates).Error; err != nil {
+		return nil, fmt.Errorf("failed to save user: %v", err)
+	}
 
-	// Set expiration time for the token
-	user.EmailVerificationTokenExpiration = time.Now().Add(global.EMAIL_VERIFICATION_EXPIRATION)
+	// Get API version prefix if needed
+	var globalPrefixUrl string
+	if global.USE_API_VERSION_IN_URL {
+		globalPrefixUrl = fmt.Sprintf("/%s", global.API_VERSION)
+	}
+	verificationURL, err := AppURL(c, fmt.Sprintf("%s/users/%s/%s", globalPrefixUrl, endpoint, token))
+	if err != nil {
+		return nil, err
+	}
 
-	// Save the user with the new token
-	_, err = s.userRepo.Save(user)
+	// Prepare email content
+	locale := mail.LocaleFromRequest(c)
+	message, err := mail.Render("confirm-email", map[string]any{
+		"FirstName": user.FirstName,
+		"URL":       verificationURL,
+		"ExpiresIn": mail.FormatDuration(global.EMAIL_VERIFICATION_EXPIRATION, locale),
+	}, mail.Scope{Locale: locale})
 	if err != nil {
-		return nil, fmt.Errorf("failed to save user: %v", err)
+		return nil, fmt.Errorf("failed to render email: %v", err)
+	}
+
+	// Configure mail options
+	mailOptions := global.MailOptions{
+		To:          recipientEmail,
+		From:        global.MAIL_FROM_ADDRESS,
+		Subject:     message.Subject,
+		Text:        message.Text,
+		Html:        message.HTML,
+		Attachments: message.Inline,
+	}
+
+	// Queue the email; the mail workers retry it until it is delivered
+	if _, err := mail.Enqueue(mailOptions, mail.EnqueueOptions{Template: "confirm-email"}); err != nil {
+		// Same answer for an address that bounced: don't tell who has an account
+		if !errors.Is(err, mail.ErrRecipientsSuppressed) {
+			return nil, err
+		}
+	}
+
+	return notification, nil
+}
+
+// ConfirmEmail confirms an email address with the token of its verification link
+func (s *UserService) ConfirmEmail(token string, isPrimary bool, c *gin.Context) error {
+	if token == "" {
+		return ErrInvalidVerificationToken
 	}
 
-	// Build verification URL
-	var endpoint string
+	var user *models.User
+	var err error
 	if isPrimary {
-		endpoint = "confirm-primary-email"
+		user, err = s.FindByPrimaryEmailVerificationToken(token)
 	} else {
-		endpoint = "confirm-primary-email"
+		user, err = s.FindByBackupEmailVerificationToken(token)
+	}
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return ErrInvalidVerificationToken
 	}
 
+	// Check token expiration, then clear the token: it is single use
+	var updates map[string]any
+	if isPrimary {
+		if user.EmailVerificationTokenExpiration.Before(time.Now()) {
+			return ErrVerificationTokenExpired
+		}
+		updates = map[string]any{
+			"is_primary_email_verified":           true,
+			"primary_email_verification_token":    "",
+			"email_verification_token_expiration": time.Time{},
+		}
+	} else {
+		if user.BackupEmailVerificationTokenExpiration.Before(time.Now()) {
+			return ErrVerificationTokenExpired
+		}
+		updates = map[string]any{
+			"is_backup_email_verified":                   true,
+			"backup_email_verification_token":            "",
+			"backup_email_verification_token_expiration": time.Time{},
+		}
+	}
 
-	// Get API version prefix if needed
-    var globalPrefixUrl string
-    if global.USE_API_VERSION_IN_URL {
-        globalPrefixUrl = fmt.Sprintf("/%s", global.API_VERSION)
-    } else {
-        globalPrefixUrl = ""
-    }
+	err = s.userRepo.CreateQueryBuilder().Where("id = ?", user.ID).Updates(updates).Error
+	if err != nil {
+		return fmt.Errorf("failed to update user: %v", err)
+	}
 
-	// Determine protocol
-    protocol := c.Request.URL.Scheme
-    if protocol == "" {
-        protocol = global.PROTOCOL // Fallback to default protocol
-    }
+	return nil
+}
 
-	verificationURL := fmt.Sprintf("%s://%s%s/users/%s/%s",
-        protocol,
-        c.Request.Host,
-        globalPrefixUrl,
-        endpoint,
-        token)
+// AppURL returns the absolute URL of path on this application, for links in emails and redirects.
+// The base is the APP_TRUSTED_HTTP_URLS entry the request came through, else APP_ROOT_HTTP_URL.
+// The request's Host header alone is never used: anyone could point the links at their own site.
+func AppURL(c *gin.Context, path string) (string, error) {
+	if config.AppConfig == nil || (config.AppConfig.App.RootURL == "" && len(config.AppConfig.App.TrustedURLs) == 0) {
+		return "", ErrNoTrustedURL
+	}
 
-	// Prepare email content
-	mailText := strings.Replace(global.ConfirmEmailMailOptionSettings.TextTemplate, "{url}", verificationURL, -1)
-	//mailHTML := strings.Replace(global.ConfirmEmailMailOptionSettings.HtmlTemplate, "{url}", verificationURL, -1)
+	base := config.AppConfig.App.RootURL
+	for _, trustedURL := range config.AppConfig.App.TrustedURLs {
+		if parsed, err := url.Parse(trustedURL); err == nil && strings.EqualFold(parsed.Host, c.Request.Host) {
+			base = trustedURL
+			break
+		}
+	}
+	if base == "" {
+		base = config.AppConfig.App.TrustedURLs[0]
+	}
+	return strings.TrimRight(base, "/") + path, nil
+}
 
+/* Email change */
 
+// ChangeEmailRequest starts changing a user's primary email address: the new address gets a
+// confirmation link, the current one a notice with a link to undo the change. Nothing changes
+// until the new address is confirmed. With promoteBackup, the backup address becomes the
+// primary one and the primary one the backup.
+// The user must give their current password, else ErrWrongPassword.
+func (s *UserService) ChangeEmailRequest(userId uint, currentPassword string, newEmail string, promoteBackup bool, c *gin.Context) (*global.GenericNotificationResponse, error) {
+	user, err := s.userRepo.FindByID(userId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find user: %v", err)
+	}
+	if user.PasswordHash == "" || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(currentPassword)) != nil {
+		return nil, ErrWrongPassword
+	}
 
-	// Determine recipient email address
-	var recipientEmail string
-	if isPrimary {
-		recipientEmail = user.PrimaryEmailAddress
-	} else {
-		recipientEmail = user.BackupEmailAddress
+	if promoteBackup {
+		if user.BackupEmailAddress == "" {
+			return nil, fmt.Errorf("%w: the user has no backup email address", ErrInvalidEmailAddress)
+		}
+		newEmail = user.BackupEmailAddress
+	}
+	address, err := netmail.ParseAddress(strings.TrimSpace(newEmail))
+	if err != nil || address.Name != "" {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidEmailAddress, newEmail)
+	}
+	newEmail = address.Address
+	if strings.EqualFold(newEmail, user.PrimaryEmailAddress) {
+		return nil, fmt.Errorf("%w: it is already the primary email address", ErrInvalidEmailAddress)
 	}
 
-	// Configure mail options
-    mailOptions := global.MailOptions{
-        To:      recipientEmail,
-    From:    global.ConfirmEmailMailOptionSettings.From,
-    Subject: global.ConfirmEmailMailOptionSettings.Subject,
-    Text:    mailText,
-    //Html:    mailHTML,
-    }
+	var count int64
+	err = s.userRepo.CreateQueryBuilder().
+		Where("id <> ? AND (LOWER(primary_email_address) = LOWER(?) OR LOWER(backup_email_address) = LOWER(?))", user.ID, newEmail, newEmail).
+		Count(&count).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to check email address: %v", err)
+	}
+	if count > 0 {
+		return nil, ErrEmailAddressInUse
+	}
+
+	changeToken, err := generateRandomToken(32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %v", err)
+	}
+	revertToken, err := generateRandomToken(32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %v", err)
+	}
+
+	err = s.userRepo.CreateQueryBuilder().Where("id = ?", user.ID).Updates(map[string]any{
+		"pending_primary_email_address":  newEmail,
+		"email_change_token":             utils.HashToken(changeToken),
+		"email_change_token_expiration":  time.Now().Add(global.EMAIL_VERIFICATION_EXPIRATION),
+		"previous_primary_email_address": user.PrimaryEmailAddress,
+		"email_change_revert_token":      utils.HashToken(revertToken),
+		"email_change_revert_expiration": time.Now().Add(global.EMAIL_CHANGE_REVERT_EXPIRATION),
+	}).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to save user: %v", err)
+	}
+
+	// Get API version prefix if needed
+	var globalPrefixUrl string
+	if global.USE_API_VERSION_IN_URL {
+		globalPrefixUrl = fmt.Sprintf("/%s", global.API_VERSION)
+	}
+
+	confirmURL, err := AppURL(c, fmt.Sprintf("%s/users/confirm-email-change/%s", globalPrefixUrl, changeToken))
+	if err != nil {
+		return nil, err
+	}
+	revertURL, err := AppURL(c, fmt.Sprintf("%s/users/revert-email-change/%s", globalPrefixUrl, revertToken))
+	if err != nil {
+		return nil, err
+	}
 
-	// Send email asynchronously
-    global.SendMailAsync(mailOptions)
+	locale := mail.LocaleFromRequest(c)
+	err = sendTemplatedMail("change-email", newEmail, mail.Scope{Locale: locale}, map[string]any{
+		"FirstName": user.FirstName,
+		"NewEmail":  newEmail,
+		"URL":       confirmURL,
+		"ExpiresIn": mail.FormatDuration(global.EMAIL_VERIFICATION_EXPIRATION, locale),
+	})
+	if errors.Is(err, mail.ErrRecipientsSuppressed) {
+		return nil, fmt.Errorf("%w: %s bounced before", ErrInvalidEmailAddress, newEmail)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-    return &global.GenericNotificationResponse{
-        NotificationClass:   "is-info",
-        NotificationMessage: "If valid user, you will receive email shortly for verification",
-    }, nil
+	err = sendTemplatedMail("email-change-notice", user.PrimaryEmailAddress, mail.Scope{Locale: locale}, map[string]any{
+		"FirstName": user.FirstName,
+		"NewEmail":  newEmail,
+		"URL":       revertURL,
+		"ExpiresIn": mail.FormatDuration(global.EMAIL_CHANGE_REVERT_EXPIRATION, locale),
+	})
+	if err != nil && !errors.Is(err, mail.ErrRecipientsSuppressed) {
+		return nil, err
+	}
 
+	return &global.GenericNotificationResponse{
+		NotificationClass:   "is-info",
+		NotificationMessage: fmt.Sprintf("Please confirm the change with the link sent to %s", newEmail),
+	}, nil
 }
 
+// ConfirmEmailChange completes an email change with the token of the link sent to the new address.
+// The new address is verified by the confirmation; every session is signed out.
+func (s *UserService) ConfirmEmailChange(token string) (*models.User, error) {
+	user, err := s.findByHashedToken("email_change_token", token)
+	if err != nil {
+		return nil, err
+	}
+	if user.PendingPrimaryEmailAddress == "" {
+		return nil, ErrInvalidVerificationToken
+	}
+	if user.EmailChangeTokenExpiration.Before(time.Now()) {
+		return nil, ErrVerificationTokenExpired
+	}
 
-// ConfirmEmail confirms an email address with a verification token
-func (s *UserService) ConfirmEmail(token string, isPrimary bool, c *gin.Context) error {
-	// Find user by verification token
-	var user models.User
-	var err error
+	newEmail := user.PendingPrimaryEmailAddress
+	updates := map[string]any{
+		"primary_email_address":         newEmail,
+		"is_primary_email_verified":     true,
+		"primary_email_deliverability":  mail.DeliverabilityOf(newEmail),
+		"pending_primary_email_address": "",
+		"email_change_token":            "",
+		"email_change_token_expiration": time.Time{},
+	}
+	if strings.EqualFold(user.BackupEmailAddress, newEmail) {
+		// Promotion of the backup address: the old primary address becomes the backup one
+		updates["backup_email_address"] = user.PrimaryEmailAddress
+		updates["is_backup_email_verified"] = user.IsPrimaryEmailVerified
+		updates["backup_email_deliverability"] = user.PrimaryEmailDeliverability
+	}
 
-	if isPrimary {
-		err = s.userRepo.CreateQueryBuilder().
-			Where("primary_email_verification_token = ?", token).
-			First(&user).Error
-	} else {
-		err = s.userRepo.CreateQueryBuilder().
-			Where("backup_email_verification_token = ?", token).
-			First(&user).Error
+	err = s.userRepo.CreateQueryBuilder().Where("id = ?", user.ID).Updates(updates).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to update user: %v", err)
 	}
+	return s.afterEmailChange(user.ID)
+}
 
+// RevertEmailChange undoes an email change with the token of the notice sent to the old address:
+// a pending change is cancelled, a completed one reversed. As the account may be in someone
+// else's hands, every session is signed out and a new password is required.
+func (s *UserService) RevertEmailChange(token string) (*models.User, error) {
+	user, err := s.findByHashedToken("email_change_revert_token", token)
 	if err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return fmt.Errorf("invalid token")
+		return nil, err
+	}
+	if user.EmailChangeRevertExpiration.Before(time.Now()) {
+		return nil, ErrVerificationTokenExpired
+	}
+
+	updates := map[string]any{
+		"pending_primary_email_address":  "",
+		"email_change_token":             "",
+		"email_change_token_expiration":  time.Time{},
+		"previous_primary_email_address": "",
+		"email_change_revert_token":      "",
+		"email_change_revert_expiration": time.Time{},
+	}
+	previousEmail := user.PreviousPrimaryEmailAddress
+	if user.PendingPrimaryEmailAddress == "" && previousEmail != "" && !strings.EqualFold(user.PrimaryEmailAddress, previousEmail) {
+		updates["primary_email_address"] = previousEmail
+		updates["is_primary_email_verified"] = true // the revert link was opened from it
+		updates["primary_email_deliverability"] = mail.DeliverabilityOf(previousEmail)
+		updates["is_password_change_required"] = true
+		if strings.EqualFold(user.BackupEmailAddress, previousEmail) {
+			// Undo a promotion of the backup address
+			updates["backup_email_address"] = user.PrimaryEmailAddress
+			updates["is_backup_email_verified"] = user.IsPrimaryEmailVerified
+			updates["backup_email_deliverability"] = user.PrimaryEmailDeliverability
 		}
-		return fmt.Errorf("error finding user: %v", err)
 	}
 
-	// Check token expiration
-	if user.EmailVerificationTokenExpiration.Before(time.Now()) {
-		return fmt.Errorf("token expired")
+	err = s.userRepo.CreateQueryBuilder().Where("id = ?", user.ID).Updates(updates).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to update user: %v", err)
 	}
+	return s.afterEmailChange(user.ID)
+}
 
-	if isPrimary {
-		user.IsPrimaryEmailVerified = true
-		user.PrimaryEmailVerificationToken = ""
-	} else {
-		user.IsBackupEmailVerified = true
-		user.BackupEmailVerificationToken = ""
+// afterEmailChange signs out every session of a user whose addresses changed,
+// reloads the user and updates the search index
+func (s *UserService) afterEmailChange(userId uint) (*models.User, error) {
+	if _, err := sessions.RevokeAllTx(s.db, userId, 0, sessions.RevokedByEmailChanged); err != nil {
+		return nil, err
 	}
+	user, err := s.userRepo.FindByID(userId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find user: %v", err)
+	}
+	if s.usersSearchService != nil {
+		if err := s.usersSearchService.Update(context.Background(), *user); err != nil {
+			log.Printf("Error updating user %d in search index: %v", user.ID, err)
+		}
+	}
+	user.Sanitize()
+	return user, nil
+}
 
-	user.EmailVerificationTokenExpiration = time.Time{} // Clear expiration
-
-	// Save user with updated verification status
-	err = s.userRepo.Update(&user)
+// findByHashedToken finds the user holding a token stored hashed in the given column
+func (s *UserService) findByHashedToken(column string, token string) (*models.User, error) {
+	if token == "" {
+		return nil, ErrInvalidVerificationToken
+	}
+	var user models.User
+	err := s.userRepo.CreateQueryBuilder().Where(column+" = ?", utils.HashToken(token)).First(&user).Error
 	if err != nil {
-		return fmt.Errorf("failed to update user: %v", err)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidVerificationToken
+		}
+		return nil, fmt.Errorf("error finding user: %v", err)
 	}
+	return &user, nil
+}
 
-	return nil
+// sendTemplatedMail renders a mail template and queues it for a single recipient
+func sendTemplatedMail(name string, to string, scope mail.Scope, data map[string]any) error {
+	message, err := mail.Render(name, data, scope)
+	if err != nil {
+		return fmt.Errorf("failed to render email: %v", err)
+	}
+	mailOptions := global.MailOptions{
+		To:          to,
+		From:        global.MAIL_FROM_ADDRESS,
+		Subject:     message.Subject,
+		Text:        message.Text,
+		Html:        message.HTML,
+		Attachments: message.Inline,
+	}
+	_, err = mail.Enqueue(mailOptions, mail.EnqueueOptions{Template: name})
+	return err
 }
 
 
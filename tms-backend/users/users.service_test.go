@@ -0,0 +1,31 @@
+package users
+
+import (
+	"testing"
+
+	"github.com/auditrakkr/tms-fullstack/tms-backend/models"
+)
+
+func TestPhotoKey(t *testing.T) {
+	renditions := &models.User{PhotoThumbURL: "photos/1/thumb.webp", PhotoOriginalURL: "photos/1/original.png", Photo: "photos/1/original.png"}
+	tests := []struct {
+		user *models.User
+		size string
+		want string
+	}{
+		{renditions, "thumb", "photos/1/thumb.webp"},
+		{renditions, "large", "photos/1/original.png"},
+		{renditions, "original", "photos/1/original.png"},
+		{&models.User{Photo: "jane.png"}, "thumb", "photos/jane.png"},
+		{&models.User{Photo: "../config/.env"}, "original", ""},
+		{&models.User{Photo: ".."}, "original", ""},
+		{&models.User{Photo: "/etc/passwd"}, "original", ""},
+		{&models.User{Photo: `..\secrets`}, "original", ""},
+		{&models.User{}, "original", ""},
+	}
+	for _, test := range tests {
+		if got := photoKey(test.user, test.size); got != test.want {
+			t.Errorf("photoKey(%q, %s) = %q, want %q", test.user.Photo, test.size, got, test.want)
+		}
+	}
+}
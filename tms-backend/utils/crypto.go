@@ -4,6 +4,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -114,6 +115,13 @@ func Decrypt(encryptedData *struct{
 	return string(plaintext), nil
 }
 
+// HashToken returns the hex SHA-256 digest under which a random token (email verification,
+// password reset, ...) is stored, so a leaked database does not leak usable tokens
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 // GeneratePassword generates a random password
 func GeneratePassword() (string, error) {
 	// Generate 12 random bytes (24 hex chars)
@@ -0,0 +1,366 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // register GIF decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+	"golang.org/x/image/draw"
+)
+
+// DetectMimeType sniffs the real content type of a file from its bytes.
+// Client supplied Content-Type headers must never be trusted.
+func DetectMimeType(data []byte) string {
+	mtype := mimetype.Detect(data)
+	// Strip parameters such as "; charset=utf-8"
+	return strings.SplitN(mtype.String(), ";", 2)[0]
+}
+
+// IsRasterImage reports whether the mime type is one we can decode
+func IsRasterImage(mimeType string) bool {
+	switch mimeType {
+	case "image/png", "image/jpeg", "image/gif":
+		return true
+	}
+	return false
+}
+
+// ResizeToFit scales img down so that it fits in a maxSize x maxSize box,
+// preserving aspect ratio. Images already small enough are returned as is.
+func ResizeToFit(img image.Image, maxSize int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxSize && height <= maxSize {
+		return img
+	}
+
+	newWidth, newHeight := maxSize, maxSize
+	if width > height {
+		newHeight = height * maxSize / width
+	} else {
+		newWidth = width * maxSize / height
+	}
+	if newWidth < 1 {
+		newWidth = 1
+	}
+	if newHeight < 1 {
+		newHeight = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	return dst
+}
+
+// RasterizeSVG draws a (sanitized, see SanitizeSVG) SVG document so that it fits in a
+// maxSize x maxSize box, preserving the aspect ratio of its viewBox
+func RasterizeSVG(data []byte, maxSize int) (image.Image, error) {
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(data), oksvg.IgnoreErrorMode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read svg: %v", err)
+	}
+	width, height := icon.ViewBox.W, icon.ViewBox.H
+	if width <= 0 || height <= 0 {
+		return nil, errors.New("invalid svg: no width, height or viewBox")
+	}
+
+	newWidth, newHeight := maxSize, maxSize
+	if width > height {
+		newHeight = int(height * float64(maxSize) / width)
+	} else {
+		newWidth = int(width * float64(maxSize) / height)
+	}
+	if newWidth < 1 {
+		newWidth = 1
+	}
+	if newHeight < 1 {
+		newHeight = 1
+	}
+
+	icon.SetTarget(0, 0, float64(newWidth), float64(newHeight))
+	dst := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+	scanner := rasterx.NewScannerGV(newWidth, newHeight, dst, dst.Bounds())
+	icon.Draw(rasterx.NewDasher(newWidth, newHeight, scanner), 1)
+	return dst, nil
+}
+
+// EncodePNG encodes img as PNG and returns the bytes
+func EncodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode png: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// EncodeJPEG encodes img as JPEG with the given quality (1-100) and returns the bytes
+func EncodeJPEG(img image.Image, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, fmt.Errorf("failed to encode jpeg: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// MaxImagePixels guards against decompression bombs: a tiny file that
+// declares huge dimensions and would exhaust memory when decoded
+const MaxImagePixels = 40_000_000
+
+// DecodeImage decodes a raster image after checking its declared dimensions.
+// JPEG EXIF orientation is applied so the image is upright once the metadata
+// is discarded by re-encoding.
+func DecodeImage(data []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image header: %v", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > MaxImagePixels {
+		return nil, fmt.Errorf("image dimensions %dx%d not allowed", config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	return applyOrientation(img, jpegOrientation(data)), nil
+}
+
+// jpegOrientation reads the EXIF orientation tag (1-8) from a JPEG. Returns 1
+// (no transformation) when absent or unreadable.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	offset := 2
+	for offset+4 <= len(data) {
+		if data[offset] != 0xFF {
+			return 1
+		}
+		marker := data[offset+1]
+		segmentLength := int(binary.BigEndian.Uint16(data[offset+2:]))
+		segmentStart := offset + 4
+		segmentEnd := offset + 2 + segmentLength
+		if segmentLength < 2 || segmentEnd > len(data) {
+			return 1
+		}
+		// APP1 carrying EXIF
+		if marker == 0xE1 && segmentEnd-segmentStart > 14 && string(data[segmentStart:segmentStart+6]) == "Exif\x00\x00" {
+			return exifOrientation(data[segmentStart+6 : segmentEnd])
+		}
+		// Start of scan: no more metadata segments
+		if marker == 0xDA {
+			return 1
+		}
+		offset = segmentEnd
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifdOffset := int(order.Uint32(tiff[4:8]))
+	if ifdOffset+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifdOffset:]))
+	for i := 0; i < entries; i++ {
+		entry := ifdOffset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// applyOrientation rotates/flips img according to an EXIF orientation value
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if orientation >= 5 {
+		width, height = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				dx, dy = bounds.Dx()-1-x, y
+			case 3: // rotated 180
+				dx, dy = bounds.Dx()-1-x, bounds.Dy()-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, bounds.Dy()-1-y
+			case 5: // mirrored horizontally, rotated 270 clockwise
+				dx, dy = y, x
+			case 6: // rotated 90 clockwise
+				dx, dy = bounds.Dy()-1-y, x
+			case 7: // mirrored horizontally, rotated 90 clockwise
+				dx, dy = bounds.Dy()-1-y, bounds.Dx()-1-x
+			case 8: // rotated 270 clockwise
+				dx, dy = y, bounds.Dx()-1-x
+			}
+			dst.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// svgForbiddenElements are dropped together with all their children
+var svgForbiddenElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+	"handler":       true,
+	"listener":      true,
+}
+
+// SanitizeSVG strips scripts, event handlers, external references and
+// DOCTYPE declarations (entity expansion) from an SVG document.
+// The document is re-serialized from the token stream so nothing that was
+// not explicitly allowed through survives.
+func SanitizeSVG(data []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = true
+
+	var out bytes.Buffer
+	skipDepth := 0
+	sawRoot := false
+	inStyle := false
+
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid svg: %v", err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if skipDepth > 0 {
+				skipDepth++
+				continue
+			}
+			if !sawRoot {
+				if strings.ToLower(t.Name.Local) != "svg" {
+					return nil, errors.New("invalid svg: root element is not <svg>")
+				}
+				sawRoot = true
+			}
+			if svgForbiddenElements[strings.ToLower(t.Name.Local)] {
+				skipDepth = 1
+				continue
+			}
+			inStyle = strings.ToLower(t.Name.Local) == "style"
+			out.WriteString("<" + rawName(t.Name))
+			for _, attr := range t.Attr {
+				if !isSafeSVGAttr(attr) {
+					continue
+				}
+				out.WriteString(" " + rawName(attr.Name) + `="`)
+				xml.EscapeText(&out, []byte(attr.Value))
+				out.WriteString(`"`)
+			}
+			out.WriteString(">")
+		case xml.EndElement:
+			if skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+			inStyle = false
+			out.WriteString("</" + rawName(t.Name) + ">")
+		case xml.CharData:
+			if skipDepth > 0 {
+				continue
+			}
+			if inStyle && !isSafeCSS(string(t)) {
+				continue
+			}
+			xml.EscapeText(&out, t)
+		case xml.ProcInst:
+			if t.Target == "xml" && !sawRoot {
+				out.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+			}
+		}
+		// Comments and directives (DOCTYPE, ENTITY) are always dropped
+	}
+
+	if !sawRoot {
+		return nil, errors.New("invalid svg: no <svg> element found")
+	}
+
+	return out.Bytes(), nil
+}
+
+func rawName(name xml.Name) string {
+	if name.Space != "" {
+		return name.Space + ":" + name.Local
+	}
+	return name.Local
+}
+
+func isSafeSVGAttr(attr xml.Attr) bool {
+	local := strings.ToLower(attr.Name.Local)
+	if strings.HasPrefix(local, "on") {
+		return false
+	}
+
+	value := strings.ToLower(strings.Join(strings.Fields(attr.Value), ""))
+	if local == "href" || local == "src" || local == "action" || local == "formaction" {
+		// Only local fragment references and embedded raster images are allowed
+		return strings.HasPrefix(value, "#") ||
+			strings.HasPrefix(value, "data:image/png") ||
+			strings.HasPrefix(value, "data:image/jpeg") ||
+			strings.HasPrefix(value, "data:image/gif")
+	}
+
+	return isSafeCSS(value)
+}
+
+// isSafeCSS rejects script URLs, imports and url(...) references to anything
+// other than a local fragment. Used for both style content and attribute values.
+func isSafeCSS(value string) bool {
+	value = strings.ToLower(strings.Join(strings.Fields(value), ""))
+	if strings.Contains(value, "javascript:") || strings.Contains(value, "expression(") ||
+		strings.Contains(value, "@import") {
+		return false
+	}
+	return !strings.Contains(strings.ReplaceAll(value, "url(#", ""), "url(")
+}